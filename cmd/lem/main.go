@@ -0,0 +1,99 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command lem runs the lem test cases for the specified packages without
+// requiring a TestLem function in each package.
+//
+// Usage:
+//
+//	lem [flags] [packages]
+//
+// The packages are resolved relative to the current working directory
+// using "go list" and default to ".". Any failed assertion is written to
+// stderr and results in a non-zero exit code.
+//
+// Please note that because there are no benchmark functions registered
+// with the command, the alloc, bytes, and metric assertions are skipped.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/akutz/lem"
+)
+
+var (
+	flagTags    = flag.String("tags", "", "a comma-separated list of build tags")
+	flagGCFlags = flag.String("gcflags", "", "a space-separated list of additional compiler flags")
+	flagFilter  = flag.String("filter", "", "a regular expression that selects the IDs of the test cases to run")
+	flagReport  = flag.String("report", "", "the path to which a JSON report is written")
+	flagJUnit   = flag.String("junit", "", "the path to which a JUnit XML report is written")
+	flagColor   = flag.Bool("color", false, "colorize the failures when writing to a terminal")
+	flagSummary = flag.Bool("summary", false, "log a summary of the test cases at the end of the run")
+	flagVerbose = flag.Bool("v", false, "write the results of all of the test cases, not just the failures")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"usage: %s [flags] [packages]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	ctx := lem.Context{
+		BuildTags:     splitTags(*flagTags),
+		Color:         *flagColor,
+		CompilerFlags: strings.Fields(*flagGCFlags),
+		Filter:        *flagFilter,
+		JUnitPath:     *flagJUnit,
+		Packages:      flag.Args(),
+		ReportPath:    *flagReport,
+		Summary:       *flagSummary,
+		UseGoPackages: true,
+	}
+
+	r := newReporter("lem", *flagVerbose)
+	start := time.Now()
+	r.run(func(r lem.Reporter) {
+		lem.RunWithReporter(r, wd, ctx)
+	})
+	fmt.Fprint(os.Stderr, r.report(time.Since(start)))
+	if r.Failed() {
+		os.Exit(1)
+	}
+}
+
+// splitTags returns the build tags from a comma-separated list.
+func splitTags(s string) []string {
+	var tags []string
+	for _, t := range strings.Split(s, ",") {
+		if t := strings.TrimSpace(t); t != "" {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
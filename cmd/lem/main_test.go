@@ -0,0 +1,103 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main_test
+
+import (
+	"bytes"
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// buildLem builds the lem command and returns the path to the binary.
+func buildLem(t *testing.T) string {
+	t.Helper()
+	bin := filepath.Join(t.TempDir(), "lem")
+	if out, err := exec.Command(
+		"go", "build", "-o", bin, ".").CombinedOutput(); err != nil {
+
+		t.Fatalf("failed to build lem: %v\n%s", err, out)
+	}
+	return bin
+}
+
+func TestLemCommand(t *testing.T) {
+	bin := buildLem(t)
+
+	testCases := []struct {
+		name     string
+		args     []string
+		expFail  bool
+		expMatch string
+	}{
+		{
+			name: "examples",
+			args: []string{
+				"./examples/match",
+				"./examples/name",
+				"./examples/natch",
+			},
+		},
+		{
+			name:     "failed assertion",
+			args:     []string{"./cmd/lem/testdata/fail"},
+			expFail:  true,
+			expMatch: "lem.put.m=x does not escape",
+		},
+		{
+			name: "filter",
+			args: []string{"-filter=^putOK$", "./cmd/lem/testdata/fail"},
+		},
+		{
+			name:     "verbose",
+			args:     []string{"-v", "-filter=^putOK$", "./cmd/lem/testdata/fail"},
+			expMatch: "--- PASS: lem/putOK",
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			cmd := exec.Command(bin, tc.args...)
+			cmd.Dir = filepath.Join("..", "..")
+			cmd.Stdout = &stdout
+			cmd.Stderr = &stderr
+			err := cmd.Run()
+
+			var exitErr *exec.ExitError
+			if tc.expFail {
+				if !errors.As(err, &exitErr) {
+					t.Fatalf("expected non-zero exit code, err=%v\n%s",
+						err, stderr.String())
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v\n%s", err, stderr.String())
+			}
+			if tc.expMatch != "" &&
+				!bytes.Contains(stderr.Bytes(), []byte(tc.expMatch)) {
+
+				t.Errorf("expected stderr to contain %q\n%s",
+					tc.expMatch, stderr.String())
+			}
+			if stdout.Len() > 0 {
+				t.Errorf("unexpected stdout: %s", stdout.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/akutz/lem"
+)
+
+// reporter is a lem.Reporter that records the results of the test cases
+// in the same format as "go test", so the command does not need to run
+// the test cases with the testing package.
+type reporter struct {
+	name    string
+	verbose bool
+
+	mu      sync.Mutex
+	output  bytes.Buffer
+	failed  bool
+	skipped bool
+}
+
+func newReporter(name string, verbose bool) *reporter {
+	return &reporter{name: name, verbose: verbose}
+}
+
+// run calls fn with the reporter in a new goroutine and waits for it to
+// return, so Fatal and Skip may stop the goroutine like they do a test's.
+func (r *reporter) run(fn func(r lem.Reporter)) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn(r)
+	}()
+	<-done
+}
+
+// report returns the reporter's status followed by its output. Only the
+// failures are reported unless the reporter is verbose.
+func (r *reporter) report(d time.Duration) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := "PASS"
+	switch {
+	case r.failed:
+		status = "FAIL"
+	case !r.verbose:
+		return ""
+	case r.skipped:
+		status = "SKIP"
+	}
+	return fmt.Sprintf("--- %s: %s (%.2fs)\n%s",
+		status, r.name, d.Seconds(), r.output.String())
+}
+
+func (r *reporter) log(s string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.output.WriteString(indent(strings.TrimSuffix(s, "\n") + "\n"))
+}
+
+func (r *reporter) fail() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failed = true
+}
+
+func (r *reporter) Error(args ...interface{}) {
+	r.log(fmt.Sprintln(args...))
+	r.fail()
+}
+
+func (r *reporter) Errorf(format string, args ...interface{}) {
+	r.log(fmt.Sprintf(format, args...))
+	r.fail()
+}
+
+func (r *reporter) Failed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.failed
+}
+
+func (r *reporter) Fatal(args ...interface{}) {
+	r.Error(args...)
+	runtime.Goexit()
+}
+
+func (r *reporter) Fatalf(format string, args ...interface{}) {
+	r.Errorf(format, args...)
+	runtime.Goexit()
+}
+
+func (r *reporter) Helper() {}
+
+func (r *reporter) Log(args ...interface{}) {
+	r.log(fmt.Sprintln(args...))
+}
+
+func (r *reporter) Logf(format string, args ...interface{}) {
+	r.log(fmt.Sprintf(format, args...))
+}
+
+func (r *reporter) Skip(args ...interface{}) {
+	r.log(fmt.Sprintln(args...))
+	r.mu.Lock()
+	r.skipped = true
+	r.mu.Unlock()
+	runtime.Goexit()
+}
+
+func (r *reporter) Skipped() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.skipped
+}
+
+func (r *reporter) Run(name string, fn func(r lem.Reporter)) bool {
+	child := newReporter(r.name+"/"+name, r.verbose)
+	start := time.Now()
+	child.run(fn)
+	failed := child.Failed()
+	if s := child.report(time.Since(start)); s != "" {
+		r.mu.Lock()
+		r.output.WriteString(indent(s))
+		r.mu.Unlock()
+	}
+	if failed {
+		r.fail()
+	}
+	return !failed
+}
+
+// indent returns the provided lines, except empty ones, indented by four
+// spaces.
+func indent(s string) string {
+	lines := strings.SplitAfter(s, "\n")
+	for i, l := range lines {
+		if l != "" && l != "\n" {
+			lines[i] = "    " + l
+		}
+	}
+	return strings.Join(lines, "")
+}
@@ -65,6 +65,16 @@ limitations under the License.
 //     to result
 //     move/too large
 //
+// The comment "lem.<ID>.suite=<SUITE>" prepends <SUITE>, also split with
+// "/" as the separator, to the path, ex. "lem.leak1.suite=leaks" changes
+// the first of the above paths to "leaks/leak1/to sink". This groups the
+// test cases with the same suite under it in the output of "go test -v".
+//
+// The comment "lem.<ID>.skip" or "lem.<ID>.skip=<REASON>" skips the test
+// case without evaluating any of its assertions. The comment
+// "lem.<ID>.tags=<TAG>[,<TAG>...]" skips the test case unless all of the
+// listed build tags are configured.
+//
 // The next comment also occurs above the function's signature and takes
 // the form "lem.<ID>.alloc=<VALUE>" or "lem.<ID>.alloc=<MIN>-<MAX>".
 // This comment asserts the number of allocations expected to occur during
@@ -78,11 +88,49 @@ limitations under the License.
 // second example asserts either two, three, or four allocations are
 // expected to have occurred.
 //
+// The number may also be an open-ended range using one of the operators
+// "<", "<=", ">", or ">=", ex. "lem.leak1.alloc=<=1" asserts no more than
+// a single allocation is expected to have occurred.
+//
+// The directive may also be qualified with an architecture in the form
+// "lem.<ID>.alloc:<GOARCH>=<VALUE>". The qualified value is used when the
+// target architecture matches, otherwise the unqualified value is used:
+//
+//     // lem.leak1.alloc=1
+//     // lem.leak1.alloc:386=2
+//
 // The next comment also occurs above the function's signature and takes
 // the form "lem.<ID>.bytes=<VALUE>" or "lem.<ID>.bytes=<MIN>-<MAX>".
 // This comment asserts the number of bytes expected to be allocated during
 // the execution of the benchmark. For more documentation please refer
-// to "lem.<ID>.alloc" as both comments have the same format rules.
+// to "lem.<ID>.alloc" as both comments have the same format rules, except
+// the bytes may include a size suffix, ex. "lem.leak1.bytes=1KiB". The
+// supported suffixes are B, KB, MB, GB, KiB, MiB, and GiB.
+//
+// Both comments also support a percentage tolerance in the form
+// "<VALUE>~<PERCENT>%", ex. "lem.leak1.bytes=16~10%" asserts between 14
+// and 18 bytes are allocated. The minimum is rounded down and the maximum
+// is rounded up. The Tolerance field of Context applies a tolerance to all
+// of the comments that do not specify their own or an open-ended range.
+//
+// The comment "lem.<ID>.noalloc" is shorthand for asserting both zero
+// allocations and zero bytes, and it is an error to combine it with a
+// non-zero "lem.<ID>.alloc" or "lem.<ID>.bytes" comment.
+//
+// The comment "lem.<ID>.fn.noalloc" is placed above or inside a function
+// and combines "lem.<ID>.noalloc" with the static assertion that nothing in
+// the function escapes or is moved to the heap according to the compiler
+// optimization output for any line of the function.
+//
+// The comment "lem.<ID>.metric:<NAME>=<VALUE>" asserts the value of a
+// custom metric reported by the benchmark with "b.ReportMetric", and it has
+// the same format rules as "lem.<ID>.alloc".
+//
+// The comment "lem.<ID>.benchtime=<BENCHTIME>" sets the "-test.benchtime"
+// flag, ex. "100000x" or "2s", while the benchmark for the <ID> is run.
+// Similarly, the comment "lem.<ID>.env=<NAME>=<VALUE>" sets an environment
+// variable while the benchmark is run, and GOMAXPROCS is applied with
+// runtime.GOMAXPROCS.
 //
 // The next comment occurs alongside a line inside of a function, and it is
 // "lem.<ID>.m=<REGEX>". This comment asserts that the Go compiler's
@@ -96,7 +144,11 @@ limitations under the License.
 // the regex "escape.go:70:\d+: x escapes to heap". Please note that
 // special characters must be escaped, such as "new\(int32\) escapes to heap".
 //
-// The last comment is a variant of the previous and takes the form
+// Trailing whitespace is never part of a pattern. A pattern that must begin
+// or end with whitespace may be written as a Go string literal in double
+// quotes or backticks, ex. "lem.<ID>.m=`  flow: .*`", which is unquoted.
+//
+// The next comment is a variant of the previous and takes the form
 // "lem.<ID>.m!=<REGEX>". This comment asserts a provided pattern should
 // not match the compiler optimization output. This is useful when you want
 // to assert a variable did not escape, leak, or move. For example:
@@ -105,5 +157,73 @@ limitations under the License.
 //
 // The above comment asserts none of the words "escape", "leak", or "move"
 // appeared in the compiler optimization output for line 80 for the source
-// file in which the comment exists.
+// file in which the comment exists. The comment "lem.<ID>.none=<REGEX>"
+// is similar, except the pattern must not match anywhere in the compiler
+// optimization output, regardless of file or line.
+// Lines matched by any of the IgnorePatterns of the Context are removed
+// from the output before any of the patterns are matched.
+//
+// The comment "lem.<ID>.mblock=<REGEX>" is a variant of the match comment
+// that matches the pattern against a block of consecutive lines of output
+// with the same position, ex. a message and its continuation lines at -m=2.
+// The positions are removed and the lines are joined by newlines, and the
+// pattern is compiled with the "(?s)" flag so "." also matches a newline.
+//
+// The comment "lem.<ID>.mseq=<REGEX>" is a variant of the match comment,
+// and all of the comments for the same line are grouped into a sequence of
+// patterns that must appear in the compiler optimization output for the
+// line in the order in which the comments are defined.
+//
+// The comments "lem.<ID>.move=<VAR>" and "lem.<ID>.escape=<EXPR>" are
+// sugar for match comments with the patterns "moved to heap: <VAR>" and
+// "<EXPR> escapes to heap", where the variable or expression is matched
+// literally.
+//
+// The comment "lem.<ID>.noiface" is sugar for a natch comment that asserts
+// the value converted to an interface on the line does not escape to the
+// heap, i.e. the conversion does not allocate.
+//
+// The comment "lem.<ID>.noclosure-escape" is sugar for a natch comment that
+// asserts the function literal that begins on the line does not escape to
+// the heap, i.e. the closure and the variables it captures are not
+// allocated.
+//
+// The comment "lem.<ID>.devirt=<TYPE>" asserts the interface method call on
+// the line is devirtualized to the specified type. A call that is only
+// devirtualized once its function is inlined is reported for the line where
+// the function was inlined, so the comment belongs on that line instead.
+//
+// The comment "lem.<ID>.inst=<TYPE>:<REGEX>" is similar to the match
+// comment, but the pattern only matches a message that also refers to the
+// instantiation of a generic function with the specified type argument,
+// ex. "lem.leak1.inst=int:escapes to heap".
+//
+// The comment "lem.<ID>.vet=<REGEX>" is similar to the match comment, but
+// the pattern is matched against the "go vet" output instead of the
+// compiler optimization output.
+//
+// The comment "lem.<ID>.mcount=<REGEX>:<COUNT>" is a variant of the match
+// comment that asserts the number of times the pattern matches the output
+// for the line, where the count has the same format as "lem.<ID>.alloc".
+//
+// The comment "lem.<ID>.fn=<REGEX>" is placed above or inside a function
+// and asserts the provided pattern matches the compiler optimization output
+// for any line of the function, from its signature to its closing brace.
+//
+// The comment "lem.<ID>.leak=<PARAM>" is placed above or inside a function
+// and is sugar for a match comment that asserts the parameter leaks, ex.
+// "leaking param: <PARAM>", for any line of the function's signature. The
+// forms "lem.<ID>.leak=<PARAM>:content" and
+// "lem.<ID>.leak=<PARAM>:result:<RESULT>[:<LEVEL>]" assert the contents of
+// the parameter leak, or the parameter leaks to the specified result, ex. 0
+// for "~r0", at any or the specified level.
+//
+// Finally, the comment "lem.<ID>.asm=<REGEX>" asserts the provided pattern
+// appears in the assembly output, from the compiler flag "-S", for the
+// function in which the comment appears or which the comment documents.
+// The comment "lem.<ID>.noruntime-alloc" asserts the same function's
+// assembly does not call runtime.newobject, runtime.makeslice, or
+// runtime.growslice. Similarly, the comment
+// "lem.<ID>.framesize=<EXPECTED>" asserts the size of the same function's
+// stack frame.
 package lem
@@ -0,0 +1,40 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package asm_test
+
+import (
+	"testing"
+
+	"github.com/akutz/lem"
+)
+
+func TestLem(t *testing.T) {
+	lem.Run(t)
+}
+
+// lem.leaf.name=compiled without a stack check
+// lem.leaf.asm=TEXT\s+.*\(SB\), NOSPLIT
+// lem.leaf.framesize=0
+func leaf(x int) int {
+	return x + 1
+}
+
+var sink []byte
+
+func nonLeaf(n int) {
+	sink = make([]byte, n) // lem.nonLeaf.asm=CALL\s+runtime\.makeslice
+}
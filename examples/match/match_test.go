@@ -26,9 +26,26 @@ func TestLem(t *testing.T) {
 	lem.Run(t)
 }
 
-var sink interface{}
+var sink, sink2 interface{}
 
 func put(x, y int32) {
 	sink = x // lem.put.m=x escapes to heap
 	sink = y // lem.put.m=y escapes to heap
 }
+
+func putLong(x, y int32) {
+	// lem.putLong.m@+1=x escapes to heap
+	sink = x
+	sink = y
+	// lem.putLong.m@-1=y escapes to heap
+}
+
+// lem.ptr.fn=moved to heap: v
+func ptr() {
+	v := 1
+	sink = &v
+}
+
+func putBoth(x, y int32) {
+	sink, sink2 = x, y // lem.putBoth.mcount=\w escapes to heap:2
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package parse_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/akutz/lem"
+)
+
+func TestParse(t *testing.T) {
+	testCases, err := lem.Parse(lem.Context{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 1, len(testCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+
+	tc := testCases[0]
+	if e, a := "put", tc.ID; e != a {
+		t.Errorf("expID=%s, actID=%s", e, a)
+	}
+	if e, a := []string{"put", "to sink"}, tc.Path; !reflect.DeepEqual(e, a) {
+		t.Errorf("expPath=%v, actPath=%v", e, a)
+	}
+	if e, a := "2", tc.AllocOp.String(); e != a {
+		t.Errorf("exp.alloc=%s, act.alloc=%s", e, a)
+	}
+	if !tc.HasBenchmark {
+		t.Error("test case should require a benchmark")
+	}
+	if e, a := 1, len(tc.Matches); e != a {
+		t.Fatalf("expMatches=%d, actMatches=%d", e, a)
+	}
+	if e, a := "parse_test.go", tc.Matches[0].File; e != a {
+		t.Errorf("expFile=%s, actFile=%s", e, a)
+	}
+	if e, a := 66, tc.Matches[0].Line; e != a {
+		t.Errorf("expLine=%d, actLine=%d", e, a)
+	}
+}
+
+var sink interface{}
+
+// lem.put.name=to sink
+// lem.put.alloc=2
+func put(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		var x int32 = 256
+		sink = x // lem.put.m=x escapes to heap
+	}
+}
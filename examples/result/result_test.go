@@ -0,0 +1,87 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package result_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/akutz/lem"
+)
+
+func TestLem(t *testing.T) {
+	result := lem.RunWithResult(t, lem.Context{
+		Benchmarks: map[string]func(*testing.B){
+			"put": put,
+		},
+	})
+
+	if result.Failed() {
+		t.Fatal("result should not have failed")
+	}
+	if e, a := 1, len(result.TestCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+
+	tc := result.TestCases[0]
+	if e, a := "put", tc.ID; e != a {
+		t.Errorf("expID=%s, actID=%s", e, a)
+	}
+	if e, a := []string{"put", "to sink"}, tc.Path; !reflect.DeepEqual(e, a) {
+		t.Errorf("expPath=%v, actPath=%v", e, a)
+	}
+	if e, a := 1, len(tc.Matches); e != a {
+		t.Fatalf("expMatches=%d, actMatches=%d", e, a)
+	}
+	if tc.Matches[0].Output == "" {
+		t.Error("match output should not be empty")
+	}
+	if e, a := 1, len(tc.Natches); e != a {
+		t.Fatalf("expNatches=%d, actNatches=%d", e, a)
+	}
+	if tc.Natches[0].Output != "" {
+		t.Errorf("natch output should be empty: %s", tc.Natches[0].Output)
+	}
+	if tc.Benchmark == nil {
+		t.Fatal("benchmark result should not be nil")
+	}
+	if e, a := int64(0), tc.Benchmark.AllocOp; e != a {
+		t.Errorf("exp.alloc=%d, act.alloc=%d", e, a)
+	}
+
+	if e, a := 1, len(result.BuildOutputs); e != a {
+		t.Fatalf("expBuildOutputs=%d, actBuildOutputs=%d", e, a)
+	}
+	for importPath, output := range result.BuildOutputs {
+		if !strings.Contains(output, "moved to heap: x") {
+			t.Errorf("unexpected build output for %s: %q", importPath, output)
+		}
+	}
+}
+
+var sink *int32
+
+// lem.put.name=to sink
+// lem.put.noalloc
+func put(b *testing.B) {
+	var x int32 // lem.put.m=moved to heap: x
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sink = &x // lem.put.m!=(leak|escape|move)
+	}
+}
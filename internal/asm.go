@@ -0,0 +1,277 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// AsmMatcher is a regular expression matched against the assembly output
+// for a single function.
+//
+// The assembly output from the compiler flag "-S" is not line-tagged like
+// the optimization output, so the match is scoped to the block of
+// assembly for the function whose TEXT instruction refers to the
+// function's declaration at File:Line.
+type AsmMatcher struct {
+	// Regexp is matched against the function's assembly.
+	Regexp *regexp.Regexp
+
+	// Source is the line of source code for which this matcher was built.
+	Source string
+
+	// File is the base name of the file in which the function is declared.
+	File string
+
+	// Line is the line on which the function is declared.
+	Line int
+}
+
+func (am AsmMatcher) deepEqual(b AsmMatcher) bool {
+	if am.File != b.File || am.Line != b.Line {
+		return false
+	}
+	return LineMatcher{Regexp: am.Regexp, Source: am.Source}.deepEqual(
+		LineMatcher{Regexp: b.Regexp, Source: b.Source})
+}
+
+// asmMatcherJSON is the JSON representation of an AsmMatcher.
+type asmMatcherJSON struct {
+	Regexp string `json:"regexp"`
+	Source string `json:"source"`
+	File   string `json:"file"`
+	Line   int    `json:"line"`
+}
+
+// MarshalJSON encodes the matcher as JSON, serializing the regular
+// expression as its string.
+func (am AsmMatcher) MarshalJSON() ([]byte, error) {
+	obj := asmMatcherJSON{
+		Source: am.Source,
+		File:   am.File,
+		Line:   am.Line,
+	}
+	if am.Regexp != nil {
+		obj.Regexp = am.Regexp.String()
+	}
+	return json.Marshal(obj)
+}
+
+// UnmarshalJSON decodes the matcher from JSON, compiling the regular
+// expression from its string.
+func (am *AsmMatcher) UnmarshalJSON(data []byte) error {
+	var obj asmMatcherJSON
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return err
+	}
+	am.Source, am.File, am.Line, am.Regexp = obj.Source, obj.File, obj.Line, nil
+	if obj.Regexp != "" {
+		r, err := regexp.Compile(obj.Regexp)
+		if err != nil {
+			return err
+		}
+		am.Regexp = r
+	}
+	return nil
+}
+
+// Scope returns a description of the assembly to which the match is
+// scoped.
+func (am AsmMatcher) Scope() string {
+	return fmt.Sprintf(
+		"TEXT block for the function declared at %s:%d", am.File, am.Line)
+}
+
+// FindString returns the text of the leftmost match of Regexp in the
+// function's assembly. The second return value is false if the function's
+// assembly was not found.
+func (am AsmMatcher) FindString(asmOutput string) (string, bool) {
+	block, ok := GetAsmBlock(asmOutput, am.File, am.Line)
+	if !ok {
+		return "", false
+	}
+	return am.Regexp.FindString(block), true
+}
+
+// GetAsmBlock returns the block of assembly from the compiler's "-S" output
+// for the function declared in the specified file and line.
+//
+// A block begins with a non-indented symbol header that includes "STEXT"
+// and continues for each subsequent, indented line. The block belongs to
+// the function if its TEXT instruction is annotated with the function's
+// declaration, ex. "(/path/to/file.go:7)".
+func GetAsmBlock(asmOutput, fileName string, lineNo int) (string, bool) {
+	var (
+		block   []string
+		inBlock bool
+		textRx  = regexp.MustCompile(fmt.Sprintf(
+			`^\s+\S+\s+\S+\s+\((?:.*[/\\])?%s:%d\)\s+TEXT\s`,
+			regexp.QuoteMeta(fileName), lineNo))
+	)
+	for _, l := range strings.Split(asmOutput, "\n") {
+		isHeader := l != "" && l[0] != ' ' && l[0] != '\t'
+		if isHeader {
+			if inBlock && len(block) > 1 {
+				break
+			}
+			block, inBlock = nil, strings.Contains(l, " STEXT")
+			if inBlock {
+				block = append(block, l)
+			}
+			continue
+		}
+		if !inBlock {
+			continue
+		}
+
+		// The first line after the header should be the TEXT instruction
+		// that identifies the function's declaration.
+		if len(block) == 1 && !textRx.MatchString(l) {
+			block, inBlock = nil, false
+			continue
+		}
+		block = append(block, l)
+	}
+	if !inBlock || len(block) < 2 {
+		return "", false
+	}
+	return strings.Join(block, "\n"), true
+}
+
+// AsmFrameSize is the expected stack frame size of a function, parsed from
+// the TEXT instruction in the function's assembly, ex. the 24 in
+// "TEXT example.com/asm.Put(SB), ABIInternal, $24-8".
+type AsmFrameSize struct {
+	// Expected is the expected frame size in bytes.
+	Expected Int64Range `json:"expected"`
+
+	// File is the base name of the file in which the function is declared.
+	File string `json:"file"`
+
+	// Line is the line on which the function is declared.
+	Line int `json:"line"`
+}
+
+func (af *AsmFrameSize) deepEqual(b *AsmFrameSize) bool {
+	if af == nil || b == nil {
+		return af == b
+	}
+	return af.Expected.deepEqual(b.Expected) &&
+		af.File == b.File &&
+		af.Line == b.Line
+}
+
+// Scope returns a description of the assembly to which the frame size is
+// scoped.
+func (af AsmFrameSize) Scope() string {
+	return AsmMatcher{File: af.File, Line: af.Line}.Scope()
+}
+
+var frameSizeRx = regexp.MustCompile(`\sTEXT\s.*\$(-?\d+)-(\d+)\s*$`)
+
+// GetFrameSize returns the stack frame size of the function declared in the
+// specified file and line from the compiler's "-S" output. The second
+// return value is false if the function's assembly was not found.
+func GetFrameSize(asmOutput, fileName string, lineNo int) (int64, bool) {
+	block, ok := GetAsmBlock(asmOutput, fileName, lineNo)
+	if !ok {
+		return 0, false
+	}
+	for _, l := range strings.Split(block, "\n") {
+		if m := frameSizeRx.FindStringSubmatch(l); m != nil {
+			n, err := strconv.ParseInt(m[1], 10, 64)
+			if err != nil {
+				return 0, false
+			}
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+// getFuncDeclLine returns the line on which the function that encloses, or
+// is documented by, the comment at the specified position is declared.
+func getFuncDeclLine(
+	fset *token.FileSet,
+	f *ast.File,
+	pos token.Pos) (int, bool) {
+
+	fd := getFuncDecl(f, pos)
+	if fd == nil {
+		return 0, false
+	}
+	return fset.Position(fd.Pos()).Line, true
+}
+
+// getFuncDeclLines returns the first and last lines of the function that
+// encloses, or is documented by, the comment at the specified position.
+// The range spans the function's signature through its closing brace, so
+// it includes any function literals declared in the function's body.
+func getFuncDeclLines(
+	fset *token.FileSet,
+	f *ast.File,
+	pos token.Pos) (int, int, bool) {
+
+	fd := getFuncDecl(f, pos)
+	if fd == nil {
+		return 0, 0, false
+	}
+	return fset.Position(fd.Pos()).Line, fset.Position(fd.End()).Line, true
+}
+
+// getFuncSigLines returns the first and last lines of the signature of the
+// function that encloses, or is documented by, the comment at the specified
+// position. The range spans the function's declaration through the opening
+// brace of its body, or the end of the declaration if there is no body.
+func getFuncSigLines(
+	fset *token.FileSet,
+	f *ast.File,
+	pos token.Pos) (int, int, bool) {
+
+	fd := getFuncDecl(f, pos)
+	if fd == nil {
+		return 0, 0, false
+	}
+	end := fd.End()
+	if fd.Body != nil {
+		end = fd.Body.Lbrace
+	}
+	return fset.Position(fd.Pos()).Line, fset.Position(end).Line, true
+}
+
+// getFuncDecl returns the function that encloses, or is documented by, the
+// comment at the specified position, otherwise nil.
+func getFuncDecl(f *ast.File, pos token.Pos) *ast.FuncDecl {
+	for _, d := range f.Decls {
+		fd, ok := d.(*ast.FuncDecl)
+		if !ok {
+			continue
+		}
+		inDoc := fd.Doc != nil && fd.Doc.Pos() <= pos && pos < fd.Doc.End()
+		inFunc := fd.Pos() <= pos && pos < fd.End()
+		if inDoc || inFunc {
+			return fd
+		}
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Baseline is a snapshot of the values observed for a set of test cases,
+// used to fail a later run only if one of the values gets worse.
+type Baseline struct {
+	// TestCases maps the ID of each test case to its observed values.
+	TestCases map[string]BaselineTestCase `json:"testCases"`
+}
+
+// BaselineTestCase is the snapshot of the values observed for a single
+// test case.
+type BaselineTestCase struct {
+	// AllocOp is the observed number of allocations per operation, or nil
+	// if the test case was not benchmarked.
+	AllocOp *int64 `json:"allocOp,omitempty"`
+
+	// BytesOp is the observed number of bytes per operation, or nil if the
+	// test case was not benchmarked.
+	BytesOp *int64 `json:"bytesOp,omitempty"`
+
+	// Escapes is the observed number of heap escapes and moves, or nil if
+	// the test case has no match directives.
+	Escapes *int64 `json:"escapes,omitempty"`
+}
+
+// NewBaseline returns a new baseline from the provided result.
+//
+// If a previous baseline is provided then its entries are kept for the
+// test cases that were not run, ex. because of a filter, as long as their
+// IDs are included in the provided list of IDs. This way the entries for
+// test cases that were removed from the source are dropped.
+func NewBaseline(prev *Baseline, ids []string, result Result) Baseline {
+	b := Baseline{TestCases: map[string]BaselineTestCase{}}
+	if prev != nil {
+		for _, id := range ids {
+			if btc, ok := prev.TestCases[id]; ok {
+				b.TestCases[id] = btc
+			}
+		}
+	}
+	for _, r := range result.TestCases {
+		if r.Skipped {
+			continue
+		}
+		var btc BaselineTestCase
+		if r.Benchmark != nil {
+			allocOp, bytesOp := r.Benchmark.AllocOp, r.Benchmark.BytesOp
+			btc.AllocOp, btc.BytesOp = &allocOp, &bytesOp
+		}
+		if r.Escapes != nil {
+			escapes := *r.Escapes
+			btc.Escapes = &escapes
+		}
+		b.TestCases[r.ID] = btc
+	}
+	return b
+}
+
+// MissingIDs returns the sorted IDs of the test cases in the baseline that
+// are not included in the provided list of IDs.
+func (b Baseline) MissingIDs(ids []string) []string {
+	known := map[string]struct{}{}
+	for _, id := range ids {
+		known[id] = struct{}{}
+	}
+	var missing []string
+	for id := range b.TestCases {
+		if _, ok := known[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// ReadBaseline reads the baseline at the specified path.
+func ReadBaseline(path string) (*Baseline, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var b Baseline
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, fmt.Errorf("invalid baseline %s: %w", path, err)
+	}
+	return &b, nil
+}
+
+// WriteBaseline writes the provided baseline to the specified path as
+// JSON.
+func WriteBaseline(path string, b Baseline) error {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// getBaselineErrs returns a message for each of the observed values in the
+// provided result that are worse than the values in the baseline.
+func getBaselineErrs(btc BaselineTestCase, r TestCaseResult) []string {
+	var errs []string
+	regressed := func(kind string, baseline *int64, actual int64) {
+		if baseline != nil && actual > *baseline {
+			errs = append(errs, fmt.Sprintf(
+				"regressed %s: baseline=%d, actual=%d",
+				kind, *baseline, actual))
+		}
+	}
+	if r.Benchmark != nil {
+		regressed("alloc", btc.AllocOp, r.Benchmark.AllocOp)
+		regressed("bytes", btc.BytesOp, r.Benchmark.BytesOp)
+	}
+	if r.Escapes != nil {
+		regressed("escapes", btc.Escapes, *r.Escapes)
+	}
+	return errs
+}
+
+// getEscapes returns the number of heap escapes and moves in the build
+// optimization output for the lines asserted by the test case's match
+// directives, and false if the test case has no such directives.
+func getEscapes(ctx Context, tc TestCase) (int64, bool) {
+	var (
+		n     int64
+		found bool
+		seen  = map[string]struct{}{}
+	)
+	lmss := [][]LineMatcher{tc.Matches, tc.Natches, tc.Counts}
+	lmss = append(lmss, tc.Seqs...)
+	for _, lms := range lmss {
+		for _, lm := range lms {
+			if lm.File == "" || lm.Line == 0 {
+				continue
+			}
+			key := fmt.Sprintf("%s:%s:%d", lm.Path, lm.File, lm.Line)
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			found = true
+			for _, l := range lm.FindLineOutput(getBuildOutput(ctx, lm)) {
+				if strings.Contains(l, "escapes to heap") ||
+					strings.Contains(l, "moved to heap:") {
+					n++
+				}
+			}
+		}
+	}
+	return n, found
+}
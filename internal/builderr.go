@@ -0,0 +1,145 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// BuildError is the error returned when the go command fails. Its message
+// includes the line of source code for each of the compiler's errors, if
+// the source is available, to make it easier to find the cause.
+type BuildError struct {
+	// Err is the error returned when running the go command.
+	Err error
+
+	// Output is the raw stderr of the go command.
+	Output string
+
+	// Diagnostics are the errors parsed from Output.
+	Diagnostics []BuildDiagnostic
+}
+
+// BuildDiagnostic is an error reported by the compiler for a line of a
+// Go source file.
+type BuildDiagnostic struct {
+	// File is the path of the file as it appears in the output.
+	File string
+
+	// Line is the line on which the error occurred.
+	Line int
+
+	// Column is the column at which the error occurred, or zero if the
+	// column was not reported.
+	Column int
+
+	// Message is the error message.
+	Message string
+
+	// Source is the line of source code on which the error occurred, or
+	// an empty string if the file could not be read.
+	Source string
+}
+
+func (e *BuildError) Error() string {
+	if len(e.Diagnostics) == 0 {
+		return fmt.Sprintf("%v\n%s", e.Err, e.Output)
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%v\n", e.Err)
+	for _, d := range e.Diagnostics {
+		if d.Column > 0 {
+			fmt.Fprintf(&sb, "%s:%d:%d: %s\n", d.File, d.Line, d.Column, d.Message)
+		} else {
+			fmt.Fprintf(&sb, "%s:%d: %s\n", d.File, d.Line, d.Message)
+		}
+		if d.Source != "" {
+			fmt.Fprintf(&sb, "\t%d | %s\n", d.Line, d.Source)
+			if caret := getCaret(d.Source, d.Column); caret != "" {
+				fmt.Fprintf(&sb, "\t%s | %s\n",
+					strings.Repeat(" ", len(strconv.Itoa(d.Line))), caret)
+			}
+		}
+	}
+	return sb.String()
+}
+
+// Unwrap returns the error returned when running the go command.
+func (e *BuildError) Unwrap() error {
+	return e.Err
+}
+
+// getCaret returns a line that points to the specified, one-based column
+// of the provided source line, or an empty string if the column is out of
+// range. Tabs in the source are preserved so the caret lines up with the
+// source.
+func getCaret(src string, col int) string {
+	if col <= 0 || col > len(src) {
+		return ""
+	}
+	var sb strings.Builder
+	for i := 0; i < col-1; i++ {
+		if src[i] == '\t' {
+			sb.WriteByte('\t')
+		} else {
+			sb.WriteByte(' ')
+		}
+	}
+	sb.WriteByte('^')
+	return sb.String()
+}
+
+var diagnosticRx = regexp.MustCompile(`^(.+?\.go):(\d+):(?:(\d+):)? (.+)$`)
+
+// newBuildError returns a BuildError for the provided error and the stderr
+// of the go command that was run in the specified directory. The relative
+// paths in the output are resolved against the directory in order to read
+// the source lines.
+func newBuildError(err error, output, dir string) *BuildError {
+	var (
+		diags     []BuildDiagnostic
+		fileLines = map[string][]string{}
+	)
+	for _, l := range newlnRx.Split(output, -1) {
+		m := diagnosticRx.FindStringSubmatch(l)
+		if m == nil {
+			continue
+		}
+		d := BuildDiagnostic{File: m[1], Message: m[4]}
+		d.Line, _ = strconv.Atoi(m[2])
+		d.Column, _ = strconv.Atoi(m[3])
+
+		lines, ok := fileLines[d.File]
+		if !ok {
+			filePath := d.File
+			if !filepath.IsAbs(filePath) {
+				filePath = filepath.Join(dir, filePath)
+			}
+			lines, _ = readLines(filePath)
+			fileLines[d.File] = lines
+		}
+		if d.Line > 0 && d.Line <= len(lines) {
+			d.Source = lines[d.Line-1]
+		}
+		diags = append(diags, d)
+	}
+	return &BuildError{Err: err, Output: output, Diagnostics: diags}
+}
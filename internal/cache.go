@@ -0,0 +1,174 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"go/build"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// getCacheDir returns the directory used to cache build output, or an
+// empty string if the cache is disabled.
+func getCacheDir(ctx Context) string {
+	if ctx.DisableBuildCache {
+		return ""
+	}
+	if ctx.BuildCacheDir != "" {
+		return ctx.BuildCacheDir
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "lem")
+}
+
+// getCacheKey returns the key used to cache the build output for the
+// provided package. The key is a hash of the go version, the target
+// platform, the context's environment variables, the compiler flags, the
+// package's import path and source files, and the build IDs of the
+// package's dependencies, so changing a dependency invalidates the cached
+// output, ex. when a function it exports may no longer be inlined.
+func getCacheKey(
+	pkg build.Package,
+	ctx Context,
+	compilerFlagVal string) (string, error) {
+
+	cmd := exec.Command(getGoCmd(ctx), "version")
+	cmd.Dir = getDir(ctx)
+	cmd.Env = getEnv(ctx)
+	goVersion, err := cmd.Output()
+	if err != nil {
+		// Include the go command's stderr, ex. the toolchain could not be
+		// downloaded, instead of just its exit status.
+		var stderr string
+		if ee, ok := err.(*exec.ExitError); ok {
+			stderr = string(ee.Stderr)
+		}
+		return "", fmt.Errorf(
+			"failed to get go version: %w", newBuildError(err, stderr, cmd.Dir))
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "version=%s\n", goVersion)
+	if ctx.BuildContext != nil {
+		fmt.Fprintf(h, "goos=%s\n", ctx.BuildContext.GOOS)
+		fmt.Fprintf(h, "goarch=%s\n", ctx.BuildContext.GOARCH)
+		fmt.Fprintf(h, "cgo=%v\n", ctx.BuildContext.CgoEnabled)
+		fmt.Fprintf(h, "tags=%s\n",
+			strings.Join(ctx.BuildContext.BuildTags, ","))
+	}
+	envKeys := make([]string, 0, len(ctx.Env))
+	for k := range ctx.Env {
+		envKeys = append(envKeys, k)
+	}
+	sort.Strings(envKeys)
+	for _, k := range envKeys {
+		fmt.Fprintf(h, "env=%s=%s\n", k, ctx.Env[k])
+	}
+	fmt.Fprintf(h, "buildmode=%s\n", ctx.BuildMode)
+	fmt.Fprintf(h, "buildargs=%s\n", strings.Join(ctx.ExtraBuildArgs, " "))
+	fmt.Fprintf(h, "testargs=%s\n", strings.Join(ctx.ExtraTestArgs, " "))
+	fmt.Fprintf(h, "gcflags=%s\n", compilerFlagVal)
+	fmt.Fprintf(h, "pkg=%s\n", pkg.ImportPath)
+
+	deps, err := getDepsBuildIDs(pkg, ctx)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(h, "deps=%s\n", deps)
+
+	var srcs []string
+	srcs = append(srcs, pkg.GoFiles...)
+	srcs = append(srcs, pkg.CgoFiles...)
+	srcs = append(srcs, pkg.TestGoFiles...)
+	srcs = append(srcs, pkg.XTestGoFiles...)
+	sort.Strings(srcs)
+	for _, src := range srcs {
+		if err := hashFile(h, filepath.Join(pkg.Dir, src)); err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// getDepsBuildIDs returns the import path and build ID of each of the
+// dependencies of the provided package, including those of its tests.
+func getDepsBuildIDs(pkg build.Package, ctx Context) ([]byte, error) {
+	args := []string{"list", "-export", "-deps", "-test"}
+	args = append(args, getTagsArgs(ctx)...)
+	args = append(args, "-f", "{{.ImportPath}} {{.BuildID}}", pkg.ImportPath)
+	var stdout bytes.Buffer
+	if err := runGoStreams(&stdout, io.Discard, ctx, args...); err != nil {
+		return nil, fmt.Errorf("failed to list dependencies: %w", err)
+	}
+	return stdout.Bytes(), nil
+}
+
+func hashFile(w io.Writer, filePath string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fmt.Fprintf(w, "file=%s\n", filepath.Base(filePath))
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// readCache returns the cached build output for the specified key.
+func readCache(dir, key string) ([]byte, bool) {
+	data, err := os.ReadFile(filepath.Join(dir, key))
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// writeCache caches the build output for the specified key.
+func writeCache(dir, key string, data []byte) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// Write the data to a temporary file and then rename it so concurrent
+	// readers never observe a partially written file.
+	f, err := os.CreateTemp(dir, key+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(dir, key))
+}
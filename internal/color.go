@@ -0,0 +1,115 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	colorReset     = "\x1b[0m"
+	colorError     = "\x1b[1;31m"
+	colorLabel     = "\x1b[1;36m"
+	colorHighlight = "\x1b[1;4;33m"
+)
+
+// colorizer adds ANSI colors to the failure messages when true.
+type colorizer bool
+
+// newColorizer returns a colorizer that is enabled only if color is
+// requested, the NO_COLOR environment variable is not set, and the test
+// output is written to a terminal.
+func newColorizer(enabled bool) colorizer {
+	if !enabled {
+		return false
+	}
+	if _, ok := os.LookupEnv("NO_COLOR"); ok {
+		return false
+	}
+	return colorizer(isTerminal(os.Stdout))
+}
+
+// isTerminal returns true if the provided file is a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+var (
+	labelRx  = regexp.MustCompile(`^(error|reason|scope|output|regexp|after|file|source|output for line):`)
+	columnRx = regexp.MustCompile(`^\t?\S+?:(\d+):(\d+): `)
+)
+
+// colorize returns the provided failure message with its labels colored.
+// If the message includes compiler output for the matcher's line then the
+// token at the reported column of the source line is highlighted as well.
+func (c colorizer) colorize(msg string, lm LineMatcher) string {
+	if !c {
+		return msg
+	}
+	col := 0
+	lines := strings.Split(msg, "\n")
+	for _, l := range lines {
+		m := columnRx.FindStringSubmatch(strings.TrimPrefix(l, "output: "))
+		if m == nil {
+			continue
+		}
+		if line, _ := strconv.Atoi(m[1]); line == lm.Line {
+			col, _ = strconv.Atoi(m[2])
+			break
+		}
+	}
+	for i, l := range lines {
+		m := labelRx.FindStringSubmatch(l)
+		if m == nil {
+			continue
+		}
+		label, value := m[0], l[len(m[0]):]
+		if m[1] == "source" {
+			value = " " + highlight(strings.TrimPrefix(value, " "), col)
+		}
+		color := colorLabel
+		if m[1] == "error" {
+			color = colorError
+		}
+		lines[i] = color + label + colorReset + value
+	}
+	return strings.Join(lines, "\n")
+}
+
+// highlight returns the provided source line with the token at the
+// specified, one-based column highlighted. The line is returned as-is if
+// the column is out of range.
+func highlight(src string, col int) string {
+	start := col - 1
+	if col <= 0 || start >= len(src) {
+		return src
+	}
+	end := start + 1
+	for end < len(src) && isTokenByte(src[end]) && isTokenByte(src[start]) {
+		end++
+	}
+	return src[:start] + colorHighlight + src[start:end] + colorReset + src[end:]
+}
+
+func isTokenByte(b byte) bool {
+	return b == '_' || b == '.' ||
+		'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9'
+}
@@ -0,0 +1,220 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Comparison is the difference between the results of running the same
+// test cases against two builds, ex. with and without inlining.
+type Comparison struct {
+	// TestCases is the comparison of each of the test cases run against
+	// both builds, in the order in which they were run against the base
+	// build.
+	TestCases []TestCaseComparison `json:"testCases"`
+
+	// Added maps the import path of each package to the lines of its
+	// optimization output that appear only in the other build.
+	Added map[string][]string `json:"added,omitempty"`
+
+	// Removed maps the import path of each package to the lines of its
+	// optimization output that appear only in the base build.
+	Removed map[string][]string `json:"removed,omitempty"`
+}
+
+// TestCaseComparison is the difference between the values observed for a
+// single test case in two builds.
+type TestCaseComparison struct {
+	// ID maps to lem.<ID>.
+	ID string `json:"id"`
+
+	// Base is the values observed for the test case in the base build.
+	Base BaselineTestCase `json:"base"`
+
+	// Other is the values observed for the test case in the other build.
+	Other BaselineTestCase `json:"other"`
+
+	// Improved is the kinds of values that are lower in the other build,
+	// ex. "alloc", "bytes", or "escapes".
+	Improved []string `json:"improved,omitempty"`
+
+	// Regressed is the kinds of values that are higher in the other
+	// build.
+	Regressed []string `json:"regressed,omitempty"`
+}
+
+// Compare returns the comparison of the results of running the same test
+// cases against a base build and another build. The test cases that were
+// skipped or only run against one of the builds are not compared.
+func Compare(base, other Result) Comparison {
+	var (
+		c         = Comparison{TestCases: []TestCaseComparison{}}
+		baseVals  = NewBaseline(nil, nil, base).TestCases
+		otherVals = NewBaseline(nil, nil, other).TestCases
+	)
+	for _, r := range base.TestCases {
+		b, ok := baseVals[r.ID]
+		if !ok {
+			continue
+		}
+		o, ok := otherVals[r.ID]
+		if !ok {
+			continue
+		}
+		tcc := TestCaseComparison{ID: r.ID, Base: b, Other: o}
+		compare := func(kind string, b, o *int64) {
+			switch {
+			case b == nil || o == nil:
+			case *o < *b:
+				tcc.Improved = append(tcc.Improved, kind)
+			case *o > *b:
+				tcc.Regressed = append(tcc.Regressed, kind)
+			}
+		}
+		compare("alloc", b.AllocOp, o.AllocOp)
+		compare("bytes", b.BytesOp, o.BytesOp)
+		compare("escapes", b.Escapes, o.Escapes)
+		c.TestCases = append(c.TestCases, tcc)
+	}
+
+	importPaths := map[string]struct{}{}
+	for importPath := range base.BuildOutputs {
+		importPaths[importPath] = struct{}{}
+	}
+	for importPath := range other.BuildOutputs {
+		importPaths[importPath] = struct{}{}
+	}
+	for importPath := range importPaths {
+		baseOutput := base.BuildOutputs[importPath]
+		otherOutput := other.BuildOutputs[importPath]
+		if added := diffLines(otherOutput, baseOutput); len(added) > 0 {
+			if c.Added == nil {
+				c.Added = map[string][]string{}
+			}
+			c.Added[importPath] = added
+		}
+		if removed := diffLines(baseOutput, otherOutput); len(removed) > 0 {
+			if c.Removed == nil {
+				c.Removed = map[string][]string{}
+			}
+			c.Removed[importPath] = removed
+		}
+	}
+
+	return c
+}
+
+// diffLines returns the lines of optimization output in a that do not
+// appear in b, in the order in which they appear in a. The lines that name
+// the package being built, ex. "# example.com/hello", are ignored.
+func diffLines(a, b string) []string {
+	inB := map[string]struct{}{}
+	for _, l := range newlnRx.Split(b, -1) {
+		inB[l] = struct{}{}
+	}
+	var diff []string
+	for _, l := range newlnRx.Split(a, -1) {
+		if l == "" || strings.HasPrefix(l, "# ") {
+			continue
+		}
+		if _, ok := inB[l]; !ok {
+			diff = append(diff, l)
+		}
+	}
+	return diff
+}
+
+// Improved returns the IDs of the test cases with at least one value that
+// is lower in the other build.
+func (c Comparison) Improved() []string {
+	var ids []string
+	for _, tcc := range c.TestCases {
+		if len(tcc.Improved) > 0 {
+			ids = append(ids, tcc.ID)
+		}
+	}
+	return ids
+}
+
+// Regressed returns the IDs of the test cases with at least one value that
+// is higher in the other build.
+func (c Comparison) Regressed() []string {
+	var ids []string
+	for _, tcc := range c.TestCases {
+		if len(tcc.Regressed) > 0 {
+			ids = append(ids, tcc.ID)
+		}
+	}
+	return ids
+}
+
+// String returns a summary of the comparison that includes the values of
+// each of the test cases that improved or regressed, as well as the lines
+// of optimization output that were added or removed for each package.
+func (c Comparison) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb,
+		"comparison: %d test case(s), %d improved, %d regressed\n",
+		len(c.TestCases), len(c.Improved()), len(c.Regressed()))
+	for _, tcc := range c.TestCases {
+		if len(tcc.Improved) == 0 && len(tcc.Regressed) == 0 {
+			continue
+		}
+		fmt.Fprintf(&sb, "\t%s:", tcc.ID)
+		for _, kind := range tcc.Improved {
+			fmt.Fprintf(&sb, " improved %s", tcc.delta(kind))
+		}
+		for _, kind := range tcc.Regressed {
+			fmt.Fprintf(&sb, " regressed %s", tcc.delta(kind))
+		}
+		sb.WriteByte('\n')
+	}
+	writeLines := func(prefix string, m map[string][]string) {
+		importPaths := make([]string, 0, len(m))
+		for importPath := range m {
+			importPaths = append(importPaths, importPath)
+		}
+		sort.Strings(importPaths)
+		for _, importPath := range importPaths {
+			fmt.Fprintf(&sb, "%s %s:\n", prefix, importPath)
+			for _, l := range m[importPath] {
+				fmt.Fprintf(&sb, "\t%s\n", l)
+			}
+		}
+	}
+	writeLines("added", c.Added)
+	writeLines("removed", c.Removed)
+	return sb.String()
+}
+
+// delta returns the specified kind of value in the base and other builds,
+// ex. "alloc=2->1".
+func (tcc TestCaseComparison) delta(kind string) string {
+	var b, o *int64
+	switch kind {
+	case "alloc":
+		b, o = tcc.Base.AllocOp, tcc.Other.AllocOp
+	case "bytes":
+		b, o = tcc.Base.BytesOp, tcc.Other.BytesOp
+	case "escapes":
+		b, o = tcc.Base.Escapes, tcc.Other.Escapes
+	}
+	return fmt.Sprintf("%s=%d->%d", kind, *b, *o)
+}
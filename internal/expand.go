@@ -0,0 +1,114 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"errors"
+	"go/build"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ExpandPackages returns the provided package patterns with any relative
+// patterns that end with "/...", ex. "./...", replaced by the relative
+// paths of the packages rooted at the pattern's directory, in the same
+// manner as the go tool.
+//
+// Directories named "testdata" or "vendor", directories whose names begin
+// with "." or "_", and directories that contain another module's go.mod
+// file are not walked. Directories without any Go files are skipped.
+//
+// Patterns that are not relative, or do not end with "/...", are returned
+// as-is.
+func ExpandPackages(
+	ctx Context,
+	dir string,
+	patterns ...string) ([]string, error) {
+
+	bctx := ctx.BuildContext
+	if bctx == nil {
+		bctx = &build.Default
+	}
+
+	var pkgs []string
+	for _, pattern := range patterns {
+		if !isRecursivePattern(pattern) {
+			pkgs = append(pkgs, pattern)
+			continue
+		}
+		root := strings.TrimSuffix(pattern, "...")
+		root = strings.TrimSuffix(root, "/")
+		rootDir := filepath.Join(dir, filepath.FromSlash(root))
+		err := filepath.Walk(rootDir, func(
+			p string, fi os.FileInfo, err error) error {
+
+			if err != nil {
+				return err
+			}
+			if !fi.IsDir() {
+				return nil
+			}
+			if p != rootDir {
+				if name := fi.Name(); name == "testdata" ||
+					name == "vendor" ||
+					strings.HasPrefix(name, ".") ||
+					strings.HasPrefix(name, "_") {
+					return filepath.SkipDir
+				}
+				if _, err := os.Stat(filepath.Join(p, "go.mod")); err == nil {
+					return filepath.SkipDir
+				}
+			}
+			if _, err := bctx.ImportDir(p, build.IgnoreVendor); err != nil {
+				var noGoErr *build.NoGoError
+				if errors.As(err, &noGoErr) {
+					return nil
+				}
+				return err
+			}
+			rel, err := filepath.Rel(rootDir, p)
+			if err != nil {
+				return err
+			}
+			// Relative paths must keep their leading "./" or "../" for
+			// build.Import to resolve them relative to dir.
+			pkg := path.Join(root, filepath.ToSlash(rel))
+			if pkg != "." && pkg != ".." &&
+				!strings.HasPrefix(pkg, "./") &&
+				!strings.HasPrefix(pkg, "../") {
+				pkg = "./" + pkg
+			}
+			pkgs = append(pkgs, pkg)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return pkgs, nil
+}
+
+// isRecursivePattern returns true if the provided pattern is a relative
+// package pattern that ends with "...".
+func isRecursivePattern(pattern string) bool {
+	return (strings.HasPrefix(pattern, "./") ||
+		strings.HasPrefix(pattern, "../")) &&
+		strings.HasSuffix(pattern, "/...")
+}
@@ -0,0 +1,30 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+// GetBenchmarkErr exports getBenchmarkErr for testing.
+var GetBenchmarkErr = getBenchmarkErr
+
+// Colorize calls colorize with colors enabled for testing.
+func Colorize(msg string, lm LineMatcher) string {
+	return colorizer(true).colorize(msg, lm)
+}
+
+// NewColorizer exports newColorizer for testing.
+func NewColorizer(enabled bool) bool {
+	return bool(newColorizer(enabled))
+}
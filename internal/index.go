@@ -0,0 +1,132 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// BuildOutputIndex indexes the lines of build optimization output by the
+// base name of the file and the line number to which each line refers, so
+// the output for a line may be looked up directly instead of matching a
+// regular expression against all of the output.
+type BuildOutputIndex struct {
+	lines  []string
+	byLine map[string][]int
+
+	// all is all of the indexed output, joined once on demand.
+	all     string
+	allOnce sync.Once
+}
+
+// fileLineRx matches the file and line number at the beginning of a line
+// of build optimization output.
+var fileLineRx = regexp.MustCompile(`^(?:.*[/\\])?([^/\\]+\.go):(\d+):\d+: `)
+
+// NewBuildOutputIndex returns a new index of the build optimization output
+// read from the provided reader in a single, streaming pass.
+func NewBuildOutputIndex(r io.Reader) (*BuildOutputIndex, error) {
+	idx := &BuildOutputIndex{byLine: map[string][]int{}}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		idx.add(scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// add appends the line to the index.
+func (idx *BuildOutputIndex) add(l string) {
+	if m := fileLineRx.FindStringSubmatch(l); m != nil {
+		key := m[1] + ":" + m[2]
+		idx.byLine[key] = append(idx.byLine[key], len(idx.lines))
+	}
+	idx.lines = append(idx.lines, l)
+}
+
+// Ignore returns a new index without the lines matched by any of the
+// provided patterns. The index itself is returned if there are no patterns.
+func (idx *BuildOutputIndex) Ignore(patterns []*regexp.Regexp) *BuildOutputIndex {
+	if len(patterns) == 0 {
+		return idx
+	}
+	filtered := &BuildOutputIndex{byLine: map[string][]int{}}
+	for _, l := range idx.lines {
+		if !isIgnored(l, patterns) {
+			filtered.add(l)
+		}
+	}
+	return filtered
+}
+
+// IgnoreBuildOutput returns the build output without the lines matched by
+// any of the provided patterns.
+func IgnoreBuildOutput(buildOutput string, patterns []*regexp.Regexp) string {
+	if len(patterns) == 0 || buildOutput == "" {
+		return buildOutput
+	}
+	var sb strings.Builder
+	for _, l := range strings.SplitAfter(buildOutput, "\n") {
+		if l != "" && !isIgnored(strings.TrimSuffix(l, "\n"), patterns) {
+			sb.WriteString(l)
+		}
+	}
+	return sb.String()
+}
+
+// isIgnored returns true if the line is matched by any of the patterns.
+func isIgnored(l string, patterns []*regexp.Regexp) bool {
+	for _, rx := range patterns {
+		if rx.MatchString(l) {
+			return true
+		}
+	}
+	return false
+}
+
+// Lookup returns the lines of output for the specified file and line, in
+// the order in which they were emitted. The file is matched by its base
+// name, the same as the regular expressions of the match directives.
+func (idx *BuildOutputIndex) Lookup(fileName string, lineNo int) []string {
+	indices := idx.byLine[fileName+":"+strconv.Itoa(lineNo)]
+	if len(indices) == 0 {
+		return nil
+	}
+	lines := make([]string, len(indices))
+	for i, j := range indices {
+		lines[i] = idx.lines[j]
+	}
+	return lines
+}
+
+// String returns all of the indexed output.
+func (idx *BuildOutputIndex) String() string {
+	idx.allOnce.Do(func() {
+		if len(idx.lines) > 0 {
+			idx.all = strings.Join(idx.lines, "\n") + "\n"
+		}
+	})
+	return idx.all
+}
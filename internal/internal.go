@@ -18,45 +18,202 @@ package internal
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"go/build"
 	"io"
-	"io/ioutil"
 	"log"
+	"math"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 // Context is an internal subset of lem.Context. Please refer to lem.Context
 // for additional information.
 type Context struct {
-	Benchmarks    map[string]func(*testing.B)
-	BuildOutput   string
-	CompilerFlags []string
+	AllowOrphanedBenchmarks bool
+	AsmOutput               string
+	Baseline                *Baseline
+	BenchmarkGOMAXPROCS     int
+	BenchmarkPrefix         string
+	Benchmarks              map[string]func(*testing.B)
+	BenchmarksMulti         map[string][]func(*testing.B)
+	BuildCacheDir           string
+	BuildContext            *build.Context
+	BuildMode               string
+	BuildOutput             string
+	BuildOutputIndex        *BuildOutputIndex
+	BuildParallelism        int
+	BuildTimeout            time.Duration
+	Color                   bool
+	CompilerFlags           []string
+	DisableBuildCache       bool
+	Env                     map[string]string
+	ExtraBuildArgs          []string
+	ExtraTestArgs           []string
+	Filter                  string
+	GoCmd                   string
+	GoToolchain             string
+	IgnorePatterns          []*regexp.Regexp
+	IncludeDeps             bool
+	Logger                  *log.Logger
+	MFlagLevel              int
+	PackageCompilerFlags    map[string][]string
+	Parallel                bool
+	Record                  bool
+	RequireBenchmarks       bool
+	SortTests               bool
+	TempDir                 string
+	Tolerance               float64
+	Verbose                 bool
+	VetOutput               string
+
+	// color is set by Tree.Run from Color.
+	color colorizer
 }
 
 // Int64Range is an inclusive range of int64 values.
+//
+// If Op is set then the range is open-ended and is evaluated using the
+// specified comparison operator:
+//
+//   - "<" and "<=" compare against Max, and Min is ignored
+//   - ">" and ">=" compare against Min, and Max is ignored
+//
+// If Tolerance is set then Min and Max were computed from Value plus or
+// minus Tolerance percent, with Min rounded down and Max rounded up so
+// the range is never narrower than the tolerance implies.
+//
+// The bounds are inclusive unless ExcludeMin or ExcludeMax is set, in
+// which case the corresponding bound is not part of the range. Both are
+// ignored if Op is set.
 type Int64Range struct {
-	Min int64
-	Max int64
+	Min        int64   `json:"min"`
+	Max        int64   `json:"max"`
+	Op         string  `json:"op,omitempty"`
+	Value      int64   `json:"value,omitempty"`
+	Tolerance  float64 `json:"tolerance,omitempty"`
+	ExcludeMin bool    `json:"excludeMin,omitempty"`
+	ExcludeMax bool    `json:"excludeMax,omitempty"`
 }
 
 func (i Int64Range) deepEqual(b Int64Range) bool {
-	return i.Min == b.Min && i.Max == b.Max
+	return i.Min == b.Min && i.Max == b.Max && i.Op == b.Op &&
+		i.Value == b.Value && i.Tolerance == b.Tolerance &&
+		i.ExcludeMin == b.ExcludeMin && i.ExcludeMax == b.ExcludeMax
 }
 
-// Eq returns true when (Min==Max && a==Min) || (a>=Min && a<=Max).
+// Eq returns true when a>=Min && a<=Max, or a>Min and a<Max if ExcludeMin
+// and ExcludeMax are set, respectively. If Op is set, Eq returns true
+// when a satisfies the comparison.
 func (i Int64Range) Eq(a int64) bool {
+	switch i.Op {
+	case "<":
+		return a < i.Max
+	case "<=":
+		return a <= i.Max
+	case ">":
+		return a > i.Min
+	case ">=":
+		return a >= i.Min
+	}
+	if a < i.Min || (i.ExcludeMin && a == i.Min) {
+		return false
+	}
+	if a > i.Max || (i.ExcludeMax && a == i.Max) {
+		return false
+	}
+	return true
+}
+
+// withTolerance returns the range widened by plus or minus p percent, with
+// Min rounded down and Max rounded up. The range is returned as is if it
+// already has a tolerance of its own, is open-ended, or excludes either of
+// its bounds, or if widening it does not change it, ex. zero.
+func (i Int64Range) withTolerance(p float64) Int64Range {
+	if p == 0 || i.Tolerance != 0 || i.Op != "" || !i.isInclusive() {
+		return i
+	}
+	w := Int64Range{
+		Min: int64(math.Floor(float64(i.Min) * (1 - p/100))),
+		Max: int64(math.Ceil(float64(i.Max) * (1 + p/100))),
+	}
+	if w.Min == i.Min && w.Max == i.Max {
+		return i
+	}
 	if i.Min == i.Max {
-		return i.Min == a
+		w.Value, w.Tolerance = i.Min, p
 	}
-	return a >= i.Min && a <= i.Max
+	return w
+}
+
+// isInclusive returns true if neither bound of the range is excluded.
+func (i Int64Range) isInclusive() bool {
+	return !i.ExcludeMin && !i.ExcludeMax
+}
+
+// delta returns the distance from the provided value to the nearest bound
+// of the range, or zero if the value is in the range. The result is
+// positive if the value is greater than the range and negative if it is
+// less.
+func (i Int64Range) delta(a int64) int64 {
+	if i.Eq(a) {
+		return 0
+	}
+	switch i.Op {
+	case "<", "<=":
+		return a - i.Max
+	case ">", ">=":
+		return a - i.Min
+	}
+	if a > i.Max || (i.ExcludeMax && a == i.Max) {
+		if i.ExcludeMax {
+			return a - i.Max + 1
+		}
+		return a - i.Max
+	}
+	if i.ExcludeMin {
+		return a - i.Min - 1
+	}
+	return a - i.Min
 }
 
 // String returns the string version of this value.
 func (i Int64Range) String() string {
+	switch i.Op {
+	case "<", "<=":
+		return fmt.Sprintf("%s%d", i.Op, i.Max)
+	case ">", ">=":
+		return fmt.Sprintf("%s%d", i.Op, i.Min)
+	}
+	if !i.isInclusive() {
+		lb, rb := "[", "]"
+		if i.ExcludeMin {
+			lb = "("
+		}
+		if i.ExcludeMax {
+			rb = ")"
+		}
+		return fmt.Sprintf("%s%d,%d%s", lb, i.Min, i.Max, rb)
+	}
+	if i.Tolerance != 0 {
+		return fmt.Sprintf(
+			"%d±%s%% (%d-%d, rounded outward)",
+			i.Value,
+			strconv.FormatFloat(i.Tolerance, 'f', -1, 64),
+			i.Min, i.Max)
+	}
 	if i.Min == i.Max {
 		return fmt.Sprintf("%d", i.Min)
 	}
@@ -66,39 +223,139 @@ func (i Int64Range) String() string {
 // Build builds the specified package in order to produce the optimization
 // output.
 func Build(w io.Writer, pkg build.Package, ctx Context) error {
+	return buildWithFlag(w, pkg, ctx, getMFlag(ctx))
+}
+
+// getMFlag returns the "-m" compiler flag for the context's MFlagLevel,
+// ex. "-m" for level one, the default, or "-m=2" for level two.
+func getMFlag(ctx Context) string {
+	if ctx.MFlagLevel <= 1 {
+		return "-m"
+	}
+	return "-m=" + strconv.Itoa(ctx.MFlagLevel)
+}
+
+// isSameFlag returns true if the two compiler flags are the same flag,
+// where any of the forms of the "-m" flag, ex. "-m" or "-m=2", are
+// considered the same.
+func isSameFlag(a, b string) bool {
+	isMFlag := func(f string) bool {
+		return f == "-m" || strings.HasPrefix(f, "-m=")
+	}
+	return a == b || (isMFlag(a) && isMFlag(b))
+}
+
+// BuildAsm builds the specified package in order to produce the assembly
+// output.
+func BuildAsm(w io.Writer, pkg build.Package, ctx Context) error {
+	return buildWithFlag(w, pkg, ctx, "-S")
+}
+
+// buildWithFlag builds the specified package with the provided compiler
+// flag in addition to the context's compiler flags.
+func buildWithFlag(
+	w io.Writer,
+	pkg build.Package,
+	ctx Context,
+	flag string) error {
 
 	// If there are no valid Go sources, test or otherwise, then
 	// return early.
 	if len(pkg.GoFiles) == 0 &&
+		len(pkg.CgoFiles) == 0 &&
 		len(pkg.TestGoFiles) == 0 &&
 		len(pkg.XTestGoFiles) == 0 {
 		return nil
 	}
 
-	// Build a set of compiler flags.
-	compilerFlags := []string{"-m"}
-	for _, f := range ctx.CompilerFlags {
-		if f != "-m" { // do not add a duplicate -m flag
-			compilerFlags = append(compilerFlags, f)
+	// Build a set of compiler flags from the global flags followed by the
+	// package's flags.
+	compilerFlags := []string{flag}
+	for _, flags := range [][]string{
+		ctx.CompilerFlags,
+		ctx.PackageCompilerFlags[pkg.ImportPath],
+	} {
+		for _, f := range flags {
+			if !isSameFlag(f, flag) { // do not add a duplicate flag
+				compilerFlags = append(compilerFlags, f)
+			}
 		}
 	}
 	compilerFlagVal := strings.Join(compilerFlags, " ")
+	if ctx.IncludeDeps {
+		compilerFlagVal = "all=" + compilerFlagVal
+	}
+
+	// The extra arguments may not override the flags set by lem.
+	if err := checkExtraArgs("ExtraTestArgs", ctx.ExtraTestArgs); err != nil {
+		return err
+	}
+	if err := checkExtraArgs("ExtraBuildArgs", ctx.ExtraBuildArgs); err != nil {
+		return err
+	}
+
+	// Return the cached build output if it exists. The cache is only used
+	// when the package's directory is known so its sources may be hashed.
+	var (
+		cacheDir string
+		cacheKey string
+		output   bytes.Buffer
+	)
+	if pkg.Dir != "" {
+		cacheDir = getCacheDir(ctx)
+	}
+	if cacheDir != "" {
+		key, err := getCacheKey(pkg, ctx, compilerFlagVal)
+		if err != nil {
+			return err
+		}
+		if data, ok := readCache(cacheDir, key); ok {
+			_, err := w.Write(data)
+			return err
+		}
+		cacheKey = key
+	}
+
+	// Write the output of the go command to a buffer so it may be cached
+	// and, when dependencies are included, so the paths may be resolved.
+	dst := w
+	w = &output
+
+	// A test binary cannot be built with every build mode, ex. c-shared,
+	// in which case only the package's non-test sources are built.
+	hasTestFiles := len(pkg.TestGoFiles) > 0 || len(pkg.XTestGoFiles) > 0
+	if hasTestFiles && !isTestBuildMode(ctx.BuildMode) {
+		if len(pkg.GoFiles)+len(pkg.CgoFiles) == 0 {
+			return fmt.Errorf(
+				"buildmode %s cannot be used to build the tests of pkg %s, "+
+					"which has no other Go files",
+				ctx.BuildMode, pkg.ImportPath)
+		}
+		getLogger(ctx).Printf(
+			"buildmode %s cannot be used to build the tests of pkg %s, "+
+				"building the pkg without its test files",
+			ctx.BuildMode, pkg.ImportPath)
+		hasTestFiles = false
+	}
 
 	// Build the package's test binary if there are any test files.
 	var didTestBuildPackage bool
-	if len(pkg.TestGoFiles) > 0 || len(pkg.XTestGoFiles) > 0 {
-		tempFileName, err := getTempFileName()
+	if hasTestFiles {
+		tempFileName, removeTempFile, err := newTempFile(ctx.TempDir)
 		if err != nil {
 			return err
 		}
-		defer os.RemoveAll(tempFileName)
+		defer removeTempFile()
 		args := []string{
 			"test",
 			"-c", "-o", tempFileName,
 			"-gcflags", compilerFlagVal,
-			pkg.ImportPath,
 		}
-		if err := forkGo(w, args...); err != nil {
+		args = append(args, getBuildModeArgs(ctx)...)
+		args = append(args, getTagsArgs(ctx)...)
+		args = append(args, ctx.ExtraTestArgs...)
+		args = append(args, pkg.ImportPath)
+		if err := forkGo(w, ctx, args...); err != nil {
 			return err
 		}
 
@@ -112,43 +369,604 @@ func Build(w io.Writer, pkg build.Package, ctx Context) error {
 	}
 
 	// Build the package if there are any sources and if the
-	if len(pkg.GoFiles) > 0 && !didTestBuildPackage {
+	if len(pkg.GoFiles)+len(pkg.CgoFiles) > 0 && !didTestBuildPackage {
 		// Build the list of arguments used to build the package.
 		args := []string{
 			"build",
 			"-gcflags", compilerFlagVal,
-			pkg.ImportPath,
 		}
-		if err := forkGo(w, args...); err != nil {
+		args = append(args, getBuildModeArgs(ctx)...)
+		args = append(args, getTagsArgs(ctx)...)
+		args = append(args, ctx.ExtraBuildArgs...)
+		args = append(args, pkg.ImportPath)
+		if err := forkGo(w, ctx, args...); err != nil {
+			return err
+		}
+	}
+
+	data := output.Bytes()
+	if len(pkg.CgoFiles) > 0 {
+		data = removeCgoOutput(data)
+	}
+	if ctx.IncludeDeps {
+		dir, err := getAbsDir(ctx)
+		if err != nil {
 			return err
 		}
+		data = absOutputPaths(data, dir)
+	}
+	if _, err := dst.Write(data); err != nil {
+		return err
+	}
+
+	if cacheKey != "" {
+		return writeCache(cacheDir, cacheKey, data)
+	}
+
+	return nil
+}
+
+// cgoOutputRx matches a line of compiler output for one of the files
+// generated by cgo, ex. _cgo_gotypes.go.
+var cgoOutputRx = regexp.MustCompile(
+	`(?m)^(?:.*[/\\])?_cgo_[^/\\:\n]*\.go:\d+:\d+: .*(?:\n|$)`)
+
+// removeCgoOutput returns the provided compiler output without the lines
+// for the files generated by cgo. The generated files are not part of the
+// package's sources, so they cannot have lem comments, and their output
+// would otherwise be matched by lem.<ID>.none= assertions. The output for
+// the package's own files that import "C" is unaffected, since cgo uses
+// line directives to map the code it rewrites back to the original files.
+func removeCgoOutput(data []byte) []byte {
+	return cgoOutputRx.ReplaceAll(data, nil)
+}
+
+// relOutputPathRx matches a line of compiler output that begins with a
+// relative path to a Go source file.
+var relOutputPathRx = regexp.MustCompile(
+	`(?m)^([^/\\\s#][^:\n]*\.go)(:\d+:\d+: )`)
+
+// absOutputPaths returns the provided compiler output with the relative
+// paths of the source files resolved against the specified directory,
+// which is the working directory of the go command. This ensures that
+// files with the same base name in different packages may be told apart
+// when the output includes the packages' dependencies.
+//
+// A relative path that does not exist in the specified directory is
+// resolved against the root directory of the directory's module instead,
+// since the go command replays the cached output of the compiler with the
+// paths relative to the directory from which the package was compiled,
+// ex. the module's root directory. When the paths are trimmed, ex. with
+// -trimpath, the files of the module are referred to by the module's path,
+// ex. example.com/hello/a.go, which is also resolved against the module's
+// root directory.
+func absOutputPaths(data []byte, dir string) []byte {
+	modPath, modRoot := getModule(dir)
+	resolved := map[string][]byte{}
+	return relOutputPathRx.ReplaceAllFunc(data, func(m []byte) []byte {
+		sm := relOutputPathRx.FindSubmatch(m)
+		rel := string(sm[1])
+		if filepath.IsAbs(rel) {
+			return m
+		}
+		p, ok := resolved[rel]
+		if !ok {
+			p = []byte(resolveOutputPath(rel, dir, modPath, modRoot))
+			resolved[rel] = p
+		}
+		return append(append([]byte{}, p...), sm[2]...)
+	})
+}
+
+// resolveOutputPath returns the absolute path of the provided relative path
+// from the compiler output. Please see absOutputPaths for more information.
+func resolveOutputPath(rel, dir, modPath, modRoot string) string {
+	p := filepath.Join(dir, rel)
+	if modRoot == "" {
+		return p
+	}
+	if _, err := os.Stat(p); err == nil {
+		return p
+	}
+	modRel := strings.TrimPrefix(rel, modPath+"/")
+	if q := filepath.Join(modRoot, filepath.FromSlash(modRel)); q != p {
+		if _, err := os.Stat(q); err == nil {
+			return q
+		}
+	}
+	return p
+}
+
+// moduleRx matches the module directive of a go.mod file.
+var moduleRx = regexp.MustCompile(`(?m)^module\s+"?([^"\s]+)"?\s*$`)
+
+// getModule returns the path and root directory of the module that
+// contains the specified directory, or empty strings if there is none.
+func getModule(dir string) (modPath, modRoot string) {
+	for d := dir; ; d = filepath.Dir(d) {
+		if data, err := os.ReadFile(filepath.Join(d, "go.mod")); err == nil {
+			if m := moduleRx.FindSubmatch(data); m != nil {
+				return string(m[1]), d
+			}
+			return "", ""
+		}
+		if filepath.Dir(d) == d {
+			return "", ""
+		}
+	}
+}
+
+// getAbsDir returns the absolute path of the working directory of the go
+// command.
+func getAbsDir(ctx Context) (string, error) {
+	if dir := getDir(ctx); dir != "" {
+		return filepath.Abs(dir)
+	}
+	return os.Getwd()
+}
+
+// BuildAll builds the specified packages concurrently, with no more than
+// ctx.BuildParallelism builds at a time, and writes their optimization
+// output to w ordered by the packages' import paths. The output of each
+// package is written as soon as it and the packages ordered before it are
+// built, and is not retained afterwards.
+func BuildAll(w io.Writer, pkgs []build.Package, ctx Context) error {
+	_, err := buildAll(w, pkgs, ctx, Build, false)
+	return err
+}
+
+// BuildAllPackages is like BuildAll, except the optimization output of each
+// package is also returned, keyed by the package's import path.
+func BuildAllPackages(
+	w io.Writer,
+	pkgs []build.Package,
+	ctx Context) (map[string]string, error) {
+
+	return buildAll(w, pkgs, ctx, Build, true)
+}
+
+// BuildAllAsm is like BuildAll, except the assembly output is written.
+func BuildAllAsm(w io.Writer, pkgs []build.Package, ctx Context) error {
+	_, err := buildAll(w, pkgs, ctx, BuildAsm, false)
+	return err
+}
+
+func buildAll(
+	w io.Writer,
+	pkgs []build.Package,
+	ctx Context,
+	buildFn func(io.Writer, build.Package, Context) error,
+	keepOutputs bool) (map[string]string, error) {
+
+	parallelism := ctx.BuildParallelism
+	if parallelism <= 0 {
+		parallelism = runtime.GOMAXPROCS(0)
+	}
+
+	// Write the output and return the first error in the order of the
+	// packages' import paths so the results are deterministic.
+	order := make([]int, len(pkgs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return pkgs[order[a]].ImportPath < pkgs[order[b]].ImportPath
+	})
+
+	var (
+		wg         sync.WaitGroup
+		sem        = make(chan struct{}, parallelism)
+		outputs    = make([]bytes.Buffer, len(pkgs))
+		errs       = make([]error, len(pkgs))
+		done       = make([]chan struct{}, len(pkgs))
+		stop       = make(chan struct{})
+		dispatched = make(chan struct{})
+	)
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+
+	// Stop starting new builds if this function returns early, ex. because
+	// a build failed, and wait for the builds that were started.
+	defer func() {
+		close(stop)
+		<-dispatched
+		wg.Wait()
+	}()
+
+	// The builds are started in the order their output is written so the
+	// output of the first package is not held up by the ones after it.
+	go func() {
+		defer close(dispatched)
+		for _, i := range order {
+			select {
+			case sem <- struct{}{}:
+			case <-stop:
+				return
+			}
+			wg.Add(1)
+			go func(i int) {
+				defer func() {
+					<-sem
+					close(done[i])
+					wg.Done()
+				}()
+				errs[i] = buildFn(&outputs[i], pkgs[i], ctx)
+			}(i)
+		}
+	}()
+
+	var pkgOutputs map[string]string
+	if keepOutputs {
+		pkgOutputs = make(map[string]string, len(pkgs))
 	}
+	for _, i := range order {
+		<-done[i]
+		if errs[i] != nil {
+			return nil, fmt.Errorf(
+				"failed to build pkg %s: %w", pkgs[i].ImportPath, errs[i])
+		}
+		if keepOutputs {
+			pkgOutputs[pkgs[i].ImportPath] += outputs[i].String()
+		}
+		_, err := outputs[i].WriteTo(w)
+		outputs[i] = bytes.Buffer{} // release the output once it is written
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return pkgOutputs, nil
+}
+
+// RunGo runs the go command with the provided arguments and returns its
+// stdout and stderr separately. The compiler's optimization output is
+// written to stderr, but some commands write the relevant output to stdout,
+// ex. "go vet -json" or "go test -json."
+func RunGo(ctx Context, args ...string) (stdout, stderr string, err error) {
+	var outBuf, errBuf bytes.Buffer
+	err = forkGoStreams(&outBuf, &errBuf, ctx, args...)
+	return outBuf.String(), errBuf.String(), err
+}
 
+// forkGo runs the go command, writes its stderr to the provided writer, and
+// logs the command if it fails. The command's stdout is discarded.
+func forkGo(w io.Writer, ctx Context, args ...string) error {
+	return forkGoStreams(nil, w, ctx, args...)
+}
+
+// forkGoStreams is like forkGo, except the command's stdout is written to
+// the provided stdout writer unless it is nil.
+func forkGoStreams(
+	stdout, stderr io.Writer, ctx Context, args ...string) error {
+
+	if err := runGoStreams(stdout, stderr, ctx, args...); err != nil {
+		getLogger(ctx).Printf(
+			"failed: %s %s\n", getGoCmd(ctx), strings.Join(args, " "))
+		return err
+	}
 	return nil
 }
 
-func forkGo(w io.Writer, args ...string) error {
+// getLogger returns the context's logger, otherwise the standard logger.
+func getLogger(ctx Context) *log.Logger {
+	if ctx.Logger != nil {
+		return ctx.Logger
+	}
+	return log.Default()
+}
+
+// runGo runs the go command with the provided arguments and writes its
+// stderr to the provided writer.
+func runGo(w io.Writer, ctx Context, args ...string) error {
+	return runGoStreams(nil, w, ctx, args...)
+}
+
+// runGoStreams runs the go command with the provided arguments and writes
+// its stdout and stderr to the provided writers. If stdout is nil then the
+// command's stdout is discarded.
+func runGoStreams(
+	stdout, w io.Writer, ctx Context, args ...string) error {
+
+	return runGoStreamsInDir(stdout, w, ctx, getDir(ctx), args...)
+}
+
+// runGoStreamsInDir is like runGoStreams, except the go command is run in
+// the provided directory instead of the context's directory.
+func runGoStreamsInDir(
+	stdout, w io.Writer, ctx Context, dir string, args ...string) error {
+
+	// Kill the go command if it runs longer than the build timeout.
+	cmdCtx := context.Background()
+	if ctx.BuildTimeout > 0 {
+		var cancel context.CancelFunc
+		cmdCtx, cancel = context.WithTimeout(cmdCtx, ctx.BuildTimeout)
+		defer cancel()
+	}
+
 	var stderr bytes.Buffer
-	cmd := exec.Command("go", args...)
+	cmd := exec.Command(getGoCmd(ctx), args...)
+	cmd.Dir = dir
+	cmd.Env = getEnv(ctx)
+	cmd.Stdout = stdout
 	cmd.Stderr = io.MultiWriter(w, &stderr)
-	if err := cmd.Run(); err != nil {
-		log.Printf("failed: go %s\n", strings.Join(args, " "))
-		return fmt.Errorf("%w\n%s", err, stderr.String())
+
+	// The go command is started in its own process group so that when the
+	// build times out, the processes it started, ex. the compiler, are
+	// killed along with it. Otherwise they would keep the command's output
+	// pipes open, and waiting on the command would not return until they
+	// exited on their own.
+	setProcessGroup(cmd)
+	err := cmd.Start()
+	if err == nil {
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-cmdCtx.Done():
+				killProcessGroup(cmd)
+			case <-done:
+			}
+		}()
+		err = cmd.Wait()
+		close(done)
+	}
+	if err != nil {
+		buildErr := newBuildError(err, stderr.String(), cmd.Dir)
+		if errors.Is(cmdCtx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("timed out after %s: %w", ctx.BuildTimeout, buildErr)
+		}
+		return buildErr
 	}
 	return nil
 }
 
-func getTempFileName() (string, error) {
-	tempFile, err := ioutil.TempFile("", "")
-	if err != nil {
-		return "", err
+// DefaultBenchmarkPrefix is the default prefix of the name of a benchmark
+// function discovered by convention for a given <ID>.
+const DefaultBenchmarkPrefix = "BenchmarkLem_"
+
+// GetBenchmark returns the benchmark function for the specified <ID>. The
+// benchmark keyed by the <ID> is preferred, otherwise the benchmark keyed by
+// the context's benchmark prefix followed by the <ID> is returned.
+func GetBenchmark(ctx Context, id string) (func(*testing.B), bool) {
+	if fn, ok := ctx.Benchmarks[id]; ok {
+		return fn, true
+	}
+	fn, ok := ctx.Benchmarks[getBenchmarkPrefix(ctx)+id]
+	return fn, ok
+}
+
+// GetBenchmarks returns all of the benchmark functions for the specified
+// <ID>, i.e. the function returned by GetBenchmark, if any, followed by the
+// functions for the <ID> from the context's BenchmarksMulti map.
+func GetBenchmarks(ctx Context, id string) []func(*testing.B) {
+	var fns []func(*testing.B)
+	if fn, ok := GetBenchmark(ctx, id); ok {
+		fns = append(fns, fn)
+	}
+	return append(fns, ctx.BenchmarksMulti[id]...)
+}
+
+// WithBenchtime calls fn with the -test.benchtime flag set to the provided
+// value. The flag's original value is restored when fn returns, even if fn
+// panics. If benchtime is empty or the flag is not defined then fn is
+// called without modifying the flag.
+func WithBenchtime(benchtime string, fn func()) error {
+	f := flag.Lookup("test.benchtime")
+	if benchtime == "" || f == nil {
+		fn()
+		return nil
+	}
+	og := f.Value.String()
+	if err := f.Value.Set(benchtime); err != nil {
+		return err
+	}
+	defer f.Value.Set(og)
+	fn()
+	return nil
+}
+
+// WithGOMAXPROCS calls fn with GOMAXPROCS set to n. The original value is
+// restored when fn returns, even if fn panics. If n is less than one then
+// fn is called without modifying GOMAXPROCS.
+func WithGOMAXPROCS(n int, fn func()) {
+	if n < 1 {
+		fn()
+		return
+	}
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(n))
+	fn()
+}
+
+// WithEnv calls fn with the provided environment applied. The original
+// values are restored when fn returns, even if fn panics.
+//
+// GOMAXPROCS is applied with runtime.GOMAXPROCS, since the runtime only
+// reads the environment variable when the process starts. The other
+// variables are set with os.Setenv, so they are only observed by code that
+// reads them while fn runs. The variables the runtime reads when the
+// process starts, ex. GOGC or GODEBUG, must instead be set before the
+// process is started.
+func WithEnv(env map[string]string, fn func()) error {
+	for k, v := range env {
+		if err := checkEnv(k, v); err != nil {
+			return err
+		}
+	}
+	for k, v := range env {
+		if k == "GOMAXPROCS" {
+			n, _ := strconv.Atoi(v)
+			defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(n))
+			continue
+		}
+		if og, ok := os.LookupEnv(k); ok {
+			defer os.Setenv(k, og)
+		} else {
+			defer os.Unsetenv(k)
+		}
+		os.Setenv(k, v)
+	}
+	fn()
+	return nil
+}
+
+// RunBenchmarks runs each of the provided benchmark functions and returns
+// the largest number of allocations and bytes per operation observed
+// across all of the runs, as well as the largest value of each custom
+// metric reported with b.ReportMetric.
+func RunBenchmarks(
+	fns ...func(*testing.B)) (allocOp, bytesOp int64, extra map[string]float64) {
+
+	for _, fn := range fns {
+		r := testing.Benchmark(fn)
+		if a := r.AllocsPerOp(); a > allocOp {
+			allocOp = a
+		}
+		if b := r.AllocedBytesPerOp(); b > bytesOp {
+			bytesOp = b
+		}
+		for k, v := range r.Extra {
+			if extra == nil {
+				extra = map[string]float64{}
+			}
+			if ov, ok := extra[k]; !ok || v > ov {
+				extra[k] = v
+			}
+		}
 	}
-	tempFileName := tempFile.Name()
-	if err := tempFile.Close(); err != nil {
-		return "", err
+	return allocOp, bytesOp, extra
+}
+
+func getBenchmarkPrefix(ctx Context) string {
+	if ctx.BenchmarkPrefix == "" {
+		return DefaultBenchmarkPrefix
 	}
-	if err := os.RemoveAll(tempFileName); err != nil {
-		return "", err
+	return ctx.BenchmarkPrefix
+}
+
+// getGoCmd returns the go command from the context, otherwise "go" so it
+// is resolved from the PATH.
+func getGoCmd(ctx Context) string {
+	if ctx.GoCmd == "" {
+		return "go"
 	}
-	return tempFileName, nil
+	return ctx.GoCmd
+}
+
+// getDir returns the working directory from the context's build context,
+// otherwise an empty string so the current working directory is used.
+func getDir(ctx Context) string {
+	if ctx.BuildContext == nil {
+		return ""
+	}
+	return ctx.BuildContext.Dir
+}
+
+// checkExtraArgs returns an error if the provided extra arguments of the go
+// command include a flag that is set by lem, i.e. -gcflags or -o.
+func checkExtraArgs(field string, args []string) error {
+	for _, a := range args {
+		if !strings.HasPrefix(a, "-") {
+			continue
+		}
+		name := strings.TrimLeft(a, "-")
+		if i := strings.IndexByte(name, '='); i >= 0 {
+			name = name[:i]
+		}
+		if name == "gcflags" || name == "o" {
+			return fmt.Errorf("%s may not include %s, which is set by lem",
+				field, a)
+		}
+	}
+	return nil
+}
+
+// isTestBuildMode returns true if the provided build mode may be used to
+// build a test binary with "go test -c".
+func isTestBuildMode(mode string) bool {
+	switch mode {
+	case "", "default", "exe", "pie":
+		return true
+	}
+	return false
+}
+
+// getBuildModeArgs returns the arguments used to pass the context's build
+// mode to the go command, if any.
+func getBuildModeArgs(ctx Context) []string {
+	if ctx.BuildMode == "" {
+		return nil
+	}
+	return []string{"-buildmode=" + ctx.BuildMode}
+}
+
+// getTagsArgs returns the arguments used to pass the build tags from the
+// context's build context to the go command, if any.
+func getTagsArgs(ctx Context) []string {
+	if ctx.BuildContext == nil || len(ctx.BuildContext.BuildTags) == 0 {
+		return nil
+	}
+	return []string{"-tags", strings.Join(ctx.BuildContext.BuildTags, ",")}
+}
+
+// getMissingTags returns the provided build tags that are not configured
+// in the context's build context.
+func getMissingTags(ctx Context, tags []string) []string {
+	var missing []string
+	for _, tag := range tags {
+		found := false
+		if ctx.BuildContext != nil {
+			for _, t := range ctx.BuildContext.BuildTags {
+				if t == tag {
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			missing = append(missing, tag)
+		}
+	}
+	return missing
+}
+
+// getEnv returns the environment used to fork the go command. If the
+// context has a build context then its target platform is honored, and
+// the context's environment variables and toolchain are merged over the
+// result. If there are none then nil is returned so the ambient
+// environment is inherited.
+func getEnv(ctx Context) []string {
+	if ctx.BuildContext == nil && len(ctx.Env) == 0 && ctx.GoToolchain == "" {
+		return nil
+	}
+	env := os.Environ()
+	if ctx.BuildContext != nil {
+		if ctx.BuildContext.GOOS != "" {
+			env = append(env, "GOOS="+ctx.BuildContext.GOOS)
+		}
+		if ctx.BuildContext.GOARCH != "" {
+			env = append(env, "GOARCH="+ctx.BuildContext.GOARCH)
+		}
+		if ctx.BuildContext.CgoEnabled {
+			env = append(env, "CGO_ENABLED=1")
+		} else {
+			env = append(env, "CGO_ENABLED=0")
+		}
+	}
+
+	// Sort the keys so the environment is deterministic. Since the
+	// variables are appended, they take precedence over any with the
+	// same name that appear earlier in the slice.
+	keys := make([]string, 0, len(ctx.Env))
+	for k := range ctx.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		env = append(env, k+"="+ctx.Env[k])
+	}
+	if ctx.GoToolchain != "" {
+		env = append(env, "GOTOOLCHAIN="+ctx.GoToolchain)
+	}
+
+	return env
 }
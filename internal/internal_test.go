@@ -17,12 +17,31 @@ limitations under the License.
 package internal_test
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"go/build"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"reflect"
 	"regexp"
+	"regexp/syntax"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/akutz/lem/internal"
+	"github.com/akutz/lem/internal/testdata/fnnoalloc"
 )
 
 func TestTestCasePath(t *testing.T) {
@@ -74,6 +93,130 @@ func TestTestCasePath(t *testing.T) {
 	}
 }
 
+func TestGetTestCasesSuite(t *testing.T) {
+	testCases, err := getTestCases(t, `package src
+
+var sink interface{}
+
+// lem.a.suite=escapes
+// lem.a.name=to sink
+func a(x int32) {
+	sink = x // lem.a.m=x escapes to heap
+}
+
+// lem.b.suite=escapes/int64
+func b(x int64) {
+	sink = x // lem.b.m=x escapes to heap
+}
+
+// lem.c.suite=escapes
+// lem.c.name=/no id
+func c(x int32) {
+	sink = x // lem.c.m=x escapes to heap
+}
+
+func d(x *int32) *int32 { // lem.d.m=leaking param: x
+	return x
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := map[string][]string{
+		"a": {"escapes", "a", "to sink"},
+		"b": {"escapes", "int64", "b"},
+		"c": {"escapes", "no id"},
+		"d": {"d"},
+	}
+	if e, a := len(exp), len(testCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	for _, tc := range testCases {
+		if e, a := exp[tc.ID], tc.Path(); !reflect.DeepEqual(e, a) {
+			t.Errorf("%s: expPath=%v, actPath=%v", tc.ID, e, a)
+		}
+	}
+
+	_, err = getTestCases(t, `package src
+
+// lem.a.suite=escapes
+// lem.a.suite=leaks
+`)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if e, a := "duplicate lem.a.suite", err.Error(); !strings.Contains(a, e) {
+		t.Errorf("expErr=%s, actErr=%s", e, a)
+	}
+}
+
+func TestTreeRunSuite(t *testing.T) {
+	testCases, err := getTestCases(t, `package src
+
+var sink interface{}
+
+// lem.b.suite=escapes
+func b(x int64) {
+	sink = x // lem.b.m=x escapes to heap
+}
+
+// lem.a.suite=escapes
+// lem.a.name=to sink
+func a(x int32) {
+	sink = x // lem.a.m=x escapes to heap
+}
+
+func c(x *int32) *int32 { // lem.c.m=leaking param: x
+	return x
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := internal.NewTree(testCases...)
+
+	// The suite is a top-level node that contains both of its test cases,
+	// while the test case without a suite is at the root.
+	if e, a := []string{"escapes"}, tree.Steps; !reflect.DeepEqual(e, a) {
+		t.Fatalf("expSteps=%v, actSteps=%v", e, a)
+	}
+	suite := &tree.Nodes[tree.Index["escapes"]]
+	if e, a := []string{"a"}, suite.Steps; !reflect.DeepEqual(e, a) {
+		t.Errorf("expSuiteSteps=%v, actSuiteSteps=%v", e, a)
+	}
+	if e, a := 1, len(suite.Tests); e != a {
+		t.Fatalf("expSuiteTests=%d, actSuiteTests=%d", e, a)
+	}
+	if e, a := "b", suite.Tests[0].Name; e != a {
+		t.Errorf("expSuiteTest=%s, actSuiteTest=%s", e, a)
+	}
+	if e, a := 1, len(tree.Tests); e != a {
+		t.Fatalf("expTests=%d, actTests=%d", e, a)
+	}
+	if e, a := "c", tree.Tests[0].Name; e != a {
+		t.Errorf("expTest=%s, actTest=%s", e, a)
+	}
+
+	buildOutput := "./src.go:7:9: x escapes to heap\n" +
+		"./src.go:13:9: x escapes to heap\n" +
+		"./src.go:16:8: leaking param: x\n"
+	var names []string
+	t.Run("names", func(t *testing.T) {
+		result := tree.Run(t, internal.Context{BuildOutput: buildOutput})
+		if result.Failed() {
+			t.Fatal("result should not have failed")
+		}
+		for _, r := range result.TestCases {
+			names = append(names, strings.Join(r.Path, "/"))
+		}
+	})
+	sort.Strings(names)
+	if e, a := []string{"c", "escapes/a/to sink", "escapes/b"},
+		names; !reflect.DeepEqual(e, a) {
+		t.Errorf("expNames=%v, actNames=%v", e, a)
+	}
+}
+
 func TestTreeInsert(t *testing.T) {
 	testCases := []struct {
 		name string
@@ -709,3 +852,6650 @@ func TestTreeInsert(t *testing.T) {
 		})
 	}
 }
+
+func TestNewTreeStrict(t *testing.T) {
+	dir := t.TempDir()
+	writeSrc := func(name, src string) string {
+		filePath := filepath.Join(dir, name)
+		if err := os.WriteFile(filePath, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return filePath
+	}
+	a := writeSrc("a.go", "package src\n\n// lem.dup.alloc=0\nfunc f() {}\n")
+	b := writeSrc("b.go", "package src\n\n\n// lem.dup.alloc=1\nfunc g() {}\n")
+
+	t.Run("identical re-insert", func(t *testing.T) {
+		tcs, err := internal.GetTestCases(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree, err := internal.NewTreeStrict(tcs[0], tcs[0])
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if e, a := 1, len(tree.Tests); e != a {
+			t.Errorf("expected %d test case(s), got %d", e, a)
+		}
+		if _, err := tree.InsertStrict(tcs[0]); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("conflicting re-insert", func(t *testing.T) {
+		tcsA, err := internal.GetTestCases(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tcsB, err := internal.GetTestCases(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = internal.NewTreeStrict(tcsA[0], tcsB[0])
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		for _, exp := range []string{
+			"duplicate test case lem.dup",
+			a + ":3",
+			b + ":4",
+		} {
+			if !strings.Contains(err.Error(), exp) {
+				t.Errorf("expected error %q to contain %q", err, exp)
+			}
+		}
+
+		// The non-strict tree keeps the first test case.
+		tree := internal.NewTree(tcsA[0], tcsB[0])
+		if e, a := 1, len(tree.Tests); e != a {
+			t.Errorf("expected %d test case(s), got %d", e, a)
+		}
+	})
+}
+
+func TestExpandPackages(t *testing.T) {
+	dir := filepath.Join("testdata", "nested")
+	testCases := []struct {
+		name     string
+		patterns []string
+		expPkgs  []string
+	}{
+		{
+			name:     "no patterns",
+			patterns: nil,
+			expPkgs:  nil,
+		},
+		{
+			name:     "explicit packages",
+			patterns: []string{".", "./a"},
+			expPkgs:  []string{".", "./a"},
+		},
+		{
+			name:     "all packages",
+			patterns: []string{"./..."},
+			expPkgs:  []string{".", "./a", "./a/b"},
+		},
+		{
+			name:     "sub-packages",
+			patterns: []string{"./a/..."},
+			expPkgs:  []string{"./a", "./a/b"},
+		},
+		{
+			name:     "mixed",
+			patterns: []string{"./a/b", "./a/..."},
+			expPkgs:  []string{"./a/b", "./a", "./a/b"},
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			pkgs, err := internal.ExpandPackages(
+				internal.Context{}, dir, tc.patterns...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e, a := tc.expPkgs, pkgs; !reflect.DeepEqual(e, a) {
+				t.Errorf("expPkgs=%v, actPkgs=%v", e, a)
+			}
+		})
+	}
+
+	t.Run("missing dir", func(t *testing.T) {
+		if _, err := internal.ExpandPackages(
+			internal.Context{}, dir, "./missing/..."); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
+
+func TestLoad(t *testing.T) {
+	pkgs, err := internal.Load(internal.Context{}, ".", "github.com/akutz/lem/examples/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 1, len(pkgs); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	pkg := pkgs[0]
+	if e, a := "github.com/akutz/lem/examples/hello", pkg.ImportPath; e != a {
+		t.Errorf("expImportPath=%s, actImportPath=%s", e, a)
+	}
+	if e, a := []string{"world.go"}, pkg.GoFiles; !reflect.DeepEqual(e, a) {
+		t.Errorf("expGoFiles=%v, actGoFiles=%v", e, a)
+	}
+	if e, a := []string{"world_test.go"}, pkg.TestGoFiles; !reflect.DeepEqual(e, a) {
+		t.Errorf("expTestGoFiles=%v, actTestGoFiles=%v", e, a)
+	}
+	if e, a := 0, len(pkg.XTestGoFiles); e != a {
+		t.Errorf("expXTestGoFiles=%d, actXTestGoFiles=%d", e, a)
+	}
+}
+
+func TestLoadInvalidPackage(t *testing.T) {
+	if _, err := internal.Load(internal.Context{}, ".", "github.com/akutz/lem/invalid"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestLoadWithTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shim script requires a POSIX shell")
+	}
+
+	// The shim hangs in a child process, like the go command listing
+	// packages that must first be downloaded.
+	dir := t.TempDir()
+	goCmd := filepath.Join(dir, "go")
+	if err := os.WriteFile(
+		goCmd, []byte("#!/bin/sh\nsleep 30\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, err := internal.Load(internal.Context{
+		BuildTimeout: 100 * time.Millisecond,
+		GoCmd:        goCmd,
+	}, dir, "./...")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if !strings.Contains(err.Error(), "timed out after 100ms") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("go list was not killed, took %s", d)
+	}
+}
+
+func TestLoadBuildError(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shim script requires a POSIX shell")
+	}
+
+	dir := t.TempDir()
+	goCmd := filepath.Join(dir, "go")
+	if err := os.WriteFile(
+		goCmd,
+		[]byte("#!/bin/sh\necho \"go: go.mod file not found\" >&2\nexit 1\n"),
+		0755); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := internal.Load(internal.Context{GoCmd: goCmd}, dir, "./...")
+	var buildErr *internal.BuildError
+	if !errors.As(err, &buildErr) {
+		t.Fatalf("expected *BuildError, got %T: %v", err, err)
+	}
+	if e, a := "go: go.mod file not found\n", buildErr.Output; e != a {
+		t.Errorf("expOutput=%q, actOutput=%q", e, a)
+	}
+}
+
+func TestBuildWithGOARCH(t *testing.T) {
+	buildContext := build.Default
+	buildContext.GOARCH = "386"
+	buildContext.CgoEnabled = false
+
+	pkg, err := buildContext.Import(
+		"github.com/akutz/lem/internal/testdata/arch", ".", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var w bytes.Buffer
+	if err := internal.Build(&w, *pkg, internal.Context{
+		BuildContext: &buildContext,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := regexp.MustCompile(`(?m)^.*arch_386.go:\d+:\d+: x escapes to heap$`)
+	if !r.MatchString(w.String()) {
+		t.Errorf("expected build output for GOARCH=386, got %s", w.String())
+	}
+}
+
+// getTestCases writes the provided source to a temporary file and returns
+// the test cases parsed from it.
+func getTestCases(t *testing.T, src string) ([]internal.TestCase, error) {
+	filePath := filepath.Join(t.TempDir(), "src.go")
+	if err := os.WriteFile(filePath, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return internal.GetTestCases(filePath)
+}
+
+// recordingReporter is a Reporter that records the errors and logs of a
+// tree and its subtests instead of failing the test that runs the tree, so
+// the test can assert the tree's failures.
+type recordingReporter struct {
+	// filter, if set, is called with the name of each of the reporter's
+	// subtests, and the subtests it returns false for are not run, like
+	// the -run flag.
+	filter func(name string) bool
+
+	mu       sync.Mutex
+	output   strings.Builder
+	failed   bool
+	skipped  bool
+	subtests []recordedSubtest
+}
+
+type recordedSubtest struct {
+	name string
+	r    *recordingReporter
+}
+
+// runRecorded runs the tree with a new recordingReporter and returns it.
+func runRecorded(tree *internal.Tree, ctx internal.Context) *recordingReporter {
+	r := &recordingReporter{}
+	r.runTree(tree, ctx)
+	return r
+}
+
+// runTree runs the tree with the reporter in a new goroutine, so a fatal
+// error stops the tree instead of the test.
+func (r *recordingReporter) runTree(
+	tree *internal.Tree, ctx internal.Context) internal.Result {
+
+	var result internal.Result
+	r.run(func(r internal.Reporter) {
+		result = tree.RunWithReporter(r, ctx)
+	})
+	return result
+}
+
+// run calls fn with the reporter in a new goroutine and waits for it to
+// return, so Fatal and Skip may stop the goroutine like they do a test's.
+func (r *recordingReporter) run(fn func(r internal.Reporter)) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn(r)
+	}()
+	<-done
+}
+
+// sub returns the reporter of the subtest with the provided name, or nil
+// if the subtest was not run.
+func (r *recordingReporter) sub(name string) *recordingReporter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, st := range r.subtests {
+		if st.name == name {
+			return st.r
+		}
+	}
+	return nil
+}
+
+// String returns the errors and logs of the reporter followed by those of
+// its subtests.
+func (r *recordingReporter) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var sb strings.Builder
+	sb.WriteString(r.output.String())
+	for _, st := range r.subtests {
+		sb.WriteString(st.r.String())
+	}
+	return sb.String()
+}
+
+func (r *recordingReporter) log(s string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.output.WriteString(strings.TrimSuffix(s, "\n") + "\n")
+}
+
+func (r *recordingReporter) fail() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failed = true
+}
+
+func (r *recordingReporter) Error(args ...interface{}) {
+	r.log(fmt.Sprintln(args...))
+	r.fail()
+}
+
+func (r *recordingReporter) Errorf(format string, args ...interface{}) {
+	r.log(fmt.Sprintf(format, args...))
+	r.fail()
+}
+
+func (r *recordingReporter) Failed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.failed
+}
+
+func (r *recordingReporter) Fatal(args ...interface{}) {
+	r.Error(args...)
+	runtime.Goexit()
+}
+
+func (r *recordingReporter) Fatalf(format string, args ...interface{}) {
+	r.Errorf(format, args...)
+	runtime.Goexit()
+}
+
+func (r *recordingReporter) Helper() {}
+
+func (r *recordingReporter) Log(args ...interface{}) {
+	r.log(fmt.Sprintln(args...))
+}
+
+func (r *recordingReporter) Logf(format string, args ...interface{}) {
+	r.log(fmt.Sprintf(format, args...))
+}
+
+func (r *recordingReporter) Skip(args ...interface{}) {
+	r.log(fmt.Sprintln(args...))
+	r.mu.Lock()
+	r.skipped = true
+	r.mu.Unlock()
+	runtime.Goexit()
+}
+
+func (r *recordingReporter) Skipped() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.skipped
+}
+
+func (r *recordingReporter) Run(
+	name string, fn func(r internal.Reporter)) bool {
+
+	if r.filter != nil && !r.filter(name) {
+		return true
+	}
+	child := &recordingReporter{}
+	r.mu.Lock()
+	r.subtests = append(r.subtests, recordedSubtest{name: name, r: child})
+	r.mu.Unlock()
+	child.run(fn)
+	if child.Failed() {
+		r.fail()
+		return false
+	}
+	return true
+}
+
+func TestRecordingReporter(t *testing.T) {
+	r := &recordingReporter{filter: func(name string) bool {
+		return name != "filtered"
+	}}
+	r.run(func(r internal.Reporter) {
+		r.Log("root")
+		if !r.Run("pass", func(r internal.Reporter) { r.Logf("%d", 1) }) {
+			t.Error("pass should have succeeded")
+		}
+		if r.Run("fail", func(r internal.Reporter) {
+			r.Fatal("fatal")
+			r.Error("unreachable")
+		}) {
+			t.Error("fail should have failed")
+		}
+		r.Run("skip", func(r internal.Reporter) { r.Skip("skipped") })
+		r.Run("filtered", func(r internal.Reporter) {
+			t.Error("filtered should not have run")
+		})
+	})
+	if !r.Failed() {
+		t.Error("root should have failed")
+	}
+	if r.sub("pass").Failed() || !r.sub("fail").Failed() {
+		t.Error("unexpected subtest status")
+	}
+	if !r.sub("skip").Skipped() {
+		t.Error("skip should have been skipped")
+	}
+	if r.sub("filtered") != nil {
+		t.Error("filtered should not have been recorded")
+	}
+	if e, a := "root\n1\nfatal\nskipped\n", r.String(); e != a {
+		t.Errorf("expOutput=%q, actOutput=%q", e, a)
+	}
+}
+
+func TestGetTestCasesFromSource(t *testing.T) {
+	// The file does not exist, so the test cases must be parsed from the
+	// source alone.
+	filePath := filepath.Join(t.TempDir(), "missing", "src.go")
+	src := append([]byte{0xEF, 0xBB, 0xBF}, `package src
+
+var sink interface{}
+
+// lem.a.name=put
+func a(x int32) {
+	sink = x // lem.a.m=x escapes to heap
+}
+`...)
+
+	testCases, err := internal.GetTestCasesFromSource(filePath, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 1, len(testCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	if e, a := "put", testCases[0].Name; e != a {
+		t.Errorf("expName=%s, actName=%s", e, a)
+	}
+	matches := testCases[0].Matches
+	if e, a := 1, len(matches); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	lm := matches[0]
+	if e, a := "src.go", lm.File; e != a {
+		t.Errorf("expFile=%s, actFile=%s", e, a)
+	}
+	if e, a := 7, lm.Line; e != a {
+		t.Errorf("expLine=%d, actLine=%d", e, a)
+	}
+	if e, a := "\tsink = x // lem.a.m=x escapes to heap", lm.Source; e != a {
+		t.Errorf("expSource=%q, actSource=%q", e, a)
+	}
+	if e, a := filePath, lm.Path; e != a {
+		t.Errorf("expPath=%s, actPath=%s", e, a)
+	}
+	if !lm.Regexp.MatchString("./src.go:7:7: x escapes to heap") {
+		t.Errorf("unexpected regexp: %s", lm.Regexp)
+	}
+
+	_, err = internal.GetTestCasesFromSource(
+		filePath, []byte("package src\n\n// lem.a.alloc=two\n"))
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if e, a := filePath+":3", err.Error(); !strings.Contains(a, e) {
+		t.Errorf("expPos=%s, actErr=%s", e, a)
+	}
+}
+
+func TestGetTestCasesBOM(t *testing.T) {
+	testCases, err := getTestCases(t, "\ufeff// lem.a.m=b\r\n"+
+		"package src\r\n"+
+		"\r\n"+
+		"var sink interface{}\r\n"+
+		"\r\n"+
+		"func a(x int32) {\r\n"+
+		"\tsink = x // lem.a.m=x escapes to heap\r\n"+
+		"}\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 1, len(testCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	matches := testCases[0].Matches
+	if e, a := 2, len(matches); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	for i, x := range []struct {
+		source string
+		line   int
+	}{
+		{
+			source: "// lem.a.m=b",
+			line:   1,
+		},
+		{
+			source: "\tsink = x // lem.a.m=x escapes to heap",
+			line:   7,
+		},
+	} {
+		lm := matches[i]
+		if e, a := x.source, lm.Source; e != a {
+			t.Errorf("exp.source=%q, act.source=%q", e, a)
+		}
+		if e, a := x.line, lm.Line; e != a {
+			t.Errorf("exp.line=%d, act.line=%d", e, a)
+		}
+		if e, a := fmt.Sprintf(`src\.go:%d:`, x.line), lm.Regexp.String(); !strings.Contains(a, e) {
+			t.Errorf("exp.regexp to contain %s, act.regexp=%s", e, a)
+		}
+	}
+}
+
+func TestGetTestCasesAllocByArch(t *testing.T) {
+	testCases, err := getTestCases(t, `package src
+
+// lem.a.alloc=1
+// lem.a.alloc:amd64=2
+// lem.a.alloc:386=3-4
+// lem.a.bytes=8
+// lem.a.bytes:386=12
+func a() {}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 1, len(testCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	tc := testCases[0]
+	for _, x := range []struct {
+		goarch string
+		alloc  internal.Int64Range
+		bytes  internal.Int64Range
+	}{
+		{
+			goarch: "amd64",
+			alloc:  internal.Int64Range{Min: 2, Max: 2},
+			bytes:  internal.Int64Range{Min: 8, Max: 8},
+		},
+		{
+			goarch: "386",
+			alloc:  internal.Int64Range{Min: 3, Max: 4},
+			bytes:  internal.Int64Range{Min: 12, Max: 12},
+		},
+		{
+			goarch: "arm64",
+			alloc:  internal.Int64Range{Min: 1, Max: 1},
+			bytes:  internal.Int64Range{Min: 8, Max: 8},
+		},
+	} {
+		if e, a := x.alloc, tc.GetAllocOp(x.goarch); e != a {
+			t.Errorf("goarch=%s, exp.alloc=%s, act.alloc=%s", x.goarch, e, a)
+		}
+		if e, a := x.bytes, tc.GetBytesOp(x.goarch); e != a {
+			t.Errorf("goarch=%s, exp.bytes=%s, act.bytes=%s", x.goarch, e, a)
+		}
+	}
+}
+
+func TestGetTestCasesAllocByArchUnknown(t *testing.T) {
+	for _, x := range []struct {
+		directive string
+		goarch    string
+	}{
+		{directive: "alloc:amd46=2", goarch: "amd46"},
+		{directive: "bytes:arm65=8", goarch: "arm65"},
+		{directive: "alloc:x=1", goarch: "x"},
+	} {
+		_, err := getTestCases(t, `package src
+
+// lem.a.`+x.directive+`
+func a() {}
+`)
+		if err == nil {
+			t.Errorf("%s: expected error", x.directive)
+			continue
+		}
+		e := fmt.Sprintf("unknown GOARCH %q", x.goarch)
+		if a := err.Error(); !strings.Contains(a, e) {
+			t.Errorf("%s: expErr=%s, actErr=%s", x.directive, e, a)
+		}
+	}
+}
+
+func TestInt64RangeString(t *testing.T) {
+	testCases := []struct {
+		name string
+		r    internal.Int64Range
+		exp  string
+	}{
+		{name: "zero", r: internal.Int64Range{}, exp: "0"},
+		{name: "exact", r: internal.Int64Range{Min: 2, Max: 2}, exp: "2"},
+		{name: "range", r: internal.Int64Range{Min: 2, Max: 4}, exp: "2-4"},
+		{name: "lt", r: internal.Int64Range{Max: 2, Op: "<"}, exp: "<2"},
+		{name: "le", r: internal.Int64Range{Max: 2, Op: "<="}, exp: "<=2"},
+		{name: "gt", r: internal.Int64Range{Min: 2, Op: ">"}, exp: ">2"},
+		{name: "ge", r: internal.Int64Range{Min: 2, Op: ">="}, exp: ">=2"},
+		{
+			name: "op ignores other bound",
+			r:    internal.Int64Range{Min: 1, Max: 2, Op: "<="},
+			exp:  "<=2",
+		},
+		{
+			name: "tolerance",
+			r: internal.Int64Range{
+				Min: 14, Max: 18, Value: 16, Tolerance: 10,
+			},
+			exp: "16±10% (14-18, rounded outward)",
+		},
+		{
+			name: "exclude min",
+			r:    internal.Int64Range{Min: 2, Max: 4, ExcludeMin: true},
+			exp:  "(2,4]",
+		},
+		{
+			name: "exclude max",
+			r:    internal.Int64Range{Min: 2, Max: 4, ExcludeMax: true},
+			exp:  "[2,4)",
+		},
+	}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			if e, a := tc.exp, tc.r.String(); e != a {
+				t.Errorf("exp=%s, act=%s", e, a)
+			}
+			// The value is rendered the same way by the %s and %v verbs.
+			if e, a := tc.exp, fmt.Sprintf("%v", tc.r); e != a {
+				t.Errorf("exp=%s, act=%s", e, a)
+			}
+		})
+	}
+}
+
+func TestGetTestCasesAllocOp(t *testing.T) {
+	testCases := []struct {
+		name  string
+		val   string
+		exp   internal.Int64Range
+		str   string
+		eq    []int64
+		noteq []int64
+	}{
+		{
+			name:  "exact",
+			val:   "1",
+			exp:   internal.Int64Range{Min: 1, Max: 1},
+			str:   "1",
+			eq:    []int64{1},
+			noteq: []int64{0, 2},
+		},
+		{
+			name:  "range",
+			val:   "1-3",
+			exp:   internal.Int64Range{Min: 1, Max: 3},
+			str:   "1-3",
+			eq:    []int64{1, 2, 3},
+			noteq: []int64{0, 4},
+		},
+		{
+			name:  "lt",
+			val:   "<2",
+			exp:   internal.Int64Range{Max: 2, Op: "<"},
+			str:   "<2",
+			eq:    []int64{0, 1},
+			noteq: []int64{2, 3},
+		},
+		{
+			name:  "le",
+			val:   "<=1",
+			exp:   internal.Int64Range{Max: 1, Op: "<="},
+			str:   "<=1",
+			eq:    []int64{0, 1},
+			noteq: []int64{2},
+		},
+		{
+			name:  "gt",
+			val:   ">2",
+			exp:   internal.Int64Range{Min: 2, Op: ">"},
+			str:   ">2",
+			eq:    []int64{3, 100},
+			noteq: []int64{1, 2},
+		},
+		{
+			name:  "ge",
+			val:   ">=2",
+			exp:   internal.Int64Range{Min: 2, Op: ">="},
+			str:   ">=2",
+			eq:    []int64{2, 3},
+			noteq: []int64{0, 1},
+		},
+		{
+			name:  "tolerance",
+			val:   "16~10%",
+			exp:   internal.Int64Range{Min: 14, Max: 18, Value: 16, Tolerance: 10},
+			str:   "16±10% (14-18, rounded outward)",
+			eq:    []int64{14, 16, 18},
+			noteq: []int64{13, 19},
+		},
+		{
+			name:  "tolerance w fraction",
+			val:   "100~2.5%",
+			exp:   internal.Int64Range{Min: 97, Max: 103, Value: 100, Tolerance: 2.5},
+			str:   "100±2.5% (97-103, rounded outward)",
+			eq:    []int64{97, 100, 103},
+			noteq: []int64{96, 104},
+		},
+		{
+			name:  "zero tolerance",
+			val:   "16~0%",
+			exp:   internal.Int64Range{Min: 16, Max: 16},
+			str:   "16",
+			eq:    []int64{16},
+			noteq: []int64{15, 17},
+		},
+		{
+			name: "unbounded",
+			val:  ">=0",
+			exp:  internal.Int64Range{Min: 0, Op: ">="},
+			str:  ">=0",
+			eq:   []int64{0, 1, 9223372036854775807},
+		},
+	}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			testCases, err := getTestCases(t, `package src
+
+// lem.a.alloc=`+tc.val+`
+func a() {}
+`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e, a := 1, len(testCases); e != a {
+				t.Fatalf("expLen=%d, actLen=%d", e, a)
+			}
+			r := testCases[0].AllocOp
+			if e, a := tc.exp, r; e != a {
+				t.Errorf("exp.alloc=%+v, act.alloc=%+v", e, a)
+			}
+			if e, a := tc.str, r.String(); e != a {
+				t.Errorf("exp.str=%s, act.str=%s", e, a)
+			}
+			for _, n := range tc.eq {
+				if !r.Eq(n) {
+					t.Errorf("%s should eq %d", r, n)
+				}
+			}
+			for _, n := range tc.noteq {
+				if r.Eq(n) {
+					t.Errorf("%s should not eq %d", r, n)
+				}
+			}
+		})
+	}
+}
+
+func TestGetTestCasesNoAlloc(t *testing.T) {
+	testCases := []struct {
+		name string
+		src  string
+		err  bool
+	}{
+		{
+			name: "noalloc",
+			src:  "// lem.a.noalloc",
+		},
+		{
+			name: "noalloc w zero alloc and bytes",
+			src:  "// lem.a.alloc=0\n// lem.a.noalloc\n// lem.a.bytes=0",
+		},
+		{
+			name: "noalloc after non-zero alloc",
+			src:  "// lem.a.alloc=1\n// lem.a.noalloc",
+			err:  true,
+		},
+		{
+			name: "noalloc before non-zero alloc",
+			src:  "// lem.a.noalloc\n// lem.a.alloc=1",
+			err:  true,
+		},
+		{
+			name: "noalloc before non-zero bytes",
+			src:  "// lem.a.noalloc\n// lem.a.bytes=8",
+			err:  true,
+		},
+		{
+			name: "noalloc after non-zero arch alloc",
+			src:  "// lem.a.alloc:386=1\n// lem.a.noalloc",
+			err:  true,
+		},
+	}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			testCases, err := getTestCases(t, "package src\n\n"+tc.src+"\nfunc a() {}\n")
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e, a := 1, len(testCases); e != a {
+				t.Fatalf("expLen=%d, actLen=%d", e, a)
+			}
+			zero := internal.Int64Range{}
+			if e, a := zero, testCases[0].AllocOp; e != a {
+				t.Errorf("exp.alloc=%s, act.alloc=%s", e, a)
+			}
+			if e, a := zero, testCases[0].BytesOp; e != a {
+				t.Errorf("exp.bytes=%s, act.bytes=%s", e, a)
+			}
+		})
+	}
+}
+
+func TestGetTestCasesInterleavedIDs(t *testing.T) {
+	testCases, err := getTestCases(t, `package src
+
+// lem.a.name=A
+// lem.b.name=B
+// lem.c.name=C
+// lem.a.alloc=5
+func a() {}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 3, len(testCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	if e, a := (internal.Int64Range{Min: 5, Max: 5}), testCases[0].AllocOp; e != a {
+		t.Errorf("exp.alloc=%s, act.alloc=%s", e, a)
+	}
+}
+
+func TestGetTestCasesDuplicates(t *testing.T) {
+	testCases := []struct {
+		name string
+		src  string
+		err  string
+	}{
+		{
+			name: "name",
+			src:  "// lem.a.name=1\n// lem.a.name=2",
+			err:  `^duplicate lem\.a\.name at .+src\.go:3 and .+src\.go:4$`,
+		},
+		{
+			name: "alloc",
+			src:  "// lem.a.alloc=2\n// lem.a.alloc=5",
+			err:  `^duplicate lem\.a\.alloc at .+src\.go:3 and .+src\.go:4$`,
+		},
+		{
+			name: "alloc w arch",
+			src:  "// lem.a.alloc:386=2\n// lem.a.alloc:386=5",
+			err:  `^duplicate lem\.a\.alloc:386 at .+src\.go:3 and .+src\.go:4$`,
+		},
+		{
+			name: "bytes",
+			src:  "// lem.a.bytes=2\n// lem.a.bytes=5",
+			err:  `^duplicate lem\.a\.bytes at .+src\.go:3 and .+src\.go:4$`,
+		},
+		{
+			name: "noalloc",
+			src:  "// lem.a.noalloc\n// lem.a.noalloc",
+			err:  `^duplicate lem\.a\.noalloc at .+src\.go:3 and .+src\.go:4$`,
+		},
+		{
+			name: "alloc and arch alloc",
+			src:  "// lem.a.alloc=2\n// lem.a.alloc:386=5",
+		},
+		{
+			name: "alloc for different IDs",
+			src:  "// lem.a.alloc=2\n// lem.b.alloc=5",
+		},
+	}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := getTestCases(t, "package src\n\n"+tc.src+"\nfunc a() {}\n")
+			if tc.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !regexp.MustCompile(tc.err).MatchString(err.Error()) {
+				t.Errorf("expErr=%s, actErr=%s", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestGetTestCasesDuplicateMatches(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "src.go")
+	if err := os.WriteFile(filePath, []byte(`package src
+
+var sink interface{}
+
+func a(x int32) {
+	sink = x // lem.a.m=x escapes to heap
+}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := internal.GetTestCases(filePath, filePath)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	r := regexp.MustCompile(`^duplicate lem\.a\.m=.+ at .+src\.go:6 and .+src\.go:6$`)
+	if !r.MatchString(err.Error()) {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestGetTestCasesAllocOpInvalid(t *testing.T) {
+	for _, val := range []string{
+		"16~-10%",
+		"16~101%",
+		"16~1.2.3%",
+	} {
+		val := val
+		t.Run(val, func(t *testing.T) {
+			if _, err := getTestCases(t, `package src
+
+// lem.a.bytes=`+val+`
+func a() {}
+`); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func TestInt64RangeEq(t *testing.T) {
+	testCases := []struct {
+		r   internal.Int64Range
+		str string
+		eq  map[int64]bool
+	}{
+		{
+			r:   internal.Int64Range{Min: 2, Max: 4},
+			str: "2-4",
+			eq:  map[int64]bool{1: false, 2: true, 3: true, 4: true, 5: false},
+		},
+		{
+			r:   internal.Int64Range{Min: 2, Max: 4, ExcludeMin: true},
+			str: "(2,4]",
+			eq:  map[int64]bool{1: false, 2: false, 3: true, 4: true, 5: false},
+		},
+		{
+			r:   internal.Int64Range{Min: 2, Max: 4, ExcludeMax: true},
+			str: "[2,4)",
+			eq:  map[int64]bool{1: false, 2: true, 3: true, 4: false, 5: false},
+		},
+		{
+			r:   internal.Int64Range{Min: 2, Max: 4, ExcludeMin: true, ExcludeMax: true},
+			str: "(2,4)",
+			eq:  map[int64]bool{1: false, 2: false, 3: true, 4: false, 5: false},
+		},
+		{
+			r:   internal.Int64Range{Min: 2, Max: 2},
+			str: "2",
+			eq:  map[int64]bool{1: false, 2: true, 3: false},
+		},
+		{
+			r:   internal.Int64Range{Min: 2, Max: 2, ExcludeMin: true},
+			str: "(2,2]",
+			eq:  map[int64]bool{1: false, 2: false, 3: false},
+		},
+		{
+			r:   internal.Int64Range{Min: 2, Max: 2, ExcludeMax: true},
+			str: "[2,2)",
+			eq:  map[int64]bool{1: false, 2: false, 3: false},
+		},
+		{
+			r:   internal.Int64Range{Min: 2, Max: 3, ExcludeMin: true, ExcludeMax: true},
+			str: "(2,3)",
+			eq:  map[int64]bool{2: false, 3: false},
+		},
+		{
+			r:   internal.Int64Range{Min: 14, Max: 18, Value: 16, Tolerance: 10, ExcludeMax: true},
+			str: "[14,18)",
+			eq:  map[int64]bool{13: false, 14: true, 17: true, 18: false},
+		},
+		{
+			r:   internal.Int64Range{Max: 4, Op: "<", ExcludeMax: true},
+			str: "<4",
+			eq:  map[int64]bool{3: true, 4: false},
+		},
+		{
+			r:   internal.Int64Range{Min: 2, Op: ">=", ExcludeMin: true},
+			str: ">=2",
+			eq:  map[int64]bool{1: false, 2: true, 3: true},
+		},
+	}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.str, func(t *testing.T) {
+			if e, a := tc.str, tc.r.String(); e != a {
+				t.Errorf("exp.str=%s, act.str=%s", e, a)
+			}
+			for n, e := range tc.eq {
+				if a := tc.r.Eq(n); e != a {
+					t.Errorf("%s.Eq(%d): exp=%v, act=%v", tc.r, n, e, a)
+				}
+			}
+		})
+	}
+}
+
+func TestGetTestCasesBytesOpUnits(t *testing.T) {
+	testCases := []struct {
+		val string
+		exp internal.Int64Range
+		str string
+	}{
+		{
+			val: "16B",
+			exp: internal.Int64Range{Min: 16, Max: 16},
+			str: "16",
+		},
+		{
+			val: "1KB",
+			exp: internal.Int64Range{Min: 1000, Max: 1000},
+			str: "1000",
+		},
+		{
+			val: "1MB",
+			exp: internal.Int64Range{Min: 1000000, Max: 1000000},
+			str: "1000000",
+		},
+		{
+			val: "1GB",
+			exp: internal.Int64Range{Min: 1000000000, Max: 1000000000},
+			str: "1000000000",
+		},
+		{
+			val: "1KiB",
+			exp: internal.Int64Range{Min: 1024, Max: 1024},
+			str: "1024",
+		},
+		{
+			val: "1MiB",
+			exp: internal.Int64Range{Min: 1048576, Max: 1048576},
+			str: "1048576",
+		},
+		{
+			val: "1GiB",
+			exp: internal.Int64Range{Min: 1073741824, Max: 1073741824},
+			str: "1073741824",
+		},
+		{
+			val: "1KiB-2KiB",
+			exp: internal.Int64Range{Min: 1024, Max: 2048},
+			str: "1024-2048",
+		},
+		{
+			val: "<=1KB",
+			exp: internal.Int64Range{Max: 1000, Op: "<="},
+			str: "<=1000",
+		},
+		{
+			val: "1KiB~10%",
+			exp: internal.Int64Range{Min: 921, Max: 1127, Value: 1024, Tolerance: 10},
+			str: "1024±10% (921-1127, rounded outward)",
+		},
+	}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.val, func(t *testing.T) {
+			testCases, err := getTestCases(t, `package src
+
+// lem.a.bytes=`+tc.val+`
+func a() {}
+`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e, a := 1, len(testCases); e != a {
+				t.Fatalf("expLen=%d, actLen=%d", e, a)
+			}
+			r := testCases[0].BytesOp
+			if e, a := tc.exp, r; e != a {
+				t.Errorf("exp.bytes=%+v, act.bytes=%+v", e, a)
+			}
+			if e, a := tc.str, r.String(); e != a {
+				t.Errorf("exp.str=%s, act.str=%s", e, a)
+			}
+		})
+	}
+}
+
+func TestGetTestCasesBytesOpUnknownUnit(t *testing.T) {
+	for _, val := range []string{
+		"1TB",
+		"1kb",
+		"1KiB-2XB",
+	} {
+		val := val
+		t.Run(val, func(t *testing.T) {
+			_, err := getTestCases(t, `package src
+
+// lem.a.bytes=`+val+`
+func a() {}
+`)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if e, a := "unknown unit", err.Error(); !strings.Contains(a, e) {
+				t.Errorf("exp err to contain %q, act=%q", e, a)
+			}
+		})
+	}
+
+	// Size suffixes are only supported by lem.<ID>.bytes.
+	if _, err := getTestCases(t, `package src
+
+// lem.a.alloc=1KiB
+func a() {}
+`); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	testCases, err := getTestCases(t, `package src
+
+var sink interface{}
+
+// lem.a.name=to sink
+// lem.a.alloc=1
+// lem.a.bytes=8~10%
+func a(x int32) {
+	sink = x // lem.a.m=x escapes to heap
+}
+
+func b(x int32) int32 {
+	return x // lem.b.m!=escapes
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree := internal.NewTree(testCases...)
+	result := tree.Run(t, internal.Context{
+		BuildOutput: "./src.go:9:2: x escapes to heap\n",
+	})
+
+	reportPath := filepath.Join(t.TempDir(), "report.json")
+	if err := internal.WriteReport(reportPath, &tree, result); err != nil {
+		t.Fatal(err)
+	}
+
+	act, err := os.ReadFile(reportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp, err := os.ReadFile(filepath.Join("testdata", "report.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(exp, act) {
+		t.Errorf("expReport=%s\nactReport=%s", exp, act)
+	}
+}
+
+func TestWriteJUnit(t *testing.T) {
+	result := internal.Result{
+		TestCases: []internal.TestCaseResult{
+			{
+				ID:      "a",
+				Package: "github.com/akutz/lem/examples/mem",
+				Path:    []string{"a", "to sink"},
+			},
+			{
+				ID:      "b",
+				Package: "github.com/akutz/lem/examples/gcflags",
+				Path:    []string{"b"},
+				Skipped: true,
+			},
+			{
+				ID:      "c",
+				Package: "github.com/akutz/lem/examples/mem",
+				Path:    []string{"c"},
+				Failed:  true,
+				Failures: []string{
+					"exp.alloc=1, act.alloc=2",
+					"exp.bytes=8, act.bytes=16",
+				},
+			},
+		},
+	}
+
+	junitPath := filepath.Join(t.TempDir(), "junit.xml")
+	if err := internal.WriteJUnit(junitPath, result); err != nil {
+		t.Fatal(err)
+	}
+
+	act, err := os.ReadFile(junitPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp, err := os.ReadFile(filepath.Join("testdata", "junit.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(exp, act) {
+		t.Errorf("expJUnit=%s\nactJUnit=%s", exp, act)
+	}
+}
+
+func TestSetPackages(t *testing.T) {
+	// Each package has a test case with the same ID as the package, and
+	// the package b also has the test case d in its sidecar file.
+	dir := t.TempDir()
+	for _, name := range []string{"a", "b", "c"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		src := fmt.Sprintf(
+			"package %[1]s\n\n// lem.%[1]s.alloc=0\nfunc %[1]s() {}\n", name)
+		if err := os.WriteFile(
+			filepath.Join(dir, name, name+".go"),
+			[]byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(
+		filepath.Join(dir, "b", internal.SidecarFileName),
+		[]byte(`{"testCases": [{"id": "d", "alloc": "0"}]}`),
+		0644); err != nil {
+		t.Fatal(err)
+	}
+	testCases, err := internal.GetTestCases(
+		filepath.Join(dir, "a", "a.go"),
+		filepath.Join(dir, "b", "b.go"),
+		filepath.Join(dir, "b", internal.SidecarFileName),
+		filepath.Join(dir, "c", "c.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The package c is not one of the provided packages.
+	internal.SetPackages(testCases, []build.Package{
+		{Dir: filepath.Join(dir, "a"), ImportPath: "example.com/a"},
+		{Dir: filepath.Join(dir, "b"), ImportPath: "example.com/b"},
+	})
+	exp := map[string]string{
+		"a": "example.com/a",
+		"b": "example.com/b",
+		"c": "",
+		"d": "example.com/b",
+	}
+	if e, a := len(exp), len(testCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	for _, tc := range testCases {
+		if e, a := exp[tc.ID], tc.Package; e != a {
+			t.Errorf("%s: expPackage=%q, actPackage=%q", tc.ID, e, a)
+		}
+	}
+}
+
+func TestBuildWithGoCmd(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shim script requires a POSIX shell")
+	}
+
+	dir := t.TempDir()
+	argsPath := filepath.Join(dir, "args")
+	goCmd := filepath.Join(dir, "go")
+	if err := os.WriteFile(
+		goCmd,
+		[]byte("#!/bin/sh\necho \"$@\" >>"+argsPath+"\n"),
+		0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var w bytes.Buffer
+	if err := internal.Build(&w, build.Package{
+		ImportPath: "example.com/hello",
+		GoFiles:    []string{"hello.go"},
+	}, internal.Context{
+		CompilerFlags: []string{"-l"},
+		GoCmd:         goCmd,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	act, err := os.ReadFile(argsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := "build -gcflags -m -l example.com/hello\n", string(act); e != a {
+		t.Errorf("expArgs=%q, actArgs=%q", e, a)
+	}
+}
+
+func TestBuildWithTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shim script requires a POSIX shell")
+	}
+
+	// The shim creates the test binary's output file, like the go command,
+	// and then hangs in a child process that inherits the shim's stderr,
+	// like the compiler started by the go command. Killing only the shim
+	// would leave the child holding stderr open until it exited.
+	dir := t.TempDir()
+	goCmd := filepath.Join(dir, "go")
+	if err := os.WriteFile(
+		goCmd,
+		[]byte("#!/bin/sh\ntouch \"$4\"\nsleep 30\n"),
+		0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Create the temp files in a directory that can be checked for leaks.
+	tempDir := t.TempDir()
+	t.Setenv("TMPDIR", tempDir)
+
+	start := time.Now()
+	err := internal.Build(io.Discard, build.Package{
+		ImportPath:  "example.com/hello",
+		TestGoFiles: []string{"hello_test.go"},
+	}, internal.Context{
+		BuildTimeout:      100 * time.Millisecond,
+		DisableBuildCache: true,
+		GoCmd:             goCmd,
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if !strings.Contains(err.Error(), "timed out after 100ms") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("build was not killed, took %s", d)
+	}
+
+	// Assert the test binary's output file was removed.
+	entries, err := os.ReadDir(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		t.Errorf("temp file was not removed: %s", e.Name())
+	}
+}
+
+func TestBuildWithLogger(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shim script requires a POSIX shell")
+	}
+
+	// The shim fails like a go command that cannot build the package.
+	dir := t.TempDir()
+	goCmd := filepath.Join(dir, "go")
+	if err := os.WriteFile(
+		goCmd,
+		[]byte("#!/bin/sh\necho failed to build >&2\nexit 1\n"),
+		0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	err := internal.Build(io.Discard, build.Package{
+		ImportPath: "example.com/hello",
+		GoFiles:    []string{"hello.go"},
+	}, internal.Context{
+		DisableBuildCache: true,
+		GoCmd:             goCmd,
+		Logger:            log.New(&logs, "", 0),
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	e := "failed: " + goCmd + " build "
+	if a := logs.String(); !strings.HasPrefix(a, e) {
+		t.Errorf("expLog=%s..., actLog=%s", e, a)
+	}
+}
+
+func TestBuildWithTempDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shim script requires a POSIX shell")
+	}
+
+	// The shim records the path of the test binary and creates it like a
+	// go command that built the package's tests.
+	dir := t.TempDir()
+	outPath := filepath.Join(dir, "out")
+	goCmd := filepath.Join(dir, "go")
+	if err := os.WriteFile(
+		goCmd,
+		[]byte("#!/bin/sh\n"+
+			"while [ $# -gt 0 ]; do\n"+
+			"  if [ \"$1\" = \"-o\" ]; then\n"+
+			"    echo \"$2\" >"+outPath+"; touch \"$2\"\n"+
+			"  fi\n"+
+			"  shift\n"+
+			"done\n"),
+		0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir := t.TempDir()
+	if err := internal.Build(io.Discard, build.Package{
+		ImportPath:  "example.com/hello",
+		TestGoFiles: []string{"hello_test.go"},
+		TestImports: []string{"example.com/hello"},
+	}, internal.Context{
+		DisableBuildCache: true,
+		GoCmd:             goCmd,
+		TempDir:           tempDir,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(outPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binPath := strings.TrimSpace(string(data))
+	if e, a := tempDir, filepath.Dir(binPath); e != a {
+		t.Errorf("expDir=%s, actDir=%s", e, a)
+	}
+	if _, err := os.Stat(binPath); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed, err=%v", binPath, err)
+	}
+}
+
+func TestBuildRemovesTempFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shim script requires a POSIX shell")
+	}
+
+	// When re-executed by the parent test, the shim interrupts this
+	// process while the test binary is being built.
+	if v := os.Getenv("LEM_TEST_TEMP_DIR"); v != "" {
+		internal.Build(io.Discard, build.Package{
+			ImportPath:  "example.com/hello",
+			TestGoFiles: []string{"hello_test.go"},
+			TestImports: []string{"example.com/hello"},
+		}, internal.Context{
+			DisableBuildCache: true,
+			GoCmd:             os.Getenv("LEM_TEST_GO_CMD"),
+			Logger:            log.New(io.Discard, "", 0),
+			TempDir:           v,
+		})
+		t.Fatal("expected process to be interrupted")
+	}
+
+	// newShim returns a shim that writes part of the test binary and then
+	// runs the provided command.
+	newShim := func(t *testing.T, cmd string) string {
+		goCmd := filepath.Join(t.TempDir(), "go")
+		if err := os.WriteFile(
+			goCmd,
+			[]byte("#!/bin/sh\n"+
+				"exec >/dev/null 2>&1\n"+
+				"while [ $# -gt 0 ]; do\n"+
+				"  if [ \"$1\" = \"-o\" ]; then echo partial >\"$2\"; fi\n"+
+				"  shift\n"+
+				"done\n"+
+				cmd+"\n"),
+			0755); err != nil {
+			t.Fatal(err)
+		}
+		return goCmd
+	}
+
+	// assertEmpty asserts the provided directory is empty.
+	assertEmpty := func(t *testing.T, dir string) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			t.Errorf("unexpected file %s", e.Name())
+		}
+	}
+
+	t.Run("build failure", func(t *testing.T) {
+		tempDir := t.TempDir()
+		if err := internal.Build(io.Discard, build.Package{
+			ImportPath:  "example.com/hello",
+			TestGoFiles: []string{"hello_test.go"},
+			TestImports: []string{"example.com/hello"},
+		}, internal.Context{
+			DisableBuildCache: true,
+			GoCmd:             newShim(t, "exit 1"),
+			Logger:            log.New(io.Discard, "", 0),
+			TempDir:           tempDir,
+		}); err == nil {
+			t.Fatal("expected error")
+		}
+		assertEmpty(t, tempDir)
+	})
+
+	t.Run("interrupt", func(t *testing.T) {
+		tempDir := t.TempDir()
+		cmd := exec.Command(
+			os.Args[0], "-test.run=^TestBuildRemovesTempFile$", "-test.v")
+		cmd.Env = append(os.Environ(),
+			"LEM_TEST_TEMP_DIR="+tempDir,
+			"LEM_TEST_GO_CMD="+newShim(t, "kill -INT $PPID; sleep 5"))
+		out, err := cmd.CombinedOutput()
+		if err == nil {
+			t.Fatalf("expected process to be interrupted\n%s", out)
+		}
+		if strings.Contains(string(out), "expected process to be interrupted") {
+			t.Fatalf("process was not interrupted\n%s", out)
+		}
+		assertEmpty(t, tempDir)
+	})
+}
+
+func TestBuildError(t *testing.T) {
+	pkg, err := build.Import(
+		"github.com/akutz/lem/internal/testdata/broken", ".", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = internal.Build(io.Discard, *pkg, internal.Context{
+		DisableBuildCache: true,
+		Logger:            log.New(io.Discard, "", 0),
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	var buildErr *internal.BuildError
+	if !errors.As(err, &buildErr) {
+		t.Fatalf("expected BuildError, got %T: %v", err, err)
+	}
+
+	// The raw output of the go command is still available.
+	if e, a := "undefined: undefinedVar", buildErr.Output; !strings.Contains(a, e) {
+		t.Errorf("expOutput to contain %s, actOutput=%s", e, a)
+	}
+
+	if e, a := 1, len(buildErr.Diagnostics); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	d := buildErr.Diagnostics[0]
+	if e, a := "broken.go", filepath.Base(d.File); e != a {
+		t.Errorf("exp.file=%s, act.file=%s", e, a)
+	}
+	if e, a := 20, d.Line; e != a {
+		t.Errorf("exp.line=%d, act.line=%d", e, a)
+	}
+	if e, a := 9, d.Column; e != a {
+		t.Errorf("exp.column=%d, act.column=%d", e, a)
+	}
+	if e, a := "undefined: undefinedVar", d.Message; e != a {
+		t.Errorf("exp.message=%s, act.message=%s", e, a)
+	}
+	if e, a := "\treturn undefinedVar", d.Source; e != a {
+		t.Errorf("exp.source=%q, act.source=%q", e, a)
+	}
+
+	// The error includes the source line and a caret at the column.
+	exp := "\t20 | \treturn undefinedVar\n\t   | \t       ^\n"
+	if a := err.Error(); !strings.Contains(a, exp) {
+		t.Errorf("expErr to contain %q, actErr=%q", exp, a)
+	}
+}
+
+func TestBuildWithDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(
+		filepath.Join(dir, "go.mod"),
+		[]byte("module example.com/hello\n\ngo 1.17\n"),
+		0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(
+		filepath.Join(dir, "hello.go"),
+		[]byte("package hello\n\nvar sink interface{}\n\nfunc put(x int32) {\n\tsink = x\n}\n"),
+		0644); err != nil {
+		t.Fatal(err)
+	}
+
+	buildContext := build.Default
+	buildContext.Dir = dir
+
+	var w bytes.Buffer
+	if err := internal.Build(&w, build.Package{
+		ImportPath: "example.com/hello",
+		GoFiles:    []string{"hello.go"},
+	}, internal.Context{
+		BuildContext: &buildContext,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := regexp.MustCompile(`(?m)^.*hello.go:6:\d+: x escapes to heap$`)
+	if !r.MatchString(w.String()) {
+		t.Errorf("expected build output for temp module, got %s", w.String())
+	}
+}
+
+func TestBuildWithTags(t *testing.T) {
+	dir := t.TempDir()
+	for name, src := range map[string]string{
+		"go.mod": "module example.com/hello\n\ngo 1.17\n",
+		"hello.go": "package hello\n\nvar sink interface{}\n\n" +
+			"func put(x int32) {\n\tsink = x\n}\n",
+		"tagged.go": "//go:build lem_tagged\n\npackage hello\n\n" +
+			"func tagged(y int64) {\n\tsink = y\n}\n",
+	} {
+		if err := os.WriteFile(
+			filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := regexp.MustCompile(`(?m)^.*tagged.go:6:\d+: y escapes to heap$`)
+	for _, tc := range []struct {
+		name   string
+		tags   []string
+		expOut bool
+	}{
+		{name: "without tags"},
+		{name: "with tags", tags: []string{"lem_tagged"}, expOut: true},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			buildContext := build.Default
+			buildContext.Dir = dir
+			buildContext.BuildTags = tc.tags
+
+			var w bytes.Buffer
+			if err := internal.Build(&w, build.Package{
+				ImportPath: "example.com/hello",
+				GoFiles:    []string{"hello.go"},
+			}, internal.Context{
+				BuildContext:      &buildContext,
+				DisableBuildCache: true,
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if e, a := tc.expOut, r.MatchString(w.String()); e != a {
+				t.Errorf("expOutput=%v, actOutput=%v\n%s", e, a, w.String())
+			}
+		})
+	}
+}
+
+func TestBuildWithBuildMode(t *testing.T) {
+	t.Run("pie", func(t *testing.T) {
+		dir := t.TempDir()
+		for name, src := range map[string]string{
+			"go.mod": "module example.com/hello\n\ngo 1.17\n",
+			"hello.go": "package hello\n\nvar sink interface{}\n\n" +
+				"func put(x int32) {\n\tsink = x\n}\n",
+			"hello_test.go": "package hello\n\nimport \"testing\"\n\n" +
+				"func TestPut(t *testing.T) {\n\tput(1)\n}\n",
+		} {
+			if err := os.WriteFile(
+				filepath.Join(dir, name), []byte(src), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		buildContext := build.Default
+		buildContext.Dir = dir
+
+		var w bytes.Buffer
+		if err := internal.Build(&w, build.Package{
+			ImportPath:  "example.com/hello",
+			GoFiles:     []string{"hello.go"},
+			TestGoFiles: []string{"hello_test.go"},
+		}, internal.Context{
+			BuildContext:      &buildContext,
+			BuildMode:         "pie",
+			DisableBuildCache: true,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		r := regexp.MustCompile(`(?m)^.*hello.go:6:\d+: x escapes to heap$`)
+		if !r.MatchString(w.String()) {
+			t.Errorf("expected escape analysis output\n%s", w.String())
+		}
+	})
+
+	t.Run("c-shared", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("shim script requires a POSIX shell")
+		}
+
+		dir := t.TempDir()
+		argsPath := filepath.Join(dir, "args")
+		goCmd := filepath.Join(dir, "go")
+		if err := os.WriteFile(
+			goCmd,
+			[]byte("#!/bin/sh\necho \"$@\" >>"+argsPath+"\n"),
+			0755); err != nil {
+			t.Fatal(err)
+		}
+
+		var w bytes.Buffer
+		if err := internal.Build(&w, build.Package{
+			ImportPath:  "example.com/hello",
+			GoFiles:     []string{"hello.go"},
+			TestGoFiles: []string{"hello_test.go"},
+		}, internal.Context{
+			BuildMode:         "c-shared",
+			DisableBuildCache: true,
+			GoCmd:             goCmd,
+			Logger:            log.New(io.Discard, "", 0),
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		act, err := os.ReadFile(argsPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(act), "test -c") {
+			t.Errorf("unexpected test build: %q", act)
+		}
+		if e, a := "build -gcflags -m -buildmode=c-shared example.com/hello\n",
+			string(act); e != a {
+			t.Errorf("expArgs=%q, actArgs=%q", e, a)
+		}
+	})
+
+	t.Run("c-shared with only tests", func(t *testing.T) {
+		var w bytes.Buffer
+		err := internal.Build(&w, build.Package{
+			ImportPath:  "example.com/hello",
+			TestGoFiles: []string{"hello_test.go"},
+		}, internal.Context{
+			BuildMode:         "c-shared",
+			DisableBuildCache: true,
+		})
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		if e, a := "buildmode c-shared cannot be used to build the tests "+
+			"of pkg example.com/hello", err.Error(); !strings.HasPrefix(a, e) {
+			t.Errorf("expErr=%q, actErr=%q", e, a)
+		}
+	})
+}
+
+func TestBuildWithExtraArgs(t *testing.T) {
+	dir := t.TempDir()
+	for name, src := range map[string]string{
+		"go.mod": "module example.com/hello\n\ngo 1.17\n",
+		"hello.go": "package hello\n\nvar sink interface{}\n\n" +
+			"func put(x int32) {\n" +
+			"\tsink = x // lem.put.m=x escapes to heap\n}\n",
+		"hello_test.go": "package hello\n\nimport \"testing\"\n\n" +
+			"func TestPut(t *testing.T) {\n\tput(1)\n}\n",
+	} {
+		if err := os.WriteFile(
+			filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testCases, err := internal.GetTestCases(filepath.Join(dir, "hello.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buildContext := build.Default
+	buildContext.Dir = dir
+
+	for _, tc := range []struct {
+		name string
+		pkg  build.Package
+		ctx  internal.Context
+	}{
+		{
+			name: "build",
+			pkg: build.Package{
+				ImportPath: "example.com/hello",
+				GoFiles:    []string{"hello.go"},
+			},
+			ctx: internal.Context{ExtraBuildArgs: []string{"-trimpath"}},
+		},
+		{
+			name: "test",
+			pkg: build.Package{
+				ImportPath:  "example.com/hello",
+				GoFiles:     []string{"hello.go"},
+				TestGoFiles: []string{"hello_test.go"},
+				TestImports: []string{"testing"},
+			},
+			ctx: internal.Context{ExtraTestArgs: []string{"-trimpath"}},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tc.ctx.BuildContext = &buildContext
+			tc.ctx.DisableBuildCache = true
+
+			var w bytes.Buffer
+			if err := internal.Build(&w, tc.pkg, tc.ctx); err != nil {
+				t.Fatal(err)
+			}
+			exp := "\nexample.com/hello/hello.go:6:9: x escapes to heap\n"
+			if a := w.String(); !strings.Contains(a, exp) {
+				t.Fatalf("expOutput=%q, actOutput=%q", exp, a)
+			}
+
+			// The matchers still match the trimmed paths.
+			tree := internal.NewTree(testCases...)
+			result := tree.Run(t, internal.Context{BuildOutput: w.String()})
+			if result.Failed() {
+				t.Errorf("result should not have failed\n%s", w.String())
+			}
+		})
+	}
+
+	for _, tc := range []struct {
+		name   string
+		ctx    internal.Context
+		expErr string
+	}{
+		{
+			name:   "build gcflags",
+			ctx:    internal.Context{ExtraBuildArgs: []string{"-gcflags=-l"}},
+			expErr: "ExtraBuildArgs may not include -gcflags=-l",
+		},
+		{
+			name:   "build output",
+			ctx:    internal.Context{ExtraBuildArgs: []string{"-o", "hello"}},
+			expErr: "ExtraBuildArgs may not include -o",
+		},
+		{
+			name:   "test gcflags",
+			ctx:    internal.Context{ExtraTestArgs: []string{"--gcflags", "-l"}},
+			expErr: "ExtraTestArgs may not include --gcflags",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			err := internal.Build(io.Discard, build.Package{
+				ImportPath: "example.com/hello",
+				GoFiles:    []string{"hello.go"},
+			}, tc.ctx)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if a := err.Error(); !strings.HasPrefix(a, tc.expErr) {
+				t.Errorf("expErr=%q, actErr=%q", tc.expErr, a)
+			}
+		})
+	}
+}
+
+func TestRunGo(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shim script requires a POSIX shell")
+	}
+
+	dir := t.TempDir()
+	goCmd := filepath.Join(dir, "go")
+	if err := os.WriteFile(
+		goCmd,
+		[]byte("#!/bin/sh\necho \"stdout $1\"\necho \"stderr $1\" >&2\n"),
+		0755); err != nil {
+		t.Fatal(err)
+	}
+	ctx := internal.Context{
+		DisableBuildCache: true,
+		GoCmd:             goCmd,
+	}
+
+	t.Run("separate streams", func(t *testing.T) {
+		stdout, stderr, err := internal.RunGo(ctx, "vet")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e, a := "stdout vet\n", stdout; e != a {
+			t.Errorf("expStdout=%q, actStdout=%q", e, a)
+		}
+		if e, a := "stderr vet\n", stderr; e != a {
+			t.Errorf("expStderr=%q, actStderr=%q", e, a)
+		}
+	})
+
+	t.Run("build output is stderr", func(t *testing.T) {
+		var w bytes.Buffer
+		if err := internal.Build(&w, build.Package{
+			ImportPath: "example.com/hello",
+			GoFiles:    []string{"hello.go"},
+		}, ctx); err != nil {
+			t.Fatal(err)
+		}
+		if e, a := "stderr build\n", w.String(); e != a {
+			t.Errorf("expOutput=%q, actOutput=%q", e, a)
+		}
+	})
+}
+
+func TestBuildWithEnv(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shim script requires a POSIX shell")
+	}
+
+	dir := t.TempDir()
+	envPath := filepath.Join(dir, "env")
+	goCmd := filepath.Join(dir, "go")
+	if err := os.WriteFile(
+		goCmd,
+		[]byte("#!/bin/sh\necho \"$LEM_TEST_ENV $GOARCH\" >"+envPath+"\n"),
+		0755); err != nil {
+		t.Fatal(err)
+	}
+
+	buildContext := build.Default
+	buildContext.GOARCH = "386"
+
+	var w bytes.Buffer
+	if err := internal.Build(&w, build.Package{
+		ImportPath: "example.com/hello",
+		GoFiles:    []string{"hello.go"},
+	}, internal.Context{
+		BuildContext: &buildContext,
+		Env: map[string]string{
+			"LEM_TEST_ENV": "hello",
+			"GOARCH":       "arm64",
+		},
+		GoCmd: goCmd,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	act, err := os.ReadFile(envPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := "hello arm64\n", string(act); e != a {
+		t.Errorf("expEnv=%q, actEnv=%q", e, a)
+	}
+}
+
+func TestBuildWithGoToolchain(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shim script requires a POSIX shell")
+	}
+
+	dir := t.TempDir()
+	envPath := filepath.Join(dir, "env")
+	goCmd := filepath.Join(dir, "go")
+	if err := os.WriteFile(
+		goCmd,
+		[]byte("#!/bin/sh\necho \"$GOTOOLCHAIN\" >"+envPath+"\n"),
+		0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// The toolchain takes precedence over GOTOOLCHAIN in Env.
+	var w bytes.Buffer
+	if err := internal.Build(&w, build.Package{
+		ImportPath: "example.com/hello",
+		GoFiles:    []string{"hello.go"},
+	}, internal.Context{
+		Env:         map[string]string{"GOTOOLCHAIN": "go1.21.0"},
+		GoCmd:       goCmd,
+		GoToolchain: "local",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	act, err := os.ReadFile(envPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := "local\n", string(act); e != a {
+		t.Errorf("expEnv=%q, actEnv=%q", e, a)
+	}
+}
+
+func TestBuildWithGoToolchainNotAvailable(t *testing.T) {
+	out, err := exec.Command("go", "env", "GOTOOLCHAIN").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(out)) == "" {
+		t.Skip("go command does not support GOTOOLCHAIN")
+	}
+
+	pkg, err := build.Import(
+		"github.com/akutz/lem/internal/testdata/move", ".", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// With the cache enabled the go version is read first, and with it
+	// disabled the package is built first. Either way the error should
+	// include why the toolchain could not be used.
+	for _, disableBuildCache := range []bool{false, true} {
+		t.Run(strconv.FormatBool(disableBuildCache), func(t *testing.T) {
+			err := internal.Build(io.Discard, *pkg, internal.Context{
+				DisableBuildCache: disableBuildCache,
+				Env:               map[string]string{"GOPROXY": "off"},
+				GoToolchain:       "go1.999.0",
+				Logger:            log.New(io.Discard, "", 0),
+				TempDir:           t.TempDir(),
+			})
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			var buildErr *internal.BuildError
+			if !errors.As(err, &buildErr) {
+				t.Fatalf("expected BuildError, got %T: %v", err, err)
+			}
+			if e, a := "go1.999.0", err.Error(); !strings.Contains(a, e) {
+				t.Errorf("expErr to contain %s, actErr=%s", e, a)
+			}
+		})
+	}
+}
+
+func TestBuildAll(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shim script requires a POSIX shell")
+	}
+
+	dir := t.TempDir()
+	goCmd := filepath.Join(dir, "go")
+	if err := os.WriteFile(
+		goCmd,
+		[]byte("#!/bin/sh\nfor last; do :; done\necho \"$last\" >&2\n"),
+		0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var pkgs []build.Package
+	for _, importPath := range []string{"c", "a", "d", "b"} {
+		pkgs = append(pkgs, build.Package{
+			ImportPath: importPath,
+			GoFiles:    []string{importPath + ".go"},
+		})
+	}
+
+	var w bytes.Buffer
+	if err := internal.BuildAll(&w, pkgs, internal.Context{
+		BuildParallelism: 2,
+		GoCmd:            goCmd,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := "a\nb\nc\nd\n", w.String(); e != a {
+		t.Errorf("expOutput=%q, actOutput=%q", e, a)
+	}
+}
+
+func TestBuildAllPackages(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shim script requires a POSIX shell")
+	}
+
+	dir := t.TempDir()
+	goCmd := filepath.Join(dir, "go")
+	if err := os.WriteFile(
+		goCmd,
+		[]byte("#!/bin/sh\nfor last; do :; done\necho \"$last.go:1:1: x\" >&2\n"),
+		0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var pkgs []build.Package
+	for _, importPath := range []string{"c", "a", "b"} {
+		pkgs = append(pkgs, build.Package{
+			ImportPath: importPath,
+			GoFiles:    []string{importPath + ".go"},
+		})
+	}
+
+	var w bytes.Buffer
+	act, err := internal.BuildAllPackages(&w, pkgs, internal.Context{
+		BuildParallelism: 2,
+		GoCmd:            goCmd,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := map[string]string{
+		"a": "a.go:1:1: x\n",
+		"b": "b.go:1:1: x\n",
+		"c": "c.go:1:1: x\n",
+	}
+	if !reflect.DeepEqual(exp, act) {
+		t.Errorf("expOutputs=%v, actOutputs=%v", exp, act)
+	}
+	if e, a := "a.go:1:1: x\nb.go:1:1: x\nc.go:1:1: x\n", w.String(); e != a {
+		t.Errorf("expOutput=%q, actOutput=%q", e, a)
+	}
+}
+
+// flagWriter creates the file at path when the data written to it contains
+// the provided string.
+type flagWriter struct {
+	contains string
+	path     string
+}
+
+func (w flagWriter) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte(w.contains)) {
+		if err := os.WriteFile(w.path, nil, 0644); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func TestBuildAllStreams(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shim script requires a POSIX shell")
+	}
+
+	// Package b is not built until the output of package a has been
+	// written, which would never happen if the output of all of the
+	// packages was written only after all of them were built.
+	dir := t.TempDir()
+	flagPath := filepath.Join(dir, "flag")
+	goCmd := filepath.Join(dir, "go")
+	if err := os.WriteFile(
+		goCmd,
+		[]byte(`#!/bin/sh
+for last; do :; done
+if [ "$last" = "b" ]; then
+	i=0
+	while [ ! -f `+flagPath+` ]; do
+		i=$((i+1))
+		if [ $i -gt 500 ]; then echo "a was not written" >&2; exit 1; fi
+		sleep 0.01
+	done
+fi
+echo "$last.go:1:1: x" >&2
+`),
+		0755); err != nil {
+		t.Fatal(err)
+	}
+
+	pkgs := []build.Package{
+		{ImportPath: "b", GoFiles: []string{"b.go"}},
+		{ImportPath: "a", GoFiles: []string{"a.go"}},
+	}
+	if err := internal.BuildAll(
+		flagWriter{contains: "a.go:1:1: x", path: flagPath},
+		pkgs,
+		internal.Context{BuildParallelism: 2, GoCmd: goCmd}); err != nil {
+
+		t.Fatal(err)
+	}
+}
+
+// BenchmarkBuildAllIndex compares the peak heap used to index the output of
+// several packages after buffering all of it, the same as lem.Run does by
+// default, with indexing it as it is streamed from the builds, the same as
+// lem.Run does when IndexBuildOutput is set.
+func BenchmarkBuildAllIndex(b *testing.B) {
+	if runtime.GOOS == "windows" {
+		b.Skip("shim script requires a POSIX shell")
+	}
+
+	const numLines = 50000
+	dir := b.TempDir()
+	goCmd := filepath.Join(dir, "go")
+	if err := os.WriteFile(
+		goCmd,
+		[]byte(fmt.Sprintf(`#!/bin/sh
+for last; do :; done
+awk 'BEGIN { for (i = 1; i <= %d; i++) printf "./%%s.go:%%d:2: x escapes to heap:\n./%%s.go:%%d:2:   flow: {heap} = &{storage for x}:\n", "'"$last"'", i, "'"$last"'", i }' >&2
+`, numLines)),
+		0755); err != nil {
+		b.Fatal(err)
+	}
+
+	var pkgs []build.Package
+	for _, importPath := range []string{"a", "b", "c", "d"} {
+		pkgs = append(pkgs, build.Package{
+			ImportPath: importPath,
+			GoFiles:    []string{importPath + ".go"},
+		})
+	}
+	ctx := internal.Context{BuildParallelism: 1, GoCmd: goCmd}
+
+	// measurePeakHeap calls fn and returns the peak heap allocated while it
+	// ran, in excess of the heap allocated before it was called. The garbage
+	// collector is run more often so the heap approximates the live objects.
+	measurePeakHeap := func(fn func()) uint64 {
+		defer debug.SetGCPercent(debug.SetGCPercent(5))
+		var ms runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&ms)
+		base, peak := ms.HeapAlloc, ms.HeapAlloc
+
+		stop, done := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(done)
+			var ms runtime.MemStats
+			for {
+				runtime.ReadMemStats(&ms)
+				if ms.HeapAlloc > peak {
+					peak = ms.HeapAlloc
+				}
+				select {
+				case <-stop:
+					return
+				case <-time.After(time.Millisecond):
+				}
+			}
+		}()
+		fn()
+		close(stop)
+		<-done
+		return peak - base
+	}
+
+	b.Run("buffered", func(b *testing.B) {
+		var peak uint64
+		for i := 0; i < b.N; i++ {
+			peak += measurePeakHeap(func() {
+				// Like lem.Run, keep the output of each package and all of
+				// the output as a string, which is indexed by Tree.Run.
+				var w bytes.Buffer
+				outputs, err := internal.BuildAllPackages(&w, pkgs, ctx)
+				if err != nil {
+					b.Fatal(err)
+				}
+				buildOutput := w.String()
+				if _, err := internal.NewBuildOutputIndex(
+					strings.NewReader(buildOutput)); err != nil {
+					b.Fatal(err)
+				}
+				runtime.KeepAlive(outputs)
+			})
+		}
+		b.ReportMetric(float64(peak)/float64(b.N), "peak-heap-B/op")
+	})
+
+	b.Run("indexed", func(b *testing.B) {
+		var peak uint64
+		for i := 0; i < b.N; i++ {
+			peak += measurePeakHeap(func() {
+				pr, pw := io.Pipe()
+				go func() {
+					pw.CloseWithError(internal.BuildAll(pw, pkgs, ctx))
+				}()
+				if _, err := internal.NewBuildOutputIndex(pr); err != nil {
+					b.Fatal(err)
+				}
+			})
+		}
+		b.ReportMetric(float64(peak)/float64(b.N), "peak-heap-B/op")
+	})
+}
+
+func BenchmarkBuildAll(b *testing.B) {
+	pkgs, err := internal.Load(
+		internal.Context{}, ".", "github.com/akutz/lem/examples/...")
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, parallelism := range []int{1, 4} {
+		parallelism := parallelism
+		b.Run(fmt.Sprintf("parallelism=%d", parallelism), func(b *testing.B) {
+			ctx := internal.Context{BuildParallelism: parallelism}
+			for i := 0; i < b.N; i++ {
+				if err := internal.BuildAll(io.Discard, pkgs, ctx); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildCache(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shim script requires a POSIX shell")
+	}
+
+	// The shim lists the build ID of a dependency as the contents of the
+	// file at depPath, so the test may simulate editing the dependency.
+	dir := t.TempDir()
+	countPath := filepath.Join(dir, "count")
+	depPath := filepath.Join(dir, "dep")
+	goCmd := filepath.Join(dir, "go")
+	if err := os.WriteFile(
+		goCmd,
+		[]byte(`#!/bin/sh
+if [ "$1" = "version" ]; then echo "go version shim"; exit 0; fi
+if [ "$1" = "list" ]; then echo "example.com/dep $(cat `+depPath+`)"; exit 0; fi
+echo "$@" >>`+countPath+`
+echo "./hello.go:6:7: x escapes to heap" >&2
+`),
+		0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(depPath, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srcPath := filepath.Join(dir, "hello.go")
+	if err := os.WriteFile(srcPath, []byte("package hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pkg := build.Package{
+		Dir:        dir,
+		ImportPath: "example.com/hello",
+		GoFiles:    []string{"hello.go"},
+	}
+	ctx := internal.Context{
+		BuildCacheDir: filepath.Join(dir, "cache"),
+		GoCmd:         goCmd,
+	}
+	doBuild := func() string {
+		var w bytes.Buffer
+		if err := internal.Build(&w, pkg, ctx); err != nil {
+			t.Fatal(err)
+		}
+		return w.String()
+	}
+	count := func() int {
+		data, err := os.ReadFile(countPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bytes.Count(data, []byte("\n"))
+	}
+
+	exp := "./hello.go:6:7: x escapes to heap\n"
+	if a := doBuild(); exp != a {
+		t.Errorf("expOutput=%q, actOutput=%q", exp, a)
+	}
+	if e, a := 1, count(); e != a {
+		t.Errorf("expBuilds=%d, actBuilds=%d", e, a)
+	}
+
+	// The second build should be a cache hit.
+	if a := doBuild(); exp != a {
+		t.Errorf("expOutput=%q, actOutput=%q", exp, a)
+	}
+	if e, a := 1, count(); e != a {
+		t.Errorf("expBuilds=%d, actBuilds=%d", e, a)
+	}
+
+	// Changing the sources should be a cache miss.
+	if err := os.WriteFile(srcPath, []byte("package hello\n\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	doBuild()
+	if e, a := 2, count(); e != a {
+		t.Errorf("expBuilds=%d, actBuilds=%d", e, a)
+	}
+
+	// Changing a dependency should be a cache miss.
+	if err := os.WriteFile(depPath, []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	doBuild()
+	if e, a := 3, count(); e != a {
+		t.Errorf("expBuilds=%d, actBuilds=%d", e, a)
+	}
+
+	// Disabling the cache should always build.
+	ctx.DisableBuildCache = true
+	doBuild()
+	if e, a := 4, count(); e != a {
+		t.Errorf("expBuilds=%d, actBuilds=%d", e, a)
+	}
+}
+
+func TestBuildCacheDependency(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name, data string) {
+		filePath := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filePath, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile("go.mod", "module example.com/m\n\ngo 1.17\n")
+	writeFile("dep/dep.go", "package dep\n\nfunc F() int { return 1 }\n")
+	writeFile("hello/hello.go", `package hello
+
+import "example.com/m/dep"
+
+func G() int { return dep.F() }
+`)
+
+	pkg := build.Package{
+		Dir:        filepath.Join(dir, "hello"),
+		ImportPath: "example.com/m/hello",
+		GoFiles:    []string{"hello.go"},
+	}
+	ctx := internal.Context{
+		BuildCacheDir: filepath.Join(dir, "cache"),
+		BuildContext:  &build.Context{Dir: dir, CgoEnabled: true},
+	}
+	doBuild := func() string {
+		var w bytes.Buffer
+		if err := internal.Build(&w, pkg, ctx); err != nil {
+			t.Fatal(err)
+		}
+		return w.String()
+	}
+
+	const inlined = "inlining call to dep.F"
+	if a := doBuild(); !strings.Contains(a, inlined) {
+		t.Fatalf("expOutput to contain %q, actOutput=%q", inlined, a)
+	}
+
+	// Preventing the dependency's function from being inlined should be a
+	// cache miss, even though the package's own sources are unchanged.
+	writeFile("dep/dep.go",
+		"package dep\n\n//go:noinline\nfunc F() int { return 1 }\n")
+	if a := doBuild(); strings.Contains(a, inlined) {
+		t.Errorf("expOutput to not contain %q, actOutput=%q", inlined, a)
+	}
+}
+
+const testAsmOutput = `# example.com/asm
+example.com/asm.(*T).Get STEXT nosplit size=4 args=0x8 locals=0x0 funcid=0x0
+	0x0000 00000 (/tmp/asm/a.go:5)	TEXT	example.com/asm.(*T).Get(SB), NOSPLIT|NOFRAME|ABIInternal, $0-8
+	0x0000 00000 (/tmp/asm/a.go:5)	MOVQ	(AX), AX
+	0x0003 00003 (/tmp/asm/a.go:5)	RET
+example.com/asm.Put STEXT size=60 args=0x8 locals=0x18 funcid=0x0
+	0x0000 00000 (/tmp/asm/a.go:7)	TEXT	example.com/asm.Put(SB), ABIInternal, $24-8
+	0x0010 00016 (/tmp/asm/a.go:8)	CALL	runtime.newobject(SB)
+	0x0020 00032 (/tmp/asm/a.go:7)	CALL	runtime.morestack_noctxt(SB)
+go:cuinfo.producer.example.com/asm SDWARFCUINFO dupok size=0
+	0x0000 2d 4e 20 2d 6c                                   -N -l
+`
+
+func TestGetAsmBlock(t *testing.T) {
+	testCases := []struct {
+		name string
+		file string
+		line int
+		exp  string
+		ok   bool
+	}{
+		{
+			name: "method",
+			file: "a.go",
+			line: 5,
+			exp: `example.com/asm.(*T).Get STEXT nosplit size=4 args=0x8 locals=0x0 funcid=0x0
+	0x0000 00000 (/tmp/asm/a.go:5)	TEXT	example.com/asm.(*T).Get(SB), NOSPLIT|NOFRAME|ABIInternal, $0-8
+	0x0000 00000 (/tmp/asm/a.go:5)	MOVQ	(AX), AX
+	0x0003 00003 (/tmp/asm/a.go:5)	RET`,
+			ok: true,
+		},
+		{
+			name: "func",
+			file: "a.go",
+			line: 7,
+			exp: `example.com/asm.Put STEXT size=60 args=0x8 locals=0x18 funcid=0x0
+	0x0000 00000 (/tmp/asm/a.go:7)	TEXT	example.com/asm.Put(SB), ABIInternal, $24-8
+	0x0010 00016 (/tmp/asm/a.go:8)	CALL	runtime.newobject(SB)
+	0x0020 00032 (/tmp/asm/a.go:7)	CALL	runtime.morestack_noctxt(SB)`,
+			ok: true,
+		},
+		{
+			name: "wrong line",
+			file: "a.go",
+			line: 8,
+		},
+		{
+			name: "wrong file",
+			file: "xa.go",
+			line: 7,
+		},
+	}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			block, ok := internal.GetAsmBlock(testAsmOutput, tc.file, tc.line)
+			if e, a := tc.ok, ok; e != a {
+				t.Fatalf("expOK=%v, actOK=%v", e, a)
+			}
+			if e, a := tc.exp, block; e != a {
+				t.Errorf("expBlock=%s\nactBlock=%s", e, a)
+			}
+		})
+	}
+}
+
+func TestGetFrameSize(t *testing.T) {
+	testCases := []struct {
+		name string
+		line int
+		exp  int64
+		ok   bool
+	}{
+		{name: "nosplit", line: 5, exp: 0, ok: true},
+		{name: "frame", line: 7, exp: 24, ok: true},
+		{name: "missing", line: 8},
+	}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			n, ok := internal.GetFrameSize(testAsmOutput, "a.go", tc.line)
+			if e, a := tc.ok, ok; e != a {
+				t.Fatalf("expOK=%v, actOK=%v", e, a)
+			}
+			if e, a := tc.exp, n; e != a {
+				t.Errorf("expFrameSize=%d, actFrameSize=%d", e, a)
+			}
+		})
+	}
+}
+
+func TestGetTestCasesAsm(t *testing.T) {
+	_, err := getTestCases(t, `package src
+
+// lem.a.asm=NOSPLIT
+func a() {
+	println() // lem.b.asm=CALL
+}
+
+// lem.c.asm=RET
+`)
+	if err == nil {
+		t.Fatal("expected error for asm directive outside of a function")
+	}
+
+	testCases, err := getTestCases(t, `package src
+
+// lem.a.asm=NOSPLIT
+func a() {
+	println() // lem.b.asm=CALL
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 2, len(testCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	for _, tc := range testCases {
+		if e, a := 1, len(tc.Asm); e != a {
+			t.Fatalf("expAsm=%d, actAsm=%d", e, a)
+		}
+		if e, a := 4, tc.Asm[0].Line; e != a {
+			t.Errorf("expLine=%d, actLine=%d", e, a)
+		}
+	}
+}
+
+func TestGetTestCasesNoRuntimeAlloc(t *testing.T) {
+	_, err := getTestCases(t, `package src
+
+// lem.a.noruntime-alloc
+`)
+	if err == nil {
+		t.Fatal("expected error for noruntime-alloc directive outside of a function")
+	}
+
+	testCases, err := getTestCases(t, `package src
+
+// lem.a.noruntime-alloc
+func a() {
+	println() // lem.b.noruntime-alloc
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 2, len(testCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	for _, tc := range testCases {
+		if e, a := 1, len(tc.AsmNatches); e != a {
+			t.Fatalf("expAsmNatches=%d, actAsmNatches=%d", e, a)
+		}
+		if e, a := 4, tc.AsmNatches[0].Line; e != a {
+			t.Errorf("expLine=%d, actLine=%d", e, a)
+		}
+		if !internal.HasAsm(tc) {
+			t.Error("test case should assert against the assembly")
+		}
+	}
+
+	// The pattern matches a call to any of the runtime's allocation
+	// helpers in the function's assembly.
+	am := testCases[0].AsmNatches[0]
+	am.File, am.Line = "a.go", 7
+	if s, ok := am.FindString(testAsmOutput); !ok || s == "" {
+		t.Errorf("expected runtime.newobject to match, ok=%v", ok)
+	}
+	am.Line = 5
+	if s, ok := am.FindString(testAsmOutput); !ok || s != "" {
+		t.Errorf("expected no match, ok=%v, s=%s", ok, s)
+	}
+
+	// The directive may only be specified once per test case.
+	if _, err := getTestCases(t, `package src
+
+// lem.a.noruntime-alloc
+// lem.a.noruntime-alloc
+func a() {}
+`); err == nil {
+		t.Fatal("expected error for duplicate noruntime-alloc directive")
+	}
+}
+
+func TestTreeRunNoRuntimeAlloc(t *testing.T) {
+	// Run the fixture's test cases so the function that calls
+	// runtime.growslice fails.
+	pkg, err := build.Import(
+		"github.com/akutz/lem/internal/testdata/noruntimealloc", ".", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases, err := internal.GetTestCases(
+		filepath.Join(pkg.Dir, "noruntimealloc.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := internal.Context{DisableBuildCache: true}
+	var w bytes.Buffer
+	if err := internal.BuildAsm(&w, *pkg, ctx); err != nil {
+		t.Fatal(err)
+	}
+	ctx.AsmOutput = w.String()
+	tree := internal.NewTree(testCases...)
+	r := runRecorded(&tree, ctx)
+	if !r.Failed() {
+		t.Fatalf("expected failure\n%s", r)
+	}
+	if !r.sub("grow").Failed() {
+		t.Errorf("grow should have failed\n%s", r)
+	}
+	if r.sub("sum").Failed() {
+		t.Errorf("sum should not have failed\n%s", r)
+	}
+	act := r.String()
+	for _, exp := range []string{
+		"reason: found",
+		"CALL\truntime.growslice(SB)",
+	} {
+		if !strings.Contains(act, exp) {
+			t.Errorf("expOutput=%s, actOutput=%s", exp, act)
+		}
+	}
+}
+
+func TestGetTestCasesFrameSize(t *testing.T) {
+	_, err := getTestCases(t, `package src
+
+// lem.a.framesize=0
+`)
+	if err == nil {
+		t.Fatal("expected error for framesize directive outside of a function")
+	}
+
+	testCases, err := getTestCases(t, `package src
+
+// lem.a.framesize=<=32
+func a() {
+	println()
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 1, len(testCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	fs := testCases[0].FrameSize
+	if fs == nil {
+		t.Fatal("frame size is nil")
+	}
+	if e, a := "<=32", fs.Expected.String(); e != a {
+		t.Errorf("expFrameSize=%s, actFrameSize=%s", e, a)
+	}
+	if e, a := 4, fs.Line; e != a {
+		t.Errorf("expLine=%d, actLine=%d", e, a)
+	}
+}
+
+func TestGetBenchmark(t *testing.T) {
+	byID := func(*testing.B) {}
+	byName := func(*testing.B) {}
+	byCustomName := func(*testing.B) {}
+	ctx := internal.Context{
+		Benchmarks: map[string]func(*testing.B){
+			"a":                byID,
+			"BenchmarkLem_a":   byName,
+			"BenchmarkLem_b":   byName,
+			"BenchmarkMine_c":  byCustomName,
+			"BenchmarkLem_xyz": byName,
+		},
+	}
+
+	testCases := []struct {
+		name   string
+		prefix string
+		id     string
+		exp    func(*testing.B)
+	}{
+		{name: "id preferred", id: "a", exp: byID},
+		{name: "default prefix", id: "b", exp: byName},
+		{name: "custom prefix", prefix: "BenchmarkMine_", id: "c", exp: byCustomName},
+		{name: "custom prefix unmatched", prefix: "BenchmarkMine_", id: "b"},
+		{name: "unmatched", id: "xy"},
+	}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := ctx
+			ctx.BenchmarkPrefix = tc.prefix
+			fn, ok := internal.GetBenchmark(ctx, tc.id)
+			if e, a := tc.exp != nil, ok; e != a {
+				t.Fatalf("expOK=%v, actOK=%v", e, a)
+			}
+			if !ok {
+				return
+			}
+			if e, a := reflect.ValueOf(tc.exp).Pointer(),
+				reflect.ValueOf(fn).Pointer(); e != a {
+				t.Errorf("unexpected benchmark function for %s", tc.id)
+			}
+		})
+	}
+}
+
+func TestRequireBenchmarks(t *testing.T) {
+	// Run a tree with a test case that asserts allocations but has no
+	// registered benchmark.
+	testCases, err := getTestCases(t, `package src
+
+// lem.a.alloc=0
+func a() {}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		mode   string
+		expErr bool
+	}{
+		{mode: "lenient"},
+		{mode: "strict", expErr: true},
+	} {
+		tc := tc
+		t.Run(tc.mode, func(t *testing.T) {
+			tree := internal.NewTree(testCases...)
+			r := runRecorded(&tree, internal.Context{
+				RequireBenchmarks: tc.mode == "strict",
+			})
+			if e, a := tc.expErr, r.Failed(); e != a {
+				t.Fatalf("expErr=%v, actErr=%v\n%s", e, a, r)
+			}
+			e, a := "benchmark function not registered for a", r.String()
+			if !strings.Contains(a, e) {
+				t.Errorf("expOutput=%s, actOutput=%s", e, a)
+			}
+		})
+	}
+}
+
+func TestTreeOrphanedBenchmarks(t *testing.T) {
+	bench := func(b *testing.B) {}
+	tree := internal.NewTree(
+		internal.TestCase{ID: "a"},
+		internal.TestCase{ID: "b"},
+		internal.TestCase{ID: "c"},
+	)
+	testCases := []struct {
+		name   string
+		ctx    internal.Context
+		expIDs []string
+	}{
+		{
+			name: "none",
+		},
+		{
+			name: "matched",
+			ctx: internal.Context{
+				Benchmarks: map[string]func(*testing.B){
+					"a":              bench,
+					"BenchmarkLem_b": bench,
+				},
+				BenchmarksMulti: map[string][]func(*testing.B){
+					"c": {bench},
+				},
+			},
+		},
+		{
+			name: "orphaned",
+			ctx: internal.Context{
+				Benchmarks: map[string]func(*testing.B){
+					"a":              bench,
+					"d":              bench,
+					"BenchmarkLem_e": bench,
+				},
+				BenchmarksMulti: map[string][]func(*testing.B){
+					"f": {bench},
+				},
+			},
+			expIDs: []string{"BenchmarkLem_e", "d", "f"},
+		},
+		{
+			name: "orphaned with prefix",
+			ctx: internal.Context{
+				BenchmarkPrefix: "BenchmarkX_",
+				Benchmarks: map[string]func(*testing.B){
+					"BenchmarkX_a":   bench,
+					"BenchmarkLem_b": bench,
+				},
+			},
+			expIDs: []string{"BenchmarkLem_b"},
+		},
+		{
+			name: "excluded by filter",
+			ctx: internal.Context{
+				Benchmarks: map[string]func(*testing.B){
+					"d":              bench,
+					"BenchmarkLem_e": bench,
+					"ex":             bench,
+				},
+				Filter: "^e",
+			},
+			expIDs: []string{"ex"},
+		},
+	}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			act := tree.OrphanedBenchmarks(tc.ctx)
+			if e, a := tc.expIDs, act; !reflect.DeepEqual(e, a) {
+				t.Errorf("expIDs=%v, actIDs=%v", e, a)
+			}
+		})
+	}
+}
+
+func TestTreeRunOrphanedBenchmarks(t *testing.T) {
+	// Run a tree with a benchmark that has no test case.
+	for _, tc := range []struct {
+		mode   string
+		expErr bool
+	}{
+		{mode: "lenient"},
+		{mode: "strict", expErr: true},
+	} {
+		tc := tc
+		t.Run(tc.mode, func(t *testing.T) {
+			tree := internal.NewTree(internal.TestCase{ID: "a"})
+			r := runRecorded(&tree, internal.Context{
+				AllowOrphanedBenchmarks: tc.mode == "lenient",
+				Benchmarks: map[string]func(*testing.B){
+					"a": func(b *testing.B) {},
+					"b": func(b *testing.B) {},
+				},
+			})
+			if e, a := tc.expErr, r.Failed(); e != a {
+				t.Fatalf("expErr=%v, actErr=%v\n%s", e, a, r)
+			}
+			e := "benchmark function registered without a test case: b\n"
+			if a := r.String(); !strings.Contains(a, e) {
+				t.Errorf("expOutput=%s, actOutput=%s", e, a)
+			}
+		})
+	}
+}
+
+func TestTreeRunBenchmarksRunFilter(t *testing.T) {
+	// Run a tree with a benchmark for each test case that records when it
+	// is run, with a reporter that only runs the test case b, like the
+	// -run flag.
+	for _, mode := range []string{"serial", "parallel"} {
+		mode := mode
+		t.Run(mode, func(t *testing.T) {
+			var (
+				mu  sync.Mutex
+				ran []string
+			)
+			var testCases []internal.TestCase
+			benchmarks := map[string]func(*testing.B){}
+			for _, id := range []string{"a", "b", "c"} {
+				id := id
+				testCases = append(testCases, internal.TestCase{ID: id})
+				benchmarks[id] = func(b *testing.B) {
+					mu.Lock()
+					defer mu.Unlock()
+					ran = append(ran, id)
+				}
+			}
+			tree := internal.NewTree(testCases...)
+			r := &recordingReporter{filter: func(name string) bool {
+				return name == "b"
+			}}
+			r.runTree(&tree, internal.Context{
+				Benchmarks: benchmarks,
+				Parallel:   mode == "parallel",
+			})
+			if r.Failed() {
+				t.Fatalf("unexpected failure\n%s", r)
+			}
+
+			// The benchmarks for the test cases excluded by the filter
+			// are not run.
+			mu.Lock()
+			defer mu.Unlock()
+			for _, id := range ran {
+				if id != "b" {
+					t.Errorf("unexpected benchmark %s", id)
+				}
+			}
+			if len(ran) == 0 {
+				t.Error("benchmark b was not run")
+			}
+		})
+	}
+}
+
+var benchSink []byte
+
+func TestTreeRunParallel(t *testing.T) {
+	const n = 64
+	var src, buildOutput strings.Builder
+	src.WriteString("package src\n\nvar sink interface{}\n")
+	for i := 0; i < n; i++ {
+		// Put half of the test cases in a nested group.
+		if i%2 == 0 {
+			fmt.Fprintf(&src, "\n// lem.f%[1]d.name=/group/f%[1]d", i)
+		} else {
+			src.WriteString("\n")
+		}
+		fmt.Fprintf(&src, "\nfunc f%[1]d(x int32) {\n"+
+			"\tsink = x // lem.f%[1]d.m=x escapes to heap\n}\n", i)
+		fmt.Fprintf(&buildOutput,
+			"./src.go:%d:2: x escapes to heap\n", 7+i*5)
+	}
+	testCases, err := getTestCases(t, src.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(parallel bool) []internal.TestCaseResult {
+		var result internal.Result
+		t.Run(fmt.Sprintf("parallel=%v", parallel), func(t *testing.T) {
+			tree := internal.NewTree(testCases...)
+			result = tree.Run(t, internal.Context{
+				Benchmarks: map[string]func(*testing.B){
+					"f1": func(b *testing.B) {},
+				},
+				BuildOutput: buildOutput.String(),
+				Parallel:    parallel,
+			})
+		})
+		return result.TestCases
+	}
+
+	// The results are in the order the test cases were declared, whether
+	// or not they were run in parallel.
+	exp, act := run(false), run(true)
+	if e, a := n, len(act); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	if !reflect.DeepEqual(exp, act) {
+		t.Errorf("expResults=%+v, actResults=%+v", exp, act)
+	}
+	for _, r := range act {
+		if r.Failed {
+			t.Errorf("unexpected failure for %s: %v", r.ID, r.Failures)
+		}
+		var i int
+		fmt.Sscanf(r.ID, "f%d", &i)
+		expPath := []string{r.ID}
+		if i%2 == 0 {
+			expPath = []string{"group", r.ID}
+		}
+		if e, a := expPath, r.Path; !reflect.DeepEqual(e, a) {
+			t.Errorf("expPath=%v, actPath=%v", e, a)
+		}
+	}
+}
+
+// delayReporter delays running the subtests with the specified names.
+type delayReporter struct {
+	internal.Reporter
+	delays map[string]time.Duration
+}
+
+func (r delayReporter) Run(name string, fn func(r internal.Reporter)) bool {
+	time.Sleep(r.delays[name])
+	return r.Reporter.Run(name, func(c internal.Reporter) {
+		fn(delayReporter{Reporter: c, delays: r.delays})
+	})
+}
+
+func TestTreeRunParallelOrder(t *testing.T) {
+	// Ensure the test cases are run at the same time even with one CPU.
+	parallel := flag.Lookup("test.parallel").Value.String()
+	if err := flag.Set("test.parallel", "4"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { flag.Set("test.parallel", parallel) })
+
+	testCases := []internal.TestCase{{ID: "a"}, {ID: "b"}, {ID: "c"}}
+	tree := internal.NewTree(testCases...)
+
+	// The first test cases are delayed the longest, so they finish last.
+	result := tree.RunWithReporter(
+		delayReporter{
+			Reporter: internal.NewTestingReporter(t),
+			delays: map[string]time.Duration{
+				"a": 200 * time.Millisecond,
+				"b": 100 * time.Millisecond,
+			},
+		},
+		internal.Context{Parallel: true})
+
+	var act []string
+	for _, r := range result.TestCases {
+		act = append(act, r.ID)
+	}
+	if e, a := []string{"a", "b", "c"}, act; !reflect.DeepEqual(e, a) {
+		t.Errorf("expIDs=%v, actIDs=%v", e, a)
+	}
+}
+
+func TestTreeRunSortTests(t *testing.T) {
+	testCases := []internal.TestCase{
+		{ID: "z"},
+		{ID: "c", Name: "/grp-b/c"},
+		{ID: "y"},
+		{ID: "a", Name: "/grp-b/a"},
+		{ID: "b", Name: "/grp-a/b"},
+	}
+
+	run := func(sortTests bool) ([]string, *internal.Tree) {
+		var (
+			names []string
+			tree  = internal.NewTree(testCases...)
+		)
+		t.Run(fmt.Sprintf("sort=%v", sortTests), func(t *testing.T) {
+			result := tree.Run(t, internal.Context{SortTests: sortTests})
+			for _, r := range result.TestCases {
+				names = append(names, strings.Join(r.Path, "/"))
+			}
+		})
+		return names, &tree
+	}
+
+	for _, tc := range []struct {
+		sortTests bool
+		exp       []string
+	}{
+		{
+			exp: []string{"grp-b/c", "grp-b/a", "grp-a/b", "z", "y"},
+		},
+		{
+			sortTests: true,
+			exp:       []string{"grp-a/b", "grp-b/a", "grp-b/c", "y", "z"},
+		},
+	} {
+		act, tree := run(tc.sortTests)
+		if !reflect.DeepEqual(tc.exp, act) {
+			t.Errorf("sort=%v: expNames=%v, actNames=%v",
+				tc.sortTests, tc.exp, act)
+		}
+
+		// The test cases are still found by their IDs after being sorted.
+		for _, id := range []string{"a", "b", "c", "y", "z"} {
+			if c := tree.Get(id); c == nil || c.ID != id {
+				t.Errorf("expID=%s, actTestCase=%+v", id, c)
+			}
+		}
+	}
+}
+
+func TestRecord(t *testing.T) {
+	src, err := os.ReadFile(filepath.Join("testdata", "record", "record.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	filePath := filepath.Join(t.TempDir(), "record.go")
+	if err := os.WriteFile(filePath, src, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	observed := map[string][2]int64{
+		"update": {1, 4},
+		"fill":   {1, 8},
+		"code":   {1, 2},
+		"keep":   {2, 16},
+	}
+	record := func() []string {
+		testCases, err := internal.GetTestCases(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree := internal.NewTree(testCases...)
+		var result internal.Result
+		for _, tc := range testCases {
+			result.TestCases = append(result.TestCases, internal.TestCaseResult{
+				ID: tc.ID,
+				Benchmark: &internal.BenchmarkResult{
+					ExpectedAllocOp: tc.AllocOp,
+					ExpectedBytesOp: tc.BytesOp,
+					AllocOp:         observed[tc.ID][0],
+					BytesOp:         observed[tc.ID][1],
+				},
+			})
+		}
+		files, err := internal.Record(internal.Context{}, &tree, result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return files
+	}
+
+	if e, a := []string{filePath}, record(); !reflect.DeepEqual(e, a) {
+		t.Fatalf("expFiles=%v, actFiles=%v", e, a)
+	}
+	exp := strings.NewReplacer(
+		"// lem.update.alloc=0", "// lem.update.alloc=1",
+		"// lem.update.bytes=8-16", "// lem.update.bytes=4",
+		"// lem.fill.alloc=1\n",
+		"// lem.fill.alloc=1\n// lem.fill.bytes=8\n",
+		"\tsink = x // lem.code.name",
+		"\t// lem.code.alloc=1\n\t// lem.code.bytes=2\n"+
+			"\tsink = x // lem.code.name",
+	).Replace(string(src))
+	act, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp != string(act) {
+		t.Errorf("expSrc=%s, actSrc=%s", exp, act)
+	}
+
+	// Recording the same values again does not modify the file.
+	if a := record(); len(a) != 0 {
+		t.Errorf("expFiles=[], actFiles=%v", a)
+	}
+}
+
+func TestTreeRunVerbose(t *testing.T) {
+	// Run a tree with a test case that has a benchmark function.
+	testCases, err := getTestCases(t, `package src
+
+// lem.a.alloc=1
+// lem.a.bytes=64
+func a() {}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mode := range []string{"disabled", "enabled"} {
+		mode := mode
+		t.Run(mode, func(t *testing.T) {
+			tree := internal.NewTree(testCases...)
+			r := runRecorded(&tree, internal.Context{
+				Benchmarks: map[string]func(*testing.B){
+					"a": func(b *testing.B) {
+						for i := 0; i < b.N; i++ {
+							benchSink = make([]byte, 64)
+						}
+					},
+				},
+				Verbose: mode == "enabled",
+			})
+			if r.Failed() {
+				t.Fatalf("unexpected failure\n%s", r)
+			}
+			e, a := "observed: alloc=1, bytes=64\n", r.String()
+			if ok := strings.Contains(a, e); ok != (mode == "enabled") {
+				t.Errorf("expContains(%q)=%v, actOutput=%s", e, !ok, a)
+			}
+		})
+	}
+}
+
+func TestGetBenchmarks(t *testing.T) {
+	fn := func(*testing.B) {}
+	ctx := internal.Context{
+		Benchmarks: map[string]func(*testing.B){
+			"a": fn,
+			"b": fn,
+		},
+		BenchmarksMulti: map[string][]func(*testing.B){
+			"b": {fn, fn},
+			"c": {fn},
+		},
+	}
+	for id, exp := range map[string]int{"a": 1, "b": 3, "c": 1, "d": 0} {
+		if e, a := exp, len(internal.GetBenchmarks(ctx, id)); e != a {
+			t.Errorf("%s: expLen=%d, actLen=%d", id, e, a)
+		}
+	}
+}
+
+func TestRunBenchmarks(t *testing.T) {
+	alloc := func(size int) func(*testing.B) {
+		return func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				benchSink = make([]byte, size)
+			}
+		}
+	}
+	noAlloc := func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			benchSink = nil
+		}
+	}
+
+	testCases := []struct {
+		name     string
+		fns      []func(*testing.B)
+		expAlloc int64
+		expBytes int64
+	}{
+		{
+			name: "none",
+		},
+		{
+			name:     "single",
+			fns:      []func(*testing.B){alloc(64)},
+			expAlloc: 1,
+			expBytes: 64,
+		},
+		{
+			name:     "max of several",
+			fns:      []func(*testing.B){noAlloc, alloc(1024), alloc(64)},
+			expAlloc: 1,
+			expBytes: 1024,
+		},
+	}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			allocOp, bytesOp, _ := internal.RunBenchmarks(tc.fns...)
+			if e, a := tc.expAlloc, allocOp; e != a {
+				t.Errorf("expAlloc=%d, actAlloc=%d", e, a)
+			}
+			if e, a := tc.expBytes, bytesOp; e != a {
+				t.Errorf("expBytes=%d, actBytes=%d", e, a)
+			}
+		})
+	}
+}
+
+func TestGetTestCasesBenchtime(t *testing.T) {
+	testCases := []struct {
+		name   string
+		val    string
+		expErr bool
+	}{
+		{name: "count", val: "100000x"},
+		{name: "duration", val: "2s"},
+		{name: "zero count", val: "0x", expErr: true},
+		{name: "invalid", val: "fast", expErr: true},
+	}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			testCases, err := getTestCases(t, fmt.Sprintf(`package src
+
+// lem.a.benchtime=%s
+`, tc.val))
+			if e, a := tc.expErr, err != nil; e != a {
+				t.Fatalf("expErr=%v, actErr=%v", e, err)
+			}
+			if tc.expErr {
+				return
+			}
+			if e, a := tc.val, testCases[0].Benchtime; e != a {
+				t.Errorf("expBenchtime=%s, actBenchtime=%s", e, a)
+			}
+		})
+	}
+}
+
+func TestWithBenchtime(t *testing.T) {
+	f := flag.Lookup("test.benchtime")
+	if f == nil {
+		t.Skip("test.benchtime flag is not defined")
+	}
+	og := f.Value.String()
+
+	var maxN int
+	if err := internal.WithBenchtime("7x", func() {
+		internal.RunBenchmarks(func(b *testing.B) {
+			if b.N > maxN {
+				maxN = b.N
+			}
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 7, maxN; e != a {
+		t.Errorf("expN=%d, actN=%d", e, a)
+	}
+	if e, a := og, f.Value.String(); e != a {
+		t.Errorf("expBenchtime=%s, actBenchtime=%s", e, a)
+	}
+
+	func() {
+		defer func() { _ = recover() }()
+		_ = internal.WithBenchtime("5x", func() { panic("boom") })
+	}()
+	if e, a := og, f.Value.String(); e != a {
+		t.Errorf("after panic: expBenchtime=%s, actBenchtime=%s", e, a)
+	}
+}
+
+var benchmemSink *[64]byte
+
+func TestTreeRunWithoutBenchmem(t *testing.T) {
+	f := flag.Lookup("test.benchmem")
+	if f == nil {
+		t.Skip("test.benchmem flag is not defined")
+	}
+
+	// The allocations are asserted even though -benchmem is disabled, since
+	// testing.Benchmark always reads the memory statistics.
+	og := f.Value.String()
+	if err := f.Value.Set("false"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Value.Set(og) })
+
+	testCases, err := getTestCases(t, `package src
+
+// lem.a.alloc=1
+// lem.a.bytes=64
+// lem.a.benchtime=100x
+func a() {}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree := internal.NewTree(testCases...)
+	result := tree.Run(t, internal.Context{
+		Benchmarks: map[string]func(*testing.B){
+			"a": func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					benchmemSink = new([64]byte)
+				}
+			},
+		},
+	})
+	if result.Failed() {
+		t.Fatal("result should not have failed")
+	}
+
+	br := result.TestCases[0].Benchmark
+	if br == nil {
+		t.Fatal("benchmark result is nil")
+	}
+	if e, a := int64(1), br.AllocOp; e != a {
+		t.Errorf("expAlloc=%d, actAlloc=%d", e, a)
+	}
+	if e, a := int64(64), br.BytesOp; e != a {
+		t.Errorf("expBytes=%d, actBytes=%d", e, a)
+	}
+}
+
+func TestWithGOMAXPROCS(t *testing.T) {
+	og := runtime.GOMAXPROCS(0)
+	pinned := og + 1
+
+	var procs int
+	var allocOp int64
+	internal.WithGOMAXPROCS(pinned, func() {
+		allocOp, _, _ = internal.RunBenchmarks(func(b *testing.B) {
+			procs = runtime.GOMAXPROCS(0)
+			b.RunParallel(func(pb *testing.PB) {
+				var sink *int64
+				for pb.Next() {
+					sink = new(int64)
+				}
+				_ = sink
+			})
+		})
+	})
+	if e, a := pinned, procs; e != a {
+		t.Errorf("expGOMAXPROCS=%d, actGOMAXPROCS=%d", e, a)
+	}
+	if e, a := int64(1), allocOp; e != a {
+		t.Errorf("expAlloc=%d, actAlloc=%d", e, a)
+	}
+	if e, a := og, runtime.GOMAXPROCS(0); e != a {
+		t.Errorf("after: expGOMAXPROCS=%d, actGOMAXPROCS=%d", e, a)
+	}
+}
+
+func TestGetTestCasesEnv(t *testing.T) {
+	testCases, err := getTestCases(t, `package src
+
+// lem.a.env=GOMAXPROCS=1
+// lem.a.env=LEM_TEST_VAR=x=y
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 1, len(testCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	exp := map[string]string{"GOMAXPROCS": "1", "LEM_TEST_VAR": "x=y"}
+	if e, a := exp, testCases[0].Env; !reflect.DeepEqual(e, a) {
+		t.Errorf("expEnv=%v, actEnv=%v", e, a)
+	}
+
+	for name, src := range map[string]string{
+		"invalid GOMAXPROCS": "// lem.a.env=GOMAXPROCS=0\n",
+		"duplicate": "// lem.a.env=LEM_TEST_VAR=1\n" +
+			"// lem.a.env=LEM_TEST_VAR=2\n",
+		"missing value": "// lem.a.env=LEM_TEST_VAR\n",
+	} {
+		if _, err := getTestCases(t, "package src\n\n"+src); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestWithEnv(t *testing.T) {
+	const name = "LEM_TEST_WITH_ENV"
+	og := runtime.GOMAXPROCS(0)
+	pinned := og + 1
+	os.Unsetenv(name)
+
+	var (
+		procs int
+		val   string
+	)
+	if err := internal.WithEnv(map[string]string{
+		"GOMAXPROCS": strconv.Itoa(pinned),
+		name:         "hello",
+	}, func() {
+		internal.RunBenchmarks(func(b *testing.B) {
+			procs = runtime.GOMAXPROCS(0)
+			val = os.Getenv(name)
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := pinned, procs; e != a {
+		t.Errorf("expGOMAXPROCS=%d, actGOMAXPROCS=%d", e, a)
+	}
+	if e, a := "hello", val; e != a {
+		t.Errorf("expEnv=%s, actEnv=%s", e, a)
+	}
+	if e, a := og, runtime.GOMAXPROCS(0); e != a {
+		t.Errorf("after: expGOMAXPROCS=%d, actGOMAXPROCS=%d", e, a)
+	}
+	if _, ok := os.LookupEnv(name); ok {
+		t.Errorf("after: %s should be unset", name)
+	}
+
+	// The original values are restored even if fn panics.
+	t.Setenv(name, "og")
+	func() {
+		defer func() { _ = recover() }()
+		_ = internal.WithEnv(map[string]string{
+			"GOMAXPROCS": strconv.Itoa(pinned),
+			name:         "hello",
+		}, func() { panic("boom") })
+	}()
+	if e, a := og, runtime.GOMAXPROCS(0); e != a {
+		t.Errorf("after panic: expGOMAXPROCS=%d, actGOMAXPROCS=%d", e, a)
+	}
+	if e, a := "og", os.Getenv(name); e != a {
+		t.Errorf("after panic: expEnv=%s, actEnv=%s", e, a)
+	}
+
+	// An invalid GOMAXPROCS is an error and fn is not called.
+	var called bool
+	if err := internal.WithEnv(
+		map[string]string{"GOMAXPROCS": "x"},
+		func() { called = true }); err == nil {
+		t.Error("expected error for invalid GOMAXPROCS")
+	}
+	if called {
+		t.Error("fn should not be called")
+	}
+}
+
+func TestTreeRunEnv(t *testing.T) {
+	og := runtime.GOMAXPROCS(0)
+	testCases, err := getTestCases(t, `package src
+
+// lem.a.env=GOMAXPROCS=1
+// lem.b.name=b
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The test case's GOMAXPROCS takes precedence over the context's.
+	procs := map[string]int{}
+	tree := internal.NewTree(testCases...)
+	result := tree.Run(t, internal.Context{
+		BenchmarkGOMAXPROCS: og + 1,
+		Benchmarks: map[string]func(*testing.B){
+			"a": func(b *testing.B) { procs["a"] = runtime.GOMAXPROCS(0) },
+			"b": func(b *testing.B) { procs["b"] = runtime.GOMAXPROCS(0) },
+		},
+	})
+	if result.Failed() {
+		t.Fatal("result should not have failed")
+	}
+	if e, a := 1, procs["a"]; e != a {
+		t.Errorf("a: expGOMAXPROCS=%d, actGOMAXPROCS=%d", e, a)
+	}
+	if e, a := og+1, procs["b"]; e != a {
+		t.Errorf("b: expGOMAXPROCS=%d, actGOMAXPROCS=%d", e, a)
+	}
+	if e, a := og, runtime.GOMAXPROCS(0); e != a {
+		t.Errorf("after: expGOMAXPROCS=%d, actGOMAXPROCS=%d", e, a)
+	}
+}
+
+func TestGetTestCasesMetric(t *testing.T) {
+	testCases, err := getTestCases(t, `package src
+
+// lem.a.metric:copies/op=<=2
+// lem.a.metric:hits=10-20
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 1, len(testCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	tc := testCases[0]
+	if !tc.HasBenchmark() {
+		t.Error("expected metric directive to require a benchmark")
+	}
+	for name, exp := range map[string]string{
+		"copies/op": "<=2",
+		"hits":      "10-20",
+	} {
+		if e, a := exp, tc.Metrics[name].String(); e != a {
+			t.Errorf("%s: expMetric=%s, actMetric=%s", name, e, a)
+		}
+	}
+}
+
+func TestRunBenchmarksMetrics(t *testing.T) {
+	report := func(v float64) func(*testing.B) {
+		return func(b *testing.B) {
+			b.ReportMetric(v, "copies/op")
+		}
+	}
+	_, _, extra := internal.RunBenchmarks(report(1), report(3), report(2))
+	if e, a := 3.0, extra["copies/op"]; e != a {
+		t.Errorf("expMetric=%v, actMetric=%v", e, a)
+	}
+	if _, ok := extra["hits"]; ok {
+		t.Error("unexpected metric hits")
+	}
+}
+
+func TestTreeRunMetricNotReported(t *testing.T) {
+	// Run a tree with a test case that asserts a metric its benchmark never
+	// reports.
+	testCases, err := getTestCases(t, `package src
+
+// lem.a.metric:copies/op=0
+func a() {}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := internal.NewTree(testCases...)
+	r := runRecorded(&tree, internal.Context{
+		Benchmarks: map[string]func(*testing.B){
+			"a": func(*testing.B) {},
+		},
+	})
+	if !r.Failed() {
+		t.Fatalf("expected failure\n%s", r)
+	}
+	e, a := "metric copies/op was not reported by the benchmark", r.String()
+	if !strings.Contains(a, e) {
+		t.Errorf("expOutput=%s, actOutput=%s", e, a)
+	}
+}
+
+var toleranceSink []byte
+
+func TestTreeRunTolerance(t *testing.T) {
+	// Run a tree whose benchmarks make ten allocations of 64 bytes per
+	// operation with the given tolerance.
+	testCases, err := getTestCases(t, `package src
+
+// lem.a.alloc=9
+// lem.a.bytes=640
+// lem.a.benchtime=100x
+func a() {}
+
+// lem.b.alloc=8~5%
+// lem.b.bytes=640
+// lem.b.benchtime=100x
+func b() {}
+
+// lem.c.alloc=10
+// lem.c.bytes=600
+// lem.c.benchtime=100x
+func c() {}
+
+// lem.d.alloc=<=9
+// lem.d.bytes=640
+// lem.d.benchtime=100x
+func d() {}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bench := func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for j := 0; j < 10; j++ {
+				toleranceSink = make([]byte, 64)
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		tolerance float64
+		expFailed map[string]bool
+		exp       string
+	}{
+		{
+			tolerance: 0,
+			expFailed: map[string]bool{"a": true, "b": true, "c": true, "d": true},
+			exp:       "expected: 9\n",
+		},
+		{
+			tolerance: 20,
+			expFailed: map[string]bool{"a": false, "b": true, "c": false, "d": true},
+			exp:       "expected: 8±5% (7-9, rounded outward)\n",
+		},
+		{
+			tolerance: 150,
+			exp:       "invalid tolerance 150%",
+		},
+	} {
+		tc := tc
+		t.Run(strconv.FormatFloat(tc.tolerance, 'f', -1, 64), func(t *testing.T) {
+			tree := internal.NewTree(testCases...)
+			r := runRecorded(&tree, internal.Context{
+				Benchmarks: map[string]func(*testing.B){
+					"a": bench, "b": bench, "c": bench, "d": bench,
+				},
+				Tolerance: tc.tolerance,
+			})
+			if !r.Failed() {
+				t.Fatalf("expected failure\n%s", r)
+			}
+			for id, exp := range tc.expFailed {
+				if a := r.sub(id).Failed(); exp != a {
+					t.Errorf("%s: expFailed=%v, actFailed=%v", id, exp, a)
+				}
+			}
+			if a := r.String(); !strings.Contains(a, tc.exp) {
+				t.Errorf("expOutput=%s, actOutput=%s", tc.exp, a)
+			}
+		})
+	}
+}
+
+func TestResultSummary(t *testing.T) {
+	result := internal.Result{
+		TestCases: []internal.TestCaseResult{
+			{ID: "a"},
+			{
+				ID:     "b",
+				Failed: true,
+				Failures: []string{
+					"error: build optimization\nreason: not found\nregexp: x\n",
+					"exp.framesize=8, act.framesize=16",
+				},
+			},
+			{ID: "c", Skipped: true, SkipReason: "skipped by lem.c.skip"},
+			{
+				ID:       "d",
+				Failed:   true,
+				Failures: []string{"error: vet\nregexp: y\n"},
+			},
+			{ID: "e"},
+		},
+	}
+	exp := `summary: 5 test case(s), 2 passed, 2 failed, 1 skipped
+failed:
+	b: build optimization: not found; exp.framesize=8, act.framesize=16
+	d: vet
+`
+	if e, a := exp, result.Summary(); e != a {
+		t.Errorf("exp=%s, act=%s", e, a)
+	}
+
+	// The failed IDs are omitted if there are no failures.
+	result.TestCases = result.TestCases[:1]
+	exp = "summary: 1 test case(s), 1 passed, 0 failed, 0 skipped\n"
+	if e, a := exp, result.Summary(); e != a {
+		t.Errorf("exp=%s, act=%s", e, a)
+	}
+}
+
+func TestColorize(t *testing.T) {
+	const msg = `error: build optimization
+reason: was found
+output: ./src.go:9:2: x escapes to heap
+regexp: x escapes
+source: 	sink = x // lem.a.m!=x escapes
+`
+	lm := internal.LineMatcher{File: "src.go", Line: 9}
+	exp := "\x1b[1;31merror:\x1b[0m build optimization\n" +
+		"\x1b[1;36mreason:\x1b[0m was found\n" +
+		"\x1b[1;36moutput:\x1b[0m ./src.go:9:2: x escapes to heap\n" +
+		"\x1b[1;36mregexp:\x1b[0m x escapes\n" +
+		"\x1b[1;36msource:\x1b[0m \t\x1b[1;4;33msink\x1b[0m = x // lem.a.m!=x escapes\n"
+	if e, a := exp, internal.Colorize(msg, lm); e != a {
+		t.Errorf("exp=%q, act=%q", e, a)
+	}
+
+	// The source is not highlighted if the output is for another line.
+	lm.Line = 10
+	if a := internal.Colorize(msg, lm); !strings.Contains(
+		a, "source:\x1b[0m \tsink = x") {
+		t.Errorf("unexpected highlight: %q", a)
+	}
+}
+
+func TestTreeRunNoColor(t *testing.T) {
+	// Run a tree with a failed match.
+	testCases, err := getTestCases(t, `package src
+
+var sink interface{}
+
+func a(x int32) {
+	sink = x // lem.a.m=x leaks to heap
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Color is never used when stdout is not a terminal, so replace it
+	// with a file while the tree is run.
+	f, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	stdout := os.Stdout
+	os.Stdout = f
+	defer func() { os.Stdout = stdout }()
+
+	for _, v := range []string{"disabled", "enabled"} {
+		v := v
+		t.Run(v, func(t *testing.T) {
+			tree := internal.NewTree(testCases...)
+			r := runRecorded(&tree, internal.Context{
+				BuildOutput: "./src.go:6:2: x escapes to heap\n",
+				Color:       v == "enabled",
+			})
+			if !r.Failed() {
+				t.Fatalf("expected failure\n%s", r)
+			}
+			act := r.String()
+			if !strings.Contains(act, "error: build optimization") {
+				t.Fatalf("expected failure message\n%s", act)
+			}
+			if strings.Contains(act, "\x1b[") {
+				t.Errorf("unexpected escape codes\n%q", act)
+			}
+		})
+	}
+
+	if internal.NewColorizer(false) {
+		t.Error("color should be disabled")
+	}
+	t.Setenv("NO_COLOR", "1")
+	if internal.NewColorizer(true) {
+		t.Error("color should be disabled by NO_COLOR")
+	}
+}
+
+func TestLineMatcherFindLineOutput(t *testing.T) {
+	const buildOutput = `./src.go:9:2: x escapes to heap
+./src.go:9:7: y does not escape
+/tmp/src/xsrc.go:9:2: z escapes to heap
+./src.go:19:2: w escapes to heap
+`
+	lm := internal.LineMatcher{File: "src.go", Line: 9}
+	exp := []string{
+		"./src.go:9:2: x escapes to heap",
+		"./src.go:9:7: y does not escape",
+	}
+	if e, a := exp, lm.FindLineOutput(buildOutput); !reflect.DeepEqual(e, a) {
+		t.Errorf("expOutput=%v, actOutput=%v", e, a)
+	}
+	lm.Line = 10
+	if a := lm.FindLineOutput(buildOutput); len(a) != 0 {
+		t.Errorf("expOutput=[], actOutput=%v", a)
+	}
+}
+
+func TestTreeRunMatchNotFound(t *testing.T) {
+	// Run a tree with a match that does not appear in the build output.
+	testCases, err := getTestCases(t, `package src
+
+var sink interface{}
+
+func a(x int32) {
+	sink = x // lem.a.m=x leaks to heap
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		mode        string
+		buildOutput string
+		exp         string
+		notExp      string
+	}{
+		{
+			mode:        "line output",
+			buildOutput: "./src.go:6:2: x escapes to heap\n",
+			exp:         "output for line:\n\t./src.go:6:2: x escapes to heap\n",
+		},
+		{
+			mode:   "no line output",
+			exp:    "reason: not found\n",
+			notExp: "output for line:",
+		},
+	} {
+		tc := tc
+		t.Run(tc.mode, func(t *testing.T) {
+			tree := internal.NewTree(testCases...)
+			r := runRecorded(&tree, internal.Context{
+				BuildOutput: tc.buildOutput,
+			})
+			if !r.Failed() {
+				t.Fatalf("expected failure\n%s", r)
+			}
+			act := r.String()
+			if !strings.Contains(act, tc.exp) {
+				t.Errorf("expOutput=%s, actOutput=%s", tc.exp, act)
+			}
+			if tc.notExp != "" && strings.Contains(act, tc.notExp) {
+				t.Errorf("unexpected output %s", tc.notExp)
+			}
+			// The failure includes the file and line of the matcher.
+			if e := "file:   src.go:6\nsource: "; !strings.Contains(act, e) {
+				t.Errorf("expOutput=%s, actOutput=%s", e, act)
+			}
+		})
+	}
+}
+
+func TestGetTestCasesSeq(t *testing.T) {
+	testCases, err := getTestCases(t, `package src
+
+var sink interface{}
+
+// lem.a.mseq@+2=leaking param: p
+// lem.a.mseq@+1=p escapes to heap
+func a(p *int32) {
+	sink = p // lem.a.mseq=other
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 1, len(testCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	seqs := testCases[0].Seqs
+	if e, a := 2, len(seqs); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	exp := [][]string{
+		{
+			`(?m)^(?:.*[/\\])?src\.go:7:\d+: leaking param: p$`,
+			`(?m)^(?:.*[/\\])?src\.go:7:\d+: p escapes to heap$`,
+		},
+		{
+			`(?m)^(?:.*[/\\])?src\.go:8:\d+: other$`,
+		},
+	}
+	for i := range exp {
+		if e, a := len(exp[i]), len(seqs[i]); e != a {
+			t.Fatalf("expLen=%d, actLen=%d", e, a)
+		}
+		for j := range exp[i] {
+			if e, a := exp[i][j], seqs[i][j].Regexp.String(); e != a {
+				t.Errorf("expRegexp=%s, actRegexp=%s", e, a)
+			}
+		}
+	}
+}
+
+func TestTreeRunSeq(t *testing.T) {
+	testCases, err := getTestCases(t, `package src
+
+var sink interface{}
+
+func a(p *int32) {
+	// lem.a.mseq@+2=leaking param: p
+	// lem.a.mseq@+1=p escapes to heap
+	sink = p
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := internal.NewTree(testCases...)
+	result := tree.Run(t, internal.Context{
+		BuildOutput: "./src.go:8:2: leaking param: p\n" +
+			"./src.go:8:7: p escapes to heap\n",
+	})
+	if result.Failed() {
+		t.Fatal("result should not have failed")
+	}
+	if e, a := 2, len(result.TestCases[0].Seqs); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	for i, e := range []string{
+		"./src.go:8:2: leaking param: p",
+		"./src.go:8:7: p escapes to heap",
+	} {
+		if a := result.TestCases[0].Seqs[i].Output; e != a {
+			t.Errorf("expOutput=%s, actOutput=%s", e, a)
+		}
+	}
+
+	for _, x := range []struct {
+		mode        string
+		buildOutput string
+		exp         string
+	}{
+		{
+			mode: "out of order",
+			buildOutput: "./src.go:8:7: p escapes to heap\n" +
+				"./src.go:8:2: leaking param: p\n",
+			exp: "reason: out of order\n" +
+				"regexp: (?m)^(?:.*[/\\\\])?src\\.go:8:\\d+: p escapes to heap$\n" +
+				"after:  (?m)^(?:.*[/\\\\])?src\\.go:8:\\d+: leaking param: p$\n",
+		},
+		{
+			mode:        "not found",
+			buildOutput: "./src.go:8:2: leaking param: p\n",
+			exp:         "reason: not found\n",
+		},
+	} {
+		x := x
+		t.Run(x.mode, func(t *testing.T) {
+			tree := internal.NewTree(testCases...)
+			r := runRecorded(&tree, internal.Context{
+				BuildOutput: x.buildOutput,
+			})
+			if !r.Failed() {
+				t.Fatalf("expected failure\n%s", r)
+			}
+			if act := r.String(); !strings.Contains(act, x.exp) {
+				t.Errorf("expOutput=%s, actOutput=%s", x.exp, act)
+			}
+		})
+	}
+}
+
+func TestGetBenchmarkErr(t *testing.T) {
+	testCases := []struct {
+		name string
+		kind string
+		exp  string
+		rng  internal.Int64Range
+		act  int64
+	}{
+		{
+			name: "exact",
+			kind: "alloc",
+			rng:  internal.Int64Range{Min: 2, Max: 2},
+			act:  3,
+			exp: `error: benchmark
+reason: alloc mismatch
+path: a/to sink
+bench: mem_test.escape1
+expected: 2
+actual: 3
+delta: +1
+`,
+		},
+		{
+			name: "range",
+			kind: "bytes",
+			rng:  internal.Int64Range{Min: 16, Max: 32},
+			act:  8,
+			exp: `error: benchmark
+reason: bytes mismatch
+path: a/to sink
+bench: mem_test.escape1
+expected: 16-32
+actual: 8
+delta: -8
+`,
+		},
+		{
+			name: "open range",
+			kind: "alloc",
+			rng:  internal.Int64Range{Max: 2, Op: "<"},
+			act:  4,
+			exp: `error: benchmark
+reason: alloc mismatch
+path: a/to sink
+bench: mem_test.escape1
+expected: <2
+actual: 4
+delta: +2
+`,
+		},
+	}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			act := internal.GetBenchmarkErr(
+				tc.kind,
+				[]string{"a", "to sink"},
+				[]string{"mem_test.escape1"},
+				tc.rng,
+				tc.act)
+			if e, a := tc.exp, act; e != a {
+				t.Errorf("expErr=%s\nactErr=%s", e, a)
+			}
+		})
+	}
+}
+
+func TestGetTestCasesUnknownDirective(t *testing.T) {
+	testCases := []struct {
+		name string
+		src  string
+		exp  string
+	}{
+		{
+			name: "allocs",
+			src:  "// lem.a.allocs=2",
+			exp:  "unknown lem.a.allocs directive at ",
+		},
+		{
+			name: "byte",
+			src:  "// lem.a.byte=16",
+			exp:  "unknown lem.a.byte directive at ",
+		},
+		{
+			name: "match",
+			src:  "// lem.a.match=x escapes to heap",
+			exp:  "unknown lem.a.match directive at ",
+		},
+		{
+			name: "no-alloc",
+			src:  "// lem.a.no_alloc",
+			exp:  "unknown lem.a.no_alloc directive at ",
+		},
+		{
+			name: "invalid alloc",
+			src:  "// lem.a.alloc=two",
+			exp:  "invalid lem.a.alloc directive at ",
+		},
+		{
+			name: "name without value",
+			src:  "// lem.a.name",
+			exp:  "invalid lem.a.name directive at ",
+		},
+		{
+			name: "noruntime with unknown suffix",
+			src:  "// lem.a.noruntime-allocs",
+			exp:  "invalid lem.a.noruntime directive at ",
+		},
+		{
+			name: "alloc with offset",
+			src:  "// lem.a.alloc@+1=2",
+			exp:  "invalid lem.a.alloc directive at ",
+		},
+		{
+			name: "metric without value",
+			src:  "// lem.a.metric:ns/op",
+			exp:  "invalid lem.a.metric directive at ",
+		},
+		{
+			name: "alloc with operator typo",
+			src:  "// lem.a.alloc<=1",
+			exp:  "invalid lem.a.alloc directive at ",
+		},
+		{
+			name: "alloc with spaces",
+			src:  "// lem.a.alloc = 2",
+			exp:  "invalid lem.a.alloc directive at ",
+		},
+		{
+			name: "match with space",
+			src:  "// lem.a.m =foo",
+			exp:  "invalid lem.a.m directive at ",
+		},
+		{
+			name: "bytes with tolerance typo",
+			src:  "// lem.a.bytes~16",
+			exp:  "invalid lem.a.bytes directive at ",
+		},
+		{
+			name: "natch with misplaced offset",
+			src:  "// lem.a.m!@+1=x",
+			exp:  "invalid lem.a.m directive at ",
+		},
+	}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := getTestCases(t, "package src\n\n"+tc.src+"\n")
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if e, a := tc.exp, err.Error(); !strings.Contains(a, e) {
+				t.Errorf("expErr=%s, actErr=%s", e, a)
+			}
+			if e, a := "src.go:3", err.Error(); !strings.Contains(a, e) {
+				t.Errorf("expPos=%s, actErr=%s", e, a)
+			}
+		})
+	}
+
+	// Comments that merely mention lem are not directives.
+	if _, err := getTestCases(t, `package src
+
+// lem.Run(t) runs the tests.
+// lem.RunWithContext(t, lem.Context{})
+// lem.Context.Filter controls which test cases are run.
+// lem.Context.BuildTags.
+`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetTestCasesInvalidRegexp(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		src  string
+		exp  string
+	}{
+		{
+			name: "match",
+			src:  "var x = 1 // lem.a.m=(unclosed",
+			exp:  "invalid regexp for lem.a.m at ",
+		},
+		{
+			name: "match with offset",
+			src:  "// lem.a.m@+1=(unclosed\nvar x = 1",
+			exp:  "invalid regexp for lem.a.m at ",
+		},
+		{
+			name: "natch",
+			src:  "var x = 1 // lem.a.m!=[unclosed",
+			exp:  "invalid regexp for lem.a.m at ",
+		},
+		{
+			name: "mseq",
+			src:  "var x = 1 // lem.a.mseq=(unclosed",
+			exp:  "invalid regexp for lem.a.mseq at ",
+		},
+		{
+			name: "mblock",
+			src:  "var x = 1 // lem.a.mblock=(unclosed",
+			exp:  "invalid regexp for lem.a.mblock at ",
+		},
+		{
+			name: "none",
+			src:  "// lem.a.none=(unclosed",
+			exp:  "invalid regexp for lem.a.none at ",
+		},
+		{
+			name: "vet",
+			src:  "var x = 1 // lem.a.vet=(unclosed",
+			exp:  "invalid regexp for lem.a.vet at ",
+		},
+		{
+			name: "mcount",
+			src:  "var x = 1 // lem.a.mcount=(unclosed:1",
+			exp:  "invalid regexp for lem.a.mcount at ",
+		},
+		{
+			name: "fn",
+			src:  "// lem.a.fn=(unclosed\nfunc a() {}",
+			exp:  "invalid regexp for lem.a.fn at ",
+		},
+		{
+			name: "asm",
+			src:  "// lem.a.asm=(unclosed\nfunc a() {}",
+			exp:  "invalid regexp for lem.a.asm at ",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := getTestCases(t, "package src\n\n"+tc.src+"\n")
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if e, a := tc.exp, err.Error(); !strings.Contains(a, e) {
+				t.Errorf("expErr=%s, actErr=%s", e, a)
+			}
+			if e, a := "src.go:3:", err.Error(); !strings.Contains(a, e) {
+				t.Errorf("expPos=%s, actErr=%s", e, a)
+			}
+			var syntaxErr *syntax.Error
+			if !errors.As(err, &syntaxErr) {
+				t.Errorf("expected a wrapped *syntax.Error, actErr=%v", err)
+			}
+		})
+	}
+}
+
+func TestGetTestCasesQuotedValue(t *testing.T) {
+	testCases, err := getTestCases(t, "package src\n"+
+		"\n"+
+		"var sink interface{}\n"+
+		"\n"+
+		"func a(y int32) {\n"+
+		"\tsink = y // lem.a.m=\"  flow: \\\\{heap\\\\}.*\"\n"+
+		"}\n"+
+		"\n"+
+		"func b(y int32) {\n"+
+		"\tsink = y // lem.b.m=`    from y \\(spill\\).*`  \n"+
+		"}\n"+
+		"\n"+
+		"func c(y int32) {\n"+
+		"\tsink = y // lem.c.m=y escapes to heap \t\n"+
+		"}\n"+
+		"\n"+
+		"func d(y int32) {\n"+
+		"\tsink = y // lem.d.m=\"y\" escapes to \"heap\"\n"+
+		"}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 4, len(testCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	for _, tc := range []struct {
+		id      string
+		matches map[string]bool
+	}{
+		{
+			id: "a",
+			matches: map[string]bool{
+				"./src.go:6:9:   flow: {heap} ← &{storage for y}:":  true,
+				"./src.go:6:9: flow: {heap} ← &{storage for y}:":    false,
+				"./src.go:6:9:    flow: {heap} ← &{storage for y}:": false,
+			},
+		},
+		{
+			id: "b",
+			matches: map[string]bool{
+				"./src.go:10:9:     from y (spill) at ./src.go:10:9": true,
+				"./src.go:10:9: from y (spill) at ./src.go:10:9":     false,
+			},
+		},
+		{
+			id: "c",
+			matches: map[string]bool{
+				"./src.go:14:9: y escapes to heap":  true,
+				"./src.go:14:9: y escapes to heap ": false,
+			},
+		},
+		{
+			id: "d",
+			matches: map[string]bool{
+				`./src.go:18:9: "y" escapes to "heap"`: true,
+				"./src.go:18:9: y escapes to heap":     false,
+			},
+		},
+	} {
+		var found bool
+		for _, ltc := range testCases {
+			if ltc.ID != tc.id {
+				continue
+			}
+			found = true
+			if e, a := 1, len(ltc.Matches); e != a {
+				t.Fatalf("%s: expLen=%d, actLen=%d", tc.id, e, a)
+			}
+			for output, exp := range tc.matches {
+				if a := ltc.Matches[0].Regexp.MatchString(output); exp != a {
+					t.Errorf("%s: %q: exp=%v, act=%v", tc.id, output, exp, a)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("test case %s not found", tc.id)
+		}
+	}
+
+	_, err = getTestCases(t, "package src\n\n// lem.a.none=\"\\q\"\n")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if e, a := "invalid quoted value for lem.a.none at ",
+		err.Error(); !strings.Contains(a, e) {
+		t.Errorf("expErr=%s, actErr=%s", e, a)
+	}
+	if e, a := "src.go:3:", err.Error(); !strings.Contains(a, e) {
+		t.Errorf("expPos=%s, actErr=%s", e, a)
+	}
+}
+
+func TestGetTestCasesMatchOffset(t *testing.T) {
+	testCases, err := getTestCases(t, `package src
+
+var sink interface{}
+
+func a(x, y int32) {
+	// lem.a.m@+1=x escapes to heap
+	sink = x
+	sink = y
+	// lem.a.m@-1!=y does not escape
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 1, len(testCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	tc := testCases[0]
+	if e, a := 1, len(tc.Matches); e != a {
+		t.Fatalf("expMatches=%d, actMatches=%d", e, a)
+	}
+	if e, a := 7, tc.Matches[0].Line; e != a {
+		t.Errorf("expMatchLine=%d, actMatchLine=%d", e, a)
+	}
+	if e, a := "\tsink = x", tc.Matches[0].Source; e != a {
+		t.Errorf("expMatchSource=%q, actMatchSource=%q", e, a)
+	}
+	if !tc.Matches[0].Regexp.MatchString("./src.go:7:2: x escapes to heap") {
+		t.Errorf("unexpected match regexp %s", tc.Matches[0].Regexp)
+	}
+	if e, a := 1, len(tc.Natches); e != a {
+		t.Fatalf("expNatches=%d, actNatches=%d", e, a)
+	}
+	if e, a := 8, tc.Natches[0].Line; e != a {
+		t.Errorf("expNatchLine=%d, actNatchLine=%d", e, a)
+	}
+
+	for _, offset := range []string{"-9", "+9"} {
+		_, err := getTestCases(t, fmt.Sprintf(`package src
+
+// lem.a.m@%s=escapes
+`, offset))
+		if err == nil {
+			t.Errorf("expected error for out-of-range offset %s", offset)
+		} else if e, a := "out of range", err.Error(); !strings.Contains(a, e) {
+			t.Errorf("expErr=%s, actErr=%s", e, a)
+		}
+	}
+}
+
+func TestGetTestCasesFunc(t *testing.T) {
+	_, err := getTestCases(t, `package src
+
+// lem.a.fn=escapes
+`)
+	if err == nil {
+		t.Fatal("expected error for fn directive outside of a function")
+	}
+
+	testCases, err := getTestCases(t, `package src
+
+var sink interface{}
+
+// lem.a.fn=moved to heap: v
+func a(x int32) {
+	v := 1
+	sink = func() *int { return &v }()
+}
+
+func b() {
+	v := 2
+	sink = &v
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 1, len(testCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	lm := testCases[0].Matches[0]
+	if e, a := 6, lm.Line; e != a {
+		t.Errorf("expLine=%d, actLine=%d", e, a)
+	}
+	for _, x := range []struct {
+		output string
+		match  bool
+	}{
+		{"./src.go:7:2: moved to heap: v", true},
+		{"./src.go:9:1: moved to heap: v", true},
+		{"./src.go:5:1: moved to heap: v", false},
+		{"./src.go:12:2: moved to heap: v", false},
+	} {
+		if e, a := x.match, lm.Regexp.MatchString(x.output); e != a {
+			t.Errorf("%s: expMatch=%v, actMatch=%v", x.output, e, a)
+		}
+	}
+}
+
+func TestGetTestCasesCount(t *testing.T) {
+	const src = `package src
+
+var sink1, sink2 interface{}
+
+func a(x, y int32) {
+	sink1, sink2 = x, y // lem.a.mcount=\w escapes to heap:2
+	sink1 = &x          // lem.a.mcount=leaking param: x:0
+}
+`
+	testCases, err := getTestCases(t, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := testCases[0]
+	if e, a := 2, len(tc.Counts); e != a {
+		t.Fatalf("expCounts=%d, actCounts=%d", e, a)
+	}
+	if e, a := "2", tc.Counts[0].Count.String(); e != a {
+		t.Errorf("expCount=%s, actCount=%s", e, a)
+	}
+	if e, a := "0", tc.Counts[1].Count.String(); e != a {
+		t.Errorf("expCount=%s, actCount=%s", e, a)
+	}
+
+	const buildOutput = `./src.go:6:17: x escapes to heap
+./src.go:6:20: y escapes to heap
+`
+	tree := internal.NewTree(testCases...)
+	result := tree.Run(t, internal.Context{BuildOutput: buildOutput})
+	if result.Failed() {
+		t.Fatal("result should not have failed")
+	}
+	counts := result.TestCases[0].Counts
+	if e, a := int64(2), *counts[0].Count; e != a {
+		t.Errorf("expCount=%d, actCount=%d", e, a)
+	}
+	if e, a := int64(0), *counts[1].Count; e != a {
+		t.Errorf("expCount=%d, actCount=%d", e, a)
+	}
+
+	// Run the tree with build output that includes a leak on the line
+	// where none are expected.
+	r := runRecorded(&tree, internal.Context{
+		BuildOutput: buildOutput + "./src.go:7:2: leaking param: x\n",
+	})
+	if !r.Failed() {
+		t.Fatalf("expected failure\n%s", r)
+	}
+	e, a := "reason: count mismatch", r.String()
+	if !strings.Contains(a, e) {
+		t.Errorf("expOutput=%s, actOutput=%s", e, a)
+	}
+}
+
+func TestBuildWithMFlagLevel(t *testing.T) {
+	pkg, err := build.Import(
+		"github.com/akutz/lem/internal/testdata/mflag", ".", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name          string
+		level         int
+		compilerFlags []string
+		expRicher     bool
+	}{
+		{name: "default"},
+		{name: "level one", level: 1},
+		{name: "level two", level: 2, expRicher: true},
+		{
+			name:          "level two w -m in compiler flags",
+			level:         2,
+			compilerFlags: []string{"-m", "-m=3"},
+			expRicher:     true,
+		},
+	}
+
+	richerRx := regexp.MustCompile(`(?m)^.*mflag.go:\d+:\d+: can inline add with cost \d+`)
+	inlineRx := regexp.MustCompile(`(?m)^.*mflag.go:\d+:\d+: can inline add`)
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			var w bytes.Buffer
+			if err := internal.Build(&w, *pkg, internal.Context{
+				CompilerFlags:     tc.compilerFlags,
+				DisableBuildCache: true,
+				MFlagLevel:        tc.level,
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if !inlineRx.MatchString(w.String()) {
+				t.Fatalf("expected optimization output, got %s", w.String())
+			}
+			if e, a := tc.expRicher, richerRx.MatchString(w.String()); e != a {
+				t.Errorf("expRicher=%v, actRicher=%v\n%s", e, a, w.String())
+			}
+		})
+	}
+}
+
+func TestBuildAllWithPackageCompilerFlags(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shim script requires a POSIX shell")
+	}
+
+	// The shim writes the import path and the value of -gcflags.
+	dir := t.TempDir()
+	goCmd := filepath.Join(dir, "go")
+	if err := os.WriteFile(
+		goCmd,
+		[]byte(`#!/bin/sh
+while [ $# -gt 1 ]; do
+  if [ "$1" = "-gcflags" ]; then gcflags="$2"; fi
+  shift
+done
+echo "$1: $gcflags" >&2
+`),
+		0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var pkgs []build.Package
+	for _, importPath := range []string{"a", "b", "c"} {
+		pkgs = append(pkgs, build.Package{
+			ImportPath: importPath,
+			GoFiles:    []string{importPath + ".go"},
+		})
+	}
+
+	var w bytes.Buffer
+	if err := internal.BuildAll(&w, pkgs, internal.Context{
+		CompilerFlags: []string{"-N"},
+		GoCmd:         goCmd,
+		MFlagLevel:    2,
+		PackageCompilerFlags: map[string][]string{
+			"a": {"-l"},
+			"b": {"-m", "-d=ssa/check_bce"},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	exp := "a: -m=2 -N -l\nb: -m=2 -N -d=ssa/check_bce\nc: -m=2 -N\n"
+	if e, a := exp, w.String(); e != a {
+		t.Errorf("expOutput=%q, actOutput=%q", e, a)
+	}
+}
+
+func TestBuildWithIncludeDeps(t *testing.T) {
+	pkg, err := build.Import(
+		"github.com/akutz/lem/internal/testdata/deps/a", ".", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := internal.Context{
+		BuildContext:      &build.Context{Dir: pkg.Dir},
+		DisableBuildCache: true,
+		IncludeDeps:       true,
+	}
+
+	var w bytes.Buffer
+	if err := internal.Build(&w, *pkg, ctx); err != nil {
+		t.Fatal(err)
+	}
+	ctx.BuildOutput = w.String()
+
+	// The output for the dependency should have an absolute path.
+	depPath := filepath.Join(filepath.Dir(pkg.Dir), "b", "util.go")
+	e := depPath + ":22:9: x escapes to heap"
+	if !strings.Contains(ctx.BuildOutput, e) {
+		t.Fatalf("expected %q in build output, got %s", e, ctx.BuildOutput)
+	}
+
+	// The natch on line 22 of a/util.go must not match the output for line
+	// 22 of b/util.go.
+	testCases, err := internal.GetTestCases(
+		filepath.Join(pkg.Dir, "util.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := internal.NewTree(testCases...)
+	if result := tree.Run(t, ctx); result.Failed() {
+		t.Fatal("result should not have failed")
+	}
+}
+
+func TestTreeRunTrimpath(t *testing.T) {
+	for _, fixture := range []string{"deps/a", "devirt", "leak", "move"} {
+		fixture := fixture
+		t.Run(fixture, func(t *testing.T) {
+			pkg, err := build.Import(
+				"github.com/akutz/lem/internal/testdata/"+fixture, ".", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var testCases []internal.TestCase
+			for _, f := range pkg.GoFiles {
+				tcs, err := internal.GetTestCases(filepath.Join(pkg.Dir, f))
+				if err != nil {
+					t.Fatal(err)
+				}
+				testCases = append(testCases, tcs...)
+			}
+
+			// run returns the outcome of each test case, keyed by its ID,
+			// when the fixture is built with the provided arguments.
+			run := func(includeDeps bool, args ...string) map[string]string {
+				ctx := internal.Context{
+					BuildContext:      &build.Context{Dir: pkg.Dir},
+					DisableBuildCache: true,
+					ExtraBuildArgs:    args,
+					IncludeDeps:       includeDeps,
+				}
+				var w bytes.Buffer
+				if err := internal.Build(&w, *pkg, ctx); err != nil {
+					t.Fatal(err)
+				}
+				ctx.BuildOutput = w.String()
+
+				outcomes := map[string]string{}
+				t.Run(fmt.Sprintf("deps=%v,args=%v", includeDeps, args),
+					func(t *testing.T) {
+						tree := internal.NewTree(testCases...)
+						for _, r := range tree.Run(t, ctx).TestCases {
+							outcomes[r.ID] = fmt.Sprintf(
+								"failed=%v,skipped=%v", r.Failed, r.Skipped)
+						}
+					})
+				return outcomes
+			}
+
+			for _, includeDeps := range []bool{false, true} {
+				exp := run(includeDeps)
+				if len(exp) == 0 {
+					t.Fatal("expected test cases")
+				}
+				act := run(includeDeps, "-trimpath")
+				if !reflect.DeepEqual(exp, act) {
+					t.Errorf("deps=%v: expOutcomes=%v, actOutcomes=%v",
+						includeDeps, exp, act)
+				}
+			}
+		})
+	}
+}
+
+func TestTreeRunXTest(t *testing.T) {
+	pkg, err := build.Import(
+		"github.com/akutz/lem/internal/testdata/xtest", ".", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 1, len(pkg.XTestGoFiles); e != a {
+		t.Fatalf("expXTestGoFiles=%d, actXTestGoFiles=%d", e, a)
+	}
+
+	// The external test package is compiled separately from the package,
+	// under its own "# <PKG>_test [<PKG>.test]" header, but its output is
+	// attributed to its files in the same manner as the package's output.
+	var files []string
+	for _, f := range append(pkg.GoFiles, pkg.XTestGoFiles...) {
+		files = append(files, filepath.Join(pkg.Dir, f))
+	}
+	testCases, err := internal.GetTestCases(files...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 3, len(testCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+
+	for _, includeDeps := range []bool{false, true} {
+		includeDeps := includeDeps
+		t.Run(fmt.Sprintf("deps=%v", includeDeps), func(t *testing.T) {
+			ctx := internal.Context{
+				DisableBuildCache: true,
+				IncludeDeps:       includeDeps,
+			}
+			var w bytes.Buffer
+			if err := internal.Build(&w, *pkg, ctx); err != nil {
+				t.Fatal(err)
+			}
+			ctx.BuildOutput = w.String()
+			if !strings.Contains(ctx.BuildOutput, "xtest_test [") {
+				t.Fatalf("expected output for the external test package\n%s",
+					ctx.BuildOutput)
+			}
+			tree := internal.NewTree(testCases...)
+			result := tree.Run(t, ctx)
+			if result.Failed() {
+				t.Fatal("result should not have failed")
+			}
+			if e, a := 3, len(result.TestCases); e != a {
+				t.Fatalf("expLen=%d, actLen=%d", e, a)
+			}
+		})
+	}
+}
+
+func TestTreeRunSkip(t *testing.T) {
+	testCases, err := getTestCases(t, `package src
+
+var sink interface{}
+
+// lem.a.skip=flaky on arm64
+func a(x int32) {
+	sink = x // lem.a.m=x leaks to heap
+}
+
+// lem.b.skip
+func b(x int32) {
+	sink = x // lem.b.m=x leaks to heap
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 2, len(testCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	if !testCases[0].Skip || testCases[0].SkipReason != "flaky on arm64" {
+		t.Errorf("unexpected skip for a: %v, %q",
+			testCases[0].Skip, testCases[0].SkipReason)
+	}
+
+	// The matches would fail if they were evaluated.
+	tree := internal.NewTree(testCases...)
+	result := tree.Run(t, internal.Context{
+		BuildOutput: "./src.go:7:2: x escapes to heap\n",
+	})
+	if result.Failed() {
+		t.Fatal("result should not have failed")
+	}
+	if e, a := 2, len(result.TestCases); e != a {
+		t.Fatalf("expResults=%d, actResults=%d", e, a)
+	}
+	for i, exp := range []string{"flaky on arm64", "skipped by lem.b.skip"} {
+		r := result.TestCases[i]
+		if !r.Skipped {
+			t.Errorf("%s: expected test case to be skipped", r.ID)
+		}
+		if e, a := exp, r.SkipReason; e != a {
+			t.Errorf("%s: expReason=%s, actReason=%s", r.ID, e, a)
+		}
+		if len(r.Matches) != 0 {
+			t.Errorf("%s: matches should not have been evaluated", r.ID)
+		}
+	}
+}
+
+func TestTreeRunTags(t *testing.T) {
+	testCases, err := getTestCases(t, `package src
+
+var sink interface{}
+
+// lem.a.tags=purego
+func a(x int32) {
+	sink = x // lem.a.m=x escapes to heap
+}
+
+// lem.b.tags=purego,debug
+func b(x int32) {
+	sink = x // lem.b.m=x escapes to heap
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 2, len(testCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	if e, a := []string{"purego", "debug"}, testCases[1].Tags; !reflect.DeepEqual(e, a) {
+		t.Fatalf("expTags=%v, actTags=%v", e, a)
+	}
+
+	buildContext := build.Default
+	buildContext.BuildTags = []string{"purego"}
+
+	tree := internal.NewTree(testCases...)
+	result := tree.Run(t, internal.Context{
+		BuildContext: &buildContext,
+		BuildOutput: "./src.go:7:6: x escapes to heap\n" +
+			"./src.go:12:6: x escapes to heap\n",
+	})
+	if result.Failed() {
+		t.Fatal("result should not have failed")
+	}
+	if e, a := 2, len(result.TestCases); e != a {
+		t.Fatalf("expResults=%d, actResults=%d", e, a)
+	}
+
+	// a requires only purego and should run.
+	if r := result.TestCases[0]; r.Skipped || len(r.Matches) != 1 {
+		t.Errorf("a: expected test case to run, skipped=%v", r.Skipped)
+	}
+
+	// b also requires debug and should be skipped.
+	r := result.TestCases[1]
+	if !r.Skipped {
+		t.Error("b: expected test case to be skipped")
+	}
+	if e, a := "skipped by lem.b.tags, missing build tags: debug",
+		r.SkipReason; e != a {
+		t.Errorf("b: expReason=%s, actReason=%s", e, a)
+	}
+}
+
+func TestFilterTestCases(t *testing.T) {
+	testCases := []internal.TestCase{
+		{ID: "escape1"},
+		{ID: "escape2"},
+		{ID: "leak1"},
+	}
+	testCases2 := func(ids ...string) []internal.TestCase {
+		var tcs []internal.TestCase
+		for _, id := range ids {
+			tcs = append(tcs, internal.TestCase{ID: id})
+		}
+		return tcs
+	}
+	for _, tc := range []struct {
+		name   string
+		filter string
+		exp    []internal.TestCase
+	}{
+		{
+			name:   "empty filter runs all",
+			filter: "",
+			exp:    testCases,
+		},
+		{
+			name:   "matches some",
+			filter: "^escape",
+			exp:    testCases2("escape1", "escape2"),
+		},
+		{
+			name:   "matches one",
+			filter: "^leak1$",
+			exp:    testCases2("leak1"),
+		},
+		{
+			name:   "matches none",
+			filter: "move",
+			exp:    nil,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			act, err := internal.FilterTestCases(tc.filter, testCases...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tc.exp, act) {
+				t.Errorf("exp=%+v, act=%+v", tc.exp, act)
+			}
+		})
+	}
+
+	t.Run("invalid filter", func(t *testing.T) {
+		if _, err := internal.FilterTestCases("(", testCases...); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
+
+func TestTreeRunBaseline(t *testing.T) {
+	testCases, err := getTestCases(t, `package src
+
+var sink interface{}
+
+func a(x int32) {
+	sink = x // lem.a.m=x escapes to heap
+}
+
+func b(x int32) {
+	sink = x // lem.b.m=x escapes to heap
+}
+
+func c(x int32) {
+	sink = x // lem.c.m=x escapes to heap
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	one, two := int64(1), int64(2)
+	baseline := &internal.Baseline{
+		TestCases: map[string]internal.BaselineTestCase{
+			// a is no worse than the baseline.
+			"a": {Escapes: &one},
+			// b is better than the baseline.
+			"b": {Escapes: &two},
+			// d was removed from the source.
+			"d": {Escapes: &one},
+		},
+	}
+
+	tree := internal.NewTree(testCases...)
+	result := tree.Run(t, internal.Context{
+		Baseline: baseline,
+		BuildOutput: "./src.go:6:2: x escapes to heap\n" +
+			"./src.go:10:2: x escapes to heap\n" +
+			"./src.go:14:2: x escapes to heap\n",
+	})
+	if result.Failed() {
+		t.Fatal("result should not have failed")
+	}
+	if e, a := []string{"d"}, baseline.MissingIDs([]string{"a", "b", "c"}); !reflect.DeepEqual(e, a) {
+		t.Errorf("expMissing=%v, actMissing=%v", e, a)
+	}
+
+	// Write a new baseline from the result, keeping the entry for an ID
+	// that was not run but is still in the source and dropping the entry
+	// for the ID that was removed.
+	baseline.TestCases["e"] = internal.BaselineTestCase{Escapes: &two}
+	path := filepath.Join(t.TempDir(), "baseline.json")
+	if err := internal.WriteBaseline(path, internal.NewBaseline(
+		baseline, []string{"a", "b", "c", "e"}, result)); err != nil {
+		t.Fatal(err)
+	}
+	next, err := internal.ReadBaseline(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 4, len(next.TestCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	for id, exp := range map[string]int64{"a": 1, "b": 1, "c": 1, "e": 2} {
+		btc, ok := next.TestCases[id]
+		if !ok || btc.Escapes == nil {
+			t.Errorf("%s: missing escapes", id)
+			continue
+		}
+		if e, a := exp, *btc.Escapes; e != a {
+			t.Errorf("%s: expEscapes=%d, actEscapes=%d", id, e, a)
+		}
+	}
+}
+
+var baselineSink *int64
+
+func TestTreeRunBaselineRegressed(t *testing.T) {
+	testCases, err := getTestCases(t, `package src
+
+var sink interface{}
+
+// lem.a.alloc=0-2
+func a(x int32) {
+	sink = x // lem.a.m=x escapes to heap
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zero := int64(0)
+	tree := internal.NewTree(testCases...)
+	r := runRecorded(&tree, internal.Context{
+		Baseline: &internal.Baseline{
+			TestCases: map[string]internal.BaselineTestCase{
+				"a": {AllocOp: &zero, Escapes: &zero},
+			},
+		},
+		Benchmarks: map[string]func(*testing.B){
+			"a": func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					baselineSink = new(int64)
+				}
+			},
+		},
+		BuildOutput: "./src.go:7:2: x escapes to heap\n",
+	})
+	if !r.Failed() {
+		t.Fatalf("expected test to fail\n%s", r)
+	}
+	out := r.String()
+	for _, exp := range []string{
+		"regressed alloc: baseline=0, actual=1",
+		"regressed escapes: baseline=0, actual=1",
+	} {
+		if !strings.Contains(out, exp) {
+			t.Errorf("expected output to contain %q\n%s", exp, out)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	one, two := int64(1), int64(2)
+	base := internal.Result{
+		TestCases: []internal.TestCaseResult{
+			{ID: "a", Benchmark: &internal.BenchmarkResult{AllocOp: 2, BytesOp: 16}},
+			{ID: "b", Escapes: &one},
+			{ID: "c", Escapes: &one},
+			{ID: "d", Skipped: true},
+			{ID: "e", Escapes: &one},
+		},
+		BuildOutputs: map[string]string{
+			"./a": "# ./a\n./a.go:3:6: can inline a\n./a.go:5:2: x escapes to heap\n",
+		},
+	}
+	other := internal.Result{
+		TestCases: []internal.TestCaseResult{
+			{ID: "a", Benchmark: &internal.BenchmarkResult{AllocOp: 1, BytesOp: 32}},
+			{ID: "b", Escapes: &two},
+			{ID: "c", Escapes: &one},
+			{ID: "d", Escapes: &one},
+		},
+		BuildOutputs: map[string]string{
+			"./a": "# ./a\n./a.go:5:2: x escapes to heap\n./a.go:6:2: y escapes to heap\n",
+		},
+	}
+	c := internal.Compare(base, other)
+
+	// The test cases that were skipped or only run against one of the
+	// builds are not compared.
+	if e, a := 3, len(c.TestCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	for i, exp := range []struct {
+		id        string
+		improved  []string
+		regressed []string
+	}{
+		{id: "a", improved: []string{"alloc"}, regressed: []string{"bytes"}},
+		{id: "b", regressed: []string{"escapes"}},
+		{id: "c"},
+	} {
+		tcc := c.TestCases[i]
+		if e, a := exp.id, tcc.ID; e != a {
+			t.Errorf("expID=%s, actID=%s", e, a)
+		}
+		if e, a := exp.improved, tcc.Improved; !reflect.DeepEqual(e, a) {
+			t.Errorf("%s: expImproved=%v, actImproved=%v", exp.id, e, a)
+		}
+		if e, a := exp.regressed, tcc.Regressed; !reflect.DeepEqual(e, a) {
+			t.Errorf("%s: expRegressed=%v, actRegressed=%v", exp.id, e, a)
+		}
+	}
+	if e, a := []string{"a"}, c.Improved(); !reflect.DeepEqual(e, a) {
+		t.Errorf("expImproved=%v, actImproved=%v", e, a)
+	}
+	if e, a := []string{"a", "b"}, c.Regressed(); !reflect.DeepEqual(e, a) {
+		t.Errorf("expRegressed=%v, actRegressed=%v", e, a)
+	}
+
+	if e, a := map[string][]string{
+		"./a": {"./a.go:6:2: y escapes to heap"},
+	}, c.Added; !reflect.DeepEqual(e, a) {
+		t.Errorf("expAdded=%v, actAdded=%v", e, a)
+	}
+	if e, a := map[string][]string{
+		"./a": {"./a.go:3:6: can inline a"},
+	}, c.Removed; !reflect.DeepEqual(e, a) {
+		t.Errorf("expRemoved=%v, actRemoved=%v", e, a)
+	}
+
+	exp := "comparison: 3 test case(s), 1 improved, 2 regressed\n" +
+		"\ta: improved alloc=2->1 regressed bytes=16->32\n" +
+		"\tb: regressed escapes=1->2\n" +
+		"added ./a:\n" +
+		"\t./a.go:6:2: y escapes to heap\n" +
+		"removed ./a:\n" +
+		"\t./a.go:3:6: can inline a\n"
+	if a := c.String(); exp != a {
+		t.Errorf("expString=%q, actString=%q", exp, a)
+	}
+}
+
+// getTestCasesWithSidecar writes the provided source and sidecar to a
+// temporary directory and returns the test cases parsed from them.
+func getTestCasesWithSidecar(
+	t *testing.T, src, sidecar string) ([]internal.TestCase, error) {
+
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "src.go")
+	if err := os.WriteFile(srcPath, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sidecarPath := filepath.Join(dir, internal.SidecarFileName)
+	if err := os.WriteFile(sidecarPath, []byte(sidecar), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return internal.GetTestCases(srcPath, sidecarPath)
+}
+
+const sidecarSrc = `package src
+
+var sink interface{}
+
+// lem.a.m=x escapes to heap
+func a(x int32) {
+	sink = x
+}
+
+func b(x int32) int32 {
+	return x
+}
+`
+
+func TestGetTestCasesSidecar(t *testing.T) {
+	testCases, err := getTestCasesWithSidecar(t, sidecarSrc, `{
+  "testCases": [
+    {
+      "id": "a",
+      "name": "to sink",
+      "alloc": "1",
+      "bytes": "8~10%",
+      "matches": [
+        {"file": "src.go", "line": 7, "pattern": "x escapes to heap"}
+      ]
+    },
+    {
+      "id": "b",
+      "natches": [
+        {"file": "src.go", "line": 11, "pattern": "escapes"}
+      ]
+    }
+  ]
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 2, len(testCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+
+	a := testCases[0]
+	if e, a := "to sink", a.Name; e != a {
+		t.Errorf("expName=%s, actName=%s", e, a)
+	}
+	if e, a := (internal.Int64Range{Min: 1, Max: 1}), a.AllocOp; e != a {
+		t.Errorf("expAllocOp=%v, actAllocOp=%v", e, a)
+	}
+	if e, a := int64(8), a.BytesOp.Value; e != a {
+		t.Errorf("expBytesOp=%d, actBytesOp=%d", e, a)
+	}
+	if e, a := 2, len(a.Matches); e != a {
+		t.Fatalf("expMatches=%d, actMatches=%d", e, a)
+	}
+	lm := a.Matches[1]
+	if e, a := `(?m)^(?:.*[/\\])?src\.go:7:\d+: x escapes to heap$`, lm.Regexp.String(); e != a {
+		t.Errorf("expRegexp=%s, actRegexp=%s", e, a)
+	}
+	if e, a := "\tsink = x", lm.Source; e != a {
+		t.Errorf("expSource=%q, actSource=%q", e, a)
+	}
+	if e, a := 7, lm.Line; e != a {
+		t.Errorf("expLine=%d, actLine=%d", e, a)
+	}
+
+	b := testCases[1]
+	if e, a := 1, len(b.Natches); e != a {
+		t.Fatalf("expNatches=%d, actNatches=%d", e, a)
+	}
+	if e, a := `(?m)^(?:.*[/\\])?src\.go:11:\d+:.*escapes.*$`, b.Natches[0].Regexp.String(); e != a {
+		t.Errorf("expRegexp=%s, actRegexp=%s", e, a)
+	}
+}
+
+func TestGetTestCasesSidecarErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		sidecar string
+		expErr  string
+	}{
+		{
+			name: "conflict with source",
+			sidecar: `{"testCases": [
+  {"id": "a", "matches": [{"file": "src.go", "line": 5, "pattern": "x escapes to heap"}]}
+]}`,
+			expErr: `duplicate lem.a.m=`,
+		},
+		{
+			name: "conflict within sidecar",
+			sidecar: `{"testCases": [
+  {"id": "b", "alloc": "1"},
+  {"id": "b", "alloc": "2"}
+]}`,
+			expErr: `duplicate lem.b.alloc at `,
+		},
+		{
+			name:    "missing id",
+			sidecar: `{"testCases": [{"alloc": "1"}]}`,
+			expErr:  `missing id at `,
+		},
+		{
+			name: "line out of range",
+			sidecar: `{"testCases": [
+  {"id": "b", "matches": [{"file": "src.go", "line": 100, "pattern": "x"}]}
+]}`,
+			expErr: `line 100 is out of range 1-13`,
+		},
+		{
+			name:    "invalid json",
+			sidecar: `{`,
+			expErr:  `invalid sidecar `,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := getTestCasesWithSidecar(t, sidecarSrc, tc.sidecar)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !strings.Contains(err.Error(), tc.expErr) {
+				t.Errorf("expErr=%s, actErr=%v", tc.expErr, err)
+			}
+		})
+	}
+}
+
+func TestGetTestCasesStableMatcherOrder(t *testing.T) {
+	dir := t.TempDir()
+	aPath := filepath.Join(dir, "a.go")
+	if err := os.WriteFile(aPath, []byte(`package src
+
+var sink interface{}
+
+func a1(x int32) {
+	sink = x // lem.a.m=x escapes to heap
+}
+
+func a2(x int32) int32 {
+	return x // lem.a.m!=escapes
+}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bPath := filepath.Join(dir, "b.go")
+	if err := os.WriteFile(bPath, []byte(`package src
+
+func b1(x int32) {
+	sink = x // lem.a.m=x escapes to heap
+	sink = x // lem.a.m=x escapes
+}
+
+func b2(x int32) int32 {
+	return x // lem.a.m!=escapes
+}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ab, err := internal.GetTestCases(aPath, bPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ba, err := internal.GetTestCases(bPath, aPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	abTree, baTree := internal.NewTree(ab...), internal.NewTree(ba...)
+	abJSON, err := json.Marshal(&abTree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baJSON, err := json.Marshal(&baTree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(abJSON, baJSON) {
+		t.Fatalf("trees are not equal\nab=%+v\nba=%+v", ab, ba)
+	}
+
+	var act []string
+	for _, lm := range ab[0].Matches {
+		act = append(act, fmt.Sprintf("%s:%d", lm.File, lm.Line))
+	}
+	for _, lm := range ab[0].Natches {
+		act = append(act, fmt.Sprintf("%s:%d", lm.File, lm.Line))
+	}
+	exp := []string{"a.go:6", "b.go:4", "b.go:5", "a.go:10", "b.go:9"}
+	if !reflect.DeepEqual(exp, act) {
+		t.Errorf("exp=%v, act=%v", exp, act)
+	}
+}
+
+func TestTreeWalk(t *testing.T) {
+	tree := internal.NewTree(
+		internal.TestCase{ID: "a1"},
+		internal.TestCase{ID: "a2", Name: "leak/to sink"},
+		internal.TestCase{ID: "a3", Name: "leak/to result"},
+		internal.TestCase{ID: "a4", Name: "/escape/to heap"},
+		internal.TestCase{ID: "a5", Name: "/escape"},
+	)
+
+	var act []string
+	tree.Walk(func(path []string, tc *internal.TestCase) {
+		act = append(act, tc.ID+"="+strings.Join(path, "/"))
+	})
+
+	// Test cases nested in steps are visited before the test cases at the
+	// same level, the same order in which they are run.
+	exp := []string{
+		"a2=a2/leak/to sink",
+		"a3=a3/leak/to result",
+		"a4=escape/to heap",
+		"a1=a1",
+		"a5=escape",
+	}
+	if !reflect.DeepEqual(exp, act) {
+		t.Errorf("exp=%v\nact=%v", exp, act)
+	}
+}
+
+func TestCheckNames(t *testing.T) {
+	testCases, err := getTestCases(t, `package src
+
+var sink interface{}
+
+// lem.put.name=to sink
+// lem.put.alloc=1
+func put(x int32) {
+	sink = x // lem.put.m=x escapes to heap
+	sink = x // lem.pt.m=x escapes to heap
+}
+
+// lem.ret.skip
+func ret(x int32) int32 {
+	return x
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The lenient path allows the test case created by the typo.
+	if e, a := 3, len(testCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+
+	// The strict path catches the typo.
+	err = internal.CheckNames(testCases...)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	exp := regexp.MustCompile(
+		`^lem\.pt\.m=.+ at .+src\.go:9 has no lem\.pt\.name directive$`)
+	if !exp.MatchString(err.Error()) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Test cases without match, natch, alloc, or bytes directives do not
+	// require names.
+	if err := internal.CheckNames(testCases[0], testCases[2]); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestTreeRunNone(t *testing.T) {
+	const src = `package src
+
+var sink interface{}
+
+// lem.a.none=runtime\.newobject
+func a(x int32) {
+	sink = x
+}
+
+func b() *int64 {
+	return new(int64)
+}
+`
+
+	testCases, err := getTestCases(t, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 1, len(testCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	nones := testCases[0].Nones
+	if e, a := 1, len(nones); e != a {
+		t.Fatalf("expNones=%d, actNones=%d", e, a)
+	}
+	if e, a := `(?m)^.*runtime\.newobject.*$`, nones[0].Regexp.String(); e != a {
+		t.Errorf("expRegexp=%s, actRegexp=%s", e, a)
+	}
+	if nones[0].File != "" || nones[0].Line != 0 {
+		t.Errorf("expected no file:line anchor, got %s:%d",
+			nones[0].File, nones[0].Line)
+	}
+
+	// The pattern does not appear anywhere in the build output.
+	tree := internal.NewTree(testCases...)
+	result := tree.Run(t, internal.Context{
+		BuildOutput: "./src.go:7:2: x escapes to heap\n",
+	})
+	if result.Failed() {
+		t.Fatal("result should not have failed")
+	}
+
+	// The pattern appears on an unrelated line.
+	r := runRecorded(&tree, internal.Context{
+		BuildOutput: "./src.go:7:2: x escapes to heap\n" +
+			"./src.go:11:12: new(int64) escapes to heap: runtime.newobject\n",
+	})
+	if !r.Failed() {
+		t.Fatalf("expected test to fail\n%s", r)
+	}
+	exp := "output: ./src.go:11:12: new(int64) escapes to heap: runtime.newobject"
+	if out := r.String(); !strings.Contains(out, exp) {
+		t.Errorf("expected output to contain %q\n%s", exp, out)
+	}
+}
+
+func TestTreeRunIgnorePatterns(t *testing.T) {
+	const src = `package src
+
+var sink interface{}
+
+// lem.a.none=runtime\.newobject
+func a(x int32) {
+	sink = x
+}
+
+func b() *int64 {
+	return new(int64)
+}
+`
+
+	testCases, err := getTestCases(t, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the ignored pattern this output fails the none directive,
+	// as asserted by TestTreeRunNone.
+	const buildOutput = "./src.go:7:2: x escapes to heap\n" +
+		"./src.go:11:12: new(int64) escapes to heap: runtime.newobject\n"
+	ignorePatterns := []*regexp.Regexp{regexp.MustCompile(`^\./src\.go:11:`)}
+
+	t.Run("BuildOutput", func(t *testing.T) {
+		tree := internal.NewTree(testCases...)
+		result := tree.Run(t, internal.Context{
+			BuildOutput:    buildOutput,
+			IgnorePatterns: ignorePatterns,
+		})
+		if result.Failed() {
+			t.Fatal("result should not have failed")
+		}
+	})
+
+	t.Run("BuildOutputIndex", func(t *testing.T) {
+		idx, err := internal.NewBuildOutputIndex(strings.NewReader(buildOutput))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree := internal.NewTree(testCases...)
+		result := tree.Run(t, internal.Context{
+			BuildOutputIndex: idx,
+			IgnorePatterns:   ignorePatterns,
+		})
+		if result.Failed() {
+			t.Fatal("result should not have failed")
+		}
+	})
+}
+
+func TestIgnoreBuildOutput(t *testing.T) {
+	const buildOutput = "./a.go:1:1: x escapes to heap\n" +
+		"./a.go:2:1: y does not escape\n" +
+		"./a.go:3:1: z escapes to heap\n"
+	patterns := []*regexp.Regexp{regexp.MustCompile(`escapes to heap$`)}
+	if e, a := "./a.go:2:1: y does not escape\n",
+		internal.IgnoreBuildOutput(buildOutput, patterns); e != a {
+		t.Errorf("exp=%q, act=%q", e, a)
+	}
+	if e, a := buildOutput,
+		internal.IgnoreBuildOutput(buildOutput, nil); e != a {
+		t.Errorf("exp=%q, act=%q", e, a)
+	}
+}
+
+func TestTreeRunMoveAndEscape(t *testing.T) {
+	pkg, err := build.Import(
+		"github.com/akutz/lem/internal/testdata/move", ".", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases, err := internal.GetTestCases(
+		filepath.Join(pkg.Dir, "move.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expRegexps := map[string]string{
+		"move":      `(?m)^(?:.*[/\\])?move\.go:22:\d+: moved to heap: x$`,
+		"escape":    `(?m)^(?:.*[/\\])?move\.go:27:\d+: x escapes to heap$`,
+		"escapeNew": `(?m)^(?:.*[/\\])?move\.go:31:\d+: new\(int32\) escapes to heap$`,
+	}
+	if e, a := len(expRegexps), len(testCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	for _, tc := range testCases {
+		if e, a := 1, len(tc.Matches); e != a {
+			t.Fatalf("%s: expMatches=%d, actMatches=%d", tc.ID, e, a)
+		}
+		if e, a := expRegexps[tc.ID], tc.Matches[0].Regexp.String(); e != a {
+			t.Errorf("%s: expRegexp=%s, actRegexp=%s", tc.ID, e, a)
+		}
+	}
+
+	// Assert the test cases against the real build optimization output.
+	var w bytes.Buffer
+	if err := internal.Build(&w, *pkg, internal.Context{
+		DisableBuildCache: true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	tree := internal.NewTree(testCases...)
+	result := tree.Run(t, internal.Context{BuildOutput: w.String()})
+	if result.Failed() {
+		t.Fatalf("result should not have failed\n%s", w.String())
+	}
+}
+
+func TestGetTestCasesInst(t *testing.T) {
+	testCases, err := getTestCases(t, `package src
+
+func a[T any](x T) {} // lem.a.inst=int:can inline
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 1, len(testCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	if e, a := 1, len(testCases[0].Matches); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	r := testCases[0].Matches[0].Regexp
+	for output, exp := range map[string]bool{
+		"./src.go:3:6: can inline a[int]":                 true,
+		"./src.go:3:6: can inline a[go.shape.int]":        true,
+		"./src.go:3:6: can inline a[string,int]":          true,
+		"./src.go:3:6: can inline a[go.shape.string]":     false,
+		"./src.go:3:6: can inline a[go.shape.int64]":      false,
+		"./src.go:3:6: can inline a":                      false,
+		"./src.go:4:6: can inline a[int]":                 false,
+		"./src.go:3:6: inlining call to a[go.shape.int]":  false,
+		"./src.go:3:6: go.shape.int(1) can inline":        true,
+		"./src.go:3:6: go.shape.integer(1) can inline":    false,
+		"./src.go:3:6: can inline a with go.shape.int(1)": true,
+	} {
+		if a := r.MatchString(output); exp != a {
+			t.Errorf("%s: exp=%v, act=%v", output, exp, a)
+		}
+	}
+}
+
+func TestTreeRunInst(t *testing.T) {
+	pkg, err := build.Import(
+		"github.com/akutz/lem/internal/testdata/generic", ".", 0)
+	if err != nil {
+		if _, ok := err.(*build.NoGoError); ok {
+			t.Skip("generics are not supported by this version of Go")
+		}
+		t.Fatal(err)
+	}
+	testCases, err := internal.GetTestCases(
+		filepath.Join(pkg.Dir, "generic.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 2, len(testCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+
+	var w bytes.Buffer
+	if err := internal.Build(&w, *pkg, internal.Context{
+		DisableBuildCache: true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	tree := internal.NewTree(testCases...)
+	result := tree.Run(t, internal.Context{BuildOutput: w.String()})
+	if result.Failed() {
+		t.Fatalf("result should not have failed\n%s", w.String())
+	}
+
+	// Each matcher only matches the output for its own instantiation.
+	for _, tc := range testCases {
+		for _, line := range []string{
+			"./generic.go:29:6: go.shape.string(1) escapes to heap",
+			"./generic.go:33:6: go.shape.int(\"s\") escapes to heap",
+		} {
+			if tc.Matches[0].Regexp.MatchString(line) {
+				t.Errorf("%s should not match %s", tc.ID, line)
+			}
+		}
+	}
+}
+
+func TestTreeRunCgo(t *testing.T) {
+	buildContext := build.Default
+	buildContext.CgoEnabled = true
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("cgo requires a C compiler")
+	}
+	pkg, err := buildContext.Import(
+		"github.com/akutz/lem/internal/testdata/cgo", ".", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := []string{"cgo.go"}, pkg.CgoFiles; !reflect.DeepEqual(e, a) {
+		t.Fatalf("expCgoFiles=%v, actCgoFiles=%v", e, a)
+	}
+	testCases, err := internal.GetTestCases(
+		filepath.Join(pkg.Dir, "cgo.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 3, len(testCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+
+	var w bytes.Buffer
+	if err := internal.Build(&w, *pkg, internal.Context{
+		BuildContext:      &buildContext,
+		DisableBuildCache: true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The output for the files generated by cgo is removed, but the output
+	// for the package's own files is not.
+	if strings.Contains(w.String(), "_cgo_gotypes.go") {
+		t.Errorf("unexpected output for generated files\n%s", w.String())
+	}
+	tree := internal.NewTree(testCases...)
+	result := tree.Run(t, internal.Context{BuildOutput: w.String()})
+	if result.Failed() {
+		t.Fatalf("result should not have failed\n%s", w.String())
+	}
+}
+
+func TestGetTestCasesNoIface(t *testing.T) {
+	testCases, err := getTestCases(t, `package src
+
+var sink interface{}
+
+func a(x int32) {
+	sink = x // lem.a.noiface
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 1, len(testCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	if e, a := 1, len(testCases[0].Natches); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	r := testCases[0].Natches[0].Regexp
+	for output, exp := range map[string]bool{
+		"./src.go:6:9: x escapes to heap":              true,
+		"./src.go:6:9: ([]byte)(x) escapes to heap":    true,
+		"./src.go:6:9: x escapes to heap in a:":        false,
+		"./src.go:6:9: x does not escape":              false,
+		"./src.go:6:9: ... argument escapes to heap":   false,
+		"./src.go:7:9: x escapes to heap":              false,
+		"./src.go:6:9: leaking param: x":               false,
+		"./src.go:6:9: moved to heap: x":               false,
+		"./src.go:6:9: &small{...} escapes to heap":    true,
+		"./src.go:6:9: ... argument does not escape":   false,
+		"/tmp/src/src.go:6:9: s escapes to heap":       true,
+		"./src.go:6:9: x escapes to heap and beyond":   false,
+		"./src.go:6:9: func literal escapes to heap":   true,
+		"./src.go:6:9: new(int32) escapes to heap":     true,
+		"./src.go:6:9: make([]int, n) escapes to heap": true,
+	} {
+		if a := r.MatchString(output); exp != a {
+			t.Errorf("%s: exp=%v, act=%v", output, exp, a)
+		}
+	}
+}
+
+func TestGetTestCasesFuncNoAlloc(t *testing.T) {
+	testCases, err := getTestCases(t, `package src
+
+// lem.a.fn.noalloc
+func a(x int) *int {
+	y := x
+	return &y
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 1, len(testCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	tc := testCases[0]
+	if !tc.HasBenchmark() {
+		t.Error("expected test case to require a benchmark")
+	}
+	if e, a := (internal.Int64Range{}), tc.AllocOp; e != a {
+		t.Errorf("expAllocOp=%s, actAllocOp=%s", e, a)
+	}
+	if e, a := 1, len(tc.Natches); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	r := tc.Natches[0].Regexp
+	for output, exp := range map[string]bool{
+		"./src.go:5:2: moved to heap: y":             true,
+		"./src.go:4:8: x escapes to heap":            true,
+		"./src.go:6:9: &y escapes to heap:":          true,
+		"./src.go:7:1: x escapes to heap":            true,
+		"./src.go:8:1: x escapes to heap":            false,
+		"./src.go:3:1: moved to heap: y":             false,
+		"./src.go:5:2: y does not escape":            false,
+		"./src.go:4:8: leaking param: x":             false,
+		"./src.go:5:2: inlining call to a":           false,
+		"/tmp/src/src.go:5:2: moved to heap: y":      true,
+		"./other.go:5:2: moved to heap: y":           false,
+		"./src.go:5:2: ... argument escapes to heap": true,
+	} {
+		if a := r.MatchString(output); exp != a {
+			t.Errorf("%s: exp=%v, act=%v", output, exp, a)
+		}
+	}
+
+	for name, src := range map[string]string{
+		"conflicting alloc": `package src
+
+// lem.a.alloc=1
+// lem.a.fn.noalloc
+func a() {}
+`,
+		"not in a function": `package src
+
+// lem.a.fn.noalloc
+var sink *int
+`,
+	} {
+		if _, err := getTestCases(t, src); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+var benchPointSink *fnnoalloc.Point
+
+func TestTreeRunFuncNoAlloc(t *testing.T) {
+	// Run a tree with a function that allocates nothing and one with a
+	// hidden allocation.
+	pkg, err := build.Import(
+		"github.com/akutz/lem/internal/testdata/fnnoalloc", ".", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases, err := internal.GetTestCases(
+		filepath.Join(pkg.Dir, "fnnoalloc.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var w bytes.Buffer
+	if err := internal.Build(&w, *pkg, internal.Context{
+		DisableBuildCache: true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	values := []int{1, 2, 3}
+	tree := internal.NewTree(testCases...)
+	r := runRecorded(&tree, internal.Context{
+		Benchmarks: map[string]func(*testing.B){
+			"sum": func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					fnnoalloc.Sum(values)
+				}
+			},
+			"offset": func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					benchPointSink = fnnoalloc.Offset(
+						fnnoalloc.Point{}, i, i)
+				}
+			},
+		},
+		BuildOutput: w.String(),
+	})
+	if !r.Failed() {
+		t.Fatalf("expected failure\n%s", r)
+	}
+	if r.sub("sum").Failed() {
+		t.Errorf("sum should not have failed\n%s", r)
+	}
+	if !r.sub("offset").Failed() {
+		t.Errorf("offset should have failed\n%s", r)
+	}
+	act := r.String()
+	for _, exp := range []string{
+		"reason: was found\noutput: ./fnnoalloc.go:38:2: moved to heap: q\n",
+		"reason: alloc mismatch\n",
+	} {
+		if !strings.Contains(act, exp) {
+			t.Errorf("expOutput=%s, actOutput=%s", exp, act)
+		}
+	}
+}
+
+func TestTreeRunNoIface(t *testing.T) {
+	pkg, err := build.Import(
+		"github.com/akutz/lem/internal/testdata/iface", ".", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases, err := internal.GetTestCases(
+		filepath.Join(pkg.Dir, "iface.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 3, len(testCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+
+	var w bytes.Buffer
+	if err := internal.Build(&w, *pkg, internal.Context{
+		DisableBuildCache: true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	tree := internal.NewTree(testCases...)
+	result := tree.Run(t, internal.Context{BuildOutput: w.String()})
+	if result.Failed() {
+		t.Fatalf("result should not have failed\n%s", w.String())
+	}
+}
+
+func TestGetTestCasesNoClosureEscape(t *testing.T) {
+	testCases, err := getTestCases(t, `package src
+
+var sinkFn func() int
+
+func a(x int) {
+	sinkFn = func() int { // lem.a.noclosure-escape
+		return x
+	}
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 1, len(testCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	natches := testCases[0].Natches
+	if e, a := 1, len(natches); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	for output, exp := range map[string]bool{
+		"./src.go:6:11: func literal escapes to heap":        true,
+		"./src.go:6:11: func literal escapes to heap in a:":  true,
+		"/tmp/src/src.go:6:11: func literal escapes to heap": true,
+		"./src.go:6:11: func literal does not escape":        false,
+		"./src.go:6:11: x escapes to heap":                   false,
+		"./src.go:5:8: moved to heap: x":                     false,
+		"./src.go:7:11: func literal escapes to heap":        false,
+	} {
+		if a := natches[0].Regexp.MatchString(output); exp != a {
+			t.Errorf("%s: exp=%v, act=%v", output, exp, a)
+		}
+	}
+}
+
+func TestTreeRunNoClosureEscape(t *testing.T) {
+	// Run the fixture's test cases so the closure that escapes fails.
+	pkg, err := build.Import(
+		"github.com/akutz/lem/internal/testdata/closure", ".", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases, err := internal.GetTestCases(
+		filepath.Join(pkg.Dir, "closure.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mFlagLevel := range []int{1, 2} {
+		mFlagLevel := mFlagLevel
+		t.Run("m="+strconv.Itoa(mFlagLevel), func(t *testing.T) {
+			ctx := internal.Context{DisableBuildCache: true}
+			if mFlagLevel == 2 {
+				ctx.MFlagLevel = 2
+			}
+			var w bytes.Buffer
+			if err := internal.Build(&w, *pkg, ctx); err != nil {
+				t.Fatal(err)
+			}
+			ctx.BuildOutput = w.String()
+			tree := internal.NewTree(testCases...)
+			r := runRecorded(&tree, ctx)
+			if !r.Failed() {
+				t.Fatalf("expected failure\n%s", r)
+			}
+			for name, exp := range map[string]bool{
+				"escapes":   true,
+				"local":     false,
+				"noCapture": false,
+			} {
+				if a := r.sub(name).Failed(); exp != a {
+					t.Errorf("%s: expFailed=%v, actFailed=%v", name, exp, a)
+				}
+			}
+			e, a := "func literal escapes to heap", r.String()
+			if !strings.Contains(a, e) {
+				t.Errorf("expOutput=%s, actOutput=%s", e, a)
+			}
+		})
+	}
+}
+
+func TestGetTestCasesLeak(t *testing.T) {
+	testCases, err := getTestCases(t, `package src
+
+// lem.a.leak=x
+// lem.b.leak=x:content
+// lem.c.leak=x:result:0
+// lem.d.leak=x:result:r:1
+func a(
+	x *int) (r *int) {
+
+	return x
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 4, len(testCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	for _, tc := range []struct {
+		id      string
+		matches map[string]bool
+	}{
+		{
+			id: "a",
+			matches: map[string]bool{
+				"./src.go:8:2: leaking param: x":                       true,
+				"./src.go:7:8: leaking param: x":                       true,
+				"./src.go:9:2: leaking param: x":                       false,
+				"./src.go:8:2: leaking param: y":                       false,
+				"./src.go:8:2: leaking param content: x":               false,
+				"./src.go:8:2: leaking param: x to result ~r0 level=0": false,
+			},
+		},
+		{
+			id: "b",
+			matches: map[string]bool{
+				"./src.go:8:2: leaking param content: x": true,
+				"./src.go:8:2: leaking param: x":         false,
+			},
+		},
+		{
+			id: "c",
+			matches: map[string]bool{
+				"./src.go:8:2: leaking param: x to result ~r0 level=0": true,
+				"./src.go:8:2: leaking param: x to result ~r0 level=1": true,
+				"./src.go:8:2: leaking param: x to result ~r1 level=0": false,
+				"./src.go:8:2: leaking param: x":                       false,
+			},
+		},
+		{
+			id: "d",
+			matches: map[string]bool{
+				"./src.go:8:2: leaking param: x to result r level=1":   true,
+				"./src.go:8:2: leaking param: x to result r level=0":   false,
+				"./src.go:8:2: leaking param: x to result ~r0 level=1": false,
+			},
+		},
+	} {
+		var found bool
+		for _, ltc := range testCases {
+			if ltc.ID != tc.id {
+				continue
+			}
+			found = true
+			if e, a := 1, len(ltc.Matches); e != a {
+				t.Fatalf("%s: expLen=%d, actLen=%d", tc.id, e, a)
+			}
+			r := ltc.Matches[0].Regexp
+			for output, exp := range tc.matches {
+				if a := r.MatchString(output); exp != a {
+					t.Errorf("%s: %s: exp=%v, act=%v", tc.id, output, exp, a)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("test case %s not found", tc.id)
+		}
+	}
+
+	if _, err := getTestCases(t, `package src
+
+// lem.a.leak=x
+var sink *int
+`); err == nil {
+		t.Error("expected error for leak directive not in a function")
+	}
+}
+
+func TestTreeRunLeak(t *testing.T) {
+	pkg, err := build.Import(
+		"github.com/akutz/lem/internal/testdata/leak", ".", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases, err := internal.GetTestCases(
+		filepath.Join(pkg.Dir, "leak.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 6, len(testCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+
+	var w bytes.Buffer
+	if err := internal.Build(&w, *pkg, internal.Context{
+		DisableBuildCache: true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	tree := internal.NewTree(testCases...)
+	result := tree.Run(t, internal.Context{BuildOutput: w.String()})
+	if result.Failed() {
+		t.Fatalf("result should not have failed\n%s", w.String())
+	}
+}
+
+func TestGetTestCasesDevirt(t *testing.T) {
+	testCases, err := getTestCases(t, `package src
+
+func a(s shape) int {
+	return s.area() // lem.a.devirt=square
+}
+
+func b(s shape) int {
+	// lem.b.devirt@+1=*circle
+	return s.area()
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 2, len(testCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	for _, tc := range []struct {
+		id      string
+		line    int
+		matches map[string]bool
+	}{
+		{
+			id:   "a",
+			line: 4,
+			matches: map[string]bool{
+				"./src.go:4:15: devirtualizing s.area to square":     true,
+				"./src.go:4:15: devirtualizing s.area to *square":    false,
+				"./src.go:4:15: devirtualizing s.area to squares":    false,
+				"./src.go:4:15: inlining call to square.area":        false,
+				"./src.go:5:15: devirtualizing s.area to square":     false,
+				"/tmp/src/src.go:4:15: devirtualizing x.y to square": true,
+			},
+		},
+		{
+			id:   "b",
+			line: 9,
+			matches: map[string]bool{
+				"./src.go:9:15: devirtualizing s.area to *circle": true,
+				"./src.go:9:15: devirtualizing s.area to circle":  false,
+				"./src.go:8:15: devirtualizing s.area to *circle": false,
+			},
+		},
+	} {
+		var found bool
+		for _, ltc := range testCases {
+			if ltc.ID != tc.id {
+				continue
+			}
+			found = true
+			if e, a := 1, len(ltc.Devirts); e != a {
+				t.Fatalf("%s: expLen=%d, actLen=%d", tc.id, e, a)
+			}
+			lm := ltc.Devirts[0]
+			if e, a := tc.line, lm.Line; e != a {
+				t.Errorf("%s: expLine=%d, actLine=%d", tc.id, e, a)
+			}
+			for output, exp := range tc.matches {
+				if a := lm.Regexp.MatchString(output); exp != a {
+					t.Errorf("%s: %s: exp=%v, act=%v", tc.id, output, exp, a)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("test case %s not found", tc.id)
+		}
+	}
+}
+
+func TestTreeRunDevirt(t *testing.T) {
+	t.Run("fixture", func(t *testing.T) {
+		pkg, err := build.Import(
+			"github.com/akutz/lem/internal/testdata/devirt", ".", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testCases, err := internal.GetTestCases(
+			filepath.Join(pkg.Dir, "devirt.go"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e, a := 3, len(testCases); e != a {
+			t.Fatalf("expLen=%d, actLen=%d", e, a)
+		}
+
+		var w bytes.Buffer
+		if err := internal.Build(&w, *pkg, internal.Context{
+			DisableBuildCache: true,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		tree := internal.NewTree(testCases...)
+		result := tree.Run(t, internal.Context{BuildOutput: w.String()})
+		if result.Failed() {
+			t.Fatalf("result should not have failed\n%s", w.String())
+		}
+	})
+
+	t.Run("not devirtualized", func(t *testing.T) {
+		// Run a tree with a call that was inlined but not devirtualized.
+		testCases, err := getTestCases(t, `package src
+
+func a(s shape) int {
+	return s.area() // lem.a.devirt=square
+}
+`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree := internal.NewTree(testCases...)
+		r := runRecorded(&tree, internal.Context{
+			BuildOutput: "./src.go:4:15: inlining call to square.area\n",
+		})
+		if !r.Failed() {
+			t.Fatalf("expected failure\n%s", r)
+		}
+		act := r.String()
+		for _, exp := range []string{
+			"error: devirtualization\nreason: not devirtualized\n",
+			"file:   src.go:4\nsource: ",
+			"output for line:\n\t./src.go:4:15: inlining call to square.area\n",
+		} {
+			if !strings.Contains(act, exp) {
+				t.Errorf("expOutput=%s, actOutput=%s", exp, act)
+			}
+		}
+	})
+}
+
+func TestGetTestCasesMBlock(t *testing.T) {
+	testCases, err := getTestCases(t, `package src
+
+var sink interface{}
+
+func a(y int32) {
+	sink = y // lem.a.mblock=^y escapes to heap in a:\n.*flow: \{heap\}
+}
+
+func b(y int32) {
+	// lem.b.mblock@+1=escapes.*assign
+	sink = y
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 2, len(testCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	for _, tc := range []struct {
+		id      string
+		line    int
+		matches map[string]bool
+	}{
+		{
+			id:   "a",
+			line: 6,
+			matches: map[string]bool{
+				"y escapes to heap in a:\n  flow: {heap} ← &{storage for y}:": true,
+				"y escapes to heap in a: flow: {heap}":                        false,
+				"x escapes to heap in a:\n  flow: {heap}":                     false,
+			},
+		},
+		{
+			id:   "b",
+			line: 11,
+			matches: map[string]bool{
+				"y escapes to heap in b:\n    from sink = y (assign)": true,
+				"y escapes to heap in b:":                             false,
+			},
+		},
+	} {
+		var found bool
+		for _, ltc := range testCases {
+			if ltc.ID != tc.id {
+				continue
+			}
+			found = true
+			if e, a := 1, len(ltc.Blocks); e != a {
+				t.Fatalf("%s: expLen=%d, actLen=%d", tc.id, e, a)
+			}
+			lm := ltc.Blocks[0]
+			if e, a := tc.line, lm.Line; e != a {
+				t.Errorf("%s: expLine=%d, actLine=%d", tc.id, e, a)
+			}
+			for output, exp := range tc.matches {
+				if a := lm.Regexp.MatchString(output); exp != a {
+					t.Errorf("%s: %q: exp=%v, act=%v", tc.id, output, exp, a)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("test case %s not found", tc.id)
+		}
+	}
+}
+
+func TestTreeRunMBlock(t *testing.T) {
+	const src = `package src
+
+var sink interface{}
+
+func a(y int32) {
+	sink = y // lem.a.mblock=^y escapes to heap in a:\n.*from sink = y \(assign\)
+}
+
+func b(y int32) {
+	sink = y // lem.b.mblock=^y escapes to heap in b:.*y escapes to heap in b:
+}
+`
+	const buildOutput = "./src.go:6:9: y escapes to heap in a:\n" +
+		"./src.go:6:9:   flow: {heap} ← &{storage for y}:\n" +
+		"./src.go:6:9:     from sink = y (assign) at ./src.go:6:7\n" +
+		"./src.go:10:9: y escapes to heap in b:\n" +
+		"./src.go:10:9:   flow: {heap} ← &{storage for y}:\n" +
+		"./src.go:10:2: y escapes to heap in b:\n"
+
+	t.Run("fixture", func(t *testing.T) {
+		pkg, err := build.Import(
+			"github.com/akutz/lem/internal/testdata/mblock", ".", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testCases, err := internal.GetTestCases(
+			filepath.Join(pkg.Dir, "mblock.go"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := internal.Context{
+			BuildContext:      &build.Context{Dir: pkg.Dir},
+			DisableBuildCache: true,
+			MFlagLevel:        2,
+		}
+		var w bytes.Buffer
+		if err := internal.Build(&w, *pkg, ctx); err != nil {
+			t.Fatal(err)
+		}
+		ctx.BuildOutput = w.String()
+		tree := internal.NewTree(testCases...)
+		result := tree.Run(t, ctx)
+		if result.Failed() {
+			t.Fatal("result should not have failed")
+		}
+		if e, a := 1, len(result.TestCases); e != a {
+			t.Fatalf("expLen=%d, actLen=%d", e, a)
+		}
+		if e, a := 1, len(result.TestCases[0].Blocks); e != a {
+			t.Fatalf("expBlocks=%d, actBlocks=%d", e, a)
+		}
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		// Run the tree so the block for b fails, since its lines do not
+		// share a position.
+		testCases, err := getTestCases(t, src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree := internal.NewTree(testCases...)
+		r := runRecorded(&tree, internal.Context{BuildOutput: buildOutput})
+		if !r.Failed() {
+			t.Fatalf("expected failure\n%s", r)
+		}
+		act := r.String()
+		if r.sub("a").Failed() {
+			t.Errorf("a should not have failed\n%s", act)
+		}
+		if !r.sub("b").Failed() {
+			t.Errorf("b should have failed\n%s", act)
+		}
+		for _, exp := range []string{
+			"output for line:\n",
+			"./src.go:10:9: y escapes to heap in b:\n",
+		} {
+			if !strings.Contains(act, exp) {
+				t.Errorf("expOutput=%s, actOutput=%s", exp, act)
+			}
+		}
+	})
+}
+
+func TestTreeRunMatchGroups(t *testing.T) {
+	const src = `package src
+
+var sink interface{}
+
+func a(x *int32) *int32 { // lem.a.m=leaking param: x to result ~r(?P<result>\d+) level=(?P<level>\d+)
+	return x
+}
+
+func b(y int32) {
+	sink = y // lem.b.m!=(?P<name>\w+) (?P<what>escapes) to heap
+}
+`
+	const buildOutput = "./src.go:5:8: leaking param: x to result ~r0 level=0\n" +
+		"./src.go:10:9: y escapes to heap\n"
+
+	t.Run("result", func(t *testing.T) {
+		testCases, err := getTestCases(t, src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testCases, err = internal.FilterTestCases("^a$", testCases...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree := internal.NewTree(testCases...)
+		result := tree.Run(t, internal.Context{BuildOutput: buildOutput})
+		if result.Failed() {
+			t.Fatal("result should not have failed")
+		}
+		if e, a := 1, len(result.TestCases); e != a {
+			t.Fatalf("expLen=%d, actLen=%d", e, a)
+		}
+		if e, a := 1, len(result.TestCases[0].Matches); e != a {
+			t.Fatalf("expMatches=%d, actMatches=%d", e, a)
+		}
+		exp := map[string]string{"result": "0", "level": "0"}
+		if a := result.TestCases[0].Matches[0].Groups; !reflect.DeepEqual(exp, a) {
+			t.Errorf("expGroups=%v, actGroups=%v", exp, a)
+		}
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		// Run the tree so the match is logged and the natch fails.
+		testCases, err := getTestCases(t, src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree := internal.NewTree(testCases...)
+		r := runRecorded(&tree, internal.Context{
+			BuildOutput: buildOutput,
+			Verbose:     true,
+		})
+		if !r.Failed() {
+			t.Fatalf("expected failure\n%s", r)
+		}
+		act := r.String()
+		for _, exp := range []string{
+			"matched: result=0 level=0\n",
+			"reason: was found\n" +
+				"output: ./src.go:10:9: y escapes to heap\n" +
+				"groups: name=y what=escapes\n",
+		} {
+			if !strings.Contains(act, exp) {
+				t.Errorf("expOutput=%s, actOutput=%s", exp, act)
+			}
+		}
+	})
+}
+
+func TestBuildOutputIndex(t *testing.T) {
+	const buildOutput = "# example.com/src\n" +
+		"./src.go:7:2: x escapes to heap\n" +
+		"./src.go:7:6: y escapes to heap\n" +
+		"/path/to/dep/src.go:7:2: z escapes to heap\n" +
+		"./other.go:7:2: x does not escape\n"
+
+	idx, err := internal.NewBuildOutputIndex(strings.NewReader(buildOutput))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []string{
+		"./src.go:7:2: x escapes to heap",
+		"./src.go:7:6: y escapes to heap",
+		"/path/to/dep/src.go:7:2: z escapes to heap",
+	}
+	if act := idx.Lookup("src.go", 7); !reflect.DeepEqual(exp, act) {
+		t.Errorf("exp=%v, act=%v", exp, act)
+	}
+	if act := idx.Lookup("src.go", 8); act != nil {
+		t.Errorf("expected no lines, got %v", act)
+	}
+	if e, a := buildOutput, idx.String(); e != a {
+		t.Errorf("expString=%q, actString=%q", e, a)
+	}
+}
+
+func TestTreeRunWithBuildOutputIndex(t *testing.T) {
+	testCases, err := getTestCases(t, `package src
+
+var sink interface{}
+
+// lem.a.none=does not escape
+func a(x, y int32) {
+	sink = x // lem.a.m=x escapes to heap
+	sink = y // lem.a.m!=escapes
+	sink = x // lem.a.mcount=x escapes to heap:1
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := internal.NewBuildOutputIndex(strings.NewReader(
+		"./src.go:7:2: x escapes to heap\n" +
+			"./src.go:9:2: x escapes to heap\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := internal.NewTree(testCases...)
+	result := tree.Run(t, internal.Context{BuildOutputIndex: idx})
+	if result.Failed() {
+		t.Fatal("result should not have failed")
+	}
+	if e, a := "./src.go:7:2: x escapes to heap",
+		result.TestCases[0].Matches[0].Output; e != a {
+		t.Errorf("expOutput=%q, actOutput=%q", e, a)
+	}
+}
+
+// BenchmarkMatchBuildOutput compares matching the patterns of the match
+// directives against all of the build optimization output with looking up
+// the output for the patterns' lines in an index first.
+func BenchmarkMatchBuildOutput(b *testing.B) {
+	const (
+		numFiles = 20
+		numLines = 1000
+	)
+	var sb strings.Builder
+	for f := 0; f < numFiles; f++ {
+		for l := 1; l <= numLines; l++ {
+			fmt.Fprintf(&sb, "./file%d.go:%d:2: x escapes to heap\n", f, l)
+		}
+	}
+	buildOutput := sb.String()
+
+	var lms []internal.LineMatcher
+	for f := 0; f < numFiles; f += 10 {
+		for l := 1; l <= numLines; l += 100 {
+			file := fmt.Sprintf("file%d.go", f)
+			lms = append(lms, internal.LineMatcher{
+				Regexp: regexp.MustCompile(fmt.Sprintf(
+					`(?m)^.*%s:%d:\d+: x escapes to heap$`, file, l)),
+				File: file,
+				Line: l,
+			})
+		}
+	}
+
+	b.Run("blob", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, lm := range lms {
+				if lm.Regexp.FindString(buildOutput) == "" {
+					b.Fatalf("no match for %s", lm.Regexp)
+				}
+			}
+		}
+	})
+
+	b.Run("index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			idx, err := internal.NewBuildOutputIndex(
+				strings.NewReader(buildOutput))
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, lm := range lms {
+				lines := strings.Join(idx.Lookup(lm.File, lm.Line), "\n")
+				if lm.Regexp.FindString(lines) == "" {
+					b.Fatalf("no match for %s", lm.Regexp)
+				}
+			}
+		}
+	})
+}
+
+// BenchmarkTreeRunBuildOutputIndex compares running a tree with the build
+// optimization output with running it with an index of the output that
+// was built ahead of time, as lem does when it streams the output of the
+// build into the index.
+func BenchmarkTreeRunBuildOutputIndex(b *testing.B) {
+	const (
+		numFuncs = 500
+		numFiles = 20
+		numLines = 1000
+	)
+
+	// Create a test case with a match and natch for each function.
+	var src, sb strings.Builder
+	src.WriteString("package src\n\nvar sink interface{}\n")
+	for i := 0; i < numFuncs; i++ {
+		line := 5 + i*5
+		fmt.Fprintf(&src, `
+func f%[1]d(x, y int32) {
+	sink = x // lem.f%[1]d.m=x escapes to heap
+	sink = y // lem.f%[1]d.m!=y leaks
+}
+`, i)
+		fmt.Fprintf(&sb, "./src.go:%d:2: x escapes to heap\n", line+1)
+		fmt.Fprintf(&sb, "./src.go:%d:2: y escapes to heap\n", line+2)
+	}
+	filePath := filepath.Join(b.TempDir(), "src.go")
+	if err := os.WriteFile(filePath, []byte(src.String()), 0644); err != nil {
+		b.Fatal(err)
+	}
+	testCases, err := internal.GetTestCases(filePath)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	// Add the output for the other files in the package being built.
+	for f := 0; f < numFiles; f++ {
+		for l := 1; l <= numLines; l++ {
+			fmt.Fprintf(&sb, "./file%d.go:%d:2: x escapes to heap\n", f, l)
+		}
+	}
+	buildOutput := sb.String()
+
+	run := func(b *testing.B, ctx internal.Context) {
+		tree := internal.NewTree(testCases...)
+		for i := 0; i < b.N; i++ {
+			if r := runRecorded(&tree, ctx); r.Failed() {
+				b.Fatalf("unexpected failure\n%s", r)
+			}
+		}
+	}
+
+	// Without an index the tree indexes the build output each time it is
+	// run.
+	b.Run("build output", func(b *testing.B) {
+		run(b, internal.Context{BuildOutput: buildOutput})
+	})
+
+	b.Run("prebuilt index", func(b *testing.B) {
+		idx, err := internal.NewBuildOutputIndex(
+			strings.NewReader(buildOutput))
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ResetTimer()
+		run(b, internal.Context{BuildOutputIndex: idx})
+	})
+}
+
+func TestTreeRunVet(t *testing.T) {
+	pkg, err := build.Import(
+		"github.com/akutz/lem/internal/testdata/vet", ".", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases, err := internal.GetTestCases(filepath.Join(pkg.Dir, "vet.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !internal.HasVet(testCases...) {
+		t.Fatal("expected test cases to have vet assertions")
+	}
+	if e, a := 1, len(testCases[0].Vets); e != a {
+		t.Fatalf("expVets=%d, actVets=%d", e, a)
+	}
+
+	// The vet diagnostics are not an error.
+	var w bytes.Buffer
+	if err := internal.VetAll(&w, []build.Package{*pkg}, internal.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	vetOutput := w.String()
+	if !strings.Contains(vetOutput, "vet.go:22:") {
+		t.Fatalf("unexpected vet output: %s", vetOutput)
+	}
+
+	tree := internal.NewTree(testCases...)
+	result := tree.Run(t, internal.Context{VetOutput: vetOutput})
+	if result.Failed() {
+		t.Fatalf("result should not have failed\n%s", vetOutput)
+	}
+	if e, a := 1, len(result.TestCases[0].Vets); e != a {
+		t.Fatalf("expVets=%d, actVets=%d", e, a)
+	}
+
+	// The result includes the matched vet diagnostic.
+	if a := result.TestCases[0].Vets[0].Output; !strings.HasSuffix(
+		a, "fmt.Printf format %d has arg s of wrong type string") {
+		t.Errorf("unexpected output: %s", a)
+	}
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"encoding/xml"
+	"os"
+	"sort"
+	"strings"
+)
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// WriteJUnit writes the provided result to the specified path as JUnit
+// XML. There is a test suite for each package, named after the package's
+// import path, and each lem ID is a test case in its package's suite. The
+// suites are sorted by import path.
+func WriteJUnit(path string, result Result) error {
+	var (
+		suites  []junitTestSuite
+		indices = map[string]int{}
+	)
+	for _, r := range result.TestCases {
+		i, ok := indices[r.Package]
+		if !ok {
+			i = len(suites)
+			indices[r.Package] = i
+			suites = append(suites, junitTestSuite{Name: r.Package})
+		}
+		suite := &suites[i]
+		suite.Tests++
+
+		tc := junitTestCase{
+			ClassName: r.Package,
+			Name:      r.ID,
+		}
+		if r.Failed {
+			suite.Failures++
+			tc.Failure = &junitFailure{
+				Message: strings.Join(r.Path, "/"),
+				Text:    strings.Join(r.Failures, "\n"),
+			}
+		}
+		if r.Skipped {
+			suite.Skipped++
+			tc.Skipped = &junitSkipped{Message: r.SkipReason}
+		}
+		suite.TestCases = append(suite.TestCases, tc)
+	}
+
+	sort.SliceStable(suites, func(i, j int) bool {
+		return suites[i].Name < suites[j].Name
+	})
+
+	data, err := xml.MarshalIndent(
+		junitTestSuites{Suites: suites}, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append([]byte(xml.Header), data...)
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/build"
+	"io"
+)
+
+// listPackage is the subset of the JSON emitted by "go list -json" that
+// is required to populate a build.Package.
+type listPackage struct {
+	Dir            string
+	ImportPath     string
+	Name           string
+	Root           string
+	Goroot         bool
+	GoFiles        []string
+	CgoFiles       []string
+	IgnoredGoFiles []string
+	TestGoFiles    []string
+	XTestGoFiles   []string
+	Imports        []string
+	TestImports    []string
+	XTestImports   []string
+	Error          *struct {
+		Err string
+	}
+}
+
+// hasNoGoFiles returns true if all of the package's Go files are excluded
+// by build constraints.
+func (lp listPackage) hasNoGoFiles() bool {
+	return len(lp.GoFiles) == 0 &&
+		len(lp.CgoFiles) == 0 &&
+		len(lp.TestGoFiles) == 0 &&
+		len(lp.XTestGoFiles) == 0 &&
+		len(lp.IgnoredGoFiles) > 0
+}
+
+// Load resolves the specified package patterns in module-aware mode
+// using "go list", the same driver used by golang.org/x/tools/go/packages,
+// and returns them as build.Package values.
+//
+// The patterns are resolved relative to dir, and the active go.mod file,
+// including any replace directives, is honored. The build tags from the
+// context's build context are also honored, as is the context's build
+// timeout.
+func Load(ctx Context, dir string, patterns ...string) ([]build.Package, error) {
+	args := []string{"list", "-e", "-json"}
+	args = append(args, getTagsArgs(ctx)...)
+	args = append(args, patterns...)
+
+	// The go command's stderr is included in the returned error.
+	var stdout bytes.Buffer
+	if err := runGoStreamsInDir(
+		&stdout, io.Discard, ctx, dir, args...); err != nil {
+
+		return nil, err
+	}
+
+	var pkgs []build.Package
+	dec := json.NewDecoder(&stdout)
+	for {
+		var lp listPackage
+		if err := dec.Decode(&lp); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		// A package whose Go files are all excluded by build constraints is
+		// not an error here so the caller may report it.
+		if lp.Error != nil && !lp.hasNoGoFiles() {
+			return nil, fmt.Errorf(
+				"failed to load pkg %s: %s", lp.ImportPath, lp.Error.Err)
+		}
+		pkgs = append(pkgs, build.Package{
+			Dir:            lp.Dir,
+			Name:           lp.Name,
+			ImportPath:     lp.ImportPath,
+			Root:           lp.Root,
+			Goroot:         lp.Goroot,
+			GoFiles:        lp.GoFiles,
+			CgoFiles:       lp.CgoFiles,
+			IgnoredGoFiles: lp.IgnoredGoFiles,
+			TestGoFiles:    lp.TestGoFiles,
+			XTestGoFiles:   lp.XTestGoFiles,
+			Imports:        lp.Imports,
+			TestImports:    lp.TestImports,
+			XTestImports:   lp.XTestImports,
+		})
+	}
+
+	return pkgs, nil
+}
@@ -0,0 +1,210 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// recordInsert is one or more lines to insert into a source file.
+type recordInsert struct {
+	line  int
+	after bool
+	lines []string
+}
+
+// Record writes the allocations and bytes per operation observed for the
+// test cases in the provided result back into the lem comments of the
+// source files in which the test cases are defined, and returns the paths
+// of the files that were modified.
+//
+// An alloc or bytes directive whose expected value does not match the
+// observed value is updated to the observed value, and a test case with a
+// benchmark but no alloc or bytes directive has the missing directive
+// added. Directives that already match the observed values are left as-is,
+// as are test cases with the noalloc directive and test cases defined in
+// sidecar files.
+func Record(ctx Context, tree *Tree, result Result) ([]string, error) {
+	var (
+		goarch  = getGOARCH(ctx)
+		files   = map[string][]string{}
+		inserts = map[string][]recordInsert{}
+	)
+
+	// getLines returns the lines of the specified file, reading it the
+	// first time it is requested.
+	getLines := func(filePath string) ([]string, error) {
+		if lines, ok := files[filePath]; ok {
+			return lines, nil
+		}
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			return nil, err
+		}
+		lines := strings.Split(string(data), "\n")
+		files[filePath] = lines
+		return lines, nil
+	}
+
+	for _, r := range result.TestCases {
+		br := r.Benchmark
+		if br == nil || r.Skipped {
+			continue
+		}
+		tc := tree.Get(r.ID)
+		if tc == nil || tc.noAlloc {
+			continue
+		}
+
+		var missing []string
+		for _, d := range []struct {
+			kind     string
+			expected Int64Range
+			observed int64
+		}{
+			{kind: "alloc", expected: br.ExpectedAllocOp, observed: br.AllocOp},
+			{kind: "bytes", expected: br.ExpectedBytesOp, observed: br.BytesOp},
+		} {
+			directive := d.kind
+			if _, ok := tc.directives[d.kind+":"+goarch]; ok {
+				directive = d.kind + ":" + goarch
+			}
+			value := strconv.FormatInt(d.observed, 10)
+			pos, ok := tc.directives[directive]
+			if !ok {
+				missing = append(missing,
+					fmt.Sprintf("// lem.%s.%s=%s", tc.ID, directive, value))
+				continue
+			}
+			if d.expected.Eq(d.observed) {
+				continue
+			}
+			filePath, lineNo, ok := splitPos(pos)
+			if !ok {
+				continue
+			}
+			lines, err := getLines(filePath)
+			if err != nil {
+				return nil, err
+			}
+			if lineNo > len(lines) {
+				return nil, fmt.Errorf("invalid position %s", pos)
+			}
+			rx := regexp.MustCompile(`(// lem\.` + regexp.QuoteMeta(tc.ID) +
+				`\.` + regexp.QuoteMeta(directive) + `=)\S+`)
+			lines[lineNo-1] = rx.ReplaceAllString(
+				lines[lineNo-1], "${1}"+value)
+		}
+		if len(missing) == 0 {
+			continue
+		}
+
+		// Add the missing directives next to the existing alloc or bytes
+		// directive, or the first directive of the test case.
+		pos := tc.origin()
+		for _, directive := range []string{"alloc", "bytes"} {
+			if p, ok := tc.directives[directive]; ok {
+				pos = p
+			}
+		}
+		filePath, lineNo, ok := splitPos(pos)
+		if !ok {
+			continue
+		}
+		lines, err := getLines(filePath)
+		if err != nil {
+			return nil, err
+		}
+		if lineNo > len(lines) {
+			return nil, fmt.Errorf("invalid position %s", pos)
+		}
+
+		// A directive on its own line is followed by the missing
+		// directives, otherwise they precede the line of code with the
+		// directive. Either way they have the same indentation.
+		line := lines[lineNo-1]
+		trimmed := strings.TrimLeft(line, " \t")
+		indent := line[:len(line)-len(trimmed)]
+		for i := range missing {
+			missing[i] = indent + missing[i]
+		}
+		inserts[filePath] = append(inserts[filePath], recordInsert{
+			line:  lineNo,
+			after: strings.HasPrefix(trimmed, "//"),
+			lines: missing,
+		})
+	}
+
+	var modified []string
+	for filePath, lines := range files {
+		// Insert the lines from the bottom of the file up so the line
+		// numbers of the remaining inserts are not affected.
+		fileInserts := inserts[filePath]
+		sort.SliceStable(fileInserts, func(i, j int) bool {
+			return fileInserts[i].line > fileInserts[j].line
+		})
+		for _, ins := range fileInserts {
+			i := ins.line - 1
+			if ins.after {
+				i++
+			}
+			lines = append(lines[:i],
+				append(append([]string{}, ins.lines...), lines[i:]...)...)
+		}
+		data := []byte(strings.Join(lines, "\n"))
+
+		prev, err := os.ReadFile(filePath)
+		if err != nil {
+			return nil, err
+		}
+		if string(prev) == string(data) {
+			continue
+		}
+		fi, err := os.Stat(filePath)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(filePath, data, fi.Mode()); err != nil {
+			return nil, err
+		}
+		modified = append(modified, filePath)
+	}
+	sort.Strings(modified)
+
+	return modified, nil
+}
+
+// splitPos returns the file path and line number of a directive's position,
+// ex. "/path/to/src.go:7". False is returned if the position does not end
+// with a line number, such as the position of a directive from a sidecar
+// file.
+func splitPos(pos string) (string, int, bool) {
+	i := strings.LastIndexByte(pos, ':')
+	if i < 0 {
+		return "", 0, false
+	}
+	lineNo, err := strconv.Atoi(pos[i+1:])
+	if err != nil || lineNo < 1 {
+		return "", 0, false
+	}
+	return pos[:i], lineNo, true
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// Report summarizes the test cases in a tree and the outcome of their
+// assertions.
+type Report struct {
+	// Failed is true if any of the test cases failed.
+	Failed bool `json:"failed"`
+
+	// TestCases is the list of test cases in the order in which they were
+	// run.
+	TestCases []ReportTestCase `json:"testCases"`
+}
+
+// ReportTestCase is a parsed test case and the outcome of its assertions.
+type ReportTestCase struct {
+	// TestCase is the test case parsed from the lem comments.
+	TestCase TestCase `json:"testCase"`
+
+	// Result is the outcome of the test case's assertions.
+	Result TestCaseResult `json:"result"`
+}
+
+// NewReport returns a new report for the provided tree and result.
+func NewReport(tree *Tree, result Result) Report {
+	report := Report{
+		Failed:    result.Failed(),
+		TestCases: []ReportTestCase{},
+	}
+	for _, r := range result.TestCases {
+		var tc TestCase
+		if p := tree.Get(r.ID); p != nil {
+			tc = *p
+		}
+		report.TestCases = append(report.TestCases, ReportTestCase{
+			TestCase: tc,
+			Result:   r,
+		})
+	}
+	return report
+}
+
+// WriteReport writes the report for the provided tree and result to the
+// specified path as JSON.
+func WriteReport(path string, tree *Tree, result Result) error {
+	data, err := json.MarshalIndent(NewReport(tree, result), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,57 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import "testing"
+
+// Reporter is the subset of the methods of *testing.T used to run the test
+// cases and report their results. It allows the test cases to be run
+// outside of a test binary, ex. by the lem command.
+//
+// Like *testing.T, the Fatal and Skip methods must stop the goroutine that
+// called them, which is the goroutine running the reporter's function.
+type Reporter interface {
+	Error(args ...interface{})
+	Errorf(format string, args ...interface{})
+	Failed() bool
+	Fatal(args ...interface{})
+	Fatalf(format string, args ...interface{})
+	Helper()
+	Log(args ...interface{})
+	Logf(format string, args ...interface{})
+	Skip(args ...interface{})
+	Skipped() bool
+
+	// Run runs fn as a subtest of the reporter called name and returns
+	// whether fn succeeded.
+	Run(name string, fn func(r Reporter)) bool
+}
+
+// NewTestingReporter returns a Reporter for the provided test.
+func NewTestingReporter(t *testing.T) Reporter {
+	return testingReporter{T: t}
+}
+
+type testingReporter struct {
+	*testing.T
+}
+
+func (r testingReporter) Run(name string, fn func(r Reporter)) bool {
+	return r.T.Run(name, func(t *testing.T) {
+		fn(testingReporter{T: t})
+	})
+}
@@ -0,0 +1,276 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Result is the result of running a tree of test cases.
+type Result struct {
+	// TestCases is the result of each of the test cases in the order in
+	// which they were run.
+	TestCases []TestCaseResult `json:"testCases"`
+
+	// BuildOutputs is the optimization output of each of the built packages,
+	// keyed by the import paths with which the packages were built. It is
+	// nil if the build output was supplied rather than built, or if it was
+	// indexed as it was built.
+	BuildOutputs map[string]string `json:"buildOutputs,omitempty"`
+}
+
+// Failed returns true if any of the test cases failed.
+func (r Result) Failed() bool {
+	for _, tc := range r.TestCases {
+		if tc.Failed {
+			return true
+		}
+	}
+	return false
+}
+
+// Summary returns a summary of the result that includes the number of test
+// cases that passed, failed, and were skipped, as well as the IDs of the
+// failed test cases along with a one-line reason for each failure.
+func (r Result) Summary() string {
+	var (
+		passed, failed, skipped int
+		sb                      strings.Builder
+	)
+	for _, tc := range r.TestCases {
+		switch {
+		case tc.Failed:
+			failed++
+			reasons := make([]string, len(tc.Failures))
+			for i, f := range tc.Failures {
+				reasons[i] = getFailureReason(f)
+			}
+			fmt.Fprintf(&sb, "\t%s: %s\n", tc.ID, strings.Join(reasons, "; "))
+		case tc.Skipped:
+			skipped++
+		default:
+			passed++
+		}
+	}
+	s := fmt.Sprintf(
+		"summary: %d test case(s), %d passed, %d failed, %d skipped\n",
+		len(r.TestCases), passed, failed, skipped)
+	if failed > 0 {
+		s += "failed:\n" + sb.String()
+	}
+	return s
+}
+
+// getFailureReason returns a one-line reason for the provided failure
+// message, ex. "build optimization: not found" for a message with the
+// lines "error: build optimization" and "reason: not found", otherwise
+// the first line of the message.
+func getFailureReason(msg string) string {
+	lines := strings.Split(msg, "\n")
+	if !strings.HasPrefix(lines[0], "error: ") {
+		return lines[0]
+	}
+	reason := strings.TrimPrefix(lines[0], "error: ")
+	for _, l := range lines[1:] {
+		if strings.HasPrefix(l, "reason: ") {
+			return reason + ": " + strings.TrimPrefix(l, "reason: ")
+		}
+	}
+	return reason
+}
+
+// TestCaseResult is the result of running a single test case.
+type TestCaseResult struct {
+	// ID maps to lem.<ID>.
+	ID string `json:"id"`
+
+	// Package is the import path of the package in which the test case is
+	// defined.
+	Package string `json:"package,omitempty"`
+
+	// Path is the path of the test case in the tree.
+	Path []string `json:"path"`
+
+	// Failed is true if any of the test case's assertions failed.
+	Failed bool `json:"failed"`
+
+	// Skipped is true if the test case was skipped, ex. because of the
+	// lem.<ID>.skip directive.
+	Skipped bool `json:"skipped,omitempty"`
+
+	// SkipReason is the reason the test case was skipped.
+	SkipReason string `json:"skipReason,omitempty"`
+
+	// Matches are the results of the test case's lem.<ID>.m= assertions.
+	Matches []LineMatcherResult `json:"matches,omitempty"`
+
+	// Natches are the results of the test case's lem.<ID>.m!= assertions.
+	Natches []LineMatcherResult `json:"natches,omitempty"`
+
+	// Seqs are the results of the test case's lem.<ID>.mseq= assertions,
+	// in the order of the sequences and then the patterns in each sequence.
+	Seqs []LineMatcherResult `json:"seqs,omitempty"`
+
+	// Nones are the results of the test case's lem.<ID>.none= assertions.
+	Nones []LineMatcherResult `json:"nones,omitempty"`
+
+	// Vets are the results of the test case's lem.<ID>.vet= assertions.
+	Vets []LineMatcherResult `json:"vets,omitempty"`
+
+	// Counts are the results of the test case's lem.<ID>.mcount=
+	// assertions.
+	Counts []LineMatcherResult `json:"counts,omitempty"`
+
+	// Devirts are the results of the test case's lem.<ID>.devirt=
+	// assertions.
+	Devirts []LineMatcherResult `json:"devirts,omitempty"`
+
+	// Blocks are the results of the test case's lem.<ID>.mblock=
+	// assertions.
+	Blocks []LineMatcherResult `json:"blocks,omitempty"`
+
+	// Asm are the results of the test case's lem.<ID>.asm= assertions.
+	Asm []LineMatcherResult `json:"asm,omitempty"`
+
+	// AsmNatches are the results of the test case's
+	// lem.<ID>.noruntime-alloc assertions.
+	AsmNatches []LineMatcherResult `json:"asmNatches,omitempty"`
+
+	// FrameSize is the result of the test case's lem.<ID>.framesize=
+	// assertion, or nil if there was no such assertion.
+	FrameSize *FrameSizeResult `json:"frameSize,omitempty"`
+
+	// Escapes is the number of heap escapes and moves in the build
+	// optimization output for the lines asserted by the test case's match
+	// directives, or nil if the test case has no such directives.
+	Escapes *int64 `json:"escapes,omitempty"`
+
+	// Benchmark is the result of the test case's benchmark, or nil if the
+	// test case was not benchmarked.
+	Benchmark *BenchmarkResult `json:"benchmark,omitempty"`
+
+	// Failures is the text of each failed assertion.
+	Failures []string `json:"failures,omitempty"`
+}
+
+// LineMatcherResult is the result of matching a LineMatcher against the
+// build optimization output.
+type LineMatcherResult struct {
+	// Regexp is the pattern matched against the build optimization output.
+	Regexp string `json:"regexp"`
+
+	// Source is the line of source code for which the matcher was built.
+	Source string `json:"source"`
+
+	// Output is the build optimization output matched by Regexp, or an
+	// empty string if there was no match.
+	Output string `json:"output"`
+
+	// Groups are the values captured by the named groups in Regexp, ex.
+	// (?P<level>\d+), keyed by the groups' names. It is nil if Regexp has
+	// no named groups or did not match.
+	Groups map[string]string `json:"groups,omitempty"`
+
+	// Count is the number of times Regexp matched the build optimization
+	// output, or nil if the assertion was not a count assertion.
+	Count *int64 `json:"count,omitempty"`
+
+	// Failed is true if the assertion failed.
+	Failed bool `json:"failed"`
+}
+
+// FrameSizeResult is the result of asserting the expected stack frame size
+// of a function.
+type FrameSizeResult struct {
+	// Expected is the expected frame size.
+	Expected Int64Range `json:"expected"`
+
+	// FrameSize is the observed frame size.
+	FrameSize int64 `json:"frameSize"`
+
+	// Failed is true if the frame size did not match or the function's
+	// assembly was not found.
+	Failed bool `json:"failed"`
+}
+
+// BenchmarkResult is the result of asserting the expected allocations and
+// bytes for a test case's benchmark.
+type BenchmarkResult struct {
+	// ExpectedAllocOp is the expected number of allocations per operation.
+	ExpectedAllocOp Int64Range `json:"expectedAllocOp"`
+
+	// ExpectedBytesOp is the expected number of bytes per operation.
+	ExpectedBytesOp Int64Range `json:"expectedBytesOp"`
+
+	// AllocOp is the observed number of allocations per operation.
+	AllocOp int64 `json:"allocOp"`
+
+	// BytesOp is the observed number of bytes per operation.
+	BytesOp int64 `json:"bytesOp"`
+
+	// ExpectedMetrics are the expected values of the custom metrics.
+	ExpectedMetrics map[string]Int64Range `json:"expectedMetrics,omitempty"`
+
+	// Metrics are the observed values of the custom metrics.
+	Metrics map[string]float64 `json:"metrics,omitempty"`
+
+	// Failed is true if the allocations, bytes, or any of the custom metrics
+	// did not match.
+	Failed bool `json:"failed"`
+}
+
+// resultSet accumulates test case results as a tree is run. Each test case
+// reserves the slot for its result before it is run, so the results are in
+// the order the test cases were declared even when they are run in parallel.
+type resultSet struct {
+	sync.Mutex
+	testCases []TestCaseResult
+	ok        []bool
+}
+
+// reserve returns the index of the slot for the next test case's result.
+func (rs *resultSet) reserve() int {
+	rs.Lock()
+	defer rs.Unlock()
+	rs.testCases = append(rs.testCases, TestCaseResult{})
+	rs.ok = append(rs.ok, false)
+	return len(rs.testCases) - 1
+}
+
+// set stores the result in the slot with the provided index.
+func (rs *resultSet) set(i int, r TestCaseResult) {
+	rs.Lock()
+	defer rs.Unlock()
+	rs.testCases[i] = r
+	rs.ok[i] = true
+}
+
+// results returns the stored results, skipping the slots of the test cases
+// that were not run, ex. because they were excluded by -test.run.
+func (rs *resultSet) results() []TestCaseResult {
+	rs.Lock()
+	defer rs.Unlock()
+	var results []TestCaseResult
+	for i, r := range rs.testCases {
+		if rs.ok[i] {
+			results = append(results, r)
+		}
+	}
+	return results
+}
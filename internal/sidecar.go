@@ -0,0 +1,213 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// SidecarFileName is the name of the file adjacent to a package's sources
+// that may declare test cases in place of, or in addition to, the lem
+// comments in the sources.
+const SidecarFileName = "lem.json"
+
+// sidecar is the format of a sidecar file.
+type sidecar struct {
+	TestCases []sidecarTestCase `json:"testCases"`
+}
+
+// sidecarTestCase is a test case declared in a sidecar file. The fields
+// map to the lem comments with the same names.
+type sidecarTestCase struct {
+	ID      string           `json:"id"`
+	Name    string           `json:"name,omitempty"`
+	Alloc   string           `json:"alloc,omitempty"`
+	Bytes   string           `json:"bytes,omitempty"`
+	Matches []sidecarMatcher `json:"matches,omitempty"`
+	Natches []sidecarMatcher `json:"natches,omitempty"`
+}
+
+// sidecarMatcher is a match or natch assertion declared in a sidecar file.
+// Since the assertion is not adjacent to the source it asserts, the file,
+// relative to the sidecar file, and line are explicit.
+type sidecarMatcher struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Pattern string `json:"pattern"`
+}
+
+// getTestCasesInSidecar returns the test cases declared in the specified
+// sidecar file. The test cases are merged with any test cases in the
+// provided lookup table, and an error is returned if the sidecar file
+// repeats a directive that was already specified.
+func getTestCasesInSidecar(
+	filePath string,
+	lookupTbl testCaseLookupTable) ([]*TestCase, error) {
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	var sc sidecar
+	if err := json.Unmarshal(data, &sc); err != nil {
+		return nil, fmt.Errorf("invalid sidecar %s: %w", filePath, err)
+	}
+
+	if lookupTbl == nil {
+		lookupTbl = testCaseLookupTable{}
+	}
+
+	var (
+		testCases []*TestCase
+		dir       = filepath.Dir(filePath)
+		lines     = map[string][]string{}
+	)
+
+	for i, stc := range sc.TestCases {
+		pos := fmt.Sprintf("%s:testCases[%d]", filePath, i)
+		if stc.ID == "" {
+			return nil, fmt.Errorf("missing id at %s", pos)
+		}
+
+		// getTestCase returns the test case for the sidecar test case's
+		// ID, creating it if it does not yet exist, and records the
+		// position of the directive, returning an error if the same
+		// directive was already specified for the test case.
+		getTestCase := func(directive string) (*TestCase, error) {
+			tc, created := lookupTbl.GetOrCreate(stc.ID)
+			if created {
+				testCases = append(testCases, tc)
+			}
+			if prevPos, ok := tc.addDirective(directive, pos); ok {
+				return nil, fmt.Errorf(
+					"duplicate lem.%s.%s at %s and %s",
+					stc.ID, directive, prevPos, pos)
+			}
+			return tc, nil
+		}
+
+		// getLineMatcher returns a line matcher for the provided sidecar
+		// matcher and the function used to build its regular expression.
+		getLineMatcher := func(
+			sm sidecarMatcher,
+			newRegexp func(string, int, string) (*regexp.Regexp, error)) (
+			LineMatcher, error) {
+
+			srcPath := sm.File
+			if !filepath.IsAbs(srcPath) {
+				srcPath = filepath.Join(dir, srcPath)
+			}
+			absSrcPath, err := filepath.Abs(srcPath)
+			if err != nil {
+				return LineMatcher{}, err
+			}
+			srcLines, ok := lines[absSrcPath]
+			if !ok {
+				if srcLines, err = readLines(absSrcPath); err != nil {
+					return LineMatcher{}, err
+				}
+				lines[absSrcPath] = srcLines
+			}
+			if sm.Line < 1 || sm.Line > len(srcLines) {
+				return LineMatcher{}, fmt.Errorf(
+					"invalid line at %s: line %d is out of range 1-%d",
+					pos, sm.Line, len(srcLines))
+			}
+			fileName := filepath.Base(absSrcPath)
+			r, err := newRegexp(fileName, sm.Line, sm.Pattern)
+			if err != nil {
+				return LineMatcher{}, err
+			}
+			return LineMatcher{
+				Regexp: r,
+				Source: srcLines[sm.Line-1],
+				File:   fileName,
+				Line:   sm.Line,
+				Path:   absSrcPath,
+			}, nil
+		}
+
+		// Ensure the test case exists even if it has no assertions.
+		tc, created := lookupTbl.GetOrCreate(stc.ID)
+		if created {
+			testCases = append(testCases, tc)
+		}
+
+		if stc.Name != "" {
+			if tc, err = getTestCase("name"); err != nil {
+				return nil, err
+			}
+			tc.Name = stc.Name
+		}
+		if stc.Alloc != "" {
+			if tc, err = getTestCase("alloc"); err != nil {
+				return nil, err
+			}
+			r, err := parseInt64Range(stc.Alloc)
+			if err != nil {
+				return nil, fmt.Errorf("invalid alloc at %s: %w", pos, err)
+			}
+			if tc.noAlloc && r != (Int64Range{}) {
+				return nil, fmt.Errorf(
+					"lem.%s.alloc=%s conflicts with lem.%s.noalloc",
+					tc.ID, stc.Alloc, tc.ID)
+			}
+			tc.AllocOp = r
+		}
+		if stc.Bytes != "" {
+			if tc, err = getTestCase("bytes"); err != nil {
+				return nil, err
+			}
+			r, err := parseBytesRange(stc.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("invalid bytes at %s: %w", pos, err)
+			}
+			if tc.noAlloc && r != (Int64Range{}) {
+				return nil, fmt.Errorf(
+					"lem.%s.bytes=%s conflicts with lem.%s.noalloc",
+					tc.ID, stc.Bytes, tc.ID)
+			}
+			tc.BytesOp = r
+		}
+		for _, sm := range stc.Matches {
+			lm, err := getLineMatcher(sm, newMatchRegexp)
+			if err != nil {
+				return nil, err
+			}
+			if tc, err = getTestCase("m=" + lm.Regexp.String()); err != nil {
+				return nil, err
+			}
+			tc.Matches = append(tc.Matches, lm)
+		}
+		for _, sm := range stc.Natches {
+			lm, err := getLineMatcher(sm, newNatchRegexp)
+			if err != nil {
+				return nil, err
+			}
+			if tc, err = getTestCase("m!=" + lm.Regexp.String()); err != nil {
+				return nil, err
+			}
+			tc.Natches = append(tc.Natches, lm)
+		}
+	}
+
+	return testCases, nil
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// tempFiles are the names of the temporary files that have not yet been
+// removed, so they may be removed if the process is interrupted.
+var tempFiles struct {
+	sync.Mutex
+	names   map[string]struct{}
+	signals chan os.Signal
+}
+
+// newTempFile returns the name of a new, temporary file in the specified
+// directory, or the default directory for temporary files if empty, and a
+// function that removes the file. The file itself is removed before the
+// name is returned so the name may be used as the output of the go command.
+//
+// Until the returned function is called, the file is also removed if the
+// process receives an interrupt or termination signal, after which the
+// signal is raised again so the process exits as it would have otherwise.
+func newTempFile(dir string) (string, func(), error) {
+	tempFile, err := os.CreateTemp(dir, "")
+	if err != nil {
+		return "", nil, err
+	}
+	tempFileName := tempFile.Name()
+	if err := tempFile.Close(); err != nil {
+		return "", nil, err
+	}
+	if err := os.RemoveAll(tempFileName); err != nil {
+		return "", nil, err
+	}
+
+	tempFiles.Lock()
+	defer tempFiles.Unlock()
+	if tempFiles.names == nil {
+		tempFiles.names = map[string]struct{}{}
+	}
+	tempFiles.names[tempFileName] = struct{}{}
+
+	// Handle the signals only while there are temporary files so the
+	// default behavior is otherwise unchanged.
+	if tempFiles.signals == nil {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+		tempFiles.signals = ch
+		go handleTempFileSignals(ch)
+	}
+
+	var once sync.Once
+	return tempFileName, func() {
+		once.Do(func() { removeTempFile(tempFileName) })
+	}, nil
+}
+
+// removeTempFile removes the specified temporary file and, if it was the
+// last one, stops handling the signals.
+func removeTempFile(name string) {
+	tempFiles.Lock()
+	defer tempFiles.Unlock()
+	os.RemoveAll(name)
+	delete(tempFiles.names, name)
+	if len(tempFiles.names) == 0 && tempFiles.signals != nil {
+		signal.Stop(tempFiles.signals)
+		close(tempFiles.signals)
+		tempFiles.signals = nil
+	}
+}
+
+// handleTempFileSignals removes all of the temporary files when a signal is
+// received on the provided channel, and then stops handling the signals and
+// raises the signal again so it has its default behavior. The function
+// returns without doing anything if the channel is closed instead.
+func handleTempFileSignals(ch chan os.Signal) {
+	sig, ok := <-ch
+	if !ok {
+		return
+	}
+
+	tempFiles.Lock()
+	for name := range tempFiles.names {
+		os.RemoveAll(name)
+		delete(tempFiles.names, name)
+	}
+	signal.Stop(ch)
+	if tempFiles.signals == ch {
+		tempFiles.signals = nil
+	}
+	tempFiles.Unlock()
+
+	if p, err := os.FindProcess(os.Getpid()); err == nil {
+		if err := p.Signal(sig); err == nil {
+			return
+		}
+	}
+	os.Exit(1)
+}
@@ -17,14 +17,21 @@ limitations under the License.
 package internal
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"go/build"
 	"go/parser"
 	"go/token"
+	"math"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
 )
 
 // LineMatcher is a regular expression used to patch an expected expression
@@ -35,10 +42,125 @@ type LineMatcher struct {
 
 	// Source is the line of source code for which this matcher was built.
 	Source string
+
+	// File is the base name of the file in which the matcher was defined.
+	File string
+
+	// Line is the line for which the matcher was built.
+	Line int
+
+	// Path is the absolute path of the file in which the matcher was
+	// defined. It is used to tell apart files with the same base name
+	// when the build optimization output includes dependencies.
+	Path string
+
+	// Count is the expected number of times Regexp matches the build
+	// optimization output, or nil if the matcher only asserts whether
+	// Regexp matches.
+	Count *Int64Range
+
+	// lastLine is the last line for which the matcher was built if the
+	// matcher spans multiple lines, ex. lem.<ID>.fn=.
+	lastLine int
+}
+
+// lines returns the first and last lines for which the matcher was built.
+func (lm LineMatcher) lines() (int, int) {
+	if lm.lastLine > lm.Line {
+		return lm.Line, lm.lastLine
+	}
+	return lm.Line, lm.Line
+}
+
+// lineMatcherJSON is the JSON representation of a LineMatcher.
+type lineMatcherJSON struct {
+	Regexp string      `json:"regexp"`
+	Source string      `json:"source"`
+	File   string      `json:"file,omitempty"`
+	Line   int         `json:"line,omitempty"`
+	Count  *Int64Range `json:"count,omitempty"`
+}
+
+// MarshalJSON encodes the matcher as JSON, serializing the regular
+// expression as its string.
+func (lm LineMatcher) MarshalJSON() ([]byte, error) {
+	var obj lineMatcherJSON
+	if lm.Regexp != nil {
+		obj.Regexp = lm.Regexp.String()
+	}
+	obj.Source = lm.Source
+	obj.File = lm.File
+	obj.Line = lm.Line
+	obj.Count = lm.Count
+	return json.Marshal(obj)
+}
+
+// UnmarshalJSON decodes the matcher from JSON, compiling the regular
+// expression from its string.
+func (lm *LineMatcher) UnmarshalJSON(data []byte) error {
+	var obj lineMatcherJSON
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return err
+	}
+	lm.Source = obj.Source
+	lm.File = obj.File
+	lm.Line = obj.Line
+	lm.Count = obj.Count
+	lm.Regexp = nil
+	if obj.Regexp != "" {
+		r, err := regexp.Compile(obj.Regexp)
+		if err != nil {
+			return err
+		}
+		lm.Regexp = r
+	}
+	return nil
+}
+
+// FindLineOutput returns all of the build optimization output emitted for
+// the file and line for which the matcher was built, regardless of whether
+// the output matches the matcher's regular expression.
+func (lm LineMatcher) FindLineOutput(buildOutput string) []string {
+	if lm.File == "" || lm.Line == 0 {
+		return nil
+	}
+	r := regexp.MustCompile(getFileLinePrefix(lm.File, lm.Line) + " .*$")
+	return r.FindAllString(buildOutput, -1)
+}
+
+// less returns true if the matcher sorts before the provided matcher by
+// file, line, path, and then pattern.
+func (lm LineMatcher) less(b LineMatcher) bool {
+	if lm.File != b.File {
+		return lm.File < b.File
+	}
+	if lm.Line != b.Line {
+		return lm.Line < b.Line
+	}
+	if lm.Path != b.Path {
+		return lm.Path < b.Path
+	}
+	return lm.regexpString() < b.regexpString()
+}
+
+// regexpString returns the matcher's pattern, or an empty string if the
+// matcher has no regular expression.
+func (lm LineMatcher) regexpString() string {
+	if lm.Regexp == nil {
+		return ""
+	}
+	return lm.Regexp.String()
 }
 
 func (lm LineMatcher) deepEqual(b LineMatcher) bool {
-	if lm.Source != b.Source {
+	if lm.Source != b.Source || lm.File != b.File || lm.Line != b.Line ||
+		lm.Path != b.Path || lm.lastLine != b.lastLine {
+		return false
+	}
+	if (lm.Count == nil) != (b.Count == nil) {
+		return false
+	}
+	if lm.Count != nil && !lm.Count.deepEqual(*b.Count) {
 		return false
 	}
 	ar, br := lm.Regexp, b.Regexp
@@ -57,27 +179,127 @@ func (lm LineMatcher) deepEqual(b LineMatcher) bool {
 // TestCase is a test case parsed from the lem comments in a source file.
 type TestCase struct {
 	// ID maps to lem.<ID>.
-	ID string
+	ID string `json:"id"`
 
 	// Name maps to lem.<ID>.name=<NAME>.
 	// Please see the lem package documentation for more information.
-	Name string
+	Name string `json:"name"`
 
-	// AllocOp maps to lem.<ID>.alloc=\d+(-\d+)? and is the expected number
+	// Suite maps to lem.<ID>.suite=<NAME> and is prepended to the path of
+	// the test case, so all of the test cases in the same suite are
+	// grouped under it in the tree of tests.
+	Suite string `json:"suite,omitempty"`
+
+	// AllocOp maps to lem.<ID>.alloc=<RANGE> and is the expected number
 	// of allocations per operation.
-	AllocOp Int64Range
+	AllocOp Int64Range `json:"allocOp"`
+
+	// AllocOpByArch maps to lem.<ID>.alloc:<GOARCH>=<RANGE> and is the
+	// expected number of allocations per operation for a specific
+	// architecture. If there is no entry for the target architecture then
+	// AllocOp is used.
+	AllocOpByArch map[string]Int64Range `json:"allocOpByArch,omitempty"`
 
-	// BytesOp maps to lem.<ID>.bytes=\d+(-\d+)? and is the expected number
+	// BytesOp maps to lem.<ID>.bytes=<RANGE> and is the expected number
 	// of bytes per per operation.
-	BytesOp Int64Range
+	BytesOp Int64Range `json:"bytesOp"`
 
-	// Matches maps to lem.<ID>.m= and is a list of patterns that must appear
-	// in the optimization output.
-	Matches []LineMatcher
+	// BytesOpByArch maps to lem.<ID>.bytes:<GOARCH>=<RANGE> and is the
+	// expected number of bytes per operation for a specific architecture.
+	// If there is no entry for the target architecture then BytesOp is used.
+	BytesOpByArch map[string]Int64Range `json:"bytesOpByArch,omitempty"`
+
+	// Metrics maps to lem.<ID>.metric:<NAME>=<RANGE> and is the expected
+	// value of a custom metric reported by the test case's benchmark with
+	// b.ReportMetric, ex. "copies/op".
+	Metrics map[string]Int64Range `json:"metrics,omitempty"`
+
+	// Matches maps to lem.<ID>.m=, lem.<ID>.fn=, lem.<ID>.move=, and
+	// lem.<ID>.escape= and is a list of patterns that must appear in the
+	// optimization output.
+	Matches []LineMatcher `json:"matches,omitempty"`
 
 	// Natches maps to lem.<ID>.m!= and is a list of patterns that must appear
 	// in the optimization output.
-	Natches []LineMatcher
+	Natches []LineMatcher `json:"natches,omitempty"`
+
+	// Seqs maps to lem.<ID>.mseq= and is a list of groups of patterns that
+	// must all appear in the optimization output for the same line, in the
+	// order in which they were defined. The directives are grouped by the
+	// line to which they apply.
+	Seqs [][]LineMatcher `json:"seqs,omitempty"`
+
+	// Nones maps to lem.<ID>.none= and is a list of patterns that must not
+	// appear anywhere in the optimization output. Unlike Natches, the
+	// patterns are not anchored to a file or line.
+	Nones []LineMatcher `json:"nones,omitempty"`
+
+	// Vets maps to lem.<ID>.vet= and is a list of patterns that must appear
+	// in the "go vet" output.
+	Vets []LineMatcher `json:"vets,omitempty"`
+
+	// Counts maps to lem.<ID>.mcount=<REGEX>:<RANGE> and is a list of
+	// patterns that must appear in the optimization output the expected
+	// number of times.
+	Counts []LineMatcher `json:"counts,omitempty"`
+
+	// Devirts maps to lem.<ID>.devirt= and is a list of patterns for the
+	// calls that must be devirtualized.
+	Devirts []LineMatcher `json:"devirts,omitempty"`
+
+	// Blocks maps to lem.<ID>.mblock= and is a list of patterns that must
+	// match a block of consecutive lines of optimization output for the
+	// same position, ex. a message and its continuation lines.
+	Blocks []LineMatcher `json:"blocks,omitempty"`
+
+	// Asm maps to lem.<ID>.asm= and is a list of patterns that must appear
+	// in the assembly output for the function in which the directive
+	// appears, or which the directive documents.
+	Asm []AsmMatcher `json:"asm,omitempty"`
+
+	// AsmNatches maps to lem.<ID>.noruntime-alloc and is a list of patterns
+	// that must not appear in the assembly output for the function in which
+	// the directive appears, or which the directive documents.
+	AsmNatches []AsmMatcher `json:"asmNatches,omitempty"`
+
+	// Benchtime maps to lem.<ID>.benchtime=<BENCHTIME> and is the value of
+	// the -test.benchtime flag used when running the test case's benchmark,
+	// ex. "100000x" or "2s".
+	Benchtime string `json:"benchtime,omitempty"`
+
+	// Env maps to lem.<ID>.env=<NAME>=<VALUE> and is the environment set
+	// while running the test case's benchmark, ex. GOMAXPROCS=1. Please see
+	// WithEnv for how the variables are applied.
+	Env map[string]string `json:"env,omitempty"`
+
+	// FrameSize maps to lem.<ID>.framesize=<RANGE> and is the expected
+	// stack frame size of the function in which the directive appears, or
+	// which the directive documents.
+	FrameSize *AsmFrameSize `json:"frameSize,omitempty"`
+
+	// Skip maps to lem.<ID>.skip and lem.<ID>.skip=<REASON> and is true if
+	// the test case should be skipped instead of asserted.
+	Skip bool `json:"skip,omitempty"`
+
+	// SkipReason is the optional reason the test case is skipped.
+	SkipReason string `json:"skipReason,omitempty"`
+
+	// Tags maps to lem.<ID>.tags=<TAG>[,<TAG>...] and are the build tags
+	// that must all be configured for the test case to run. Otherwise the
+	// test case is skipped.
+	Tags []string `json:"tags,omitempty"`
+
+	// Package is the import path of the package in which the test case is
+	// defined. Please see SetPackages for more information.
+	Package string `json:"package,omitempty"`
+
+	// noAlloc is true if lem.<ID>.noalloc or lem.<ID>.fn.noalloc was
+	// specified.
+	noAlloc bool
+
+	// directives maps the directives parsed for this test case to the
+	// position at which they were defined.
+	directives map[string]string
 }
 
 func (tc TestCase) deepEqual(b TestCase) bool {
@@ -87,12 +309,27 @@ func (tc TestCase) deepEqual(b TestCase) bool {
 	if tc.Name != b.Name {
 		return false
 	}
+	if tc.Suite != b.Suite {
+		return false
+	}
+	if tc.Package != b.Package {
+		return false
+	}
 	if !tc.AllocOp.deepEqual(b.AllocOp) {
 		return false
 	}
+	if !int64RangeMapDeepEqual(tc.AllocOpByArch, b.AllocOpByArch) {
+		return false
+	}
 	if !tc.BytesOp.deepEqual(b.BytesOp) {
 		return false
 	}
+	if !int64RangeMapDeepEqual(tc.BytesOpByArch, b.BytesOpByArch) {
+		return false
+	}
+	if !int64RangeMapDeepEqual(tc.Metrics, b.Metrics) {
+		return false
+	}
 	if len(tc.Matches) != len(b.Matches) {
 		return false
 	}
@@ -109,13 +346,322 @@ func (tc TestCase) deepEqual(b TestCase) bool {
 			return false
 		}
 	}
+	if len(tc.Seqs) != len(b.Seqs) {
+		return false
+	}
+	for i := range tc.Seqs {
+		if len(tc.Seqs[i]) != len(b.Seqs[i]) {
+			return false
+		}
+		for j := range tc.Seqs[i] {
+			if !tc.Seqs[i][j].deepEqual(b.Seqs[i][j]) {
+				return false
+			}
+		}
+	}
+	if len(tc.Nones) != len(b.Nones) {
+		return false
+	}
+	for i := range tc.Nones {
+		if !tc.Nones[i].deepEqual(b.Nones[i]) {
+			return false
+		}
+	}
+	if len(tc.Vets) != len(b.Vets) {
+		return false
+	}
+	for i := range tc.Vets {
+		if !tc.Vets[i].deepEqual(b.Vets[i]) {
+			return false
+		}
+	}
+	if len(tc.Counts) != len(b.Counts) {
+		return false
+	}
+	for i := range tc.Counts {
+		if !tc.Counts[i].deepEqual(b.Counts[i]) {
+			return false
+		}
+	}
+	if len(tc.Devirts) != len(b.Devirts) {
+		return false
+	}
+	for i := range tc.Devirts {
+		if !tc.Devirts[i].deepEqual(b.Devirts[i]) {
+			return false
+		}
+	}
+	if len(tc.Blocks) != len(b.Blocks) {
+		return false
+	}
+	for i := range tc.Blocks {
+		if !tc.Blocks[i].deepEqual(b.Blocks[i]) {
+			return false
+		}
+	}
+	if len(tc.Asm) != len(b.Asm) {
+		return false
+	}
+	for i := range tc.Asm {
+		if !tc.Asm[i].deepEqual(b.Asm[i]) {
+			return false
+		}
+	}
+	if len(tc.AsmNatches) != len(b.AsmNatches) {
+		return false
+	}
+	for i := range tc.AsmNatches {
+		if !tc.AsmNatches[i].deepEqual(b.AsmNatches[i]) {
+			return false
+		}
+	}
+	if !tc.FrameSize.deepEqual(b.FrameSize) {
+		return false
+	}
+	if tc.Benchtime != b.Benchtime {
+		return false
+	}
+	if len(tc.Env) != len(b.Env) {
+		return false
+	}
+	for k, v := range tc.Env {
+		if bv, ok := b.Env[k]; !ok || v != bv {
+			return false
+		}
+	}
+	if tc.Skip != b.Skip || tc.SkipReason != b.SkipReason {
+		return false
+	}
+	if len(tc.Tags) != len(b.Tags) {
+		return false
+	}
+	for i := range tc.Tags {
+		if tc.Tags[i] != b.Tags[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func int64RangeMapDeepEqual(a, b map[string]Int64Range) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for ak, av := range a {
+		if bv, ok := b[ak]; !ok || !av.deepEqual(bv) {
+			return false
+		}
+	}
 	return true
 }
 
-// Path returns the test case path from the provided ID and name.
+// addDirective records the position of the specified directive. If the
+// directive was already recorded then the position of the previous
+// directive is returned along with true.
+func (tc *TestCase) addDirective(directive, pos string) (string, bool) {
+	if prevPos, ok := tc.directives[directive]; ok {
+		return prevPos, true
+	}
+	if tc.directives == nil {
+		tc.directives = map[string]string{}
+	}
+	tc.directives[directive] = pos
+	return "", false
+}
+
+// origin returns the position of the first directive of the test case,
+// ex. "/path/to/src.go:7", or "unknown" if the position is not known.
+func (tc TestCase) origin() string {
+	var (
+		origin   string
+		file     string
+		lineNo   int
+		hasFirst bool
+	)
+	for _, pos := range tc.directives {
+		i := strings.LastIndexByte(pos, ':')
+		if i < 0 {
+			continue
+		}
+		// Positions from sidecar files do not end with a line number.
+		n, _ := strconv.Atoi(pos[i+1:])
+		if !hasFirst || pos[:i] < file || (pos[:i] == file && n < lineNo) {
+			origin, file, lineNo, hasFirst = pos, pos[:i], n, true
+		}
+	}
+	if !hasFirst {
+		return "unknown"
+	}
+	return origin
+}
+
+// SetPackages sets the package of each of the provided test cases to the
+// import path of the package whose directory contains the test case's
+// first directive. The package of a test case whose first directive is not
+// in any of the packages' directories is not modified.
+func SetPackages(testCases []TestCase, pkgs []build.Package) {
+	importPaths := map[string]string{}
+	for _, pkg := range pkgs {
+		importPaths[filepath.Clean(pkg.Dir)] = pkg.ImportPath
+	}
+	for i := range testCases {
+		// Positions end with a line number for source files, and the
+		// index of the test case for sidecar files.
+		origin := testCases[i].origin()
+		j := strings.LastIndexByte(origin, ':')
+		if j < 0 {
+			continue
+		}
+		if importPath, ok := importPaths[filepath.Dir(origin[:j])]; ok {
+			testCases[i].Package = importPath
+		}
+	}
+}
+
+// getTargetLine returns the line to which a positional directive on the
+// specified line applies, given the directive's optional offset, ex. "+1"
+// for the next line or "-1" for the previous line.
+func getTargetLine(lineNo int, offset string, numLines int) (int, error) {
+	if offset == "" {
+		return lineNo, nil
+	}
+	n, err := strconv.Atoi(offset)
+	if err != nil {
+		return 0, err
+	}
+	target := lineNo + n
+	if target < 1 || target > numLines {
+		return 0, fmt.Errorf(
+			"line %d is out of range 1-%d", target, numLines)
+	}
+	return target, nil
+}
+
+// knownDirectives are the names of the directives that may follow
+// "lem.<ID>.", used to distinguish an invalid directive from an unknown one.
+var knownDirectives = map[string]bool{
+	"alloc":     true,
+	"asm":       true,
+	"benchtime": true,
+	"bytes":     true,
+	"devirt":    true,
+	"env":       true,
+	"escape":    true,
+	"fn":        true,
+	"framesize": true,
+	"inst":      true,
+	"leak":      true,
+	"m":         true,
+	"mblock":    true,
+	"mcount":    true,
+	"mseq":      true,
+	"move":      true,
+	"metric":    true,
+	"name":      true,
+	"noalloc":   true,
+	"noclosure": true,
+	"noiface":   true,
+	"none":      true,
+	"noruntime": true,
+	"skip":      true,
+	"suite":     true,
+	"tags":      true,
+	"vet":       true,
+}
+
+// knownGOARCH are the values of GOARCH supported by the go command, as
+// listed by "go tool dist list", used to reject a misspelled suffix of the
+// alloc and bytes directives, ex. lem.<ID>.alloc:amd46.
+var knownGOARCH = map[string]bool{
+	"386":      true,
+	"amd64":    true,
+	"arm":      true,
+	"arm64":    true,
+	"loong64":  true,
+	"mips":     true,
+	"mips64":   true,
+	"mips64le": true,
+	"mipsle":   true,
+	"ppc64":    true,
+	"ppc64le":  true,
+	"riscv64":  true,
+	"s390x":    true,
+	"wasm":     true,
+}
+
+// checkEnv returns an error if the provided value is not valid for the
+// environment variable with the specified name, ex. GOMAXPROCS must be a
+// positive integer.
+func checkEnv(name, val string) error {
+	if name != "GOMAXPROCS" {
+		return nil
+	}
+	if n, err := strconv.Atoi(val); err != nil || n <= 0 {
+		return fmt.Errorf("invalid GOMAXPROCS %q: must be a positive integer", val)
+	}
+	return nil
+}
+
+// checkBenchtime returns an error if the provided value is not valid for
+// the -test.benchtime flag, i.e. a duration or a count with an "x" suffix.
+func checkBenchtime(val string) error {
+	if strings.HasSuffix(val, "x") {
+		n, err := strconv.Atoi(strings.TrimSuffix(val, "x"))
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid count %q", val)
+		}
+		return nil
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		return err
+	}
+	if d <= 0 {
+		return fmt.Errorf("invalid duration %q", val)
+	}
+	return nil
+}
+
+// HasBenchmark returns true if the test case has any of the alloc, bytes,
+// noalloc, or metric directives, which require a benchmark to be asserted.
+func (tc TestCase) HasBenchmark() bool {
+	for directive := range tc.directives {
+		switch {
+		case directive == "noalloc", directive == "fn.noalloc",
+			directive == "alloc", strings.HasPrefix(directive, "alloc:"),
+			directive == "bytes", strings.HasPrefix(directive, "bytes:"),
+			strings.HasPrefix(directive, "metric:"):
+			return true
+		}
+	}
+	return false
+}
+
+// GetAllocOp returns the expected number of allocations per operation for
+// the specified architecture.
+func (tc TestCase) GetAllocOp(goarch string) Int64Range {
+	if r, ok := tc.AllocOpByArch[goarch]; ok {
+		return r
+	}
+	return tc.AllocOp
+}
+
+// GetBytesOp returns the expected number of bytes per operation for the
+// specified architecture.
+func (tc TestCase) GetBytesOp(goarch string) Int64Range {
+	if r, ok := tc.BytesOpByArch[goarch]; ok {
+		return r
+	}
+	return tc.BytesOp
+}
+
+// Path returns the test case path from the provided suite, ID, and name.
 // Please see the lem package documentation for more information.
 func (tc TestCase) Path() []string {
 	var path []string
+	if len(tc.Suite) > 0 {
+		path = append(path, strings.Split(tc.Suite, "/")...)
+	}
 	if len(tc.Name) == 0 || tc.Name[0] != '/' {
 		path = append(path, tc.ID)
 	}
@@ -136,178 +682,1225 @@ func (tc TestCase) Path() []string {
 
 var (
 	nameRx  = regexp.MustCompile(`^// lem\.([^.]+)\.name=(.+)$`)
-	allocRx = regexp.MustCompile(`^// lem\.([^.]+)\.alloc=(\d+)(?:-(\d+))?$`)
-	bytesRx = regexp.MustCompile(`^// lem\.([^.]+)\.bytes=(\d+)(?:-(\d+))?$`)
-	matchRx = regexp.MustCompile(`^// lem\.([^.]+)\.m=(.+)$`)
-	natchRx = regexp.MustCompile(`^// lem\.([^.]+)\.m!=(.+)$`)
+	suitRx  = regexp.MustCompile(`^// lem\.([^.]+)\.suite=(.+)$`)
+	allocRx = regexp.MustCompile(`^// lem\.([^.]+)\.alloc(?::(\w+))?=([<>]=?\d+|\d+(?:-\d+|~-?[\d.]+%)?)$`)
+	bytesRx = regexp.MustCompile(`^// lem\.([^.]+)\.bytes(?::(\w+))?=([<>]=?\d+[[:alpha:]]*|\d+[[:alpha:]]*(?:-\d+[[:alpha:]]*|~-?[\d.]+%)?)$`)
+	noallRx = regexp.MustCompile(`^// lem\.([^.]+)\.noalloc$`)
+	fnNoRx  = regexp.MustCompile(`^// lem\.([^.]+)\.fn\.noalloc$`)
+	matchRx = regexp.MustCompile(`^// lem\.([^.]+)\.m(?:@([+-]\d+))?=(.+)$`)
+	natchRx = regexp.MustCompile(`^// lem\.([^.]+)\.m(?:@([+-]\d+))?!=(.+)$`)
+	mseqRx  = regexp.MustCompile(`^// lem\.([^.]+)\.mseq(?:@([+-]\d+))?=(.+)$`)
+	countRx = regexp.MustCompile(`^// lem\.([^.]+)\.mcount=(.+):([<>]=?\d+|\d+(?:-\d+|~-?[\d.]+%)?)$`)
+	noneRx  = regexp.MustCompile(`^// lem\.([^.]+)\.none=(.+)$`)
+	moveRx  = regexp.MustCompile(`^// lem\.([^.]+)\.move=(.+)$`)
+	escpRx  = regexp.MustCompile(`^// lem\.([^.]+)\.escape=(.+)$`)
+	noifRx  = regexp.MustCompile(`^// lem\.([^.]+)\.noiface$`)
+	nocloRx = regexp.MustCompile(`^// lem\.([^.]+)\.noclosure-escape$`)
+	nortRx  = regexp.MustCompile(`^// lem\.([^.]+)\.noruntime-alloc$`)
+	dvrtRx  = regexp.MustCompile(`^// lem\.([^.]+)\.devirt(?:@([+-]\d+))?=(.+)$`)
+	mblkRx  = regexp.MustCompile(`^// lem\.([^.]+)\.mblock(?:@([+-]\d+))?=(.+)$`)
+	instRx  = regexp.MustCompile(`^// lem\.([^.]+)\.inst=([^:]+):(.+)$`)
+	vetRx   = regexp.MustCompile(`^// lem\.([^.]+)\.vet=(.+)$`)
+	funcRx  = regexp.MustCompile(`^// lem\.([^.]+)\.fn=(.+)$`)
+	leakRx  = regexp.MustCompile(`^// lem\.([^.]+)\.leak=(\w+)(?::(content)|:result:(\w+)(?::(\d+))?)?$`)
+	asmRx   = regexp.MustCompile(`^// lem\.([^.]+)\.asm=(.+)$`)
+	metriRx = regexp.MustCompile(`^// lem\.([^.]+)\.metric:([^=]+)=([<>]=?\d+|\d+(?:-\d+|~-?[\d.]+%)?)$`)
+	otherRx = regexp.MustCompile(`^// lem\.([^.\s(]+)\.(\w+)(?:[-.]\w+)*\s*(?:[=<>!~@:]|$)`)
+	skipRx  = regexp.MustCompile(`^// lem\.([^.]+)\.skip(?:=(.+))?$`)
+	tagsRx  = regexp.MustCompile(`^// lem\.([^.]+)\.tags=([\w.]+(?:,[\w.]+)*)$`)
+	btimeRx = regexp.MustCompile(`^// lem\.([^.]+)\.benchtime=(.+)$`)
+	envRx   = regexp.MustCompile(`^// lem\.([^.]+)\.env=([A-Za-z_]\w*)=(.*)$`)
+	frameRx = regexp.MustCompile(`^// lem\.([^.]+)\.framesize=([<>]=?\d+|\d+(?:-\d+|~-?[\d.]+%)?)$`)
 	newlnRx = regexp.MustCompile(`\r?\n`)
 )
 
+// FilterTestCases returns the provided test cases whose IDs match the
+// specified regular expression. If the expression is empty then all of
+// the test cases are returned.
+func FilterTestCases(filter string, testCases ...TestCase) ([]TestCase, error) {
+	if filter == "" {
+		return testCases, nil
+	}
+	rx, err := regexp.Compile(filter)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %w", filter, err)
+	}
+	var filtered []TestCase
+	for _, tc := range testCases {
+		if rx.MatchString(tc.ID) {
+			filtered = append(filtered, tc)
+		}
+	}
+	return filtered, nil
+}
+
+// CheckNames returns an error if any of the provided test cases have a
+// match, natch, alloc, or bytes directive but no name directive, which is
+// usually the result of a typo in the ID of the directive.
+func CheckNames(testCases ...TestCase) error {
+	for _, tc := range testCases {
+		if _, ok := tc.directives["name"]; ok {
+			continue
+		}
+		var directives []string
+		for directive := range tc.directives {
+			switch {
+			case strings.HasPrefix(directive, "m="),
+				strings.HasPrefix(directive, "m!="),
+				strings.HasPrefix(directive, "mseq="),
+				strings.HasPrefix(directive, "alloc"),
+				strings.HasPrefix(directive, "bytes"):
+				directives = append(directives, directive)
+			}
+		}
+		if len(directives) == 0 {
+			continue
+		}
+		sort.Strings(directives)
+		return fmt.Errorf(
+			"lem.%[1]s.%[2]s at %[3]s has no lem.%[1]s.name directive",
+			tc.ID, directives[0], tc.directives[directives[0]])
+	}
+	return nil
+}
+
+// HasAsm returns true if any of the provided test cases have assertions
+// against the assembly output.
+func HasAsm(testCases ...TestCase) bool {
+	for _, tc := range testCases {
+		if len(tc.Asm) > 0 || len(tc.AsmNatches) > 0 || tc.FrameSize != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// HasVet returns true if any of the provided test cases have assertions
+// against the "go vet" output.
+func HasVet(testCases ...TestCase) bool {
+	for _, tc := range testCases {
+		if len(tc.Vets) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 // GetTestCases parses the provided Go source files & returns a TestCase slice.
+// Any of the files named SidecarFileName are parsed as sidecar files, and
+// their test cases are merged with the test cases from the sources.
 func GetTestCases(files ...string) ([]TestCase, error) {
 	var (
-		testCases []TestCase
+		testCases []*TestCase
 		lookupTbl = testCaseLookupTable{}
 	)
 	for _, filePath := range files {
-		testCasesInFile, err := getTestCasesInFile(filePath, lookupTbl)
+		getTestCases := getTestCasesInFile
+		if filepath.Base(filePath) == SidecarFileName {
+			getTestCases = getTestCasesInSidecar
+		}
+		testCasesInFile, err := getTestCases(filePath, lookupTbl)
 		if err != nil {
 			return nil, err
 		}
-
-		// Store the length of the testCases slice and then append the
-		// test cases from the file to it.
-		indexOfUnmappedTestCases := len(testCases)
 		testCases = append(testCases, testCasesInFile...)
+	}
+	for _, tc := range testCases {
+		tc.sortLineMatchers()
+	}
+	return derefTestCases(testCases), nil
+}
+
+// sortLineMatchers sorts the test case's matchers by file, line, and
+// pattern so their order does not depend on the order in which the files
+// that contributed to the test case were parsed.
+func (tc *TestCase) sortLineMatchers() {
+	for _, lms := range [][]LineMatcher{
+		tc.Matches, tc.Natches, tc.Nones, tc.Vets, tc.Counts, tc.Devirts,
+		tc.Blocks} {
+
+		sort.SliceStable(lms, func(i, j int) bool {
+			return lms[i].less(lms[j])
+		})
+	}
+
+	// The matchers in a sequence are never reordered, only the sequences
+	// themselves by the file and line to which they apply.
+	sort.SliceStable(tc.Seqs, func(i, j int) bool {
+		a, b := tc.Seqs[i][0], tc.Seqs[j][0]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Path < b.Path
+	})
+}
 
-		// Add the newly appended test cases to the lookup table.
-		for i := indexOfUnmappedTestCases; i < len(testCases); i++ {
-			lookupTbl[testCases[i].ID] = &testCases[i]
+// addSeqMatcher appends the provided matcher to the test case's sequence
+// for the matcher's file and line, creating the sequence if necessary.
+func (tc *TestCase) addSeqMatcher(lm LineMatcher) {
+	for i, seq := range tc.Seqs {
+		if seq[0].Path == lm.Path && seq[0].File == lm.File &&
+			seq[0].Line == lm.Line {
+
+			tc.Seqs[i] = append(seq, lm)
+			return
 		}
 	}
-	return testCases, nil
+	tc.Seqs = append(tc.Seqs, []LineMatcher{lm})
+}
+
+// derefTestCases returns a slice of the test cases the provided pointers
+// reference.
+func derefTestCases(src []*TestCase) []TestCase {
+	if src == nil {
+		return nil
+	}
+	dst := make([]TestCase, len(src))
+	for i := range src {
+		dst[i] = *src[i]
+	}
+	return dst
 }
 
 // testCaseLookupTable provides a quick way to check if a test case already
 // exists.
+//
+// The test cases are referenced by pointers that are not into a slice, so
+// they remain valid as new test cases are discovered.
 type testCaseLookupTable map[string]*TestCase
 
-// Get the test case with the specified ID, otherwise an error is returned.
-func (t testCaseLookupTable) Get(id string) (*TestCase, error) {
-	tc, ok := t[id]
-	if !ok {
-		return nil, fmt.Errorf("unknown test case ID: %s", id)
+// GetOrCreate returns the test case with the specified ID. If the test
+// case does not exist then it is created, and the second return value is
+// true.
+func (t testCaseLookupTable) GetOrCreate(id string) (*TestCase, bool) {
+	if tc, ok := t[id]; ok {
+		return tc, false
 	}
-	return tc, nil
+	tc := &TestCase{ID: id}
+	t[id] = tc
+	return tc, true
 }
 
-func readLines(filePath string) ([]string, error) {
-	data, err := os.ReadFile(filePath)
-	if err != nil {
-		return nil, err
-	}
-	return newlnRx.Split(string(data), -1), nil
+// parseInt64Range returns an Int64Range from the provided value, which
+// may be N, N-M, N~P%, <N, <=N, >N, or >=N.
+func parseInt64Range(val string) (Int64Range, error) {
+	return parseInt64RangeFunc(val, parseInt64)
 }
 
-func getTestCasesInFile(
-	filePath string,
-	lookupTbl testCaseLookupTable) ([]TestCase, error) {
+// parseBytesRange is like parseInt64Range, but each N may include one of
+// the size suffixes in byteUnits, ex. 1KiB or 2MB.
+func parseBytesRange(val string) (Int64Range, error) {
+	return parseInt64RangeFunc(val, parseByteSize)
+}
 
-	var (
-		testCases []TestCase
-		fileName  = filepath.Base(filePath)
-	)
+func parseInt64(val string) (int64, error) {
+	return strconv.ParseInt(val, 10, 64)
+}
 
-	if lookupTbl == nil {
-		lookupTbl = testCaseLookupTable{}
-	}
+// byteUnits maps the size suffixes supported by parseByteSize to the
+// number of bytes they represent.
+var byteUnits = map[string]int64{
+	"B":   1,
+	"KB":  1000,
+	"MB":  1000 * 1000,
+	"GB":  1000 * 1000 * 1000,
+	"KiB": 1 << 10,
+	"MiB": 1 << 20,
+	"GiB": 1 << 30,
+}
 
-	var fset token.FileSet
-	f, err := parser.ParseFile(&fset, filePath, nil, parser.ParseComments)
-	if err != nil {
-		return nil, err
+// parseByteSize returns the number of bytes represented by the provided
+// value, ex. 1MiB returns 1048576.
+func parseByteSize(val string) (int64, error) {
+	i := strings.IndexFunc(val, func(r rune) bool { return r < '0' || r > '9' })
+	if i < 0 {
+		return parseInt64(val)
 	}
-
-	lines, err := readLines(filePath)
+	unit, ok := byteUnits[val[i:]]
+	if !ok {
+		return 0, fmt.Errorf(
+			"invalid size %s: unknown unit %q, must be one of B, KB, MB, GB, KiB, MiB, or GiB",
+			val, val[i:])
+	}
+	n, err := parseInt64(val[:i])
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+	if n > math.MaxInt64/unit {
+		return 0, fmt.Errorf("invalid size %s: overflows int64", val)
 	}
+	return n * unit, nil
+}
 
-	// Scan each line of the file for lem comments.
-	for _, cg := range f.Comments {
-		for _, c := range cg.List {
-			var (
-				l      = c.Text
-				tc     *TestCase
-				lineNo = fset.Position(c.Pos()).Line
-			)
+// parseInt64RangeFunc returns an Int64Range from the provided value,
+// using parseN to parse each of its numbers.
+func parseInt64RangeFunc(
+	val string, parseN func(string) (int64, error)) (Int64Range, error) {
 
-			// lem.<ID>.name=<NAME>
-			if m := nameRx.FindStringSubmatch(l); m != nil {
-				id, name := m[1], m[2]
-				if tc, _ = lookupTbl.Get(id); tc != nil {
-					if tc.Name != "" {
-						return nil, fmt.Errorf("duplicate lem.%s.name", id)
-					}
-					tc.Name = name
-				} else {
-					testCases = append(testCases, TestCase{ID: id, Name: name})
-					lookupTbl[id] = &testCases[len(testCases)-1]
+	if i := strings.IndexByte(val, '~'); i >= 0 {
+		n, err := parseN(val[:i])
+		if err != nil {
+			return Int64Range{}, err
+		}
+		return parseInt64RangeTolerance(n, val[i+1:])
+	}
+	for _, op := range []string{"<=", ">=", "<", ">"} {
+		if !strings.HasPrefix(val, op) {
+			continue
+		}
+		n, err := parseN(val[len(op):])
+		if err != nil {
+			return Int64Range{}, err
+		}
+		if op[0] == '<' {
+			return Int64Range{Max: n, Op: op}, nil
+		}
+		return Int64Range{Min: n, Op: op}, nil
+	}
+	parts := strings.SplitN(val, "-", 2)
+	min, err := parseN(parts[0])
+	if err != nil {
+		return Int64Range{}, err
+	}
+	if len(parts) == 1 {
+		return Int64Range{Min: min, Max: min}, nil
+	}
+	max, err := parseN(parts[1])
+	if err != nil {
+		return Int64Range{}, err
+	}
+	return Int64Range{Min: min, Max: max}, nil
+}
+
+// parseInt64RangeTolerance returns an Int64Range from the provided value
+// and a tolerance in the form P%. The minimum is rounded down and the
+// maximum is rounded up.
+func parseInt64RangeTolerance(n int64, tol string) (Int64Range, error) {
+	p, err := strconv.ParseFloat(strings.TrimSuffix(tol, "%"), 64)
+	if err != nil {
+		return Int64Range{}, err
+	}
+	if p < 0 || p > 100 {
+		return Int64Range{}, fmt.Errorf(
+			"invalid tolerance %s: must be between 0%% and 100%%", tol)
+	}
+	if p == 0 {
+		return Int64Range{Min: n, Max: n}, nil
+	}
+	d := float64(n) * p / 100
+	return Int64Range{
+		Min:       int64(math.Floor(float64(n) - d)),
+		Max:       int64(math.Ceil(float64(n) + d)),
+		Value:     n,
+		Tolerance: p,
+	}, nil
+}
+
+// checkNoAlloc returns an error if the provided test case has a non-zero
+// alloc or bytes assertion that conflicts with lem.<ID>.noalloc.
+func checkNoAlloc(tc TestCase) error {
+	if tc.AllocOp != (Int64Range{}) {
+		return fmt.Errorf(
+			"lem.%s.noalloc conflicts with lem.%s.alloc=%s",
+			tc.ID, tc.ID, tc.AllocOp)
+	}
+	if tc.BytesOp != (Int64Range{}) {
+		return fmt.Errorf(
+			"lem.%s.noalloc conflicts with lem.%s.bytes=%s",
+			tc.ID, tc.ID, tc.BytesOp)
+	}
+	for goarch, r := range tc.AllocOpByArch {
+		if r != (Int64Range{}) {
+			return fmt.Errorf(
+				"lem.%s.noalloc conflicts with lem.%s.alloc:%s=%s",
+				tc.ID, tc.ID, goarch, r)
+		}
+	}
+	for goarch, r := range tc.BytesOpByArch {
+		if r != (Int64Range{}) {
+			return fmt.Errorf(
+				"lem.%s.noalloc conflicts with lem.%s.bytes:%s=%s",
+				tc.ID, tc.ID, goarch, r)
+		}
+	}
+	return nil
+}
+
+// unquoteValue returns the value of a directive with a pattern, ex. the
+// pattern of a lem.<ID>.m= comment. Editors often remove trailing spaces,
+// so the whitespace at the end of a comment is never part of its value.
+// A value that must begin or end with whitespace may be a Go string
+// literal instead, i.e. enclosed in double quotes or backticks, in which
+// case it is unquoted. Otherwise the value is used verbatim, including a
+// value that only begins and ends with quotes, ex. "x" escapes to "y".
+func unquoteValue(v string) (string, error) {
+	if n := len(v); n < 2 || v[0] != v[n-1] || (v[0] != '"' && v[0] != '`') {
+		return v, nil
+	}
+	q, err := strconv.QuotedPrefix(v)
+	if err != nil {
+		return "", err
+	}
+	if q != v {
+		return v, nil
+	}
+	return strconv.Unquote(v)
+}
+
+// newMatchRegexp returns the regular expression for a lem.<ID>.m=
+// assertion against the specified file and line.
+func newMatchRegexp(fileName string, lineNo int, pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile(fmt.Sprintf(
+		"%s %s$", getFileLinePrefix(fileName, lineNo), pattern))
+}
+
+// newInstRegexp returns the regular expression for a lem.<ID>.inst=
+// assertion against the specified file and line. The pattern may appear
+// anywhere in the message, but the message must also refer to the
+// specified type as the instantiation of a generic function, either as a
+// type argument, ex. leak[int] or leak[go.shape.int], or as a shape type,
+// ex. go.shape.int(1).
+func newInstRegexp(fileName string, lineNo int, typ, pattern string) (*regexp.Regexp, error) {
+	typ = regexp.QuoteMeta(typ)
+	inst := fmt.Sprintf(
+		`(?:[\[,](?:go\.shape\.)?%[1]s[\],]|\bgo\.shape\.%[1]s\b)`, typ)
+	return regexp.Compile(fmt.Sprintf(
+		"%s (?:.*(?:%s).*%s.*|.*%s.*(?:%s).*)$",
+		getFileLinePrefix(fileName, lineNo), pattern, inst, inst, pattern))
+}
+
+// newNoIfaceRegexp returns the regular expression for a lem.<ID>.noiface
+// assertion against the specified file and line. It matches any value that
+// escapes to the heap, which is how the compiler reports a value that is
+// allocated when it is converted to an interface, except for the implicit
+// slice of a variadic call, ex. "... argument escapes to heap", which is
+// not an interface conversion.
+func newNoIfaceRegexp(fileName string, lineNo int) (*regexp.Regexp, error) {
+	return regexp.Compile(fmt.Sprintf(
+		"%s [^.].* escapes to heap$", getFileLinePrefix(fileName, lineNo)))
+}
+
+// newNoClosureEscapeRegexp returns the regular expression for a
+// lem.<ID>.noclosure-escape assertion against the specified file and line.
+// It matches the message the compiler emits for a function literal that is
+// allocated on the heap, ex. because it escapes along with the variables
+// it captures by reference, including the "in <FUNC>:" form at -m=2.
+func newNoClosureEscapeRegexp(fileName string, lineNo int) (*regexp.Regexp, error) {
+	return regexp.Compile(fmt.Sprintf(
+		"%s func literal escapes to heap(?: in .+:)?$",
+		getFileLinePrefix(fileName, lineNo)))
+}
+
+// runtimeAllocRx matches a call in a function's assembly to one of the
+// runtime's helpers for allocating an object or a slice on the heap.
+var runtimeAllocRx = regexp.MustCompile(
+	`(?m)^.*\bCALL\s+runtime\.(?:newobject|makeslice|growslice)\(SB\).*$`)
+
+// newDevirtRegexp returns the regular expression for a lem.<ID>.devirt=
+// assertion against the specified file and line, ex. the message
+// "devirtualizing s.area to square" for the type "square".
+func newDevirtRegexp(fileName string, lineNo int, typ string) (*regexp.Regexp, error) {
+	return regexp.Compile(fmt.Sprintf(
+		"%s devirtualizing \\S+ to %s$",
+		getFileLinePrefix(fileName, lineNo), regexp.QuoteMeta(typ)))
+}
+
+// newFuncNoAllocRegexp returns the regular expression for the natch of a
+// lem.<ID>.fn.noalloc assertion against the specified range of lines, ex.
+// the lines of a function. It matches any value that escapes to the heap or
+// variable that is moved to the heap.
+func newFuncNoAllocRegexp(fileName string, firstLineNo, lastLineNo int) (*regexp.Regexp, error) {
+	return regexp.Compile(fmt.Sprintf(
+		"%s (?:.* escapes to heap:?|moved to heap: .*)$",
+		getFileLinesPrefix(fileName, firstLineNo, lastLineNo)))
+}
+
+// newLeakRegexp returns the regular expression for a lem.<ID>.leak=
+// assertion against the specified range of lines, ex. the lines of a
+// function's signature. The expected message depends on how the parameter
+// leaks:
+//
+//   - leak=<PARAM> matches "leaking param: <PARAM>"
+//   - leak=<PARAM>:content matches "leaking param content: <PARAM>"
+//   - leak=<PARAM>:result:<RESULT> matches "leaking param: <PARAM> to
+//     result <RESULT> level=<N>" for any level, where a numeric <RESULT>
+//     is the index of an unnamed result, ex. 0 for ~r0
+//   - leak=<PARAM>:result:<RESULT>:<LEVEL> matches the same message with
+//     the specified level
+func newLeakRegexp(
+	fileName string,
+	firstLineNo, lastLineNo int,
+	param, content, result, level string) (*regexp.Regexp, error) {
+
+	var pattern string
+	switch {
+	case content != "":
+		pattern = "leaking param content: " + param
+	case result != "":
+		if _, err := strconv.Atoi(result); err == nil {
+			result = "~r" + result
+		}
+		if level == "" {
+			level = `\d+`
+		}
+		pattern = fmt.Sprintf(
+			"leaking param: %s to result %s level=%s", param, result, level)
+	default:
+		pattern = "leaking param: " + param
+	}
+	return regexp.Compile(fmt.Sprintf(
+		"%s %s$",
+		getFileLinesPrefix(fileName, firstLineNo, lastLineNo), pattern))
+}
+
+// newNatchRegexp returns the regular expression for a lem.<ID>.m!=
+// assertion against the specified file and line.
+func newNatchRegexp(fileName string, lineNo int, pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile(fmt.Sprintf(
+		"%s.*%s.*$", getFileLinePrefix(fileName, lineNo), pattern))
+}
+
+// getFileLinePrefix returns the beginning of a regular expression that
+// matches a line of build optimization output for the specified file and
+// line. The file is matched by its base name, so the output may refer to
+// the file by a relative or absolute path, or by a path trimmed with
+// -trimpath, ex. example.com/hello/hello.go.
+func getFileLinePrefix(fileName string, lineNo int) string {
+	return fmt.Sprintf(
+		`(?m)^(?:.*[/\\])?%s:%d:\d+:`, regexp.QuoteMeta(fileName), lineNo)
+}
+
+// getFileLinesPrefix is like getFileLinePrefix, except it matches the
+// output for any of the lines in the specified range.
+func getFileLinesPrefix(fileName string, firstLineNo, lastLineNo int) string {
+	lineNos := make([]string, 0, lastLineNo-firstLineNo+1)
+	for i := firstLineNo; i <= lastLineNo; i++ {
+		lineNos = append(lineNos, strconv.Itoa(i))
+	}
+	return fmt.Sprintf(
+		`(?m)^(?:.*[/\\])?%s:(?:%s):\d+:`,
+		regexp.QuoteMeta(fileName), strings.Join(lineNos, "|"))
+}
+
+// utf8BOM is the UTF-8 byte order mark.
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// readSource returns the contents of the specified file without a leading
+// UTF-8 byte order mark, if any, so the positions reported by the parser
+// and the lines of the file agree with one another.
+func readSource(filePath string) ([]byte, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimPrefix(data, utf8BOM), nil
+}
+
+// splitLines returns the lines of the provided source.
+func splitLines(src []byte) []string {
+	return newlnRx.Split(string(src), -1)
+}
+
+func readLines(filePath string) ([]string, error) {
+	data, err := readSource(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return splitLines(data), nil
+}
+
+// GetTestCasesFromSource is like GetTestCases, except the test cases are
+// parsed from the provided Go source instead of reading a file, ex. for a
+// tool that holds the source in memory. The file path is used to name the
+// file in the matchers and any errors, and it need not exist.
+func GetTestCasesFromSource(filePath string, src []byte) ([]TestCase, error) {
+	testCases, err := getTestCasesInSource(
+		filePath, bytes.TrimPrefix(src, utf8BOM), testCaseLookupTable{})
+	if err != nil {
+		return nil, err
+	}
+	for _, tc := range testCases {
+		tc.sortLineMatchers()
+	}
+	return derefTestCases(testCases), nil
+}
+
+func getTestCasesInFile(
+	filePath string,
+	lookupTbl testCaseLookupTable) ([]*TestCase, error) {
+
+	// Read the file once so the parser and the lines of the file are
+	// both without a leading byte order mark.
+	src, err := readSource(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return getTestCasesInSource(filePath, src, lookupTbl)
+}
+
+func getTestCasesInSource(
+	filePath string,
+	src []byte,
+	lookupTbl testCaseLookupTable) ([]*TestCase, error) {
+
+	var (
+		testCases []*TestCase
+		fileName  = filepath.Base(filePath)
+	)
+
+	absFilePath, err := filepath.Abs(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if lookupTbl == nil {
+		lookupTbl = testCaseLookupTable{}
+	}
+
+	// Use NewFileSet rather than the zero value, whose base of zero means a
+	// comment at the very start of the file has the position token.NoPos.
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filePath, src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := splitLines(src)
+
+	// Scan each line of the file for lem comments.
+	for _, cg := range f.Comments {
+		for _, c := range cg.List {
+			var (
+				l      = strings.TrimRightFunc(c.Text, unicode.IsSpace)
+				lineNo = fset.Position(c.Pos()).Line
+				pos    = fmt.Sprintf("%s:%d", filePath, lineNo)
+			)
+
+			// unquote returns the value of a directive with a pattern,
+			// returning an error with the position of the directive if a
+			// quoted value is invalid.
+			unquote := func(id, directive, v string) (string, error) {
+				u, err := unquoteValue(v)
+				if err != nil {
+					return "", fmt.Errorf(
+						"invalid quoted value for lem.%s.%s at %s: %w",
+						id, directive, pos, err)
+				}
+				return u, nil
+			}
+
+			// getTestCase returns the test case for the provided ID,
+			// creating it if it does not yet exist, and records the
+			// position of the directive, returning an error if the same
+			// directive was already specified for the test case.
+			getTestCase := func(id, directive string) (*TestCase, error) {
+				tc, created := lookupTbl.GetOrCreate(id)
+				if created {
+					testCases = append(testCases, tc)
+				}
+				if prevPos, ok := tc.addDirective(directive, pos); ok {
+					return nil, fmt.Errorf(
+						"duplicate lem.%s.%s at %s and %s",
+						id, directive, prevPos, pos)
 				}
+				return tc, nil
+			}
+
+			// lem.<ID>.name=<NAME>
+			if m := nameRx.FindStringSubmatch(l); m != nil {
+				tc, err := getTestCase(m[1], "name")
+				if err != nil {
+					return nil, err
+				}
+				tc.Name = m[2]
+			} else if m := suitRx.FindStringSubmatch(l); m != nil {
+				tc, err := getTestCase(m[1], "suite")
+				if err != nil {
+					return nil, err
+				}
+				tc.Suite = m[2]
 			} else if m := allocRx.FindStringSubmatch(l); m != nil {
-				if tc, _ = lookupTbl.Get(m[1]); tc == nil {
-					testCases = append(testCases, TestCase{ID: m[1]})
-					tc = &testCases[len(testCases)-1]
-					lookupTbl[m[1]] = tc
+				directive := "alloc"
+				if goarch := m[2]; goarch != "" {
+					if !knownGOARCH[goarch] {
+						return nil, fmt.Errorf(
+							"unknown GOARCH %q for lem.%s.alloc at %s",
+							goarch, m[1], pos)
+					}
+					directive += ":" + goarch
 				}
-				min, err := strconv.ParseInt(m[2], 10, 64)
+				tc, err := getTestCase(m[1], directive)
 				if err != nil {
 					return nil, err
 				}
-				tc.AllocOp.Min = min
-				if len(m) < 3 || m[3] == "" {
-					tc.AllocOp.Max = min
+				r, err := parseInt64Range(m[3])
+				if err != nil {
+					return nil, err
+				}
+				if tc.noAlloc && r != (Int64Range{}) {
+					return nil, fmt.Errorf(
+						"lem.%s.alloc=%s conflicts with lem.%s.noalloc",
+						tc.ID, m[3], tc.ID)
+				}
+				if goarch := m[2]; goarch == "" {
+					tc.AllocOp = r
 				} else {
-					max, err := strconv.ParseInt(m[3], 10, 64)
-					if err != nil {
-						return nil, err
+					if tc.AllocOpByArch == nil {
+						tc.AllocOpByArch = map[string]Int64Range{}
 					}
-					tc.AllocOp.Max = max
+					tc.AllocOpByArch[goarch] = r
 				}
 			} else if m := bytesRx.FindStringSubmatch(l); m != nil {
-				if tc, _ = lookupTbl.Get(m[1]); tc == nil {
-					testCases = append(testCases, TestCase{ID: m[1]})
-					tc = &testCases[len(testCases)-1]
-					lookupTbl[m[1]] = tc
+				directive := "bytes"
+				if goarch := m[2]; goarch != "" {
+					if !knownGOARCH[goarch] {
+						return nil, fmt.Errorf(
+							"unknown GOARCH %q for lem.%s.bytes at %s",
+							goarch, m[1], pos)
+					}
+					directive += ":" + goarch
+				}
+				tc, err := getTestCase(m[1], directive)
+				if err != nil {
+					return nil, err
 				}
-				min, err := strconv.ParseInt(m[2], 10, 64)
+				r, err := parseBytesRange(m[3])
 				if err != nil {
 					return nil, err
 				}
-				tc.BytesOp.Min = min
-				if len(m) < 3 || m[3] == "" {
-					tc.BytesOp.Max = min
+				if tc.noAlloc && r != (Int64Range{}) {
+					return nil, fmt.Errorf(
+						"lem.%s.bytes=%s conflicts with lem.%s.noalloc",
+						tc.ID, m[3], tc.ID)
+				}
+				if goarch := m[2]; goarch == "" {
+					tc.BytesOp = r
 				} else {
-					max, err := strconv.ParseInt(m[3], 10, 64)
-					if err != nil {
-						return nil, err
+					if tc.BytesOpByArch == nil {
+						tc.BytesOpByArch = map[string]Int64Range{}
 					}
-					tc.BytesOp.Max = max
+					tc.BytesOpByArch[goarch] = r
+				}
+			} else if m := noallRx.FindStringSubmatch(l); m != nil {
+				tc, err := getTestCase(m[1], "noalloc")
+				if err != nil {
+					return nil, err
+				}
+				if err := checkNoAlloc(*tc); err != nil {
+					return nil, err
+				}
+				tc.noAlloc = true
+				tc.AllocOp = Int64Range{}
+				tc.BytesOp = Int64Range{}
+			} else if m := fnNoRx.FindStringSubmatch(l); m != nil {
+				// lem.<ID>.fn.noalloc is sugar for lem.<ID>.noalloc and a
+				// natch for any heap allocation in the function.
+				firstLineNo, lastLineNo, ok := getFuncDeclLines(fset, f, c.Pos())
+				if !ok {
+					return nil, fmt.Errorf(
+						"lem.%s.fn.noalloc at %s is not in or above a function",
+						m[1], pos)
 				}
+				tc, err := getTestCase(m[1], "fn.noalloc")
+				if err != nil {
+					return nil, err
+				}
+				if err := checkNoAlloc(*tc); err != nil {
+					return nil, err
+				}
+				tc.noAlloc = true
+				tc.AllocOp = Int64Range{}
+				tc.BytesOp = Int64Range{}
+				r, err := newFuncNoAllocRegexp(fileName, firstLineNo, lastLineNo)
+				if err != nil {
+					return nil, err
+				}
+				tc.Natches = append(tc.Natches, LineMatcher{
+					Regexp:   r,
+					Source:   lines[firstLineNo-1],
+					File:     fileName,
+					Line:     firstLineNo,
+					Path:     absFilePath,
+					lastLine: lastLineNo,
+				})
 			} else if m := matchRx.FindStringSubmatch(l); m != nil {
-				if tc, _ = lookupTbl.Get(m[1]); tc == nil {
-					testCases = append(testCases, TestCase{ID: m[1]})
-					tc = &testCases[len(testCases)-1]
-					lookupTbl[m[1]] = tc
+				targetLineNo, err := getTargetLine(lineNo, m[2], len(lines))
+				if err != nil {
+					return nil, fmt.Errorf(
+						"invalid lem.%s.m@%s at %s: %w", m[1], m[2], pos, err)
+				}
+				pattern, err := unquote(m[1], "m", m[3])
+				if err != nil {
+					return nil, err
+				}
+				r, err := newMatchRegexp(fileName, targetLineNo, pattern)
+				if err != nil {
+					return nil, fmt.Errorf(
+						"invalid regexp for lem.%s.m at %s: %w", m[1], pos, err)
+				}
+				tc, err := getTestCase(m[1], "m="+r.String())
+				if err != nil {
+					return nil, err
+				}
+				tc.Matches = append(tc.Matches, LineMatcher{
+					Regexp: r,
+					Source: lines[targetLineNo-1],
+					File:   fileName,
+					Line:   targetLineNo,
+					Path:   absFilePath,
+				})
+			} else if m := natchRx.FindStringSubmatch(l); m != nil {
+				targetLineNo, err := getTargetLine(lineNo, m[2], len(lines))
+				if err != nil {
+					return nil, fmt.Errorf(
+						"invalid lem.%s.m@%s at %s: %w", m[1], m[2], pos, err)
+				}
+				pattern, err := unquote(m[1], "m", m[3])
+				if err != nil {
+					return nil, err
+				}
+				r, err := newNatchRegexp(fileName, targetLineNo, pattern)
+				if err != nil {
+					return nil, fmt.Errorf(
+						"invalid regexp for lem.%s.m at %s: %w", m[1], pos, err)
+				}
+				tc, err := getTestCase(m[1], "m!="+r.String())
+				if err != nil {
+					return nil, err
+				}
+				tc.Natches = append(tc.Natches, LineMatcher{
+					Regexp: r,
+					Source: lines[targetLineNo-1],
+					File:   fileName,
+					Line:   targetLineNo,
+					Path:   absFilePath,
+				})
+			} else if m := mseqRx.FindStringSubmatch(l); m != nil {
+				targetLineNo, err := getTargetLine(lineNo, m[2], len(lines))
+				if err != nil {
+					return nil, fmt.Errorf(
+						"invalid lem.%s.mseq@%s at %s: %w", m[1], m[2], pos, err)
+				}
+				pattern, err := unquote(m[1], "mseq", m[3])
+				if err != nil {
+					return nil, err
+				}
+				r, err := newMatchRegexp(fileName, targetLineNo, pattern)
+				if err != nil {
+					return nil, fmt.Errorf(
+						"invalid regexp for lem.%s.mseq at %s: %w", m[1], pos, err)
+				}
+				tc, err := getTestCase(m[1], "mseq="+r.String())
+				if err != nil {
+					return nil, err
+				}
+				tc.addSeqMatcher(LineMatcher{
+					Regexp: r,
+					Source: lines[targetLineNo-1],
+					File:   fileName,
+					Line:   targetLineNo,
+					Path:   absFilePath,
+				})
+			} else if m := moveRx.FindStringSubmatch(l); m != nil {
+				// lem.<ID>.move=<VAR> is sugar for "moved to heap: <VAR>".
+				r, err := newMatchRegexp(
+					fileName, lineNo, "moved to heap: "+regexp.QuoteMeta(m[2]))
+				if err != nil {
+					return nil, err
+				}
+				tc, err := getTestCase(m[1], "m="+r.String())
+				if err != nil {
+					return nil, err
+				}
+				tc.Matches = append(tc.Matches, LineMatcher{
+					Regexp: r,
+					Source: lines[lineNo-1],
+					File:   fileName,
+					Line:   lineNo,
+					Path:   absFilePath,
+				})
+			} else if m := escpRx.FindStringSubmatch(l); m != nil {
+				// lem.<ID>.escape=<EXPR> is sugar for "<EXPR> escapes to heap".
+				r, err := newMatchRegexp(
+					fileName, lineNo, regexp.QuoteMeta(m[2])+" escapes to heap")
+				if err != nil {
+					return nil, err
+				}
+				tc, err := getTestCase(m[1], "m="+r.String())
+				if err != nil {
+					return nil, err
+				}
+				tc.Matches = append(tc.Matches, LineMatcher{
+					Regexp: r,
+					Source: lines[lineNo-1],
+					File:   fileName,
+					Line:   lineNo,
+					Path:   absFilePath,
+				})
+			} else if m := noifRx.FindStringSubmatch(l); m != nil {
+				// lem.<ID>.noiface is sugar for a natch that asserts the
+				// interface conversion on the line does not allocate.
+				r, err := newNoIfaceRegexp(fileName, lineNo)
+				if err != nil {
+					return nil, err
+				}
+				tc, err := getTestCase(m[1], "m!="+r.String())
+				if err != nil {
+					return nil, err
+				}
+				tc.Natches = append(tc.Natches, LineMatcher{
+					Regexp: r,
+					Source: lines[lineNo-1],
+					File:   fileName,
+					Line:   lineNo,
+					Path:   absFilePath,
+				})
+			} else if m := nocloRx.FindStringSubmatch(l); m != nil {
+				// lem.<ID>.noclosure-escape is sugar for a natch that asserts
+				// the function literal on the line is not allocated on the
+				// heap.
+				r, err := newNoClosureEscapeRegexp(fileName, lineNo)
+				if err != nil {
+					return nil, err
+				}
+				tc, err := getTestCase(m[1], "m!="+r.String())
+				if err != nil {
+					return nil, err
+				}
+				tc.Natches = append(tc.Natches, LineMatcher{
+					Regexp: r,
+					Source: lines[lineNo-1],
+					File:   fileName,
+					Line:   lineNo,
+					Path:   absFilePath,
+				})
+			} else if m := dvrtRx.FindStringSubmatch(l); m != nil {
+				targetLineNo, err := getTargetLine(lineNo, m[2], len(lines))
+				if err != nil {
+					return nil, fmt.Errorf(
+						"invalid lem.%s.devirt@%s at %s: %w", m[1], m[2], pos, err)
+				}
+				r, err := newDevirtRegexp(fileName, targetLineNo, m[3])
+				if err != nil {
+					return nil, fmt.Errorf(
+						"invalid regexp for lem.%s.devirt at %s: %w", m[1], pos, err)
+				}
+				tc, err := getTestCase(m[1], "devirt="+r.String())
+				if err != nil {
+					return nil, err
+				}
+				tc.Devirts = append(tc.Devirts, LineMatcher{
+					Regexp: r,
+					Source: lines[targetLineNo-1],
+					File:   fileName,
+					Line:   targetLineNo,
+					Path:   absFilePath,
+				})
+			} else if m := mblkRx.FindStringSubmatch(l); m != nil {
+				targetLineNo, err := getTargetLine(lineNo, m[2], len(lines))
+				if err != nil {
+					return nil, fmt.Errorf(
+						"invalid lem.%s.mblock@%s at %s: %w", m[1], m[2], pos, err)
+				}
+				// The pattern is matched against the messages of a block,
+				// without their positions, so it is not anchored to them.
+				pattern, err := unquote(m[1], "mblock", m[3])
+				if err != nil {
+					return nil, err
+				}
+				r, err := regexp.Compile("(?s)" + pattern)
+				if err != nil {
+					return nil, fmt.Errorf(
+						"invalid regexp for lem.%s.mblock at %s: %w", m[1], pos, err)
+				}
+				tc, err := getTestCase(m[1], fmt.Sprintf(
+					"mblock=%s:%d:%s", fileName, targetLineNo, r.String()))
+				if err != nil {
+					return nil, err
+				}
+				tc.Blocks = append(tc.Blocks, LineMatcher{
+					Regexp: r,
+					Source: lines[targetLineNo-1],
+					File:   fileName,
+					Line:   targetLineNo,
+					Path:   absFilePath,
+				})
+			} else if m := instRx.FindStringSubmatch(l); m != nil {
+				// lem.<ID>.inst=<TYPE>:<PATTERN> is a match scoped to the
+				// instantiation of a generic function with <TYPE>.
+				pattern, err := unquote(m[1], "inst", m[3])
+				if err != nil {
+					return nil, err
+				}
+				r, err := newInstRegexp(fileName, lineNo, m[2], pattern)
+				if err != nil {
+					return nil, fmt.Errorf(
+						"invalid regexp for lem.%s.inst at %s: %w", m[1], pos, err)
+				}
+				tc, err := getTestCase(m[1], "m="+r.String())
+				if err != nil {
+					return nil, err
+				}
+				tc.Matches = append(tc.Matches, LineMatcher{
+					Regexp: r,
+					Source: lines[lineNo-1],
+					File:   fileName,
+					Line:   lineNo,
+					Path:   absFilePath,
+				})
+			} else if m := vetRx.FindStringSubmatch(l); m != nil {
+				pattern, err := unquote(m[1], "vet", m[2])
+				if err != nil {
+					return nil, err
+				}
+				r, err := newMatchRegexp(fileName, lineNo, pattern)
+				if err != nil {
+					return nil, fmt.Errorf(
+						"invalid regexp for lem.%s.vet at %s: %w", m[1], pos, err)
+				}
+				tc, err := getTestCase(m[1], "vet="+r.String())
+				if err != nil {
+					return nil, err
+				}
+				tc.Vets = append(tc.Vets, LineMatcher{
+					Regexp: r,
+					Source: lines[lineNo-1],
+					File:   fileName,
+					Line:   lineNo,
+					Path:   absFilePath,
+				})
+			} else if m := noneRx.FindStringSubmatch(l); m != nil {
+				pattern, err := unquote(m[1], "none", m[2])
+				if err != nil {
+					return nil, err
+				}
+				r, err := regexp.Compile(fmt.Sprintf("(?m)^.*%s.*$", pattern))
+				if err != nil {
+					return nil, fmt.Errorf(
+						"invalid regexp for lem.%s.none at %s: %w", m[1], pos, err)
+				}
+				tc, err := getTestCase(m[1], "none="+r.String())
+				if err != nil {
+					return nil, err
+				}
+				tc.Nones = append(tc.Nones, LineMatcher{
+					Regexp: r,
+					Source: lines[lineNo-1],
+				})
+			} else if m := countRx.FindStringSubmatch(l); m != nil {
+				pattern, err := unquote(m[1], "mcount", m[2])
+				if err != nil {
+					return nil, err
 				}
 				r, err := regexp.Compile(
 					fmt.Sprintf(
-						"(?m)^.*%s:%d:\\d+: %s$", fileName, lineNo, m[2]),
+						"%s %s$", getFileLinePrefix(fileName, lineNo), pattern),
 				)
+				if err != nil {
+					return nil, fmt.Errorf(
+						"invalid regexp for lem.%s.mcount at %s: %w", m[1], pos, err)
+				}
+				count, err := parseInt64Range(m[3])
 				if err != nil {
 					return nil, err
 				}
-				tc.Matches = append(tc.Matches, LineMatcher{
+				tc, err := getTestCase(m[1], "mcount="+r.String())
+				if err != nil {
+					return nil, err
+				}
+				tc.Counts = append(tc.Counts, LineMatcher{
 					Regexp: r,
 					Source: lines[lineNo-1],
+					File:   fileName,
+					Line:   lineNo,
+					Path:   absFilePath,
+					Count:  &count,
 				})
-			} else if m := natchRx.FindStringSubmatch(l); m != nil {
-				if tc, _ = lookupTbl.Get(m[1]); tc == nil {
-					testCases = append(testCases, TestCase{ID: m[1]})
-					tc = &testCases[len(testCases)-1]
-					lookupTbl[m[1]] = tc
+			} else if m := funcRx.FindStringSubmatch(l); m != nil {
+				firstLineNo, lastLineNo, ok := getFuncDeclLines(fset, f, c.Pos())
+				if !ok {
+					return nil, fmt.Errorf(
+						"lem.%s.fn at %s is not in or above a function",
+						m[1], pos)
+				}
+				pattern, err := unquote(m[1], "fn", m[2])
+				if err != nil {
+					return nil, err
 				}
 				r, err := regexp.Compile(
 					fmt.Sprintf(
-						"(?m)^.*%s:%d:\\d+:.*%s.*$", fileName, lineNo, m[2]),
+						"%s %s$",
+						getFileLinesPrefix(fileName, firstLineNo, lastLineNo),
+						pattern),
 				)
+				if err != nil {
+					return nil, fmt.Errorf(
+						"invalid regexp for lem.%s.fn at %s: %w", m[1], pos, err)
+				}
+				tc, err := getTestCase(m[1], "fn="+r.String())
 				if err != nil {
 					return nil, err
 				}
-				tc.Natches = append(tc.Natches, LineMatcher{
+				tc.Matches = append(tc.Matches, LineMatcher{
+					Regexp:   r,
+					Source:   lines[firstLineNo-1],
+					File:     fileName,
+					Line:     firstLineNo,
+					Path:     absFilePath,
+					lastLine: lastLineNo,
+				})
+			} else if m := leakRx.FindStringSubmatch(l); m != nil {
+				firstLineNo, lastLineNo, ok := getFuncSigLines(fset, f, c.Pos())
+				if !ok {
+					return nil, fmt.Errorf(
+						"lem.%s.leak at %s is not in or above a function",
+						m[1], pos)
+				}
+				r, err := newLeakRegexp(
+					fileName, firstLineNo, lastLineNo, m[2], m[3], m[4], m[5])
+				if err != nil {
+					return nil, fmt.Errorf(
+						"invalid regexp for lem.%s.leak at %s: %w", m[1], pos, err)
+				}
+				tc, err := getTestCase(m[1], "m="+r.String())
+				if err != nil {
+					return nil, err
+				}
+				tc.Matches = append(tc.Matches, LineMatcher{
+					Regexp:   r,
+					Source:   lines[firstLineNo-1],
+					File:     fileName,
+					Line:     firstLineNo,
+					Path:     absFilePath,
+					lastLine: lastLineNo,
+				})
+			} else if m := asmRx.FindStringSubmatch(l); m != nil {
+				funcLineNo, ok := getFuncDeclLine(fset, f, c.Pos())
+				if !ok {
+					return nil, fmt.Errorf(
+						"lem.%s.asm at %s is not in or above a function",
+						m[1], pos)
+				}
+				pattern, err := unquote(m[1], "asm", m[2])
+				if err != nil {
+					return nil, err
+				}
+				r, err := regexp.Compile("(?m)" + pattern)
+				if err != nil {
+					return nil, fmt.Errorf(
+						"invalid regexp for lem.%s.asm at %s: %w", m[1], pos, err)
+				}
+				tc, err := getTestCase(
+					m[1], fmt.Sprintf("asm=%s@%d", m[2], lineNo))
+				if err != nil {
+					return nil, err
+				}
+				tc.Asm = append(tc.Asm, AsmMatcher{
 					Regexp: r,
 					Source: lines[lineNo-1],
+					File:   fileName,
+					Line:   funcLineNo,
 				})
+			} else if m := nortRx.FindStringSubmatch(l); m != nil {
+				// lem.<ID>.noruntime-alloc asserts the function's assembly
+				// does not call the runtime's heap allocation helpers.
+				funcLineNo, ok := getFuncDeclLine(fset, f, c.Pos())
+				if !ok {
+					return nil, fmt.Errorf(
+						"lem.%s.noruntime-alloc at %s is not in or above a function",
+						m[1], pos)
+				}
+				tc, err := getTestCase(m[1], "noruntime-alloc")
+				if err != nil {
+					return nil, err
+				}
+				tc.AsmNatches = append(tc.AsmNatches, AsmMatcher{
+					Regexp: runtimeAllocRx,
+					Source: lines[lineNo-1],
+					File:   fileName,
+					Line:   funcLineNo,
+				})
+			} else if m := frameRx.FindStringSubmatch(l); m != nil {
+				funcLineNo, ok := getFuncDeclLine(fset, f, c.Pos())
+				if !ok {
+					return nil, fmt.Errorf(
+						"lem.%s.framesize at %s is not in or above a function",
+						m[1], pos)
+				}
+				tc, err := getTestCase(m[1], "framesize")
+				if err != nil {
+					return nil, err
+				}
+				r, err := parseInt64Range(m[2])
+				if err != nil {
+					return nil, err
+				}
+				tc.FrameSize = &AsmFrameSize{
+					Expected: r,
+					File:     fileName,
+					Line:     funcLineNo,
+				}
+			} else if m := metriRx.FindStringSubmatch(l); m != nil {
+				tc, err := getTestCase(m[1], "metric:"+m[2])
+				if err != nil {
+					return nil, err
+				}
+				r, err := parseInt64Range(m[3])
+				if err != nil {
+					return nil, err
+				}
+				if tc.Metrics == nil {
+					tc.Metrics = map[string]Int64Range{}
+				}
+				tc.Metrics[m[2]] = r
+			} else if m := btimeRx.FindStringSubmatch(l); m != nil {
+				tc, err := getTestCase(m[1], "benchtime")
+				if err != nil {
+					return nil, err
+				}
+				if err := checkBenchtime(m[2]); err != nil {
+					return nil, fmt.Errorf(
+						"invalid lem.%s.benchtime at %s: %w", m[1], pos, err)
+				}
+				tc.Benchtime = m[2]
+			} else if m := envRx.FindStringSubmatch(l); m != nil {
+				tc, err := getTestCase(m[1], "env:"+m[2])
+				if err != nil {
+					return nil, err
+				}
+				if err := checkEnv(m[2], m[3]); err != nil {
+					return nil, fmt.Errorf(
+						"invalid lem.%s.env at %s: %w", m[1], pos, err)
+				}
+				if tc.Env == nil {
+					tc.Env = map[string]string{}
+				}
+				tc.Env[m[2]] = m[3]
+			} else if m := skipRx.FindStringSubmatch(l); m != nil {
+				tc, err := getTestCase(m[1], "skip")
+				if err != nil {
+					return nil, err
+				}
+				tc.Skip = true
+				tc.SkipReason = m[2]
+			} else if m := tagsRx.FindStringSubmatch(l); m != nil {
+				tc, err := getTestCase(m[1], "tags")
+				if err != nil {
+					return nil, err
+				}
+				tc.Tags = strings.Split(m[2], ",")
+			} else if m := otherRx.FindStringSubmatch(l); m != nil {
+				if knownDirectives[m[2]] {
+					return nil, fmt.Errorf(
+						"invalid lem.%s.%s directive at %s: %s",
+						m[1], m[2], pos, strings.TrimPrefix(l, "// "))
+				}
+				return nil, fmt.Errorf(
+					"unknown lem.%s.%s directive at %s",
+					m[1], m[2], pos)
 			}
 		}
 	}
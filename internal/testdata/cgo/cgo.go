@@ -0,0 +1,35 @@
+//go:build cgo
+// +build cgo
+
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cgo
+
+// #include <stdlib.h>
+import "C"
+
+var sink interface{}
+
+// lem.generated.none=_cgo_
+func leak(x int32) {
+	sink = x // lem.leak.escape=x
+}
+
+func malloc() {
+	p := C.malloc(8) // lem.malloc.m=inlining call to C._CMalloc
+	C.free(p)
+}
@@ -0,0 +1,46 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package closure
+
+var sinkFn func() int
+
+// The closure captures x by reference and escapes, so x is moved to the
+// heap as well as the closure itself. The directive is expected to fail.
+func escapes(x int) {
+	sinkFn = func() int { // lem.escapes.noclosure-escape
+		x++
+		return x
+	}
+}
+
+func local(x int) int {
+	f := func() int { // lem.local.noclosure-escape
+		x++
+		return x
+	}
+	return f()
+}
+
+func apply(f func(int) int, x int) int {
+	return f(x)
+}
+
+func noCapture(x int) int {
+	return apply(func(y int) int { // lem.noCapture.noclosure-escape
+		return y * 2
+	}, x)
+}
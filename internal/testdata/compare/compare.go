@@ -0,0 +1,30 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package compare
+
+type point struct{ x, y int }
+
+// The point escapes from newPoint in both builds, but when newPoint is
+// inlined into sum the point does not escape from sum.
+func newPoint(x, y int) *point {
+	return &point{x, y} // lem.newPoint.m=&point{...} escapes to heap
+}
+
+func sum() int {
+	p := newPoint(1, 2) // lem.sum.m!=escapes to heap
+	return p.x + p.y
+}
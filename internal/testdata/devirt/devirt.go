@@ -0,0 +1,55 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package devirt
+
+// Shape is a sealed interface. Only the types in this package may
+// implement it because of its unexported method.
+type Shape interface {
+	Area() int
+	sealed()
+}
+
+type Square struct{ N int }
+
+func (s Square) Area() int { return s.N * s.N }
+func (Square) sealed()     {}
+
+type Circle struct{ R int }
+
+func (c *Circle) Area() int { return 3 * c.R * c.R }
+func (*Circle) sealed()     {}
+
+func square() int {
+	var s Shape = Square{N: 2}
+	return s.Area() // lem.square.devirt=Square
+}
+
+func circle() int {
+	var s Shape = &Circle{R: 2}
+	// lem.circle.devirt@+1=*Circle
+	return s.Area()
+}
+
+func area(s Shape) int {
+	return s.Area()
+}
+
+// The call in area is only devirtualized once area is inlined, so the
+// message is attributed to the line that calls area.
+func inlined() int {
+	return area(Square{N: 3}) // lem.inlined.devirt=Square
+}
@@ -0,0 +1,40 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fnnoalloc
+
+// Sum performs no heap allocations.
+//
+// lem.sum.fn.noalloc
+func Sum(values []int) int {
+	var n int
+	for _, v := range values {
+		n += v
+	}
+	return n
+}
+
+// Point is a point in two dimensions.
+type Point struct{ X, Y int }
+
+// Offset looks like it does not allocate, but the point it returns the
+// address of is moved to the heap.
+//
+// lem.offset.fn.noalloc
+func Offset(p Point, dx, dy int) *Point {
+	q := Point{X: p.X + dx, Y: p.Y + dy}
+	return &q
+}
@@ -0,0 +1,34 @@
+//go:build go1.18
+// +build go1.18
+
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package generic
+
+var sink interface{}
+
+func leak[T any](x T) {
+	sink = x
+}
+
+func leakInt() {
+	leak(1) // lem.leakInt.inst=int:escapes to heap
+}
+
+func leakString() {
+	leak("s") // lem.leakString.inst=string:escapes to heap
+}
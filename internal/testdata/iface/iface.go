@@ -0,0 +1,34 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iface
+
+var sink interface{}
+
+type small struct{ a int32 }
+
+func ptr(p *int32) {
+	sink = p // lem.ptr.noiface
+}
+
+func local(s small) {
+	var i interface{} = s // lem.local.noiface
+	_ = i
+}
+
+func convert(x int32) {
+	sink = x // lem.convert.escape=x
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package leak
+
+var sink *int
+
+// lem.put.leak=x
+func put(x *int) {
+	sink = x
+}
+
+// lem.content.leak=x:content
+func content(x []*int) {
+	sink = x[0]
+}
+
+// lem.id.leak=x:result:0
+// lem.id.leak=x:result:0:0
+func id(x *int) *int {
+	return x
+}
+
+// lem.swap.leak=a:result:1
+// lem.swap.leak=b:result:0
+func swap(a, b *int) (*int, *int) {
+	return b, a
+}
+
+func named(x *int) (r *int) { // lem.named.leak=x:result:r
+	r = x
+	return
+}
+
+// lem.deref.leak=x:result:0:1
+func deref(
+	x **int) *int {
+
+	return *x
+}
@@ -0,0 +1,32 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package move
+
+var sink interface{}
+
+func move() *int32 {
+	var x int32 // lem.move.move=x
+	return &x
+}
+
+func escape(x int32) {
+	sink = x // lem.escape.escape=x
+}
+
+func escapeNew() {
+	sink = new(int32) // lem.escapeNew.escape=new(int32)
+}
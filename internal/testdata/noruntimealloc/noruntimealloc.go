@@ -0,0 +1,33 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package noruntimealloc
+
+// The append may exceed the capacity of the slice, so the function calls
+// runtime.growslice. The directive is expected to fail.
+//
+// lem.grow.noruntime-alloc
+func grow(s []int, x int) []int {
+	return append(s, x)
+}
+
+func sum(s []int) int { // lem.sum.noruntime-alloc
+	n := 0
+	for _, x := range s {
+		n += x
+	}
+	return n
+}
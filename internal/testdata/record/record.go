@@ -0,0 +1,41 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package record
+
+var sink interface{}
+
+// lem.update.alloc=0
+// lem.update.bytes=8-16
+func update(x int32) {
+	sink = x // lem.update.m=x escapes to heap
+}
+
+// lem.fill.name=Fill in bytes
+// lem.fill.alloc=1
+func fill(x int64) {
+	sink = x
+}
+
+func code(x int16) {
+	sink = x // lem.code.name=Directive in code
+}
+
+// lem.keep.alloc=1-3
+// lem.keep.bytes=<=32
+func keep(x int8) {
+	sink = x
+}
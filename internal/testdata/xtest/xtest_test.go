@@ -0,0 +1,37 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package xtest_test
+
+import (
+	"testing"
+
+	"github.com/akutz/lem/internal/testdata/xtest"
+)
+
+var sink interface{}
+
+func TestPut(t *testing.T) {
+	xtest.Put(1)
+}
+
+func put(x int32) {
+	sink = x // lem.xput.escape=x
+}
+
+func keep(x int64) *int64 { // lem.xkeep.move=x
+	return &x
+}
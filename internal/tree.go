@@ -17,7 +17,15 @@ limitations under the License.
 package internal
 
 import (
+	"flag"
 	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 )
@@ -36,15 +44,137 @@ func NewTree(testCases ...TestCase) Tree {
 	return tree
 }
 
+// NewTreeStrict is like NewTree, but returns an error if more than one of
+// the provided test cases has the same ID and they are not identical.
+func NewTreeStrict(testCases ...TestCase) (*Tree, error) {
+	tree := &Tree{}
+	for _, tc := range testCases {
+		if _, err := tree.InsertStrict(tc); err != nil {
+			return nil, err
+		}
+	}
+	return tree, nil
+}
+
 // DeepEqual returns true if the two trees are equal.
 // Only exported fields are compared.
 func (tr *Tree) DeepEqual(b Tree) bool {
 	return tr.TreeNode.deepEqual(b.TreeNode)
 }
 
-// Run the tests for this tree.
-func (tr Tree) Run(t *testing.T, ctx Context) {
-	tr.run(t, ctx)
+// Run the tests for this tree and return their results.
+func (tr Tree) Run(t *testing.T, ctx Context) Result {
+	return tr.RunWithReporter(NewTestingReporter(t), ctx)
+}
+
+// RunWithReporter is the same as Run, except the results are reported to
+// the provided reporter instead of a test.
+func (tr *Tree) RunWithReporter(t Reporter, ctx Context) Result {
+	// Strip the ignored lines from the build output before anything is
+	// matched so neither the matches nor the natches see them.
+	if len(ctx.IgnorePatterns) > 0 {
+		ctx.BuildOutput = IgnoreBuildOutput(
+			ctx.BuildOutput, ctx.IgnorePatterns)
+		if ctx.BuildOutputIndex != nil {
+			ctx.BuildOutputIndex = ctx.BuildOutputIndex.Ignore(
+				ctx.IgnorePatterns)
+		}
+	}
+
+	// Index the build output once so each matcher is only evaluated
+	// against the output for its own lines instead of all of the output.
+	if ctx.BuildOutputIndex == nil && ctx.BuildOutput != "" {
+		idx, err := NewBuildOutputIndex(strings.NewReader(ctx.BuildOutput))
+		if err != nil {
+			t.Fatalf("failed to index build output: %v", err)
+		}
+		ctx.BuildOutputIndex = idx
+	}
+
+	ctx.color = newColorizer(ctx.Color)
+
+	if ctx.Tolerance < 0 || ctx.Tolerance > 100 {
+		t.Fatalf(
+			"invalid tolerance %s%%: must be between 0%% and 100%%",
+			strconv.FormatFloat(ctx.Tolerance, 'f', -1, 64))
+	}
+
+	if ctx.SortTests {
+		tr.Sort()
+	}
+
+	// A benchmark whose ID does not match any of the test cases would
+	// otherwise silently never be run.
+	if orphaned := tr.OrphanedBenchmarks(ctx); len(orphaned) > 0 {
+		msg := fmt.Sprintf(
+			"benchmark function registered without a test case: %s",
+			strings.Join(orphaned, ","))
+		if ctx.AllowOrphanedBenchmarks {
+			t.Log(msg)
+		} else {
+			t.Error(msg)
+		}
+	}
+
+	var results resultSet
+	tr.run(t, ctx, nil, &results)
+	return Result{TestCases: results.results()}
+}
+
+// Walk calls the provided function for each test case in the tree, in the
+// same order the test cases are run, with the test case's full path, ex.
+// the names of the nested subtests used to run it.
+func (tr *Tree) Walk(fn func(path []string, tc *TestCase)) {
+	tr.TreeNode.walk(nil, fn)
+}
+
+// Sort sorts the groups and test cases of each of the tree's nodes in
+// alphabetical order by name. Two test cases with the same name keep the
+// order in which they were inserted.
+func (tr *Tree) Sort() {
+	tr.TreeNode.sort()
+
+	// The test cases were moved, so update the pointers to them.
+	if tr.testsByID != nil {
+		tr.TreeNode.walk(nil, func(_ []string, tc *TestCase) {
+			tr.testsByID[tc.ID] = tc
+		})
+	}
+}
+
+// OrphanedBenchmarks returns the sorted keys of the context's Benchmarks
+// and BenchmarksMulti maps that do not correspond to any of the tree's test
+// cases, either by <ID> or by the benchmark prefix followed by the <ID>.
+// The keys whose <ID> does not match the context's filter, if any, are not
+// returned, since their test cases may have been excluded by the filter.
+func (tr *Tree) OrphanedBenchmarks(ctx Context) []string {
+	var filterRx *regexp.Regexp
+	if ctx.Filter != "" {
+		filterRx, _ = regexp.Compile(ctx.Filter)
+	}
+	isOrphaned := func(id string) bool {
+		if tr.Get(id) != nil {
+			return false
+		}
+		return filterRx == nil || filterRx.MatchString(id)
+	}
+
+	var orphaned []string
+	prefix := getBenchmarkPrefix(ctx)
+	for k := range ctx.Benchmarks {
+		if isOrphaned(k) &&
+			(!strings.HasPrefix(k, prefix) ||
+				isOrphaned(strings.TrimPrefix(k, prefix))) {
+			orphaned = append(orphaned, k)
+		}
+	}
+	for k := range ctx.BenchmarksMulti {
+		if isOrphaned(k) {
+			orphaned = append(orphaned, k)
+		}
+	}
+	sort.Strings(orphaned)
+	return orphaned
 }
 
 func (tr *Tree) Get(id string) *TestCase {
@@ -65,6 +195,27 @@ func (tr *Tree) Insert(testCase TestCase) *TestCase {
 	return tc
 }
 
+// InsertStrict is like Insert, but returns an error if the tree already has
+// a test case with the same ID that is not identical to the provided test
+// case. Inserting an identical test case more than once is not an error.
+func (tr *Tree) InsertStrict(testCase TestCase) (*TestCase, error) {
+	if tc := tr.Get(testCase.ID); tc != nil {
+		// The name of an inserted test case is the last element of its
+		// path, so compare the provided test case the same way.
+		if path := testCase.Path(); len(path) > 0 {
+			testCase.Name = path[len(path)-1]
+		}
+		if !tc.deepEqual(testCase) {
+			return nil, fmt.Errorf(
+				"duplicate test case lem.%s: defined at %s and at %s "+
+					"with different directives",
+				testCase.ID, tc.origin(), testCase.origin())
+		}
+		return tc, nil
+	}
+	return tr.Insert(testCase), nil
+}
+
 // TreeNode organizes the TestCases in a tree structure.
 type TreeNode struct {
 	sync.Once
@@ -110,6 +261,48 @@ func (tr *TreeNode) deepEqual(b TreeNode) bool {
 	return true
 }
 
+func (tr *TreeNode) walk(
+	path []string,
+	fn func(path []string, tc *TestCase)) {
+
+	for i, s := range tr.Steps {
+		tr.Nodes[i].walk(appendPath(path, s), fn)
+	}
+	for i := range tr.Tests {
+		tc := &tr.Tests[i]
+		fn(appendPath(path, tc.Name), tc)
+	}
+}
+
+func (tr *TreeNode) sort() {
+	// The steps and nodes are swapped in lockstep, and the index is rebuilt
+	// from the steps' new positions.
+	swapNodes := reflect.Swapper(tr.Nodes)
+	sort.Stable(stepsByName{tr: tr, swapNodes: swapNodes})
+	for i, s := range tr.Steps {
+		tr.Index[s] = i
+	}
+	for i := range tr.Nodes {
+		tr.Nodes[i].sort()
+	}
+	sort.SliceStable(tr.Tests, func(i, j int) bool {
+		return tr.Tests[i].Name < tr.Tests[j].Name
+	})
+}
+
+// stepsByName sorts a node's steps, and their nodes, by name.
+type stepsByName struct {
+	tr        *TreeNode
+	swapNodes func(i, j int)
+}
+
+func (s stepsByName) Len() int           { return len(s.tr.Steps) }
+func (s stepsByName) Less(i, j int) bool { return s.tr.Steps[i] < s.tr.Steps[j] }
+func (s stepsByName) Swap(i, j int) {
+	s.tr.Steps[i], s.tr.Steps[j] = s.tr.Steps[j], s.tr.Steps[i]
+	s.swapNodes(i, j)
+}
+
 func (tr *TreeNode) insert(testCase TestCase, path ...string) *TestCase {
 	tr.Once.Do(func() { tr.Index = map[string]int{} })
 	if len(path) < 2 {
@@ -128,78 +321,866 @@ func (tr *TreeNode) insert(testCase TestCase, path ...string) *TestCase {
 	}
 }
 
-func (tr TreeNode) run(t *testing.T, ctx Context) {
+func (tr TreeNode) run(
+	t Reporter,
+	ctx Context,
+	path []string,
+	results *resultSet) {
 
 	// Descend into any possible children.
 	for i, s := range tr.Steps {
 		i, s := i, s
-		t.Run(s, func(t *testing.T) {
-			tr.Nodes[i].run(t, ctx)
+		t.Run(s, func(t Reporter) {
+			tr.Nodes[i].run(t, ctx, appendPath(path, s), results)
 		})
 	}
 
-	// Run this node's tests.
+	// Run this node's tests. When running in parallel, the tests without a
+	// benchmark function are run concurrently, and the tests with one are
+	// run by themselves so the benchmarks do not contend for the CPU.
+	//
+	// Please note the parallel tests do not call t.Parallel, as that would
+	// defer them until the function that called Tree.Run returns, and it
+	// would not be possible to return their results. Instead t.Run is
+	// called from multiple goroutines, which the testing package allows,
+	// and the results are stored in the order the tests were declared.
+	var (
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, getParallelism())
+	)
+	defer wg.Wait()
 	for i := range tr.Tests {
 		tc := tr.Tests[i]
-		t.Run(tc.Name, func(t *testing.T) {
+		slot := results.reserve()
+		runTest := func(t Reporter) {
+			result := TestCaseResult{
+				ID:      tc.ID,
+				Package: tc.Package,
+				Path:    appendPath(path, tc.Name),
+			}
+			defer func() {
+				result.Failed = t.Failed()
+				result.Skipped = t.Skipped()
+				results.set(slot, result)
+			}()
+
+			// Skip the test case before any of its assertions are evaluated.
+			if tc.Skip {
+				reason := tc.SkipReason
+				if reason == "" {
+					reason = fmt.Sprintf("skipped by lem.%s.skip", tc.ID)
+				}
+				result.SkipReason = reason
+				t.Skip(reason)
+			}
+
+			// Skip the test case if any of its required build tags are not
+			// configured.
+			if missing := getMissingTags(ctx, tc.Tags); len(missing) > 0 {
+				reason := fmt.Sprintf(
+					"skipped by lem.%s.tags, missing build tags: %s",
+					tc.ID, strings.Join(missing, ","))
+				result.SkipReason = reason
+				t.Skip(reason)
+			}
+
+			// failLine records the failure with the result and the test.
+			// Only the test output is colorized so the results, and any
+			// reports written from them, remain plain text.
+			failLine := func(lm LineMatcher, msg string) {
+				t.Helper()
+				t.Error(ctx.color.colorize(msg, lm))
+				result.Failures = append(result.Failures, msg)
+			}
+
+			// fail records a failure that is not for a specific line.
+			fail := func(msg string) {
+				t.Helper()
+				failLine(LineMatcher{}, msg)
+			}
+
 			// Assert the expected leak, escape, move decisions match.
 			for _, lm := range tc.Matches {
-				if s := lm.Regexp.FindString(ctx.BuildOutput); s == "" {
-					t.Error(getBuildOutputErr(lm, s))
+				buildOutput := getBuildOutput(ctx, lm)
+				s, groups := findStringGroups(lm.Regexp, buildOutput)
+				if s == "" {
+					failLine(lm, getBuildOutputErr(lm, s, buildOutput))
+				} else if ctx.Verbose && len(groups) > 0 {
+					t.Logf("matched: %s", getGroupsMsg(lm.Regexp, groups))
 				}
+				r := newLineMatcherResult(lm, s, s == "")
+				r.Groups = groups
+				result.Matches = append(result.Matches, r)
 			}
 
 			// Assert the expected leak, escape, move decisions do not match.
 			for _, lm := range tc.Natches {
-				if s := lm.Regexp.FindString(ctx.BuildOutput); s != "" {
-					t.Error(getBuildOutputErr(lm, s))
+				buildOutput := getBuildOutput(ctx, lm)
+				s, groups := findStringGroups(lm.Regexp, buildOutput)
+				if s != "" {
+					failLine(lm, getBuildOutputErr(lm, s, buildOutput))
+				}
+				r := newLineMatcherResult(lm, s, s != "")
+				r.Groups = groups
+				result.Natches = append(result.Natches, r)
+			}
+
+			// Assert the expected sequences of patterns appear in order in
+			// the output for their lines.
+			for _, seq := range tc.Seqs {
+				buildOutput := getBuildOutput(ctx, seq[0])
+				seqResults, failedAt, reason := matchSeq(seq, buildOutput)
+				if failedAt >= 0 {
+					failLine(seq[failedAt], getSeqOutputErr(
+						seq, failedAt, reason, buildOutput))
+				}
+				result.Seqs = append(result.Seqs, seqResults...)
+			}
+
+			// Assert the patterns do not appear anywhere in the build
+			// optimization output.
+			for _, lm := range tc.Nones {
+				buildOutput := getAllBuildOutput(ctx)
+				s := lm.Regexp.FindString(buildOutput)
+				if s != "" {
+					failLine(lm, getBuildOutputErr(lm, s, buildOutput))
 				}
+				result.Nones = append(
+					result.Nones, newLineMatcherResult(lm, s, s != ""))
+			}
+
+			// Assert the expected patterns appear in the "go vet" output.
+			for _, lm := range tc.Vets {
+				s := lm.Regexp.FindString(ctx.VetOutput)
+				if s == "" {
+					failLine(lm, getVetOutputErr(lm, ctx.VetOutput))
+				}
+				result.Vets = append(
+					result.Vets, newLineMatcherResult(lm, s, s == ""))
+			}
+
+			// Assert the expected leak, escape, move decisions occur the
+			// expected number of times.
+			for _, lm := range tc.Counts {
+				all := lm.Regexp.FindAllString(getBuildOutput(ctx, lm), -1)
+				n := int64(len(all))
+				ok := lm.Count.Eq(n)
+				if !ok {
+					failLine(lm, getBuildOutputCountErr(lm, all))
+				}
+				r := newLineMatcherResult(lm, strings.Join(all, "\n"), !ok)
+				r.Count = &n
+				result.Counts = append(result.Counts, r)
+			}
+
+			// Assert the expected calls are devirtualized.
+			for _, lm := range tc.Devirts {
+				buildOutput := getBuildOutput(ctx, lm)
+				s := lm.Regexp.FindString(buildOutput)
+				if s == "" {
+					failLine(lm, getDevirtOutputErr(lm, buildOutput))
+				}
+				result.Devirts = append(
+					result.Devirts, newLineMatcherResult(lm, s, s == ""))
+			}
+
+			// Assert the expected patterns match a block of consecutive
+			// lines of output for the same position, ex. a message and its
+			// continuation lines at -m=2.
+			for _, lm := range tc.Blocks {
+				buildOutput := getBuildOutput(ctx, lm)
+				s := findBlock(lm, buildOutput)
+				if s == "" {
+					failLine(lm, getBuildOutputErr(lm, s, buildOutput))
+				}
+				result.Blocks = append(
+					result.Blocks, newLineMatcherResult(lm, s, s == ""))
+			}
+
+			// Record the number of heap escapes and moves for the lines
+			// asserted by the match directives.
+			if n, ok := getEscapes(ctx, tc); ok {
+				result.Escapes = &n
+			}
+
+			// Assert the expected patterns appear in the functions' assembly.
+			for _, am := range tc.Asm {
+				s, ok := am.FindString(ctx.AsmOutput)
+				if s == "" {
+					fail(getAsmOutputErr(am, ok))
+				}
+				result.Asm = append(result.Asm, LineMatcherResult{
+					Regexp: am.Regexp.String(),
+					Source: am.Source,
+					Output: s,
+					Failed: s == "",
+				})
+			}
+
+			// Assert the unexpected patterns do not appear in the functions'
+			// assembly.
+			for _, am := range tc.AsmNatches {
+				s, ok := am.FindString(ctx.AsmOutput)
+				if !ok || s != "" {
+					fail(getAsmOutputFoundErr(am, ok, s))
+				}
+				result.AsmNatches = append(result.AsmNatches, LineMatcherResult{
+					Regexp: am.Regexp.String(),
+					Source: am.Source,
+					Output: s,
+					Failed: !ok || s != "",
+				})
+			}
+
+			// Assert the expected stack frame size.
+			if af := tc.FrameSize; af != nil {
+				fs, ok := GetFrameSize(ctx.AsmOutput, af.File, af.Line)
+				fr := FrameSizeResult{Expected: af.Expected, FrameSize: fs}
+				if !ok {
+					fail(fmt.Sprintf(
+						"exp.framesize=%s, act.framesize=unknown: "+
+							"no %s in assembly output",
+						af.Expected, af.Scope()))
+					fr.Failed = true
+				} else if !af.Expected.Eq(fs) {
+					fail(fmt.Sprintf(
+						"exp.framesize=%s, act.framesize=%d", af.Expected, fs))
+					fr.Failed = true
+				}
+				result.FrameSize = &fr
 			}
 
 			// Find the benchmark function.
-			if benchFn, ok := ctx.Benchmarks[tc.ID]; !ok {
-				if ctx.Benchmarks != nil {
-					t.Logf("benchmark function not registered for %s", tc.ID)
+			if benchFns := GetBenchmarks(ctx, tc.ID); len(benchFns) == 0 {
+				msg := fmt.Sprintf(
+					"benchmark function not registered for %s or %s",
+					tc.ID, getBenchmarkPrefix(ctx)+tc.ID)
+				if ctx.RequireBenchmarks && tc.HasBenchmark() {
+					fail(msg)
+				} else if ctx.Benchmarks != nil ||
+					ctx.BenchmarksMulti != nil ||
+					tc.HasBenchmark() {
+					t.Log(msg)
 				}
 			} else {
 				// Assert the expected allocs and bytes match.
-				r := testing.Benchmark(benchFn)
-				if ea, aa := tc.AllocOp, r.AllocsPerOp(); !ea.Eq(aa) {
-					t.Errorf("exp.alloc=%d, act.alloc=%d", ea, aa)
+				var (
+					allocOp, bytesOp int64
+					extra            map[string]float64
+				)
+				// The test case's environment is applied last so its
+				// GOMAXPROCS, if any, takes precedence over the context's.
+				var envErr error
+				if err := WithBenchtime(tc.Benchtime, func() {
+					WithGOMAXPROCS(ctx.BenchmarkGOMAXPROCS, func() {
+						envErr = WithEnv(tc.Env, func() {
+							allocOp, bytesOp, extra = RunBenchmarks(benchFns...)
+						})
+					})
+				}); err != nil {
+					t.Fatalf("failed to set benchtime=%s: %v", tc.Benchtime, err)
+				}
+				if envErr != nil {
+					t.Fatalf("failed to set env: %v", envErr)
+				}
+				goarch := getGOARCH(ctx)
+				br := BenchmarkResult{
+					ExpectedAllocOp: tc.GetAllocOp(goarch).withTolerance(ctx.Tolerance),
+					ExpectedBytesOp: tc.GetBytesOp(goarch).withTolerance(ctx.Tolerance),
+					AllocOp:         allocOp,
+					BytesOp:         bytesOp,
 				}
-				if eb, ab := tc.BytesOp, r.AllocedBytesPerOp(); !eb.Eq(ab) {
-					t.Errorf("exp.bytes=%d, act.bytes=%d", eb, ab)
+				if ctx.Verbose {
+					t.Log(getObservedMsg(allocOp, bytesOp, extra))
 				}
+				benchNames := getFuncNames(benchFns...)
+
+				// When recording, the observed values are written to the
+				// sources after the run instead of failing the test case.
+				record := ctx.Record && !tc.noAlloc
+				if ea, aa := br.ExpectedAllocOp, br.AllocOp; !ea.Eq(aa) {
+					if record {
+						t.Logf("recording alloc=%d", aa)
+					} else {
+						fail(getBenchmarkErr(
+							"alloc", result.Path, benchNames, ea, aa))
+						br.Failed = true
+					}
+				}
+				if eb, ab := br.ExpectedBytesOp, br.BytesOp; !eb.Eq(ab) {
+					if record {
+						t.Logf("recording bytes=%d", ab)
+					} else {
+						fail(getBenchmarkErr(
+							"bytes", result.Path, benchNames, eb, ab))
+						br.Failed = true
+					}
+				}
+
+				// Assert the expected custom metrics match.
+				metricNames := make([]string, 0, len(tc.Metrics))
+				for name := range tc.Metrics {
+					metricNames = append(metricNames, name)
+				}
+				sort.Strings(metricNames)
+				for _, name := range metricNames {
+					em := tc.Metrics[name]
+					if br.ExpectedMetrics == nil {
+						br.ExpectedMetrics = map[string]Int64Range{}
+					}
+					br.ExpectedMetrics[name] = em
+					am, ok := extra[name]
+					if !ok {
+						fail(fmt.Sprintf(
+							"exp.metric:%[1]s=%[2]s, act.metric:%[1]s=unknown: "+
+								"metric %[1]s was not reported by the benchmark",
+							name, em))
+						br.Failed = true
+						continue
+					}
+					if br.Metrics == nil {
+						br.Metrics = map[string]float64{}
+					}
+					br.Metrics[name] = am
+					if !em.Eq(int64(math.Round(am))) {
+						fail(fmt.Sprintf(
+							"exp.metric:%[1]s=%[2]s, act.metric:%[1]s=%[3]v",
+							name, em, am))
+						br.Failed = true
+					}
+				}
+				result.Benchmark = &br
 			}
-		})
+
+			// Assert the observed values are no worse than the baseline.
+			if b := ctx.Baseline; b != nil {
+				if btc, ok := b.TestCases[tc.ID]; !ok {
+					t.Logf("no baseline for %s", tc.ID)
+				} else {
+					for _, msg := range getBaselineErrs(btc, result) {
+						fail(msg)
+					}
+				}
+			}
+		}
+		if !ctx.Parallel || len(GetBenchmarks(ctx, tc.ID)) > 0 {
+			wg.Wait()
+			t.Run(tc.Name, runTest)
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			t.Run(tc.Name, runTest)
+		}()
+	}
+}
+
+// getParallelism returns the maximum number of test cases to run at once
+// when running in parallel, which is the value of the -test.parallel flag,
+// or GOMAXPROCS if the flag is not defined.
+func getParallelism() int {
+	if f := flag.Lookup("test.parallel"); f != nil {
+		if g, ok := f.Value.(flag.Getter); ok {
+			if n, ok := g.Get().(int); ok && n > 0 {
+				return n
+			}
+		}
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// getObservedMsg returns a message with the allocs and bytes per operation,
+// and any custom metrics sorted by name, observed for a test case, ex.
+// "observed: alloc=2, bytes=32, metric:items/op=4".
+func getObservedMsg(
+	allocOp, bytesOp int64,
+	extra map[string]float64) string {
+
+	var w strings.Builder
+	fmt.Fprintf(&w, "observed: alloc=%d, bytes=%d", allocOp, bytesOp)
+	names := make([]string, 0, len(extra))
+	for name := range extra {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&w, ", metric:%s=%v", name, extra[name])
+	}
+	return w.String()
+}
+
+// appendPath returns a new slice with the provided element appended to
+// the path so sibling paths never share a backing array.
+func appendPath(path []string, s string) []string {
+	dst := make([]string, len(path), len(path)+1)
+	copy(dst, path)
+	return append(dst, s)
+}
+
+func newLineMatcherResult(
+	lm LineMatcher, output string, failed bool) LineMatcherResult {
+
+	return LineMatcherResult{
+		Regexp: lm.Regexp.String(),
+		Source: lm.Source,
+		Output: output,
+		Failed: failed,
+	}
+}
+
+// getBuildOutput returns the build optimization output against which the
+// provided matcher is matched. If the output is indexed and the matcher is
+// anchored to a file and line then it is limited to the lines for the
+// matcher's file and line(s). If the output includes the dependencies of
+// the packages then it is also limited to the lines for the matcher's file,
+// since files in different packages may have the same base name.
+func getBuildOutput(ctx Context, lm LineMatcher) string {
+	var lines []string
+	if idx := ctx.BuildOutputIndex; idx != nil && lm.File != "" && lm.Line > 0 {
+		firstLine, lastLine := lm.lines()
+		for i := firstLine; i <= lastLine; i++ {
+			lines = append(lines, idx.Lookup(lm.File, i)...)
+		}
+	} else if !ctx.IncludeDeps || lm.Path == "" {
+		return getAllBuildOutput(ctx)
+	} else {
+		lines = strings.SplitAfter(getAllBuildOutput(ctx), "\n")
+	}
+	var (
+		sb     strings.Builder
+		prefix = lm.Path + ":"
+	)
+	for _, l := range lines {
+		if !ctx.IncludeDeps || lm.Path == "" || strings.HasPrefix(l, prefix) {
+			sb.WriteString(strings.TrimSuffix(l, "\n"))
+			sb.WriteByte('\n')
+		}
 	}
+	return sb.String()
+}
+
+// getAllBuildOutput returns all of the build optimization output.
+func getAllBuildOutput(ctx Context) string {
+	if ctx.BuildOutput == "" && ctx.BuildOutputIndex != nil {
+		return ctx.BuildOutputIndex.String()
+	}
+	return ctx.BuildOutput
+}
+
+// getGOARCH returns the target architecture from the context's build
+// context, otherwise the architecture of the running program.
+func getGOARCH(ctx Context) string {
+	if ctx.BuildContext != nil && ctx.BuildContext.GOARCH != "" {
+		return ctx.BuildContext.GOARCH
+	}
+	return runtime.GOARCH
 }
 
 const expectedBuildOutputNotFound = `error: build optimization
 reason: not found
 regexp: %s
-source: %s
+%ssource: %s
+`
+
+const expectedBuildOutputNotFoundWithLineOutput = `error: build optimization
+reason: not found
+regexp: %s
+%ssource: %s
+output for line:
+%s
 `
 
 const expectedBuildOutputWasFound = `error: build optimization
 reason: was found
 output: %s
-regexp: %s
-source: %s
+%sregexp: %s
+%ssource: %s
 `
 
-func getBuildOutputErr(lm LineMatcher, found string) string {
+// findStringGroups returns the leftmost match of the provided regexp in s,
+// and the values captured by the regexp's named groups, if any.
+func findStringGroups(rx *regexp.Regexp, s string) (string, map[string]string) {
+	sm := rx.FindStringSubmatch(s)
+	if sm == nil {
+		return "", nil
+	}
+	var groups map[string]string
+	for i, name := range rx.SubexpNames() {
+		if name == "" {
+			continue
+		}
+		if groups == nil {
+			groups = map[string]string{}
+		}
+		groups[name] = sm[i]
+	}
+	return sm[0], groups
+}
+
+// getGroupsMsg returns the values captured by the named groups of the
+// provided regexp, in the order in which the groups appear in the regexp,
+// ex. "name=x level=0".
+func getGroupsMsg(rx *regexp.Regexp, groups map[string]string) string {
+	var pairs []string
+	for _, name := range rx.SubexpNames() {
+		if v, ok := groups[name]; ok && name != "" {
+			pairs = append(pairs, fmt.Sprintf("%s=%s", name, v))
+		}
+	}
+	return strings.Join(pairs, " ")
+}
+
+// getGroupsLine returns the "groups:" line of a failure message for the
+// values captured by the named groups of the provided regexp from the
+// found output, or an empty string if the regexp has no named groups.
+func getGroupsLine(rx *regexp.Regexp, found string) string {
+	_, groups := findStringGroups(rx, found)
+	if len(groups) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("groups: %s\n", getGroupsMsg(rx, groups))
+}
+
+// getFileLine returns the "file:" line of a failure message for the
+// provided file and line, or an empty string if the file is unknown.
+func getFileLine(file string, line int) string {
+	if file == "" {
+		return ""
+	}
+	return fmt.Sprintf("file:   %s:%d\n", file, line)
+}
+
+func getBuildOutputErr(lm LineMatcher, found, buildOutput string) string {
 	if found == "" {
+		// Include what the compiler did emit for the line, if anything, to
+		// make it easier to diagnose a regexp that nearly matched.
+		if lineOutput := lm.FindLineOutput(buildOutput); len(lineOutput) > 0 {
+			return fmt.Sprintf(
+				expectedBuildOutputNotFoundWithLineOutput,
+				lm.Regexp.String(),
+				getFileLine(lm.File, lm.Line),
+				lm.Source,
+				"\t"+strings.Join(lineOutput, "\n\t"),
+			)
+		}
 		return fmt.Sprintf(
 			expectedBuildOutputNotFound,
 			lm.Regexp.String(),
+			getFileLine(lm.File, lm.Line),
 			lm.Source,
 		)
 	}
 	return fmt.Sprintf(
 		expectedBuildOutputWasFound,
 		found,
+		getGroupsLine(lm.Regexp, found),
+		lm.Regexp.String(),
+		getFileLine(lm.File, lm.Line),
+		lm.Source,
+	)
+}
+
+// blockPosRx matches the position at the beginning of a line of build
+// optimization output, ex. "./a.go:7:2: ".
+var blockPosRx = regexp.MustCompile(`^.*?\.go:\d+:\d+: `)
+
+// findBlock returns the first block of build optimization output for the
+// matcher's file and line that is matched by the matcher's regexp, or an
+// empty string if there is none. A block is a run of consecutive lines
+// with the same position, ex. a message and its continuation lines, and
+// the regexp is matched against the messages of the block, without their
+// positions, joined by newlines.
+func findBlock(lm LineMatcher, buildOutput string) string {
+	var (
+		pos   string
+		block []string
+		found string
+	)
+	match := func() bool {
+		if len(block) > 0 && lm.Regexp.MatchString(strings.Join(block, "\n")) {
+			found = pos + strings.Join(block, "\n"+pos)
+			return true
+		}
+		return false
+	}
+	for _, l := range lm.FindLineOutput(buildOutput) {
+		p := blockPosRx.FindString(l)
+		if p != pos {
+			if match() {
+				return found
+			}
+			pos, block = p, nil
+		}
+		block = append(block, l[len(p):])
+	}
+	match()
+	return found
+}
+
+// matchSeq matches the patterns of the provided sequence against the build
+// optimization output in order, where each pattern must match a line after
+// the line matched by the previous pattern. The index of the first pattern
+// that did not match is returned along with the reason, otherwise -1. The
+// patterns after the first one that did not match are not evaluated and
+// are reported as failed.
+func matchSeq(
+	seq []LineMatcher,
+	buildOutput string) ([]LineMatcherResult, int, string) {
+
+	var (
+		offset   int
+		failedAt = -1
+		reason   string
+		results  = make([]LineMatcherResult, len(seq))
+	)
+	for i, lm := range seq {
+		if failedAt >= 0 {
+			results[i] = newLineMatcherResult(lm, "", true)
+			continue
+		}
+		loc := lm.Regexp.FindStringIndex(buildOutput[offset:])
+		if loc == nil {
+			failedAt, reason = i, "not found"
+			if lm.Regexp.MatchString(buildOutput) {
+				reason = "out of order"
+			}
+			results[i] = newLineMatcherResult(lm, "", true)
+			continue
+		}
+		results[i] = newLineMatcherResult(
+			lm, buildOutput[offset+loc[0]:offset+loc[1]], false)
+		offset += loc[1]
+	}
+	return results, failedAt, reason
+}
+
+const expectedSeqOutputNotFound = `error: build optimization
+reason: %s
+regexp: %s
+%s%ssource: %s
+output for line:
+%s
+`
+
+func getSeqOutputErr(
+	seq []LineMatcher, failedAt int, reason, buildOutput string) string {
+
+	lm := seq[failedAt]
+	var after string
+	if failedAt > 0 {
+		after = fmt.Sprintf("after:  %s\n", seq[failedAt-1].Regexp.String())
+	}
+	lineOutput := "\t<none>"
+	if l := lm.FindLineOutput(buildOutput); len(l) > 0 {
+		lineOutput = "\t" + strings.Join(l, "\n\t")
+	}
+	return fmt.Sprintf(
+		expectedSeqOutputNotFound,
+		reason,
+		lm.Regexp.String(),
+		after,
+		getFileLine(lm.File, lm.Line),
+		lm.Source,
+		lineOutput,
+	)
+}
+
+const expectedAsmOutputNotFound = `error: assembly
+reason: %s
+scope:  %s
+regexp: %s
+%ssource: %s
+`
+
+const expectedAsmOutputFound = `error: assembly
+reason: found
+scope:  %s
+regexp: %s
+output: %s
+%ssource: %s
+`
+
+const expectedVetOutputNotFound = `error: vet
+reason: not found
+regexp: %s
+%ssource: %s
+`
+
+const expectedVetOutputNotFoundWithLineOutput = `error: vet
+reason: not found
+regexp: %s
+%ssource: %s
+output for line:
+%s
+`
+
+func getVetOutputErr(lm LineMatcher, vetOutput string) string {
+	if lineOutput := lm.FindLineOutput(vetOutput); len(lineOutput) > 0 {
+		return fmt.Sprintf(
+			expectedVetOutputNotFoundWithLineOutput,
+			lm.Regexp.String(),
+			getFileLine(lm.File, lm.Line),
+			lm.Source,
+			"\t"+strings.Join(lineOutput, "\n\t"),
+		)
+	}
+	return fmt.Sprintf(
+		expectedVetOutputNotFound,
+		lm.Regexp.String(),
+		getFileLine(lm.File, lm.Line),
+		lm.Source,
+	)
+}
+
+const expectedBuildOutputCount = `error: build optimization
+reason: count mismatch
+expected: %s
+actual: %d
+regexp: %s
+%ssource: %s
+`
+
+const expectedBuildOutputCountWithOutput = `error: build optimization
+reason: count mismatch
+expected: %s
+actual: %d
+output:
+%s
+regexp: %s
+%ssource: %s
+`
+
+func getBuildOutputCountErr(lm LineMatcher, found []string) string {
+	if len(found) == 0 {
+		return fmt.Sprintf(
+			expectedBuildOutputCount,
+			lm.Count,
+			len(found),
+			lm.Regexp.String(),
+			getFileLine(lm.File, lm.Line),
+			lm.Source,
+		)
+	}
+	return fmt.Sprintf(
+		expectedBuildOutputCountWithOutput,
+		lm.Count,
+		len(found),
+		"\t"+strings.Join(found, "\n\t"),
+		lm.Regexp.String(),
+		getFileLine(lm.File, lm.Line),
+		lm.Source,
+	)
+}
+
+const expectedDevirtNotFound = `error: devirtualization
+reason: not devirtualized
+regexp: %s
+%ssource: %s
+`
+
+const expectedDevirtNotFoundWithLineOutput = `error: devirtualization
+reason: not devirtualized
+regexp: %s
+%ssource: %s
+output for line:
+%s
+`
+
+// getDevirtOutputErr returns a report of a lem.<ID>.devirt= assertion
+// that failed, including what the compiler did emit for the line, if
+// anything, ex. that the call was inlined instead.
+func getDevirtOutputErr(lm LineMatcher, buildOutput string) string {
+	if lineOutput := lm.FindLineOutput(buildOutput); len(lineOutput) > 0 {
+		return fmt.Sprintf(
+			expectedDevirtNotFoundWithLineOutput,
+			lm.Regexp.String(),
+			getFileLine(lm.File, lm.Line),
+			lm.Source,
+			"\t"+strings.Join(lineOutput, "\n\t"),
+		)
+	}
+	return fmt.Sprintf(
+		expectedDevirtNotFound,
 		lm.Regexp.String(),
+		getFileLine(lm.File, lm.Line),
 		lm.Source,
 	)
 }
+
+func getAsmOutputErr(am AsmMatcher, foundFunc bool) string {
+	reason := "not found"
+	if !foundFunc {
+		reason = "function not found in assembly output"
+	}
+	return fmt.Sprintf(
+		expectedAsmOutputNotFound,
+		reason,
+		am.Scope(),
+		am.Regexp.String(),
+		getFileLine(am.File, am.Line),
+		am.Source,
+	)
+}
+
+// getAsmOutputFoundErr returns the error for an unexpected pattern that
+// was found in a function's assembly, or for a function whose assembly
+// was not found at all, since then the pattern cannot be asserted.
+func getAsmOutputFoundErr(am AsmMatcher, foundFunc bool, output string) string {
+	if !foundFunc {
+		return getAsmOutputErr(am, false)
+	}
+	return fmt.Sprintf(
+		expectedAsmOutputFound,
+		am.Scope(),
+		am.Regexp.String(),
+		output,
+		getFileLine(am.File, am.Line),
+		am.Source,
+	)
+}
+
+const expectedBenchmarkMismatch = `error: benchmark
+reason: %s mismatch
+path: %s
+bench: %s
+expected: %s
+actual: %d
+delta: %+d
+`
+
+// getBenchmarkErr returns a report of an alloc or bytes assertion that
+// failed, where delta is the distance from the actual value to the nearest
+// bound of the expected range.
+func getBenchmarkErr(
+	kind string,
+	path, benchNames []string,
+	exp Int64Range,
+	act int64) string {
+
+	return fmt.Sprintf(
+		expectedBenchmarkMismatch,
+		kind,
+		strings.Join(path, "/"),
+		strings.Join(benchNames, ", "),
+		exp,
+		act,
+		exp.delta(act),
+	)
+}
+
+// getFuncNames returns the package-qualified names of the provided
+// functions, ex. "mem_test.escape1".
+func getFuncNames(fns ...func(*testing.B)) []string {
+	names := make([]string, len(fns))
+	for i, fn := range fns {
+		name := runtime.FuncForPC(reflect.ValueOf(fn).Pointer()).Name()
+		if j := strings.LastIndex(name, "/"); j >= 0 {
+			name = name[j+1:]
+		}
+		names[i] = name
+	}
+	return names
+}
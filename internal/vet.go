@@ -0,0 +1,59 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"errors"
+	"go/build"
+	"io"
+	"os/exec"
+)
+
+// Vet runs "go vet" for the specified package and writes its diagnostics
+// to the provided writer.
+//
+// Please note it is not an error for "go vet" to report diagnostics, since
+// the diagnostics are what lem.<ID>.vet= assertions are matched against.
+func Vet(w io.Writer, pkg build.Package, ctx Context) error {
+	// If there are no valid Go sources, test or otherwise, then
+	// return early.
+	if len(pkg.GoFiles) == 0 &&
+		len(pkg.CgoFiles) == 0 &&
+		len(pkg.TestGoFiles) == 0 &&
+		len(pkg.XTestGoFiles) == 0 {
+		return nil
+	}
+
+	args := []string{"vet"}
+	args = append(args, getTagsArgs(ctx)...)
+	args = append(args, pkg.ImportPath)
+
+	// The go command exits with a status of one if there are diagnostics.
+	var exitErr *exec.ExitError
+	if err := runGo(w, ctx, args...); err != nil &&
+		!(errors.As(err, &exitErr) && exitErr.ExitCode() == 1) {
+		return err
+	}
+	return nil
+}
+
+// VetAll runs "go vet" for the specified packages and writes their
+// diagnostics to the provided writer.
+func VetAll(w io.Writer, pkgs []build.Package, ctx Context) error {
+	_, err := buildAll(w, pkgs, ctx, Vet, false)
+	return err
+}
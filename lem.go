@@ -18,45 +18,200 @@ package lem
 
 import (
 	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"go/build"
+	"io"
+	"io/fs"
+	"log"
+	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"runtime"
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/akutz/lem/internal"
 )
 
 // Context provides a means to configure the test execution.
 type Context struct {
+	// AllowOrphanedBenchmarks may be set to true in order to log, instead of
+	// fail, a benchmark in the Benchmarks or BenchmarksMulti maps whose
+	// <ID> does not match any of the test cases. Otherwise such a benchmark
+	// is an error, since it would silently never be run.
+	AllowOrphanedBenchmarks bool
+
+	// AsmOutput may be used in place of building any of the specified
+	// packages to produce their assembly.
+	// If this field is specified then there will be no calls to "go build"
+	// or "go test" with the "-S" flag.
+	AsmOutput string
+
+	// BaselinePath is an optional path to a baseline file of the values
+	// observed for the test cases during a previous run. If specified then
+	// a test case fails if any of its observed allocations, bytes, or heap
+	// escapes are greater than the values in the baseline.
+	//
+	// Please note test cases not in the baseline are not compared, and
+	// test cases in the baseline that no longer exist are logged.
+	BaselinePath string
+
+	// BenchmarkGOMAXPROCS is an optional value to which GOMAXPROCS is pinned
+	// while the benchmarks are run. The original value is restored after
+	// each benchmark.
+	//
+	// Please note this should be set when asserting the allocations and/or
+	// bytes of benchmarks that use b.RunParallel, as the number of goroutines,
+	// and any per-goroutine allocations, depends on GOMAXPROCS. Pinning it
+	// makes the assertions reproducible across machines.
+	BenchmarkGOMAXPROCS int
+
+	// BenchmarkPrefix is the prefix of the name of a benchmark function
+	// discovered by convention for a given <ID>. Defaults to "BenchmarkLem_".
+	//
+	// Please see the Benchmarks function for more information.
+	BenchmarkPrefix string
+
 	// Benchmarks is an optional map of functions to benchmark.
 	//
-	// Keys in this map should correspond go the <ID> from "lem.<ID>" comments.
+	// Keys in this map should correspond go the <ID> from "lem.<ID>" comments,
+	// or to BenchmarkPrefix followed by the <ID>.
 	//
 	// Please note this is required to assert allocations and/or bytes.
 	Benchmarks map[string]func(*testing.B)
 
+	// BenchmarksMulti is an optional map of functions to benchmark, where
+	// more than one function may contribute to the same <ID>, ex. to run the
+	// same code with several input sizes.
+	//
+	// Each function is run and the largest number of allocations and bytes
+	// per operation across all of the runs are asserted. The functions for
+	// an <ID> in this map are run in addition to any function for the same
+	// <ID> in the Benchmarks map.
+	BenchmarksMulti map[string][]func(*testing.B)
+
+	// BuildCacheDir is the directory used to cache build output. Defaults
+	// to a directory named "lem" in os.UserCacheDir().
+	//
+	// The build output for a package is cached using a key derived from
+	// the go version, the target platform, Env, CompilerFlags, the contents
+	// of the package's source files, and the build IDs of the package's
+	// dependencies as reported by "go list -export -deps".
+	BuildCacheDir string
+
 	// BuildContext is the support context for building the specified
 	// packages and discovering their source files.
 	//
+	// The GOOS, GOARCH, and CgoEnabled fields are used to set the target
+	// platform when building the packages, making it possible to assert
+	// escape analysis results for architectures other than the host's.
+	//
+	// The Dir field, if set, is used as the working directory when building
+	// the packages.
+	//
 	// Please see https://pkg.go.dev/go/build#Context for more information.
 	BuildContext *build.Context
 
+	// BuildMode is passed to the go command as -buildmode when building the
+	// specified packages.
+	// Build modes that cannot be used with "go test -c," ex. c-shared, cause
+	// packages to be built without their test files.
+	//
+	// Please see "go help buildmode" for more information.
+	BuildMode string
+
 	// BuildOutput may be used in place of building any of the specified
 	// packages.
 	// If this field is specified then there will be no calls to "go build"
 	// or "go test."
 	BuildOutput string
 
+	// BuildParallelism is the maximum number of packages built at the same
+	// time. Defaults to runtime.GOMAXPROCS(0).
+	BuildParallelism int
+
+	// BuildTags is an optional list of build tags used to build the
+	// specified packages and discover their source files. If non-empty,
+	// these tags take precedence over both the value of the -tags flag and
+	// the BuildTags field of the BuildContext.
+	//
+	// This makes it possible to specify the build tags when lem is run
+	// without a -tags flag, ex. from another command or test harness.
+	BuildTags []string
+
+	// BuildTimeout is an optional, maximum amount of time each invocation
+	// of the go command used to build the specified packages may run. If
+	// the timeout elapses then the go command is killed and the test fails
+	// instead of hanging.
+	BuildTimeout time.Duration
+
+	// Color may be set to true to colorize the labels of the failure
+	// messages and highlight the part of the source line targeted by a
+	// failed assertion. Color is only used when the test output is written
+	// to a terminal and the NO_COLOR environment variable is not set.
+	Color bool
+
 	// CompilerFlags is a list of flags to pass to the compiler.
 	//
 	// Please note the "-m" flag will always be used, whether it is included
-	// in this list or not.
+	// in this list or not. Please see MFlagLevel for more information.
+	//
+	// Please see PackageCompilerFlags to specify flags for a single package.
 	CompilerFlags []string
 
+	// DisableBuildCache may be set to true to always build the specified
+	// packages instead of using previously cached build output.
+	DisableBuildCache bool
+
+	// Env is an optional map of environment variables merged over the
+	// current environment when building the specified packages, ex.
+	// GOEXPERIMENT or GOFLAGS.
+	Env map[string]string
+
+	// ExtraBuildArgs is an optional list of arguments passed to "go build"
+	// after the compiler flags and before the import path when building a
+	// package without its tests, ex. "-trimpath". The arguments may not
+	// include the -gcflags or -o flags, which are set by lem.
+	ExtraBuildArgs []string
+
+	// ExtraTestArgs is like ExtraBuildArgs, except the arguments are passed
+	// to "go test -c" when building a package with its tests.
+	ExtraTestArgs []string
+
+	// Filter is an optional regular expression used to select the test
+	// cases to run by their IDs, similar to the -run flag. Test cases
+	// whose IDs do not match are not run. If empty then all test cases
+	// are run.
+	Filter string
+
+	// GoCmd is the go command used to build the specified packages. If
+	// the value is an absolute path it is used verbatim, otherwise it is
+	// resolved from the PATH. Defaults to "go".
+	GoCmd string
+
+	// GoToolchain is an optional Go toolchain used to build the specified
+	// packages, ex. "go1.22.0" or "local", in order to pin the compiler
+	// and thus its optimization decisions. The value is passed to the go
+	// command as the GOTOOLCHAIN environment variable and takes precedence
+	// over GOTOOLCHAIN in Env. If the toolchain is not installed and
+	// cannot be downloaded, the error includes the go command's message.
+	//
+	// Please note this requires Go 1.21 or later.
+	GoToolchain string
+
+	// IgnorePatterns is an optional list of regular expressions used to
+	// strip lines from the build output before the test cases are run.
+	// Because the lines are removed before any matching occurs, neither
+	// the match nor the natch directives see them, ex. to ignore noisy
+	// output from generated code. Each pattern is matched against a
+	// single line of output, including its file and line prefix.
+	IgnorePatterns []*regexp.Regexp
+
 	// ImportedPackages is a list of imported packages to include in the
 	// testing.
 	//
@@ -64,30 +219,333 @@ type Context struct {
 	// the Packages field is ignored.
 	ImportedPackages []build.Package
 
+	// IncludeDeps may be set to true in order to build the specified
+	// packages with "-gcflags=all=...", so the build optimization output
+	// includes the decisions made for the packages' dependencies, ex. for
+	// a function from another package that was inlined.
+	//
+	// The paths of the source files in the output are resolved to absolute
+	// paths so a match directive only matches the output for its own file,
+	// even if a dependency has a file with the same base name. Therefore,
+	// if BuildOutput is also specified, its paths must be absolute.
+	IncludeDeps bool
+
+	// IndexBuildOutput may be set to true in order to index the build
+	// optimization output by file and line as it is streamed from the
+	// go command, instead of buffering all of the output and indexing it
+	// afterwards. This reduces the memory used to test very large
+	// packages, especially when IncludeDeps is also set.
+	//
+	// Please note the output of each package is not kept when the output
+	// is indexed, so Result.BuildOutputs is nil.
+	IndexBuildOutput bool
+
+	// JUnitPath is an optional path to which a JUnit XML report of every
+	// test case and the outcome of its assertions is written after the
+	// tests have been run.
+	JUnitPath string
+
+	// Logger is an optional logger to which the diagnostics are written,
+	// ex. the go command that failed to build a package. If nil then the
+	// diagnostics are written to the standard logger.
+	Logger *log.Logger
+
+	// MFlagLevel is the verbosity of the compiler's "-m" flag used to
+	// produce the build optimization output. Defaults to one, i.e. "-m".
+	// Higher levels, ex. two for "-m=2", include details such as the cost
+	// of inlining a function and the flow that caused a value to escape.
+	//
+	// Please note any form of the "-m" flag in CompilerFlags is ignored.
+	MFlagLevel int
+
+	// PackageCompilerFlags is an optional map of flags to pass to the
+	// compiler when building a specific package, keyed by the package's
+	// import path, ex. "-l" to disable inlining for only one package.
+	//
+	// The flags for a package are passed to the compiler after the flags
+	// from CompilerFlags, and, like CompilerFlags, any form of the "-m"
+	// flag is ignored.
+	PackageCompilerFlags map[string][]string
+
 	// Packages is a list of packages to include in the testing.
 	//
+	// Relative patterns that end with "/...", ex. "./...", are expanded to
+	// the packages rooted at the pattern's directory, excluding testdata and
+	// vendor directories, in the same manner as the go tool.
+	//
 	// Please note this field is ignored if the ImportedPackages field has a
 	// non-zero number of elements.
 	Packages []string
+
+	// Parallel may be set to true in order to run the test cases without a
+	// benchmark function concurrently, up to the value of the
+	// -test.parallel flag at once. The test cases with a benchmark function
+	// are still run by themselves so their benchmarks do not contend for
+	// the CPU with other test cases.
+	Parallel bool
+
+	// Record may be set to true in order to write the allocs and bytes per
+	// operation observed for the test cases back into the lem comments of
+	// the source files, similar to the -update flag used by tests with
+	// golden files. An alloc or bytes directive that does not match the
+	// observed value is updated, a missing alloc or bytes directive is
+	// added for a test case with a benchmark function, and neither fails
+	// the test case.
+	//
+	// Please note the source files are modified in place.
+	Record bool
+
+	// ReportPath is an optional path to which a JSON report of every test
+	// case and the outcome of its assertions is written after the tests
+	// have been run.
+	ReportPath string
+
+	// RequireBenchmarks may be set to true in order to fail a test case
+	// that has alloc, bytes, or noalloc directives but no registered
+	// benchmark function. Otherwise the missing benchmark is only logged
+	// and the assertions are skipped.
+	RequireBenchmarks bool
+
+	// RequireNames may be set to true in order to fail if a test case has
+	// a match, natch, alloc, or bytes directive but no name directive.
+	// Because any directive creates a test case for an unknown ID, this
+	// catches a typo in the ID of a directive that would otherwise create
+	// a new test case instead of adding to the intended one.
+	RequireNames bool
+
+	// SortTests may be set to true in order to run the test cases, and any
+	// groups of them, in alphabetical order by name instead of the order in
+	// which they were parsed, ex. for stable "go test -v" output.
+	SortTests bool
+
+	// Summary may be set to true in order to log a summary at the end of
+	// the run with the number of test cases that passed, failed, and were
+	// skipped, as well as the IDs of the failed test cases and a one-line
+	// reason for each of their failures.
+	Summary bool
+
+	// TempDir is an optional directory in which the temporary test binaries
+	// are created when building the specified packages. If empty, the
+	// default directory for temporary files is used, ex. $TMPDIR. This is
+	// useful when the default directory is read-only or slow, ex. in a
+	// sandboxed CI environment.
+	TempDir string
+
+	// Tolerance is an optional percentage, ex. 5 for 5%, by which the
+	// expected allocs and bytes per operation of every test case are
+	// widened in both directions before they are compared to the observed
+	// values, ex. lem.<ID>.alloc=100 passes for 95 through 105 allocations.
+	// A directive with a tolerance of its own, ex. "alloc=100~2%", uses
+	// that tolerance instead, and open-ended ranges, ex. "alloc=<=100,"
+	// are never widened. Must be between 0 and 100.
+	Tolerance float64
+
+	// UpdateBaseline may be set to true in order to write the values
+	// observed for the test cases to BaselinePath instead of comparing
+	// them to the baseline.
+	UpdateBaseline bool
+
+	// UseGoPackages may be set to true in order to resolve the specified
+	// packages in module-aware mode with "go list", the same mechanism used
+	// by golang.org/x/tools/go/packages, instead of the go/build package.
+	// This honors the active go.mod file, including replace directives, as
+	// well as packages outside of GOPATH.
+	//
+	// Please note this field is ignored if the ImportedPackages field has a
+	// non-zero number of elements.
+	UseGoPackages bool
+
+	// Verbose may be set to true in order to log the allocs and bytes per
+	// operation, as well as any custom metrics, observed for every test case
+	// with a benchmark function, whether or not its assertions passed. This
+	// is useful for discovering the values to assert.
+	Verbose bool
+
+	// VetOutput may be used in place of running "go vet" for any of the
+	// specified packages.
+	// If this field is specified then there will be no calls to "go vet".
+	VetOutput string
 }
 
 // Copy returns a copy of this context.
 func (src Context) Copy() Context {
 	return Context{
-		Benchmarks:       copyNillableBenchmarksMap(src.Benchmarks),
-		BuildContext:     copyNillableGoBuildContext(src.BuildContext),
-		BuildOutput:      src.BuildOutput,
-		CompilerFlags:    copyNillableStringSlice(src.CompilerFlags),
-		ImportedPackages: copyNillableImportedPackageSlice(src.ImportedPackages),
-		Packages:         copyNillableStringSlice(src.Packages),
+		AllowOrphanedBenchmarks: src.AllowOrphanedBenchmarks,
+		AsmOutput:               src.AsmOutput,
+		BaselinePath:            src.BaselinePath,
+		BenchmarkGOMAXPROCS:     src.BenchmarkGOMAXPROCS,
+		BenchmarkPrefix:         src.BenchmarkPrefix,
+		Benchmarks:              copyNillableBenchmarksMap(src.Benchmarks),
+		BenchmarksMulti:         copyNillableBenchmarksMultiMap(src.BenchmarksMulti),
+		BuildCacheDir:           src.BuildCacheDir,
+		BuildContext:            copyNillableGoBuildContext(src.BuildContext),
+		BuildMode:               src.BuildMode,
+		BuildOutput:             src.BuildOutput,
+		BuildParallelism:        src.BuildParallelism,
+		BuildTags:               copyNillableStringSlice(src.BuildTags),
+		BuildTimeout:            src.BuildTimeout,
+		Color:                   src.Color,
+		CompilerFlags:           copyNillableStringSlice(src.CompilerFlags),
+		DisableBuildCache:       src.DisableBuildCache,
+		Env:                     copyNillableStringMap(src.Env),
+		ExtraBuildArgs:          copyNillableStringSlice(src.ExtraBuildArgs),
+		ExtraTestArgs:           copyNillableStringSlice(src.ExtraTestArgs),
+		Filter:                  src.Filter,
+		GoCmd:                   src.GoCmd,
+		GoToolchain:             src.GoToolchain,
+		IgnorePatterns:          copyNillableRegexpSlice(src.IgnorePatterns),
+		IncludeDeps:             src.IncludeDeps,
+		IndexBuildOutput:        src.IndexBuildOutput,
+		ImportedPackages:        copyNillableImportedPackageSlice(src.ImportedPackages),
+		JUnitPath:               src.JUnitPath,
+		Logger:                  src.Logger,
+		MFlagLevel:              src.MFlagLevel,
+		PackageCompilerFlags:    copyNillableStringSliceMap(src.PackageCompilerFlags),
+		Packages:                copyNillableStringSlice(src.Packages),
+		Parallel:                src.Parallel,
+		Record:                  src.Record,
+		ReportPath:              src.ReportPath,
+		RequireBenchmarks:       src.RequireBenchmarks,
+		RequireNames:            src.RequireNames,
+		SortTests:               src.SortTests,
+		Summary:                 src.Summary,
+		TempDir:                 src.TempDir,
+		Tolerance:               src.Tolerance,
+		UpdateBaseline:          src.UpdateBaseline,
+		UseGoPackages:           src.UseGoPackages,
+		Verbose:                 src.Verbose,
+		VetOutput:               src.VetOutput,
+	}
+}
+
+// Merge returns a copy of this context with the fields of the other context
+// merged over it, ex. to overlay the overrides for a test on a base context.
+//
+// The merge follows these rules:
+//
+//   - A string, number, duration, or pointer field is replaced by the other
+//     context's value if it is non-zero, ex. a non-empty GoCmd or a non-nil
+//     BuildContext.
+//   - A bool field is true if it is true in either context, i.e. a merge
+//     cannot reset a field to false.
+//   - A slice field, ex. CompilerFlags or Packages, is the concatenation of
+//     this context's elements followed by the other context's elements.
+//   - A map field is the union of both maps. For Benchmarks and Env the
+//     other context's value for a key replaces this context's value, while
+//     for BenchmarksMulti and PackageCompilerFlags the values for a key are
+//     concatenated like slice fields.
+//
+// Neither context is modified, and the returned context shares no slices
+// or maps with either of them.
+func (src Context) Merge(other Context) Context {
+	dst := src.Copy()
+	dst.AllowOrphanedBenchmarks = src.AllowOrphanedBenchmarks ||
+		other.AllowOrphanedBenchmarks
+	dst.AsmOutput = mergeString(src.AsmOutput, other.AsmOutput)
+	dst.BaselinePath = mergeString(src.BaselinePath, other.BaselinePath)
+	if other.BenchmarkGOMAXPROCS != 0 {
+		dst.BenchmarkGOMAXPROCS = other.BenchmarkGOMAXPROCS
+	}
+	dst.BenchmarkPrefix = mergeString(src.BenchmarkPrefix, other.BenchmarkPrefix)
+	dst.Benchmarks = mergeNillableBenchmarksMap(
+		src.Benchmarks, other.Benchmarks)
+	dst.BenchmarksMulti = mergeNillableBenchmarksMultiMap(
+		src.BenchmarksMulti, other.BenchmarksMulti)
+	dst.BuildCacheDir = mergeString(src.BuildCacheDir, other.BuildCacheDir)
+	if other.BuildContext != nil {
+		dst.BuildContext = copyNillableGoBuildContext(other.BuildContext)
+	}
+	dst.BuildMode = mergeString(src.BuildMode, other.BuildMode)
+	dst.BuildOutput = mergeString(src.BuildOutput, other.BuildOutput)
+	if other.BuildParallelism != 0 {
+		dst.BuildParallelism = other.BuildParallelism
+	}
+	dst.BuildTags = mergeNillableStringSlice(src.BuildTags, other.BuildTags)
+	if other.BuildTimeout != 0 {
+		dst.BuildTimeout = other.BuildTimeout
 	}
+	dst.Color = src.Color || other.Color
+	dst.CompilerFlags = mergeNillableStringSlice(
+		src.CompilerFlags, other.CompilerFlags)
+	dst.DisableBuildCache = src.DisableBuildCache || other.DisableBuildCache
+	dst.Env = mergeNillableStringMap(src.Env, other.Env)
+	dst.ExtraBuildArgs = mergeNillableStringSlice(
+		src.ExtraBuildArgs, other.ExtraBuildArgs)
+	dst.ExtraTestArgs = mergeNillableStringSlice(
+		src.ExtraTestArgs, other.ExtraTestArgs)
+	dst.Filter = mergeString(src.Filter, other.Filter)
+	dst.GoCmd = mergeString(src.GoCmd, other.GoCmd)
+	dst.GoToolchain = mergeString(src.GoToolchain, other.GoToolchain)
+	dst.IgnorePatterns = mergeNillableRegexpSlice(
+		src.IgnorePatterns, other.IgnorePatterns)
+	dst.ImportedPackages = mergeNillableImportedPackageSlice(
+		src.ImportedPackages, other.ImportedPackages)
+	dst.IncludeDeps = src.IncludeDeps || other.IncludeDeps
+	dst.IndexBuildOutput = src.IndexBuildOutput || other.IndexBuildOutput
+	dst.JUnitPath = mergeString(src.JUnitPath, other.JUnitPath)
+	if other.Logger != nil {
+		dst.Logger = other.Logger
+	}
+	if other.MFlagLevel != 0 {
+		dst.MFlagLevel = other.MFlagLevel
+	}
+	dst.PackageCompilerFlags = mergeNillableStringSliceMap(
+		src.PackageCompilerFlags, other.PackageCompilerFlags)
+	dst.Packages = mergeNillableStringSlice(src.Packages, other.Packages)
+	dst.Parallel = src.Parallel || other.Parallel
+	dst.Record = src.Record || other.Record
+	dst.ReportPath = mergeString(src.ReportPath, other.ReportPath)
+	dst.RequireBenchmarks = src.RequireBenchmarks || other.RequireBenchmarks
+	dst.RequireNames = src.RequireNames || other.RequireNames
+	dst.SortTests = src.SortTests || other.SortTests
+	dst.Summary = src.Summary || other.Summary
+	dst.TempDir = mergeString(src.TempDir, other.TempDir)
+	if other.Tolerance != 0 {
+		dst.Tolerance = other.Tolerance
+	}
+	dst.UpdateBaseline = src.UpdateBaseline || other.UpdateBaseline
+	dst.UseGoPackages = src.UseGoPackages || other.UseGoPackages
+	dst.Verbose = src.Verbose || other.Verbose
+	dst.VetOutput = mergeString(src.VetOutput, other.VetOutput)
+	return dst
 }
 
 func (src Context) toInternal() internal.Context {
 	return internal.Context{
-		Benchmarks:    copyNillableBenchmarksMap(src.Benchmarks),
-		BuildOutput:   src.BuildOutput,
-		CompilerFlags: copyNillableStringSlice(src.CompilerFlags),
+		AllowOrphanedBenchmarks: src.AllowOrphanedBenchmarks,
+		AsmOutput:               src.AsmOutput,
+		BenchmarkGOMAXPROCS:     src.BenchmarkGOMAXPROCS,
+		BenchmarkPrefix:         src.BenchmarkPrefix,
+		Benchmarks:              copyNillableBenchmarksMap(src.Benchmarks),
+		BenchmarksMulti:         copyNillableBenchmarksMultiMap(src.BenchmarksMulti),
+		BuildCacheDir:           src.BuildCacheDir,
+		BuildContext:            copyNillableGoBuildContext(src.BuildContext),
+		BuildMode:               src.BuildMode,
+		BuildOutput:             src.BuildOutput,
+		BuildParallelism:        src.BuildParallelism,
+		BuildTimeout:            src.BuildTimeout,
+		Color:                   src.Color,
+		CompilerFlags:           copyNillableStringSlice(src.CompilerFlags),
+		DisableBuildCache:       src.DisableBuildCache,
+		Env:                     copyNillableStringMap(src.Env),
+		ExtraBuildArgs:          copyNillableStringSlice(src.ExtraBuildArgs),
+		ExtraTestArgs:           copyNillableStringSlice(src.ExtraTestArgs),
+		Filter:                  src.Filter,
+		GoCmd:                   src.GoCmd,
+		GoToolchain:             src.GoToolchain,
+		IgnorePatterns:          copyNillableRegexpSlice(src.IgnorePatterns),
+		IncludeDeps:             src.IncludeDeps,
+		Logger:                  src.Logger,
+		MFlagLevel:              src.MFlagLevel,
+		PackageCompilerFlags:    copyNillableStringSliceMap(src.PackageCompilerFlags),
+		Parallel:                src.Parallel,
+		Record:                  src.Record,
+		RequireBenchmarks:       src.RequireBenchmarks,
+		SortTests:               src.SortTests,
+		TempDir:                 src.TempDir,
+		Tolerance:               src.Tolerance,
+		Verbose:                 src.Verbose,
+		VetOutput:               src.VetOutput,
 	}
 }
 
@@ -97,7 +555,7 @@ func copyGoBuildContext(src build.Context) build.Context {
 		GOARCH:        src.GOARCH,
 		GOOS:          src.GOOS,
 		GOROOT:        src.GOROOT,
-		GOPATH:        src.GOROOT,
+		GOPATH:        src.GOPATH,
 		Dir:           src.Dir,
 		CgoEnabled:    src.CgoEnabled,
 		UseAllFiles:   src.UseAllFiles,
@@ -141,6 +599,18 @@ func copyNillableBenchmarksMap(
 	return dst
 }
 
+func copyNillableBenchmarksMultiMap(
+	src map[string][]func(*testing.B)) map[string][]func(*testing.B) {
+	if src == nil {
+		return nil
+	}
+	dst := map[string][]func(*testing.B){}
+	for k, v := range src {
+		dst[k] = append([]func(*testing.B){}, v...)
+	}
+	return dst
+}
+
 func copyNillableStringSlice(src []string) []string {
 	if src == nil {
 		return nil
@@ -155,6 +625,40 @@ func copyNillableStringSlice(src []string) []string {
 	return dst
 }
 
+func copyNillableStringMap(src map[string]string) map[string]string {
+	if src == nil {
+		return nil
+	}
+	dst := map[string]string{}
+	for k, v := range src {
+		dst[k] = v
+	}
+	return dst
+}
+
+func copyNillableInt64RangeMap(
+	src map[string]Int64Range) map[string]Int64Range {
+	if src == nil {
+		return nil
+	}
+	dst := map[string]Int64Range{}
+	for k, v := range src {
+		dst[k] = v
+	}
+	return dst
+}
+
+func copyNillableStringSliceMap(src map[string][]string) map[string][]string {
+	if src == nil {
+		return nil
+	}
+	dst := map[string][]string{}
+	for k, v := range src {
+		dst[k] = copyNillableStringSlice(v)
+	}
+	return dst
+}
+
 func copyNillableImportedPackageSlice(
 	src []build.Package) []build.Package {
 	if src == nil {
@@ -170,6 +674,108 @@ func copyNillableImportedPackageSlice(
 	return dst
 }
 
+func copyNillableRegexpSlice(src []*regexp.Regexp) []*regexp.Regexp {
+	if src == nil {
+		return nil
+	}
+	if len(src) == 0 {
+		return []*regexp.Regexp{}
+	}
+	dst := make([]*regexp.Regexp, len(src))
+	for i := range src {
+		dst[i] = src[i]
+	}
+	return dst
+}
+
+func mergeString(a, b string) string {
+	if b != "" {
+		return b
+	}
+	return a
+}
+
+func mergeNillableStringSlice(a, b []string) []string {
+	if b == nil {
+		return copyNillableStringSlice(a)
+	}
+	return append(copyNillableStringSlice(a), b...)
+}
+
+func mergeNillableImportedPackageSlice(
+	a, b []build.Package) []build.Package {
+	if b == nil {
+		return copyNillableImportedPackageSlice(a)
+	}
+	return append(copyNillableImportedPackageSlice(a), b...)
+}
+
+func mergeNillableRegexpSlice(a, b []*regexp.Regexp) []*regexp.Regexp {
+	if b == nil {
+		return copyNillableRegexpSlice(a)
+	}
+	return append(copyNillableRegexpSlice(a), b...)
+}
+
+func mergeNillableStringMap(a, b map[string]string) map[string]string {
+	if b == nil {
+		return copyNillableStringMap(a)
+	}
+	dst := map[string]string{}
+	for k, v := range a {
+		dst[k] = v
+	}
+	for k, v := range b {
+		dst[k] = v
+	}
+	return dst
+}
+
+func mergeNillableStringSliceMap(
+	a, b map[string][]string) map[string][]string {
+	if b == nil {
+		return copyNillableStringSliceMap(a)
+	}
+	dst := copyNillableStringSliceMap(a)
+	if dst == nil {
+		dst = map[string][]string{}
+	}
+	for k, v := range b {
+		dst[k] = mergeNillableStringSlice(dst[k], v)
+	}
+	return dst
+}
+
+func mergeNillableBenchmarksMap(
+	a, b map[string]func(*testing.B)) map[string]func(*testing.B) {
+	if b == nil {
+		return copyNillableBenchmarksMap(a)
+	}
+	dst := map[string]func(*testing.B){}
+	for k, v := range a {
+		dst[k] = v
+	}
+	for k, v := range b {
+		dst[k] = v
+	}
+	return dst
+}
+
+func mergeNillableBenchmarksMultiMap(
+	a, b map[string][]func(*testing.B)) map[string][]func(*testing.B) {
+	if b == nil {
+		return copyNillableBenchmarksMultiMap(a)
+	}
+	dst := copyNillableBenchmarksMultiMap(a)
+	if dst == nil {
+		dst = map[string][]func(*testing.B){}
+	}
+	for k, v := range b {
+		dst[k] = append(dst[k], v...)
+	}
+	return dst
+}
+
 func theirDirectory() (string, error) {
 	_, callersFilePath, _, ok := runtime.Caller(2)
 	if !ok {
@@ -197,7 +803,9 @@ func SetBenchtime(s string) string {
 // value if one was present, otherwise an empty string is returned.
 //
 // Please note this function is a no-op if the flag is not already
-// defined.
+// defined. It is also not required in order to assert allocations, since
+// testing.Benchmark always reads the memory statistics, whether or not
+// the flag is set.
 func SetBenchmem(s string) string {
 	f := flag.Lookup("test.benchmem")
 	if f == nil {
@@ -224,6 +832,28 @@ func Tags() []string {
 	return tags
 }
 
+// Benchmarks returns a map of the provided benchmark functions keyed by
+// their names, ex. "BenchmarkLem_escape1". Because lem looks up a test
+// case's benchmark by "<BenchmarkPrefix><ID>" when there is no benchmark
+// keyed by the <ID>, this allows benchmarks to be discovered by convention
+// instead of by keys that must be kept in sync with the "lem.<ID>" comments:
+//
+//	lem.RunWithBenchmarks(t, lem.Benchmarks(
+//	    BenchmarkLem_escape1,
+//	    BenchmarkLem_escape2,
+//	))
+func Benchmarks(fns ...func(*testing.B)) map[string]func(*testing.B) {
+	m := make(map[string]func(*testing.B), len(fns))
+	for _, fn := range fns {
+		name := runtime.FuncForPC(reflect.ValueOf(fn).Pointer()).Name()
+		if i := strings.LastIndex(name, "."); i >= 0 {
+			name = name[i+1:]
+		}
+		m[name] = fn
+	}
+	return m
+}
+
 // Run validates the leak, escape, and move assertions for the caller's
 // package and test package (if different).
 func Run(t *testing.T) {
@@ -231,7 +861,7 @@ func Run(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	run(t, dir, Context{})
+	run(internal.NewTestingReporter(t), dir, Context{})
 }
 
 // RunWithBenchmarks validates the leak, escape, move assertions, and
@@ -242,7 +872,7 @@ func RunWithBenchmarks(t *testing.T, benchmarks map[string]func(*testing.B)) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	run(t, dir, Context{Benchmarks: benchmarks})
+	run(internal.NewTestingReporter(t), dir, Context{Benchmarks: benchmarks})
 }
 
 // RunWithContext validates the leak, escape, and move assertions for the
@@ -253,10 +883,273 @@ func RunWithContext(t *testing.T, ctx Context) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	run(t, dir, ctx)
+	run(internal.NewTestingReporter(t), dir, ctx)
+}
+
+// Result is the result of running the lem test cases.
+type Result = internal.Result
+
+// TestCaseResult is the result of running a single lem test case.
+type TestCaseResult = internal.TestCaseResult
+
+// LineMatcherResult is the result of a match or natch assertion.
+type LineMatcherResult = internal.LineMatcherResult
+
+// BenchmarkResult is the result of the alloc and bytes assertions.
+type BenchmarkResult = internal.BenchmarkResult
+
+// Int64Range is an inclusive or open-ended range of int64 values.
+type Int64Range = internal.Int64Range
+
+// RunWithResult is the same as RunWithContext, except the results of the
+// assertions are also returned for programmatic consumption.
+func RunWithResult(t *testing.T, ctx Context) Result {
+	dir, err := theirDirectory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return run(internal.NewTestingReporter(t), dir, ctx)
+}
+
+// RunInDir is the same as RunWithResult, except the packages are resolved
+// relative to the provided directory instead of the caller's directory,
+// ex. when lem is run outside of a test package.
+func RunInDir(t *testing.T, dir string, ctx Context) Result {
+	return run(internal.NewTestingReporter(t), dir, ctx)
+}
+
+// Reporter is the subset of the methods of *testing.T used to run the lem
+// test cases and report their results.
+type Reporter = internal.Reporter
+
+// RunWithReporter is the same as RunInDir, except the results are reported
+// to the provided reporter instead of a test, ex. when lem is run by a
+// command instead of a test binary.
+func RunWithReporter(r Reporter, dir string, ctx Context) Result {
+	return run(r, dir, ctx)
+}
+
+// Comparison is the difference between the results of running the lem
+// test cases against two builds.
+type Comparison = internal.Comparison
+
+// TestCaseComparison is the difference between the values observed for a
+// single lem test case in two builds.
+type TestCaseComparison = internal.TestCaseComparison
+
+// RunComparison runs the test cases against two builds of the packages,
+// once with the base context and once with the base context merged with
+// the provided overrides, ex. alternate compiler flags, and returns the
+// comparison of their results. The builds are run as the subtests "base"
+// and "other", so the assertions are evaluated for both, and the
+// comparison is logged.
+//
+// Please note the benchmarks are run in the current process for both
+// builds, so the allocs and bytes only differ if the contexts do, ex. in
+// their benchmarks. Also, the files written by a run, ex. ReportPath, are
+// written by both, so the overrides should specify different paths.
+func RunComparison(t *testing.T, base, overrides Context) Comparison {
+	dir, err := theirDirectory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var baseResult, otherResult Result
+	t.Run("base", func(t *testing.T) {
+		baseResult = run(internal.NewTestingReporter(t), dir, base)
+	})
+	t.Run("other", func(t *testing.T) {
+		otherResult = run(internal.NewTestingReporter(t), dir, base.Merge(overrides))
+	})
+	c := internal.Compare(baseResult, otherResult)
+	t.Log(c.String())
+	return c
+}
+
+func run(t Reporter, srcDir string, ctx Context) Result {
+	ctx, err := loadPackages(srcDir, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Skip if there is nothing to compile, ex. because the packages' Go
+	// files are all excluded by build constraints.
+	if err := checkSourceFiles(ctx); err != nil {
+		t.Skip(err)
+	}
+
+	// Build the packages if build output has not already been supplied. If
+	// the output is indexed then it is indexed as it is streamed from the
+	// go command.
+	var (
+		buildOutputIndex *internal.BuildOutputIndex
+		buildOutputs     map[string]string
+	)
+	if ctx.BuildOutput == "" && ctx.IndexBuildOutput {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(internal.BuildAll(
+				pw,
+				ctx.ImportedPackages,
+				ctx.toInternal()))
+		}()
+		if buildOutputIndex, err = internal.NewBuildOutputIndex(pr); err != nil {
+			pr.CloseWithError(err) // unblock the build if indexing failed
+			t.Fatalf("failed to build pkgs: %v", err)
+		}
+	} else if ctx.BuildOutput == "" {
+		var buildOutput bytes.Buffer
+		if buildOutputs, err = internal.BuildAllPackages(
+			&buildOutput,
+			ctx.ImportedPackages,
+			ctx.toInternal()); err != nil {
+
+			t.Fatalf("failed to build pkgs: %v", err)
+		}
+		ctx.BuildOutput = buildOutput.String()
+	} else if ctx.IndexBuildOutput {
+		if buildOutputIndex, err = internal.NewBuildOutputIndex(
+			strings.NewReader(ctx.BuildOutput)); err != nil {
+
+			t.Fatalf("failed to index build output: %v", err)
+		}
+	}
+
+	testCases, err := internal.GetTestCases(getSourceFiles(ctx)...)
+	if err != nil {
+		t.Fatalf("failed to get test cases: %v", err)
+	}
+	internal.SetPackages(testCases, ctx.ImportedPackages)
+
+	// Ensure each test case has a name if names are required.
+	if ctx.RequireNames {
+		if err := internal.CheckNames(testCases...); err != nil {
+			t.Fatalf("failed to get test cases: %v", err)
+		}
+	}
+
+	// Record the IDs of all of the test cases in the source so the baseline
+	// may account for the test cases that were removed.
+	ids := make([]string, len(testCases))
+	for i, tc := range testCases {
+		ids[i] = tc.ID
+	}
+
+	// Prune the test cases whose IDs do not match the filter, if any.
+	if ctx.Filter != "" {
+		n := len(testCases)
+		if testCases, err = internal.FilterTestCases(
+			ctx.Filter, testCases...); err != nil {
+
+			t.Fatalf("failed to filter test cases: %v", err)
+		}
+		if len(testCases) == 0 {
+			t.Logf("filter %q excluded all %d test case(s)", ctx.Filter, n)
+		}
+	}
+
+	// Build the packages' assembly if any of the test cases assert against
+	// it and the assembly output has not already been supplied.
+	if ctx.AsmOutput == "" && internal.HasAsm(testCases...) {
+		var asmOutput bytes.Buffer
+		if err := internal.BuildAllAsm(
+			&asmOutput,
+			ctx.ImportedPackages,
+			ctx.toInternal()); err != nil {
+
+			t.Fatalf("failed to build pkgs' assembly: %v", err)
+		}
+		ctx.AsmOutput = asmOutput.String()
+	}
+
+	// Vet the packages if any of the test cases assert against the vet
+	// output and the vet output has not already been supplied.
+	if ctx.VetOutput == "" && internal.HasVet(testCases...) {
+		var vetOutput bytes.Buffer
+		if err := internal.VetAll(
+			&vetOutput,
+			ctx.ImportedPackages,
+			ctx.toInternal()); err != nil {
+
+			t.Fatalf("failed to vet pkgs: %v", err)
+		}
+		ctx.VetOutput = vetOutput.String()
+	}
+
+	// Load the baseline if one was specified and is not being updated.
+	internalCtx := ctx.toInternal()
+	internalCtx.BuildOutputIndex = buildOutputIndex
+	if ctx.BaselinePath != "" && !ctx.UpdateBaseline {
+		baseline, err := internal.ReadBaseline(ctx.BaselinePath)
+		if err != nil {
+			t.Fatalf("failed to read baseline: %v", err)
+		}
+		if missing := baseline.MissingIDs(ids); len(missing) > 0 {
+			t.Logf("baseline has test case(s) no longer in source: %s",
+				strings.Join(missing, ","))
+		}
+		internalCtx.Baseline = baseline
+	}
+
+	// Build a test case tree and run the tests.
+	tree, err := internal.NewTreeStrict(testCases...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := tree.RunWithReporter(t, internalCtx)
+	result.BuildOutputs = buildOutputs
+
+	// Log the summary of the run if one was requested.
+	if ctx.Summary {
+		t.Log(result.Summary())
+	}
+
+	// Write the observed values to the sources if recording was requested.
+	if ctx.Record {
+		files, err := internal.Record(internalCtx, tree, result)
+		if err != nil {
+			t.Fatalf("failed to record observed values: %v", err)
+		}
+		for _, f := range files {
+			t.Logf("recorded observed values in %s", f)
+		}
+	}
+
+	// Write the baseline if one was requested. The entries of the previous
+	// baseline, if any, are kept for the test cases that were not run.
+	if ctx.BaselinePath != "" && ctx.UpdateBaseline {
+		prev, err := internal.ReadBaseline(ctx.BaselinePath)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("failed to read baseline: %v", err)
+		}
+		if err := internal.WriteBaseline(
+			ctx.BaselinePath,
+			internal.NewBaseline(prev, ids, result)); err != nil {
+
+			t.Fatalf("failed to write baseline: %v", err)
+		}
+	}
+
+	// Write the report if one was requested.
+	if ctx.ReportPath != "" {
+		if err := internal.WriteReport(ctx.ReportPath, tree, result); err != nil {
+			t.Fatalf("failed to write report: %v", err)
+		}
+	}
+
+	// Write the JUnit report if one was requested.
+	if ctx.JUnitPath != "" {
+		if err := internal.WriteJUnit(ctx.JUnitPath, result); err != nil {
+			t.Fatalf("failed to write junit report: %v", err)
+		}
+	}
+
+	return result
 }
 
-func run(t *testing.T, srcDir string, ctx Context) {
+// loadPackages returns a copy of the provided context with the defaults
+// applied and the ImportedPackages field populated from the Packages field,
+// relative to the provided source directory, if it was empty.
+func loadPackages(srcDir string, ctx Context) (Context, error) {
 	ctx = ctx.Copy()
 
 	// Create a new build context if one does not exist.
@@ -266,66 +1159,125 @@ func run(t *testing.T, srcDir string, ctx Context) {
 		ctx.BuildContext.BuildTags = Tags()
 	}
 
+	// The build tags from the context take precedence over those from the
+	// flag or the build context.
+	if len(ctx.BuildTags) > 0 {
+		ctx.BuildContext.BuildTags = copyNillableStringSlice(ctx.BuildTags)
+	}
+
 	// If no package was specified then default to the package relative to
 	// the provided source directory.
 	if len(ctx.Packages) == 0 {
 		ctx.Packages = []string{"."}
 	}
 
+	// If ctx.ImportedPackages is empty and go/packages-style loading is
+	// enabled, then create it from the packages specified in ctx.Packages
+	// using "go list".
+	if len(ctx.ImportedPackages) == 0 && ctx.UseGoPackages {
+		pkgs, err := internal.Load(
+			ctx.toInternal(),
+			srcDir,
+			ctx.Packages...)
+		if err != nil {
+			return ctx, fmt.Errorf(
+				"failed to load pkgs %v: %w", ctx.Packages, err)
+		}
+		ctx.ImportedPackages = pkgs
+	}
+
 	// If ctx.ImportedPackages is empty then create it from the
-	// packages specified in ctx.Packages.
+	// packages specified in ctx.Packages, expanding any "./..." patterns.
 	if len(ctx.ImportedPackages) == 0 {
+		pkgs, err := internal.ExpandPackages(
+			ctx.toInternal(),
+			srcDir,
+			ctx.Packages...)
+		if err != nil {
+			return ctx, fmt.Errorf(
+				"failed to expand pkgs %v: %w", ctx.Packages, err)
+		}
+		ctx.Packages = pkgs
 		ctx.ImportedPackages = make([]build.Package, len(ctx.Packages))
 		for i, pkg := range ctx.Packages {
 			ipkg, err := ctx.BuildContext.Import(
 				pkg,
 				srcDir,
 				build.IgnoreVendor)
-			if err != nil {
-				t.Fatalf("failed to import pkg %s: %v", pkg, err)
+			// A package whose Go files are all excluded by build
+			// constraints is not an error here so run may report it.
+			var noGoErr *build.NoGoError
+			if err != nil && !errors.As(err, &noGoErr) {
+				return ctx, fmt.Errorf("failed to import pkg %s: %w", pkg, err)
 			}
 			ctx.ImportedPackages[i] = *ipkg
 		}
 	}
 
+	return ctx, nil
+}
+
+// checkSourceFiles returns an error if none of the context's imported
+// packages have any Go files to compile.
+func checkSourceFiles(ctx Context) error {
 	var (
-		allSrcFiles []string
-		buildOutput bytes.Buffer
+		importPaths []string
+		ignored     []string
 	)
-
 	for _, pkg := range ctx.ImportedPackages {
-
-		// Build the package if build output has not already been supplied.
-		if ctx.BuildOutput == "" {
-			if err := internal.Build(
-				&buildOutput,
-				pkg,
-				ctx.toInternal()); err != nil {
-
-				t.Fatalf("failed to build pkg %s: %v", pkg.ImportPath, err)
-			}
+		if len(pkg.GoFiles) > 0 ||
+			len(pkg.CgoFiles) > 0 ||
+			len(pkg.TestGoFiles) > 0 ||
+			len(pkg.XTestGoFiles) > 0 {
+			return nil
 		}
+		importPaths = append(importPaths, pkg.ImportPath)
+		ignored = append(ignored, pkg.IgnoredGoFiles...)
+	}
+	if len(ignored) > 0 {
+		return fmt.Errorf(
+			"no Go files to compile in pkgs %v, "+
+				"excluded by build constraints: %v",
+			importPaths, ignored)
+	}
+	return fmt.Errorf("no Go files to compile in pkgs %v", importPaths)
+}
+
+// getSourceFiles returns the source files, and any sidecar files, of the
+// context's imported packages.
+func getSourceFiles(ctx Context) []string {
+	var allSrcFiles []string
+	for _, pkg := range ctx.ImportedPackages {
 
 		// Get the package's sources and sort them so they maintain
 		// lexographical order between all different types of sources.
 		pkgSrcs := append([]string{}, pkg.GoFiles...)
+		pkgSrcs = append(pkgSrcs, pkg.CgoFiles...)
 		pkgSrcs = append(pkgSrcs, pkg.TestGoFiles...)
 		pkgSrcs = append(pkgSrcs, pkg.XTestGoFiles...)
 		sort.Strings(pkgSrcs)
 
-		// Append the package sources to the overall number of sources.
-		allSrcFiles = append(allSrcFiles, pkgSrcs...)
-	}
+		// Resolve the sources relative to the package's directory so they
+		// may be read regardless of the current working directory.
+		if pkg.Dir != "" {
+			for i := range pkgSrcs {
+				if !filepath.IsAbs(pkgSrcs[i]) {
+					pkgSrcs[i] = filepath.Join(pkg.Dir, pkgSrcs[i])
+				}
+			}
+		}
 
-	if ctx.BuildOutput == "" {
-		ctx.BuildOutput = buildOutput.String()
-	}
+		// Include the package's sidecar file, if any, after its sources so
+		// its test cases are merged with the ones from the sources.
+		if pkg.Dir != "" {
+			sidecarPath := filepath.Join(pkg.Dir, internal.SidecarFileName)
+			if _, err := os.Stat(sidecarPath); err == nil {
+				pkgSrcs = append(pkgSrcs, sidecarPath)
+			}
+		}
 
-	testCases, err := internal.GetTestCases(allSrcFiles...)
-	if err != nil {
-		t.Fatalf("failed to get test cases: %v", err)
+		// Append the package sources to the overall number of sources.
+		allSrcFiles = append(allSrcFiles, pkgSrcs...)
 	}
-
-	// Build a test case tree and run the tests.
-	internal.NewTree(testCases...).Run(t, ctx.toInternal())
+	return allSrcFiles
 }
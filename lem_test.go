@@ -0,0 +1,461 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lem_test
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/akutz/lem"
+)
+
+func TestContextCopyBuildContext(t *testing.T) {
+	buildContext := lem.NewBuildContext()
+	buildContext.GOROOT = "/path/to/goroot"
+	buildContext.GOPATH = "/path/to/gopath"
+
+	src := lem.Context{BuildContext: &buildContext}
+	dst := src.Copy()
+
+	if dst.BuildContext == nil {
+		t.Fatal("build context is nil")
+	}
+	if dst.BuildContext == src.BuildContext {
+		t.Fatal("build context was not copied")
+	}
+	if e, a := "/path/to/goroot", dst.BuildContext.GOROOT; e != a {
+		t.Errorf("expGOROOT=%s, actGOROOT=%s", e, a)
+	}
+	if e, a := "/path/to/gopath", dst.BuildContext.GOPATH; e != a {
+		t.Errorf("expGOPATH=%s, actGOPATH=%s", e, a)
+	}
+}
+
+func BenchmarkLem_escape1(b *testing.B) {}
+
+func BenchmarkLem_escape2(b *testing.B) {}
+
+func TestBenchmarks(t *testing.T) {
+	benchmarks := lem.Benchmarks(BenchmarkLem_escape1, BenchmarkLem_escape2)
+	if e, a := 2, len(benchmarks); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	for _, name := range []string{
+		"BenchmarkLem_escape1",
+		"BenchmarkLem_escape2",
+	} {
+		if _, ok := benchmarks[name]; !ok {
+			t.Errorf("missing benchmark %s", name)
+		}
+	}
+}
+
+func TestContextCopyBenchmarksMulti(t *testing.T) {
+	fn := func(*testing.B) {}
+	src := lem.Context{
+		BenchmarksMulti: map[string][]func(*testing.B){"a": {fn, fn}},
+	}
+	dst := src.Copy()
+	dst.BenchmarksMulti["a"][0] = nil
+	if src.BenchmarksMulti["a"][0] == nil {
+		t.Fatal("benchmarks were not copied")
+	}
+	if e, a := 2, len(dst.BenchmarksMulti["a"]); e != a {
+		t.Errorf("expLen=%d, actLen=%d", e, a)
+	}
+}
+
+func TestContextMerge(t *testing.T) {
+	fn1 := func(*testing.B) {}
+	fn2 := func(*testing.B) {}
+	fn3 := func(*testing.B) {}
+
+	base := lem.Context{
+		Benchmarks: map[string]func(*testing.B){"a": fn1, "b": fn1},
+		BenchmarksMulti: map[string][]func(*testing.B){
+			"a": {fn1},
+		},
+		CompilerFlags: []string{"-l"},
+		Env:           map[string]string{"GOFLAGS": "-mod=mod", "CGO": "0"},
+		GoCmd:         "go",
+		MFlagLevel:    2,
+		PackageCompilerFlags: map[string][]string{
+			"example.com/a": {"-N"},
+		},
+		Packages: []string{"./a"},
+		Verbose:  true,
+	}
+	overrides := lem.Context{
+		Benchmarks: map[string]func(*testing.B){"b": fn2, "c": fn3},
+		BenchmarksMulti: map[string][]func(*testing.B){
+			"a": {fn2},
+			"b": {fn3},
+		},
+		CompilerFlags: []string{"-d=ssa/check_bce"},
+		Env:           map[string]string{"CGO": "1"},
+		GoCmd:         "/usr/local/go/bin/go",
+		PackageCompilerFlags: map[string][]string{
+			"example.com/a": {"-l"},
+			"example.com/b": {"-l"},
+		},
+		Packages: []string{"./b"},
+	}
+	merged := base.Merge(overrides)
+
+	t.Run("slices", func(t *testing.T) {
+		if e, a := []string{"-l", "-d=ssa/check_bce"},
+			merged.CompilerFlags; !reflect.DeepEqual(e, a) {
+			t.Errorf("expCompilerFlags=%v, actCompilerFlags=%v", e, a)
+		}
+		if e, a := []string{"./a", "./b"},
+			merged.Packages; !reflect.DeepEqual(e, a) {
+			t.Errorf("expPackages=%v, actPackages=%v", e, a)
+		}
+		if merged.BuildTags != nil {
+			t.Errorf("expBuildTags=nil, actBuildTags=%v", merged.BuildTags)
+		}
+	})
+
+	t.Run("maps", func(t *testing.T) {
+		if e, a := 3, len(merged.Benchmarks); e != a {
+			t.Fatalf("expLen=%d, actLen=%d", e, a)
+		}
+		for id, fn := range map[string]func(*testing.B){
+			"a": fn1, "b": fn2, "c": fn3,
+		} {
+			if e, a := reflect.ValueOf(fn).Pointer(),
+				reflect.ValueOf(merged.Benchmarks[id]).Pointer(); e != a {
+				t.Errorf("%s: unexpected benchmark", id)
+			}
+		}
+		if e, a := 2, len(merged.BenchmarksMulti["a"]); e != a {
+			t.Errorf("expMultiLen=%d, actMultiLen=%d", e, a)
+		}
+		if e, a := 1, len(merged.BenchmarksMulti["b"]); e != a {
+			t.Errorf("expMultiLen=%d, actMultiLen=%d", e, a)
+		}
+		if e, a := map[string]string{"GOFLAGS": "-mod=mod", "CGO": "1"},
+			merged.Env; !reflect.DeepEqual(e, a) {
+			t.Errorf("expEnv=%v, actEnv=%v", e, a)
+		}
+		if e, a := map[string][]string{
+			"example.com/a": {"-N", "-l"},
+			"example.com/b": {"-l"},
+		}, merged.PackageCompilerFlags; !reflect.DeepEqual(e, a) {
+			t.Errorf("expPackageCompilerFlags=%v, actPackageCompilerFlags=%v",
+				e, a)
+		}
+	})
+
+	t.Run("scalars", func(t *testing.T) {
+		if e, a := "/usr/local/go/bin/go", merged.GoCmd; e != a {
+			t.Errorf("expGoCmd=%s, actGoCmd=%s", e, a)
+		}
+		if e, a := 2, merged.MFlagLevel; e != a {
+			t.Errorf("expMFlagLevel=%d, actMFlagLevel=%d", e, a)
+		}
+		if !merged.Verbose {
+			t.Error("expected verbose to remain true")
+		}
+	})
+
+	t.Run("copies", func(t *testing.T) {
+		merged.CompilerFlags[0] = "-N"
+		merged.Env["CGO"] = "2"
+		merged.BenchmarksMulti["a"][0] = nil
+		if e, a := "-l", base.CompilerFlags[0]; e != a {
+			t.Errorf("expBaseCompilerFlag=%s, actBaseCompilerFlag=%s", e, a)
+		}
+		if e, a := "0", base.Env["CGO"]; e != a {
+			t.Errorf("expBaseCGO=%s, actBaseCGO=%s", e, a)
+		}
+		if e, a := "1", overrides.Env["CGO"]; e != a {
+			t.Errorf("expOverridesCGO=%s, actOverridesCGO=%s", e, a)
+		}
+		if base.BenchmarksMulti["a"][0] == nil {
+			t.Error("base benchmarks were not copied")
+		}
+	})
+}
+
+func TestParseSource(t *testing.T) {
+	const src = `package src
+
+var sink interface{}
+
+// lem.put.name=to sink
+// lem.put.alloc=1
+func put(x int32) {
+	sink = x // lem.put.m=x escapes to heap
+}
+`
+	testCases, err := lem.ParseSource("src.go", strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 1, len(testCases); e != a {
+		t.Fatalf("expLen=%d, actLen=%d", e, a)
+	}
+	tc := testCases[0]
+	if e, a := []string{"put", "to sink"}, tc.Path; !reflect.DeepEqual(e, a) {
+		t.Errorf("expPath=%v, actPath=%v", e, a)
+	}
+	if !tc.HasBenchmark {
+		t.Error("test case should require a benchmark")
+	}
+	if e, a := 1, len(tc.Matches); e != a {
+		t.Fatalf("expMatches=%d, actMatches=%d", e, a)
+	}
+	if e, a := "src.go", tc.Matches[0].File; e != a {
+		t.Errorf("expFile=%s, actFile=%s", e, a)
+	}
+	if e, a := 8, tc.Matches[0].Line; e != a {
+		t.Errorf("expLine=%d, actLine=%d", e, a)
+	}
+
+	if _, err := lem.ParseSource(
+		"src.go", strings.NewReader("package src\n\n// lem.put.m@+9=x\n"),
+	); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestRunNoGoFiles(t *testing.T) {
+	const pkg = "./internal/testdata/notags"
+
+	for _, tc := range []struct {
+		name          string
+		tags          []string
+		ctxTags       []string
+		useGoPackages bool
+		expSkipped    bool
+	}{
+		{name: "excluded by build tags", expSkipped: true},
+		{
+			name:          "excluded by build tags w go packages",
+			useGoPackages: true,
+			expSkipped:    true,
+		},
+		{name: "included by build tags", tags: []string{"lem_notags"}},
+		{name: "included by context build tags", ctxTags: []string{"lem_notags"}},
+		{
+			name:          "included by context build tags w go packages",
+			ctxTags:       []string{"lem_notags"},
+			useGoPackages: true,
+		},
+		{
+			name:       "context build tags take precedence",
+			tags:       []string{"lem_notags"},
+			ctxTags:    []string{"lem_other"},
+			expSkipped: true,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			buildContext := lem.NewBuildContext()
+			buildContext.BuildTags = tc.tags
+
+			var skipped bool
+			t.Run("run", func(t *testing.T) {
+				defer func() { skipped = t.Skipped() }()
+				lem.RunInDir(t, ".", lem.Context{
+					BuildContext:  &buildContext,
+					BuildTags:     tc.ctxTags,
+					Packages:      []string{pkg},
+					UseGoPackages: tc.useGoPackages,
+				})
+			})
+			if e, a := tc.expSkipped, skipped; e != a {
+				t.Errorf("expSkipped=%v, actSkipped=%v", e, a)
+			}
+		})
+	}
+}
+
+func TestRunWithIndexBuildOutput(t *testing.T) {
+	lem.RunInDir(t, ".", lem.Context{
+		IndexBuildOutput: true,
+		Packages:         []string{"./examples/match"},
+	})
+}
+
+func TestRunWithResultBuildOutputs(t *testing.T) {
+	for _, index := range []bool{false, true} {
+		index := index
+		t.Run(map[bool]string{false: "buffered", true: "indexed"}[index],
+			func(t *testing.T) {
+				var result lem.Result
+				t.Run("run", func(t *testing.T) {
+					result = lem.RunInDir(t, ".", lem.Context{
+						IndexBuildOutput: index,
+						Packages: []string{
+							"./examples/match",
+							"./examples/natch",
+						},
+					})
+				})
+
+				// The output of each package is not kept when indexing.
+				if index {
+					if result.BuildOutputs != nil {
+						t.Errorf("expBuildOutputs=nil, actBuildOutputs=%v",
+							result.BuildOutputs)
+					}
+					return
+				}
+
+				var act []string
+				for importPath := range result.BuildOutputs {
+					act = append(act, importPath)
+				}
+				sort.Strings(act)
+				exp := []string{"./examples/match", "./examples/natch"}
+				if strings.Join(exp, ",") != strings.Join(act, ",") {
+					t.Fatalf("expImportPaths=%v, actImportPaths=%v", exp, act)
+				}
+
+				// The output of each package does not refer to the other
+				// package's files.
+				for i, importPath := range exp {
+					output := result.BuildOutputs[importPath]
+					if output == "" {
+						t.Errorf("build output for %s is empty", importPath)
+					}
+					own := filepath.Clean(importPath)
+					if !strings.Contains(output, own+string(filepath.Separator)) {
+						t.Errorf("build output for %s does not refer to %s:\n%s",
+							importPath, own, output)
+					}
+					other := filepath.Clean(exp[len(exp)-1-i])
+					if strings.Contains(output, other+string(filepath.Separator)) {
+						t.Errorf("build output for %s refers to %s:\n%s",
+							importPath, other, output)
+					}
+				}
+			})
+	}
+}
+
+func TestRunWithJUnit(t *testing.T) {
+	// The packages do not share any test case IDs, since test cases with
+	// the same ID are merged.
+	junitPath := filepath.Join(t.TempDir(), "junit.xml")
+	var result lem.Result
+	t.Run("run", func(t *testing.T) {
+		result = lem.RunInDir(t, ".", lem.Context{
+			JUnitPath: junitPath,
+			Packages: []string{
+				"./examples/match",
+				"./examples/name",
+			},
+		})
+	})
+
+	data, err := os.ReadFile(junitPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var junit struct {
+		Suites []struct {
+			Name      string `xml:"name,attr"`
+			TestCases []struct {
+				ClassName string `xml:"classname,attr"`
+				Name      string `xml:"name,attr"`
+			} `xml:"testcase"`
+		} `xml:"testsuite"`
+	}
+	if err := xml.Unmarshal(data, &junit); err != nil {
+		t.Fatal(err)
+	}
+
+	// There is a suite for each package, and each test case is in the
+	// suite of the package that defines it.
+	exp := map[string]string{}
+	for _, tc := range result.TestCases {
+		exp[tc.ID] = tc.Package
+	}
+	act := map[string]string{}
+	var suites []string
+	for _, s := range junit.Suites {
+		suites = append(suites, s.Name)
+		for _, tc := range s.TestCases {
+			if tc.ClassName != s.Name {
+				t.Errorf("%s: expClassName=%s, actClassName=%s",
+					tc.Name, s.Name, tc.ClassName)
+			}
+			act[tc.Name] = s.Name
+		}
+	}
+	if e, a := []string{"./examples/match", "./examples/name"},
+		suites; !reflect.DeepEqual(e, a) {
+		t.Fatalf("expSuites=%v, actSuites=%v", e, a)
+	}
+	if !reflect.DeepEqual(exp, act) {
+		t.Errorf("expPackages=%v, actPackages=%v", exp, act)
+	}
+}
+
+func TestRunComparison(t *testing.T) {
+	c := lem.RunComparison(
+		t,
+		lem.Context{
+			DisableBuildCache: true,
+			Packages:          []string{"./internal/testdata/compare"},
+		},
+		lem.Context{CompilerFlags: []string{"-l"}},
+	)
+
+	var ids []string
+	for _, tcc := range c.TestCases {
+		ids = append(ids, tcc.ID)
+		if tcc.Base.Escapes == nil || tcc.Other.Escapes == nil {
+			t.Fatalf("%s: escapes should be observed for both builds", tcc.ID)
+		}
+	}
+	sort.Strings(ids)
+	if e, a := "newPoint,sum", strings.Join(ids, ","); e != a {
+		t.Fatalf("expIDs=%s, actIDs=%s", e, a)
+	}
+	if a := c.Regressed(); len(a) != 0 {
+		t.Errorf("expected no regressions, got %v", a)
+	}
+
+	// Disabling inlining removes the messages about inlining as well as
+	// the escape analysis of the inlined call to newPoint.
+	importPath := "./internal/testdata/compare"
+	if a := c.Added[importPath]; len(a) != 0 {
+		t.Errorf("expected no added lines, got %v", a)
+	}
+	removed := strings.Join(c.Removed[importPath], "\n")
+	for _, exp := range []string{
+		"can inline newPoint",
+		"inlining call to newPoint",
+		"&point{...} does not escape",
+	} {
+		if !strings.Contains(removed, exp) {
+			t.Errorf("expRemoved to contain %q, actRemoved=%s", exp, removed)
+		}
+	}
+	if strings.Contains(removed, "escapes to heap") {
+		t.Errorf("escape of newPoint should not be removed: %s", removed)
+	}
+}
@@ -0,0 +1,252 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lem
+
+import (
+	"io"
+	"regexp"
+
+	"github.com/akutz/lem/internal"
+)
+
+// TestCase is a test case parsed from the lem comments in a source file.
+type TestCase struct {
+	// ID maps to lem.<ID>.
+	ID string
+
+	// Name maps to lem.<ID>.name=<NAME>.
+	Name string
+
+	// Suite maps to lem.<ID>.suite=<NAME>.
+	Suite string
+
+	// Path is the path of the test case in the tree of tests, built from
+	// the Suite, ID, and Name.
+	Path []string
+
+	// AllocOp maps to lem.<ID>.alloc=<RANGE>.
+	AllocOp Int64Range
+
+	// AllocOpByArch maps to lem.<ID>.alloc:<GOARCH>=<RANGE>.
+	AllocOpByArch map[string]Int64Range
+
+	// BytesOp maps to lem.<ID>.bytes=<RANGE>.
+	BytesOp Int64Range
+
+	// BytesOpByArch maps to lem.<ID>.bytes:<GOARCH>=<RANGE>.
+	BytesOpByArch map[string]Int64Range
+
+	// Metrics maps to lem.<ID>.metric:<NAME>=<RANGE>.
+	Metrics map[string]Int64Range
+
+	// Benchtime maps to lem.<ID>.benchtime=<BENCHTIME>.
+	Benchtime string
+
+	// Env maps to lem.<ID>.env=<NAME>=<VALUE>.
+	Env map[string]string
+
+	// Skip maps to lem.<ID>.skip.
+	Skip bool
+
+	// SkipReason maps to lem.<ID>.skip=<REASON>.
+	SkipReason string
+
+	// Tags maps to lem.<ID>.tags=<TAG>[,<TAG>...].
+	Tags []string
+
+	// HasBenchmark is true if the test case has any directives that require
+	// a benchmark to be asserted.
+	HasBenchmark bool
+
+	// Matches maps to lem.<ID>.m=<REGEX>.
+	Matches []LineMatcher
+
+	// Natches maps to lem.<ID>.m!=<REGEX>.
+	Natches []LineMatcher
+
+	// Seqs maps to lem.<ID>.mseq=<REGEX>, grouped by the line to which
+	// the directives apply.
+	Seqs [][]LineMatcher
+
+	// Nones maps to lem.<ID>.none=<REGEX>.
+	Nones []LineMatcher
+
+	// Vets maps to lem.<ID>.vet=<REGEX>.
+	Vets []LineMatcher
+
+	// Counts maps to lem.<ID>.mcount=<REGEX>:<RANGE>.
+	Counts []LineMatcher
+
+	// Devirts maps to lem.<ID>.devirt=<TYPE>.
+	Devirts []LineMatcher
+
+	// Blocks maps to lem.<ID>.mblock=<REGEX>.
+	Blocks []LineMatcher
+
+	// Asm maps to lem.<ID>.asm=<REGEX>. The File and Line of each matcher
+	// are those of the function to which the matcher is scoped.
+	Asm []LineMatcher
+
+	// AsmNatches maps to lem.<ID>.noruntime-alloc. The File and Line of
+	// each matcher are those of the function to which the matcher is
+	// scoped.
+	AsmNatches []LineMatcher
+
+	// FrameSize maps to lem.<ID>.framesize=<RANGE>, or is nil if the
+	// directive was not specified.
+	FrameSize *Int64Range
+}
+
+// LineMatcher is a regular expression matched against the output of the
+// compiler for a line in a Go source file.
+type LineMatcher struct {
+	// Regexp is matched against the compiler's output.
+	Regexp *regexp.Regexp
+
+	// Source is the line of source code for which the matcher was built.
+	Source string
+
+	// File is the base name of the file in which the matcher was defined.
+	File string
+
+	// Line is the line for which the matcher was built.
+	Line int
+
+	// Count is the expected number of matches for lem.<ID>.mcount, or nil.
+	Count *Int64Range
+}
+
+// Parse returns the test cases parsed from the lem comments in the
+// packages specified in the provided context, relative to the caller's
+// package, without building the packages or running any tests. This is
+// useful for validating lem comments, ex. in a pre-commit hook.
+func Parse(ctx Context) ([]TestCase, error) {
+	dir, err := theirDirectory()
+	if err != nil {
+		return nil, err
+	}
+	return parse(dir, ctx)
+}
+
+// ParseSource returns the test cases parsed from the lem comments in the
+// Go source read from the provided reader, ex. the contents of an editor's
+// buffer. The file path is used to name the file in the test cases and any
+// errors, and it need not exist.
+func ParseSource(filePath string, src io.Reader) ([]TestCase, error) {
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+	testCases, err := internal.GetTestCasesFromSource(filePath, data)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]TestCase, len(testCases))
+	for i := range testCases {
+		result[i] = newTestCase(testCases[i])
+	}
+	return result, nil
+}
+
+func parse(srcDir string, ctx Context) ([]TestCase, error) {
+	ctx, err := loadPackages(srcDir, ctx)
+	if err != nil {
+		return nil, err
+	}
+	testCases, err := internal.GetTestCases(getSourceFiles(ctx)...)
+	if err != nil {
+		return nil, err
+	}
+	if ctx.RequireNames {
+		if err := internal.CheckNames(testCases...); err != nil {
+			return nil, err
+		}
+	}
+	result := make([]TestCase, len(testCases))
+	for i := range testCases {
+		result[i] = newTestCase(testCases[i])
+	}
+	return result, nil
+}
+
+func newTestCase(src internal.TestCase) TestCase {
+	dst := TestCase{
+		ID:            src.ID,
+		Name:          src.Name,
+		Suite:         src.Suite,
+		Path:          src.Path(),
+		AllocOp:       src.AllocOp,
+		AllocOpByArch: copyNillableInt64RangeMap(src.AllocOpByArch),
+		BytesOp:       src.BytesOp,
+		BytesOpByArch: copyNillableInt64RangeMap(src.BytesOpByArch),
+		Metrics:       copyNillableInt64RangeMap(src.Metrics),
+		Benchtime:     src.Benchtime,
+		Env:           copyNillableStringMap(src.Env),
+		Skip:          src.Skip,
+		SkipReason:    src.SkipReason,
+		Tags:          copyNillableStringSlice(src.Tags),
+		HasBenchmark:  src.HasBenchmark(),
+		Matches:       newLineMatchers(src.Matches),
+		Natches:       newLineMatchers(src.Natches),
+		Nones:         newLineMatchers(src.Nones),
+		Vets:          newLineMatchers(src.Vets),
+		Counts:        newLineMatchers(src.Counts),
+		Devirts:       newLineMatchers(src.Devirts),
+		Blocks:        newLineMatchers(src.Blocks),
+	}
+	for _, seq := range src.Seqs {
+		dst.Seqs = append(dst.Seqs, newLineMatchers(seq))
+	}
+	for _, am := range src.Asm {
+		dst.Asm = append(dst.Asm, LineMatcher{
+			Regexp: am.Regexp,
+			Source: am.Source,
+			File:   am.File,
+			Line:   am.Line,
+		})
+	}
+	for _, am := range src.AsmNatches {
+		dst.AsmNatches = append(dst.AsmNatches, LineMatcher{
+			Regexp: am.Regexp,
+			Source: am.Source,
+			File:   am.File,
+			Line:   am.Line,
+		})
+	}
+	if src.FrameSize != nil {
+		r := src.FrameSize.Expected
+		dst.FrameSize = &r
+	}
+	return dst
+}
+
+func newLineMatchers(src []internal.LineMatcher) []LineMatcher {
+	if src == nil {
+		return nil
+	}
+	dst := make([]LineMatcher, len(src))
+	for i, lm := range src {
+		dst[i] = LineMatcher{
+			Regexp: lm.Regexp,
+			Source: lm.Source,
+			File:   lm.File,
+			Line:   lm.Line,
+			Count:  lm.Count,
+		}
+	}
+	return dst
+}